@@ -0,0 +1,335 @@
+// Package auth provides optional authentication for the API, using local users
+// with bcrypt passwords, session cookies for the frontend, and personal API
+// tokens for scripts.
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/davidschlachter/lychnos/src/backend/dialect"
+	"github.com/davidschlachter/lychnos/src/backend/httperror"
+)
+
+// CookieName is the name of the session cookie.
+const CookieName = "lychnos_session"
+
+// DefaultSessionLifetime is used if Config.SessionLifetime is not set.
+const DefaultSessionLifetime = 30 * 24 * time.Hour
+
+// timeFormat is used for timestamps stored in the database.
+const timeFormat = "2006-01-02 15:04:05"
+
+// ErrInvalidCredentials is returned if a username and password do not match.
+var ErrInvalidCredentials = errors.New("invalid username or password")
+
+type Config struct {
+	// Enabled turns on authentication. If false, Require does not check
+	// requests.
+	Enabled bool
+	// SessionLifetime is how long a session cookie remains valid after
+	// logging in.
+	SessionLifetime time.Duration
+	// Admins are the usernames of the users allowed to call the handlers
+	// wrapped with RequireAdmin.
+	Admins []string
+}
+
+type User struct {
+	ID       int    `json:"id"`
+	Username string `json:"username"`
+}
+
+type Auth struct {
+	db     *sql.DB
+	d      dialect.Dialect
+	config Config
+}
+
+func New(db *sql.DB, d dialect.Dialect, config Config) *Auth {
+	if config.SessionLifetime == 0 {
+		config.SessionLifetime = DefaultSessionLifetime
+	}
+	return &Auth{db: db, d: d, config: config}
+}
+
+// Enabled reports whether authentication is required.
+func (a *Auth) Enabled() bool {
+	return a.config.Enabled
+}
+
+type contextKey struct{}
+
+// UserFromContext returns the user that authenticated the request, if any.
+func UserFromContext(ctx context.Context) (User, bool) {
+	u, ok := ctx.Value(contextKey{}).(User)
+	return u, ok
+}
+
+// Require wraps h so that it is only called for authenticated requests, either
+// with a session cookie or an API token (as "Authorization: Bearer <token>").
+// If authentication is not enabled, h is returned unchanged.
+func (a *Auth) Require(h http.HandlerFunc) http.HandlerFunc {
+	if !a.config.Enabled {
+		return h
+	}
+	return func(w http.ResponseWriter, req *http.Request) {
+		u, err := a.authenticate(req)
+		if errors.Is(err, ErrInvalidCredentials) {
+			httperror.Send(w, req, http.StatusUnauthorized, "Authentication required")
+			return
+		}
+		if err != nil {
+			httperror.Send(w, req, http.StatusInternalServerError, fmt.Sprintf("Could not authenticate request: %s", err))
+			return
+		}
+		h(w, req.WithContext(context.WithValue(req.Context(), contextKey{}, u)))
+	}
+}
+
+// RequireAdmin wraps h like Require, but only calls it for the users in
+// Config.Admins. If authentication is not enabled, h is returned unchanged.
+func (a *Auth) RequireAdmin(h http.HandlerFunc) http.HandlerFunc {
+	if !a.config.Enabled {
+		return h
+	}
+	return a.Require(func(w http.ResponseWriter, req *http.Request) {
+		u, _ := UserFromContext(req.Context())
+		if !slices.Contains(a.config.Admins, u.Username) {
+			httperror.Send(w, req, http.StatusForbidden, "Only administrators may use this endpoint")
+			return
+		}
+		h(w, req)
+	})
+}
+
+func (a *Auth) authenticate(req *http.Request) (User, error) {
+	const (
+		q_token   = "SELECT users.id, users.username FROM api_tokens JOIN users ON users.id = api_tokens.user_id WHERE api_tokens.token_hash = ?;"
+		q_session = "SELECT users.id, users.username, sessions.expires_at FROM sessions JOIN users ON users.id = sessions.user_id WHERE sessions.token_hash = ?;"
+	)
+
+	var (
+		u       User
+		expires time.Time
+	)
+
+	if bearer, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer "); ok {
+		err := a.db.QueryRow(a.d.Rebind(q_token), hashToken(strings.TrimSpace(bearer))).Scan(&u.ID, &u.Username)
+		if errors.Is(err, sql.ErrNoRows) {
+			return User{}, ErrInvalidCredentials
+		}
+		return u, err
+	}
+
+	cookie, err := req.Cookie(CookieName)
+	if err != nil {
+		return User{}, ErrInvalidCredentials
+	}
+	err = a.db.QueryRow(a.d.Rebind(q_session), hashToken(cookie.Value)).Scan(&u.ID, &u.Username, &expires)
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, ErrInvalidCredentials
+	}
+	if err != nil {
+		return User{}, err
+	}
+	if time.Now().After(expires) {
+		return User{}, ErrInvalidCredentials
+	}
+	return u, nil
+}
+
+// HandleLogin checks the username and password submitted as a form, and sets a
+// session cookie if they match.
+func (a *Auth) HandleLogin(w http.ResponseWriter, req *http.Request) {
+	const (
+		q_create = "INSERT INTO sessions (token_hash, user_id, expires_at) VALUES(?, ?, ?);"
+		q_expire = "DELETE FROM sessions WHERE expires_at < ?;"
+	)
+
+	log.Printf("%s %s", req.Method, req.RequestURI)
+	if req.Method != "POST" {
+		w.WriteHeader(http.StatusNotImplemented)
+		fmt.Fprintf(w, "Unsupported method %s", req.Method)
+		return
+	}
+
+	err := req.ParseForm()
+	if err != nil {
+		httperror.Send(w, req, http.StatusInternalServerError, "Could not parse POST data")
+		return
+	}
+
+	u, err := a.Login(req.Form.Get("username"), req.Form.Get("password"))
+	if errors.Is(err, ErrInvalidCredentials) {
+		httperror.Send(w, req, http.StatusUnauthorized, "Invalid username or password")
+		return
+	}
+	if err != nil {
+		httperror.Send(w, req, http.StatusInternalServerError, fmt.Sprintf("Could not log in: %s", err))
+		return
+	}
+
+	token, err := newToken()
+	if err != nil {
+		httperror.Send(w, req, http.StatusInternalServerError, fmt.Sprintf("Could not create session: %s", err))
+		return
+	}
+	now := time.Now()
+	expires := now.Add(a.config.SessionLifetime)
+
+	_, err = a.db.Exec(a.d.Rebind(q_expire), now.UTC().Format(timeFormat))
+	if err != nil {
+		log.Printf("Could not delete expired sessions: %s", err)
+	}
+	_, err = a.db.Exec(a.d.Rebind(q_create), hashToken(token), u.ID, expires.UTC().Format(timeFormat))
+	if err != nil {
+		httperror.Send(w, req, http.StatusInternalServerError, fmt.Sprintf("Could not create session: %s", err))
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     CookieName,
+		Value:    token,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   isHTTPS(req),
+		SameSite: http.SameSiteLaxMode,
+	})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(u)
+}
+
+// HandleLogout ends the current session and clears the session cookie.
+func (a *Auth) HandleLogout(w http.ResponseWriter, req *http.Request) {
+	const q = "DELETE FROM sessions WHERE token_hash = ?;"
+
+	log.Printf("%s %s", req.Method, req.RequestURI)
+	if req.Method != "POST" {
+		w.WriteHeader(http.StatusNotImplemented)
+		fmt.Fprintf(w, "Unsupported method %s", req.Method)
+		return
+	}
+
+	if cookie, err := req.Cookie(CookieName); err == nil {
+		_, err = a.db.Exec(a.d.Rebind(q), hashToken(cookie.Value))
+		if err != nil {
+			httperror.Send(w, req, http.StatusInternalServerError, fmt.Sprintf("Could not delete session: %s", err))
+			return
+		}
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     CookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   isHTTPS(req),
+		SameSite: http.SameSiteLaxMode,
+	})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleMe returns the authenticated user.
+func (a *Auth) HandleMe(w http.ResponseWriter, req *http.Request) {
+	log.Printf("%s %s", req.Method, req.RequestURI)
+	u, ok := UserFromContext(req.Context())
+	if !ok {
+		httperror.Send(w, req, http.StatusUnauthorized, "Authentication required")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(u)
+}
+
+// Login returns the user if the password matches, or ErrInvalidCredentials.
+func (a *Auth) Login(username, password string) (User, error) {
+	const q = "SELECT id, username, password_hash FROM users WHERE username = ?;"
+
+	var (
+		u    User
+		hash string
+	)
+	err := a.db.QueryRow(a.d.Rebind(q), username).Scan(&u.ID, &u.Username, &hash)
+	if errors.Is(err, sql.ErrNoRows) {
+		// Compare anyway, so that unknown usernames take as long to reject
+		// as wrong passwords.
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return User{}, ErrInvalidCredentials
+	}
+	if err != nil {
+		return User{}, err
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return User{}, ErrInvalidCredentials
+	}
+	return u, nil
+}
+
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("lychnos"), bcrypt.DefaultCost)
+
+// SetPassword creates the user with the provided username, or updates their
+// password if they already exist.
+func (a *Auth) SetPassword(username, password string) error {
+	const (
+		q_find   = "SELECT id FROM users WHERE username = ?;"
+		q_create = "INSERT INTO users (username, password_hash) VALUES(?, ?);"
+		q_update = "UPDATE users SET password_hash = ? WHERE id = ?;"
+	)
+
+	if username == "" || password == "" {
+		return fmt.Errorf("username and password must not be empty")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return fmt.Errorf("could not hash password: %s", err)
+	}
+
+	var id int
+	err = a.db.QueryRow(a.d.Rebind(q_find), username).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		_, err = a.db.Exec(a.d.Rebind(q_create), username, string(hash))
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	_, err = a.db.Exec(a.d.Rebind(q_update), string(hash), id)
+	return err
+}
+
+// newToken returns a random token, suitable for sessions and API tokens.
+func newToken() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// hashToken returns the hash under which a token is stored, so that tokens
+// cannot be recovered from the database.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func isHTTPS(req *http.Request) bool {
+	return req.TLS != nil || req.Header.Get("X-Forwarded-Proto") == "https"
+}
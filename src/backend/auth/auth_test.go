@@ -0,0 +1,212 @@
+package auth_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/davidschlachter/lychnos/src/backend/auth"
+	"github.com/davidschlachter/lychnos/src/backend/dialect"
+)
+
+func TestRequireDisabled(t *testing.T) {
+	a := auth.New(nil, dialect.SQLite, auth.Config{})
+
+	var called bool
+	h := a.Require(func(w http.ResponseWriter, req *http.Request) { called = true })
+	h(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/budgets/", nil))
+	if !called {
+		t.Fatalf("Handler was not called with authentication disabled")
+	}
+}
+
+func TestRequire(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Unexpected error opening mock database connection: %s\n", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery(`SELECT users.id, users.username FROM api_tokens`).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username"}).AddRow(1, "david"))
+	mock.ExpectQuery(`SELECT users.id, users.username FROM api_tokens`).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username"}))
+	mock.ExpectQuery(`SELECT users.id, users.username, sessions.expires_at FROM sessions`).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username", "expires_at"}).AddRow(1, "david", time.Now().Add(-time.Hour)))
+
+	a := auth.New(db, dialect.SQLite, auth.Config{Enabled: true})
+	var user auth.User
+	h := a.Require(func(w http.ResponseWriter, req *http.Request) {
+		user, _ = auth.UserFromContext(req.Context())
+	})
+
+	tests := []struct {
+		name     string
+		header   string
+		cookie   string
+		expected int
+	}{
+		{name: "no credentials", expected: http.StatusUnauthorized},
+		{name: "valid token", header: "Bearer abc", expected: http.StatusOK},
+		{name: "revoked token", header: "Bearer abc", expected: http.StatusUnauthorized},
+		{name: "expired session", cookie: "abc", expected: http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		user = auth.User{}
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/api/budgets/", nil)
+		if test.header != "" {
+			req.Header.Set("Authorization", test.header)
+		}
+		if test.cookie != "" {
+			req.AddCookie(&http.Cookie{Name: auth.CookieName, Value: test.cookie})
+		}
+		h(w, req)
+		if w.Result().StatusCode != test.expected {
+			t.Fatalf("%s: status code = %d, want %d", test.name, w.Result().StatusCode, test.expected)
+		}
+		if test.expected == http.StatusOK && user.Username != "david" {
+			t.Fatalf("%s: got user %+v, wanted david", test.name, user)
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestRequireAdmin(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Unexpected error opening mock database connection: %s\n", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery(`SELECT users.id, users.username FROM api_tokens`).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username"}).AddRow(1, "david"))
+	mock.ExpectQuery(`SELECT users.id, users.username FROM api_tokens`).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username"}).AddRow(2, "guest"))
+
+	a := auth.New(db, dialect.SQLite, auth.Config{Enabled: true, Admins: []string{"david"}})
+	h := a.RequireAdmin(func(w http.ResponseWriter, req *http.Request) {})
+	for _, expected := range []int{http.StatusOK, http.StatusForbidden} {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodDelete, "/api/cache", nil)
+		req.Header.Set("Authorization", "Bearer abc")
+		h(w, req)
+		if w.Result().StatusCode != expected {
+			t.Fatalf("Status code = %d, want %d", w.Result().StatusCode, expected)
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestLogin(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Unexpected error opening mock database connection: %s\n", err)
+	}
+	defer db.Close()
+
+	hash, _ := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	mock.ExpectQuery(`SELECT id, username, password_hash FROM users WHERE username = \?;`).WithArgs("david").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username", "password_hash"}).AddRow(1, "david", string(hash)))
+	mock.ExpectQuery(`SELECT id, username, password_hash FROM users WHERE username = \?;`).WithArgs("david").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username", "password_hash"}).AddRow(1, "david", string(hash)))
+	mock.ExpectExec(`DELETE FROM sessions WHERE expires_at < \?;`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`INSERT INTO sessions`).WithArgs(sqlmock.AnyArg(), 1, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	a := auth.New(db, dialect.SQLite, auth.Config{Enabled: true})
+
+	// Wrong password
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/api/auth/login", strings.NewReader("username=david&password=hunter3"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	a.HandleLogin(w, req)
+	if w.Result().StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Status code = %d, want %d\n", w.Result().StatusCode, http.StatusUnauthorized)
+	}
+
+	// Correct password
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodPost, "/api/auth/login", strings.NewReader("username=david&password=hunter2"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	a.HandleLogin(w, req)
+	if w.Result().StatusCode != http.StatusOK {
+		t.Fatalf("Status code = %d, want %d\n", w.Result().StatusCode, http.StatusOK)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != auth.CookieName || !cookies[0].HttpOnly || cookies[0].Value == "" {
+		t.Fatalf("Got cookies %+v, wanted a single HttpOnly session cookie", cookies)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestTokens(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Unexpected error opening mock database connection: %s\n", err)
+	}
+	defer db.Close()
+
+	tokenQuery := `SELECT users.id, users.username FROM api_tokens`
+	mock.ExpectQuery(tokenQuery).WillReturnRows(sqlmock.NewRows([]string{"id", "username"}).AddRow(1, "david"))
+	mock.ExpectExec(`INSERT INTO api_tokens`).WithArgs(1, "backup script", sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(3, 1))
+	mock.ExpectQuery(tokenQuery).WillReturnRows(sqlmock.NewRows([]string{"id", "username"}).AddRow(1, "david"))
+	mock.ExpectExec(`DELETE FROM api_tokens WHERE id = \? AND user_id = \?;`).WithArgs(3, 1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(tokenQuery).WillReturnRows(sqlmock.NewRows([]string{"id", "username"}).AddRow(1, "david"))
+	mock.ExpectExec(`DELETE FROM api_tokens WHERE id = \? AND user_id = \?;`).WithArgs(4, 1).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	a := auth.New(db, dialect.SQLite, auth.Config{Enabled: true})
+	h := a.Require(a.HandleTokens)
+
+	// Create
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/api/tokens/", strings.NewReader("name=backup+script"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "Bearer abc")
+	h(w, req)
+	if w.Result().StatusCode != http.StatusCreated {
+		t.Fatalf("Status code = %d, want %d\n", w.Result().StatusCode, http.StatusCreated)
+	}
+	if !strings.Contains(w.Body.String(), `"token":"`) {
+		t.Fatalf("Expected new token in response, got: %s", w.Body.String())
+	}
+
+	// Revoke
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodDelete, "/api/tokens/3", nil)
+	req.Header.Set("Authorization", "Bearer abc")
+	h(w, req)
+	if w.Result().StatusCode != http.StatusNoContent {
+		t.Fatalf("Status code = %d, want %d\n", w.Result().StatusCode, http.StatusNoContent)
+	}
+
+	// Revoke a token of another user
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodDelete, "/api/tokens/4", nil)
+	req.Header.Set("Authorization", "Bearer abc")
+	h(w, req)
+	if w.Result().StatusCode != http.StatusNotFound {
+		t.Fatalf("Status code = %d, want %d\n", w.Result().StatusCode, http.StatusNotFound)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
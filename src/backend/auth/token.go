@@ -0,0 +1,127 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/davidschlachter/lychnos/src/backend/httperror"
+)
+
+// Token is a personal API token. The token itself is only returned when it is
+// created, since only its hash is stored.
+type Token struct {
+	ID        int       `json:"id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+	Token     string    `json:"token,omitempty"`
+}
+
+// HandleTokens lists, creates and revokes the API tokens of the authenticated
+// user. It must be wrapped with Require.
+func (a *Auth) HandleTokens(w http.ResponseWriter, req *http.Request) {
+	log.Printf("%s %s", req.Method, req.RequestURI)
+	u, ok := UserFromContext(req.Context())
+	if !ok {
+		httperror.Send(w, req, http.StatusUnauthorized, "Authentication required")
+		return
+	}
+
+	switch req.Method {
+	case "GET":
+		a.listTokens(w, req, u)
+	case "POST":
+		a.createToken(w, req, u)
+	case "DELETE":
+		hasID := regexp.MustCompile(`/[0-9]+$`)
+		if !hasID.MatchString(req.URL.Path) {
+			httperror.Send(w, req, http.StatusBadRequest, "Must provide ID of token to revoke")
+			return
+		}
+		a.revokeToken(w, req, u)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+		fmt.Fprintf(w, "Unsupported method %s", req.Method)
+	}
+}
+
+func (a *Auth) listTokens(w http.ResponseWriter, req *http.Request, u User) {
+	const q = "SELECT id, name, created_at FROM api_tokens WHERE user_id = ? ORDER BY id;"
+
+	rows, err := a.db.Query(a.d.Rebind(q), u.ID)
+	if err != nil {
+		httperror.Send(w, req, http.StatusInternalServerError, fmt.Sprintf("Could not list tokens: %s", err))
+		return
+	}
+	defer rows.Close()
+
+	tokens := []Token{}
+	for rows.Next() {
+		var t Token
+		err = rows.Scan(&t.ID, &t.Name, &t.CreatedAt)
+		if err != nil {
+			httperror.Send(w, req, http.StatusInternalServerError, fmt.Sprintf("Could not read token: %s", err))
+			return
+		}
+		tokens = append(tokens, t)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tokens)
+}
+
+func (a *Auth) createToken(w http.ResponseWriter, req *http.Request, u User) {
+	const q = "INSERT INTO api_tokens (user_id, name, token_hash, created_at) VALUES(?, ?, ?, ?);"
+
+	err := req.ParseForm()
+	if err != nil {
+		httperror.Send(w, req, http.StatusInternalServerError, "Could not parse POST data")
+		return
+	}
+
+	t := Token{
+		Name:      strings.TrimSpace(req.Form.Get("name")),
+		CreatedAt: time.Now().UTC().Truncate(time.Second),
+	}
+	if t.Name == "" {
+		httperror.Send(w, req, http.StatusBadRequest, "Must provide a name for the token")
+		return
+	}
+	t.Token, err = newToken()
+	if err != nil {
+		httperror.Send(w, req, http.StatusInternalServerError, fmt.Sprintf("Could not create token: %s", err))
+		return
+	}
+
+	t.ID, err = a.d.InsertID(a.db, q, u.ID, t.Name, hashToken(t.Token), t.CreatedAt.Format(timeFormat))
+	if err != nil {
+		httperror.Send(w, req, http.StatusInternalServerError, fmt.Sprintf("Could not create token: %s", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(t)
+}
+
+func (a *Auth) revokeToken(w http.ResponseWriter, req *http.Request, u User) {
+	const q = "DELETE FROM api_tokens WHERE id = ? AND user_id = ?;"
+
+	id, _ := strconv.Atoi(req.URL.Path[strings.LastIndex(req.URL.Path, "/")+1:])
+	res, err := a.db.Exec(a.d.Rebind(q), id, u.ID)
+	if err != nil {
+		httperror.Send(w, req, http.StatusInternalServerError, fmt.Sprintf("Could not revoke token: %s", err))
+		return
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		httperror.Send(w, req, http.StatusNotFound, fmt.Sprintf("Could not find token with ID = %d", id))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -3,6 +3,7 @@ package budget
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -11,24 +12,28 @@ import (
 	"strings"
 	"time"
 
+	"github.com/davidschlachter/lychnos/src/backend/dialect"
 	"github.com/davidschlachter/lychnos/src/backend/httperror"
+	"github.com/davidschlachter/lychnos/src/backend/interval"
 )
 
-const dateFormat = "2006-01-02 15:04:05"
+// DateFormat is the format of the start and end dates submitted by clients.
+const DateFormat = "2006-01-02 15:04:05"
 
 type Budget struct {
-	ID                int       `json:"id"`
-	Start             time.Time `json:"start"`
-	End               time.Time `json:"end"`
-	ReportingInterval int       `json:"reporting_interval"`
+	ID                int           `json:"id"`
+	Start             time.Time     `json:"start"`
+	End               time.Time     `json:"end"`
+	ReportingInterval interval.Kind `json:"reporting_interval"`
 }
 
 type Budgets struct {
 	db *sql.DB
+	d  dialect.Dialect
 }
 
-func New(db *sql.DB) *Budgets {
-	return &Budgets{db: db}
+func New(db *sql.DB, d dialect.Dialect) *Budgets {
+	return &Budgets{db: db, d: d}
 }
 
 func (b *Budgets) Handle(w http.ResponseWriter, req *http.Request) {
@@ -69,9 +74,9 @@ func (b *Budgets) fetch(w http.ResponseWriter, req *http.Request) {
 }
 
 func (b *Budgets) Fetch(id string) ([]Budget, error) {
-	const q = "SELECT id, start, end, reporting_interval FROM budgets WHERE id = ?;"
+	const q = `SELECT id, start, "end", reporting_interval FROM budgets WHERE id = ?;`
 
-	row := b.db.QueryRow(q, id)
+	row := b.db.QueryRow(b.d.Rebind(q), id)
 	if err := row.Err(); err != nil {
 		return nil, err
 	}
@@ -97,8 +102,8 @@ func (b *Budgets) list(w http.ResponseWriter, req *http.Request) {
 }
 
 func (b *Budgets) List() ([]Budget, error) {
-	const q = "SELECT id, start, end, reporting_interval FROM budgets;"
-	rows, err := b.db.Query(q)
+	const q = `SELECT id, start, "end", reporting_interval FROM budgets;`
+	rows, err := b.db.Query(b.d.Rebind(q))
 	if err != nil {
 		return nil, err
 	}
@@ -117,9 +122,9 @@ func (b *Budgets) List() ([]Budget, error) {
 
 func (b *Budgets) upsert(w http.ResponseWriter, req *http.Request) {
 	var (
-		err      error
-		interval int
-		id       int
+		err               error
+		reportingInterval interval.Kind
+		id                int
 	)
 
 	err = req.ParseForm()
@@ -147,11 +152,11 @@ func (b *Budgets) upsert(w http.ResponseWriter, req *http.Request) {
 	}
 	intervalString := req.Form.Get("interval")
 	if len(intervalString) == 0 {
-		interval = 0
+		reportingInterval = interval.Monthly
 	} else {
-		interval, err = strconv.Atoi(intervalString)
+		reportingInterval, err = interval.Parse(intervalString)
 		if err != nil {
-			httperror.Send(w, req, http.StatusBadRequest, "Interval must be an integer")
+			httperror.Send(w, req, http.StatusBadRequest, fmt.Sprintf("Invalid interval: %s", err))
 			return
 		}
 	}
@@ -159,12 +164,12 @@ func (b *Budgets) upsert(w http.ResponseWriter, req *http.Request) {
 	// Validate dates
 	// TODO(davidschlachter): if the client doesn't provide a time zone, these
 	// will be created in UTC, which will lead to unexpected behaviour.
-	start, err := time.Parse(dateFormat, startString)
+	start, err := time.Parse(DateFormat, startString)
 	if err != nil {
 		httperror.Send(w, req, http.StatusBadRequest, fmt.Sprintf("Could not parse start time: %s", err))
 		return
 	}
-	end, err := time.Parse(dateFormat, endString)
+	end, err := time.Parse(DateFormat, endString)
 	if err != nil {
 		httperror.Send(w, req, http.StatusBadRequest, fmt.Sprintf("Could not parse end time: %s", err))
 		return
@@ -174,11 +179,13 @@ func (b *Budgets) upsert(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	// TODO(davidschlachter): check that the new budget does not overlap the
-	// date ranges of any other one
-
 	// Insert the budget into the database
-	err = b.Upsert(id, start, end, interval)
+	err = b.Upsert(id, start, end, reportingInterval)
+	var overlap *OverlapError
+	if errors.As(err, &overlap) {
+		httperror.Send(w, req, http.StatusConflict, err.Error())
+		return
+	}
 	if err != nil {
 		httperror.Send(w, req, http.StatusBadRequest, fmt.Sprintf("Could not upsert budget: %s", err))
 		return
@@ -187,14 +194,197 @@ func (b *Budgets) upsert(w http.ResponseWriter, req *http.Request) {
 	w.WriteHeader(http.StatusCreated)
 }
 
-func (b *Budgets) Upsert(id int, start, end time.Time, interval int) error {
-	const q = "REPLACE INTO budgets (id, start, end, reporting_interval) VALUES(?, ?, ?, ?);"
+// OverlapError is returned when a budget would overlap the date range of an
+// existing budget.
+type OverlapError struct {
+	Budget Budget
+}
 
-	// Insert the budget into the database
-	_, err := b.db.Exec(q, id, start.UTC().Format(dateFormat), end.UTC().Format(dateFormat), interval)
+func (e *OverlapError) Error() string {
+	return fmt.Sprintf("budget would overlap budget %d (%s to %s)", e.Budget.ID, e.Budget.Start.Format(DateFormat), e.Budget.End.Format(DateFormat))
+}
+
+// Upsert creates or replaces the budget with the provided ID. If the ID is 0,
+// a new budget is created. If the budget's date range overlaps any other
+// budget, an *OverlapError is returned. The check and the write run in one
+// database transaction, so that concurrent upserts can't both pass the check.
+func (b *Budgets) Upsert(id int, start, end time.Time, reportingInterval interval.Kind) error {
+	tx, err := b.db.Begin()
+	if err != nil {
+		return fmt.Errorf("could not begin transaction: %s", err)
+	}
+	defer tx.Rollback()
+
+	if id == 0 {
+		_, err = b.create(tx, start, end, reportingInterval)
+	} else {
+		err = b.replace(tx, id, start, end, reportingInterval)
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (b *Budgets) replace(tx *sql.Tx, id int, start, end time.Time, reportingInterval interval.Kind) error {
+	err := b.validate(tx, id, start, end, reportingInterval)
+	if err != nil {
+		return err
+	}
+
+	q := b.d.Upsert("budgets", "id", "start", `"end"`, "reporting_interval")
+	_, err = tx.Exec(q, id, start.UTC().Format(DateFormat), end.UTC().Format(DateFormat), reportingInterval)
 	return err
 }
 
+// CreateTx creates a new budget as part of the database transaction tx,
+// returning its ID. As for Upsert, an *OverlapError is returned if the budget
+// would overlap any other budget.
+func (b *Budgets) CreateTx(tx *sql.Tx, start, end time.Time, reportingInterval interval.Kind) (int, error) {
+	return b.create(tx, start, end, reportingInterval)
+}
+
+func (b *Budgets) create(e dialect.Execer, start, end time.Time, reportingInterval interval.Kind) (int, error) {
+	const q = `INSERT INTO budgets (start, "end", reporting_interval) VALUES(?, ?, ?);`
+
+	err := b.validate(e, 0, start, end, reportingInterval)
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := b.d.InsertID(e, q, start.UTC().Format(DateFormat), end.UTC().Format(DateFormat), reportingInterval)
+	if err != nil {
+		return 0, fmt.Errorf("could not create budget: %s", err)
+	}
+	return id, nil
+}
+
+// validate checks that the budget with the provided ID has a known reporting
+// interval, and that it does not overlap any other budget. The check runs on e,
+// so that within a database transaction, it sees the same budgets as the
+// insert that follows it.
+func (b *Budgets) validate(e dialect.Execer, id int, start, end time.Time, reportingInterval interval.Kind) error {
+	const q = `SELECT id, start, "end", reporting_interval FROM budgets WHERE id <> ? AND start <= ? AND "end" >= ? ORDER BY start LIMIT 1;`
+
+	if !reportingInterval.Valid() {
+		return fmt.Errorf("unknown reporting interval %d", reportingInterval)
+	}
+	if start.After(end) {
+		return fmt.Errorf("start must be before end")
+	}
+
+	var bgt Budget
+	err := e.QueryRow(b.d.Rebind(q), id, end.UTC().Format(DateFormat), start.UTC().Format(DateFormat)).Scan(&bgt.ID, &bgt.Start, &bgt.End, &bgt.ReportingInterval)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("could not check for overlapping budgets: %s", err)
+	}
+	return &OverlapError{Budget: bgt}
+}
+
+// ErrNoBudget is returned when no budget contains the requested date.
+var ErrNoBudget = errors.New("no budget contains the requested date")
+
+// ForDate returns the budget whose date range contains t, or ErrNoBudget if
+// there is none.
+func (b *Budgets) ForDate(t time.Time) (Budget, error) {
+	bgts, err := b.List()
+	if err != nil {
+		return Budget{}, err
+	}
+	for _, bgt := range bgts {
+		if !t.Before(bgt.Start) && !t.After(bgt.End) {
+			return bgt, nil
+		}
+	}
+	return Budget{}, ErrNoBudget
+}
+
+// Previous returns the latest budget ending before bgt starts, or ErrNoBudget
+// if there is none.
+func (b *Budgets) Previous(bgt Budget) (Budget, error) {
+	bgts, err := b.List()
+	if err != nil {
+		return Budget{}, err
+	}
+	var prev Budget
+	for _, other := range bgts {
+		if other.ID == bgt.ID || !other.End.Before(bgt.Start) {
+			continue
+		}
+		if prev.ID == 0 || other.End.After(prev.End) {
+			prev = other
+		}
+	}
+	if prev.ID == 0 {
+		return Budget{}, ErrNoBudget
+	}
+	return prev, nil
+}
+
+// Current returns the budget containing now. If no budget exists for now, a
+// new budget is created for the current calendar year, shortened to end before
+// and start after any other budgets in that year.
+func (b *Budgets) Current(now time.Time) (Budget, error) {
+	bgt, err := b.ForDate(now)
+	if !errors.Is(err, ErrNoBudget) {
+		return bgt, err
+	}
+
+	tx, err := b.db.Begin()
+	if err != nil {
+		return Budget{}, fmt.Errorf("could not begin transaction: %s", err)
+	}
+	defer tx.Rollback()
+
+	bgt, err = b.gap(tx, now)
+	if err != nil {
+		return Budget{}, fmt.Errorf("no budget existed, failed to find the dates for a new budget: %s", err)
+	}
+	bgt.ID, err = b.create(tx, bgt.Start, bgt.End, bgt.ReportingInterval)
+	if err != nil {
+		return Budget{}, fmt.Errorf("no budget existed, failed to create a new budget: %w", err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return Budget{}, fmt.Errorf("no budget existed, failed to create a new budget: %w", err)
+	}
+	return bgt, nil
+}
+
+// gap returns a budget for the calendar year of now, which must not be in any
+// budget, that starts after the budget before now and ends before the budget
+// after now.
+func (b *Budgets) gap(e dialect.Execer, now time.Time) (Budget, error) {
+	const (
+		q_before = `SELECT "end" FROM budgets WHERE "end" < ? ORDER BY "end" DESC LIMIT 1;`
+		q_after  = `SELECT start FROM budgets WHERE start > ? ORDER BY start LIMIT 1;`
+	)
+
+	bgt := Budget{
+		Start: time.Date(now.Year(), time.January, 01, 0, 0, 0, 0, time.Local),
+		End:   time.Date(now.Year(), time.December, 31, 23, 59, 59, 59, time.Local),
+	}
+	var before, after time.Time
+	err := e.QueryRow(b.d.Rebind(q_before), now.UTC().Format(DateFormat)).Scan(&before)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return Budget{}, err
+	}
+	if err == nil && !before.Before(bgt.Start) {
+		bgt.Start = before.Add(time.Second)
+	}
+	err = e.QueryRow(b.d.Rebind(q_after), now.UTC().Format(DateFormat)).Scan(&after)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return Budget{}, err
+	}
+	if err == nil && !after.After(bgt.End) {
+		bgt.End = after.Add(-time.Second)
+	}
+	return bgt, nil
+}
+
 func (b *Budgets) delete(w http.ResponseWriter, req *http.Request) {
 	const q = "DELETE FROM budgets WHERE id = ?;"
 
@@ -210,7 +400,7 @@ func (b *Budgets) delete(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	_, err = b.db.Exec(q, id)
+	_, err = b.db.Exec(b.d.Rebind(q), id)
 	if err != nil {
 		httperror.Send(w, req, http.StatusBadRequest, fmt.Sprintf("Could not delete budget: %s", err))
 		return
@@ -1,40 +1,79 @@
 package budget_test
 
 import (
+	"database/sql/driver"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/davidschlachter/lychnos/src/backend/budget"
+	"github.com/davidschlachter/lychnos/src/backend/dialect"
 )
 
 func TestHandle(t *testing.T) {
+	for _, d := range dialect.All {
+		t.Run(d.String(), func(t *testing.T) { testHandle(t, d) })
+	}
+}
+
+// expectCreate expects a new budget to be inserted with the provided arguments.
+func expectCreate(mock sqlmock.Sqlmock, d dialect.Dialect, id int, args ...driver.Value) {
+	if d == dialect.Postgres {
+		mock.ExpectQuery(`INSERT INTO budgets .* RETURNING id;`).WithArgs(args...).
+			WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(id))
+		return
+	}
+	mock.ExpectExec(`INSERT INTO budgets`).WithArgs(args...).
+		WillReturnResult(sqlmock.NewResult(int64(id), 1))
+}
+
+// expectReplace expects the budget to be replaced with the provided arguments.
+func expectReplace(mock sqlmock.Sqlmock, d dialect.Dialect, args ...driver.Value) {
+	q := `REPLACE INTO budgets`
+	if d == dialect.Postgres {
+		q = `INSERT INTO budgets .* ON CONFLICT \(id\) DO UPDATE`
+	}
+	mock.ExpectExec(q).WithArgs(args...).WillReturnResult(sqlmock.NewResult(1, 1))
+}
+
+// expectOverlap expects a check for budgets overlapping a budget with the
+// provided ID, start and end, returning rows.
+func expectOverlap(mock sqlmock.Sqlmock, id int, start, end string, rows *sqlmock.Rows) {
+	mock.ExpectQuery(`SELECT id, start, .end., reporting_interval FROM budgets WHERE id <> (\?|\$1) AND start <= (\?|\$2) AND .end. >= (\?|\$3) ORDER BY start LIMIT 1;`).
+		WithArgs(id, end, start).WillReturnRows(rows)
+}
 
+func testHandle(t *testing.T, d dialect.Dialect) {
 	db, mock, err := sqlmock.New()
 	if err != nil {
 		t.Fatalf("Unexpected error opening mock database connection: %s\n", err)
 	}
 	defer db.Close()
 
-	mock.ExpectExec(`REPLACE INTO budgets`).
-		WithArgs(0, "2021-01-01 00:00:00", "2021-12-31 23:59:59", 0).
-		WillReturnResult(sqlmock.NewResult(1, 1))
-	mock.ExpectQuery(`SELECT id, start, end, reporting_interval FROM budgets;`).
+	// The overlap check and the write share a transaction
+	mock.ExpectBegin()
+	expectOverlap(mock, 0, "2021-01-01 00:00:00", "2021-12-31 23:59:59", sqlmock.NewRows([]string{"id", "start", "end", "reporting_interval"}))
+	expectCreate(mock, d, 1, "2021-01-01 00:00:00", "2021-12-31 23:59:59", 0)
+	mock.ExpectCommit()
+	mock.ExpectQuery(`SELECT id, start, .end., reporting_interval FROM budgets;`).
 		WillReturnRows(sqlmock.NewRows([]string{"id", "start", "end", "reporting_interval"}).
 			AddRow(1, "2021-01-01 00:00:00", "2021-12-31 23:59:59", 0))
-	mock.ExpectQuery(`SELECT id, start, end, reporting_interval FROM budgets WHERE id = \?;`).
+	mock.ExpectQuery(`SELECT id, start, .end., reporting_interval FROM budgets WHERE id = (\?|\$1);`).
 		WithArgs("1").WillReturnRows(sqlmock.NewRows([]string{"id", "start", "end", "reporting_interval"}).
 		AddRow(1, "2021-01-01 00:00:00", "2021-12-31 23:59:59", 0))
-	mock.ExpectExec(`REPLACE INTO budgets`).
-		WithArgs(1, "2022-01-01 00:00:00", "2022-12-31 23:59:59", 0).
-		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectBegin()
+	expectOverlap(mock, 1, "2022-01-01 00:00:00", "2022-12-31 23:59:59", sqlmock.NewRows([]string{"id", "start", "end", "reporting_interval"}))
+	expectReplace(mock, d, 1, "2022-01-01 00:00:00", "2022-12-31 23:59:59", 0)
+	mock.ExpectCommit()
 	mock.ExpectExec(`DELETE FROM budgets WHERE id`).WithArgs(1).
 		WillReturnResult(sqlmock.NewResult(1, 1))
 
-	b := budget.New(db)
+	b := budget.New(db, d)
 
 	// Create
 	w := httptest.NewRecorder()
@@ -91,3 +130,142 @@ func TestHandle(t *testing.T) {
 		t.Errorf("there were unfulfilled expectations: %s", err)
 	}
 }
+
+func TestUpsertOverlap(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Unexpected error opening mock database connection: %s\n", err)
+	}
+	defer db.Close()
+
+	// The transaction is rolled back without writing anything
+	mock.ExpectBegin()
+	expectOverlap(mock, 0, "2021-07-01 00:00:00", "2022-06-30 23:59:59", sqlmock.NewRows([]string{"id", "start", "end", "reporting_interval"}).
+		AddRow(1, time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2021, 12, 31, 23, 59, 59, 0, time.UTC), 0))
+	mock.ExpectRollback()
+
+	b := budget.New(db, dialect.SQLite)
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/api/budgets/", strings.NewReader("start=2021-07-01%2000%3A00%3A00&end=2022-06-30%2023%3A59%3A59"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	b.Handle(w, req)
+	if w.Result().StatusCode != http.StatusConflict {
+		t.Fatalf("Status code = %d, want %d\n", w.Result().StatusCode, http.StatusConflict)
+	}
+	if !strings.Contains(w.Body.String(), "budget 1") {
+		t.Fatalf("Expected error to name conflicting budget 1, got: %s", w.Body.String())
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestForDate(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Unexpected error opening mock database connection: %s\n", err)
+	}
+	defer db.Close()
+
+	rows := func() *sqlmock.Rows {
+		return sqlmock.NewRows([]string{"id", "start", "end", "reporting_interval"}).
+			AddRow(1, time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2021, 12, 31, 23, 59, 59, 0, time.UTC), 0).
+			AddRow(2, time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2022, 12, 31, 23, 59, 59, 0, time.UTC), 0)
+	}
+	mock.ExpectQuery(`SELECT id, start, .end., reporting_interval FROM budgets;`).WillReturnRows(rows())
+	mock.ExpectQuery(`SELECT id, start, .end., reporting_interval FROM budgets;`).WillReturnRows(rows())
+
+	b := budget.New(db, dialect.SQLite)
+
+	bgt, err := b.ForDate(time.Date(2022, 3, 14, 12, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if bgt.ID != 2 {
+		t.Fatalf("Got budget %d, wanted 2", bgt.ID)
+	}
+
+	_, err = b.ForDate(time.Date(2023, 3, 14, 12, 0, 0, 0, time.UTC))
+	if !errors.Is(err, budget.ErrNoBudget) {
+		t.Fatalf("Got error %v, wanted ErrNoBudget", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestUpsertInvalidInterval(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Unexpected error opening mock database connection: %s\n", err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	expectOverlap(mock, 0, "2021-01-01 00:00:00", "2021-12-31 23:59:59", sqlmock.NewRows([]string{"id", "start", "end", "reporting_interval"}))
+	expectCreate(mock, dialect.SQLite, 1, "2021-01-01 00:00:00", "2021-12-31 23:59:59", 2)
+	mock.ExpectCommit()
+
+	b := budget.New(db, dialect.SQLite)
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/api/budgets/", strings.NewReader("start=2021-01-01%2000%3A00%3A00&end=2021-12-31%2023%3A59%3A59&interval=fortnightly"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	b.Handle(w, req)
+	if w.Result().StatusCode != http.StatusBadRequest {
+		t.Fatalf("Status code = %d, want %d\n", w.Result().StatusCode, http.StatusBadRequest)
+	}
+
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodPost, "/api/budgets/", strings.NewReader("start=2021-01-01%2000%3A00%3A00&end=2021-12-31%2023%3A59%3A59&interval=biweekly"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	b.Handle(w, req)
+	if w.Result().StatusCode != http.StatusCreated {
+		t.Fatalf("Status code = %d, want %d\n", w.Result().StatusCode, http.StatusCreated)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestCurrent(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Unexpected error opening mock database connection: %s\n", err)
+	}
+	defer db.Close()
+
+	// Budgets from July to June, with a gap from July to October 2021
+	before := time.Date(2021, 6, 30, 23, 59, 59, 0, time.UTC)
+	after := time.Date(2021, 11, 1, 0, 0, 0, 0, time.UTC)
+	mock.ExpectQuery(`SELECT id, start, .end., reporting_interval FROM budgets;`).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "start", "end", "reporting_interval"}).
+			AddRow(1, time.Date(2020, 7, 1, 0, 0, 0, 0, time.UTC), before, 0).
+			AddRow(2, after, time.Date(2022, 10, 31, 23, 59, 59, 0, time.UTC), 0))
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT .end. FROM budgets WHERE .end. < \? ORDER BY .end. DESC LIMIT 1;`).WithArgs("2021-09-15 12:00:00").
+		WillReturnRows(sqlmock.NewRows([]string{"end"}).AddRow(before))
+	mock.ExpectQuery(`SELECT start FROM budgets WHERE start > \? ORDER BY start LIMIT 1;`).WithArgs("2021-09-15 12:00:00").
+		WillReturnRows(sqlmock.NewRows([]string{"start"}).AddRow(after))
+	expectOverlap(mock, 0, "2021-07-01 00:00:00", "2021-10-31 23:59:59", sqlmock.NewRows([]string{"id", "start", "end", "reporting_interval"}))
+	expectCreate(mock, dialect.SQLite, 3, "2021-07-01 00:00:00", "2021-10-31 23:59:59", 0)
+	mock.ExpectCommit()
+
+	b := budget.New(db, dialect.SQLite)
+
+	bgt, err := b.Current(time.Date(2021, 9, 15, 12, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if bgt.ID != 3 || !bgt.Start.Equal(before.Add(time.Second)) || !bgt.End.Equal(after.Add(-time.Second)) {
+		t.Fatalf("Got budget %+v, wanted budget 3 from 2021-07-01 to 2021-10-31", bgt)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
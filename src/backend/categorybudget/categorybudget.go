@@ -13,6 +13,7 @@ import (
 	"time"
 
 	"github.com/davidschlachter/lychnos/src/backend/budget"
+	"github.com/davidschlachter/lychnos/src/backend/dialect"
 	"github.com/davidschlachter/lychnos/src/backend/httperror"
 	"github.com/shopspring/decimal"
 )
@@ -22,15 +23,56 @@ type CategoryBudget struct {
 	Budget   int             `json:"budget"`
 	Category int             `json:"category"`
 	Amount   decimal.Decimal `json:"amount"`
+	Rollover RolloverMode    `json:"rollover"`
+}
+
+// RolloverMode determines whether the amount left over in the category's
+// budget for the previous period is carried over into this one.
+type RolloverMode int
+
+const (
+	// RolloverNone starts every budget from zero.
+	RolloverNone RolloverMode = iota
+	// RolloverSurplus carries over any amount that was not spent.
+	RolloverSurplus
+	// RolloverSurplusAndDeficit carries over any amount that was not spent,
+	// and subtracts any amount that was overspent.
+	RolloverSurplusAndDeficit
+)
+
+// Valid reports whether m is a known RolloverMode.
+func (m RolloverMode) Valid() bool {
+	return m >= RolloverNone && m <= RolloverSurplusAndDeficit
+}
+
+// CarriedOver returns the amount carried over from a previous period with the
+// budgeted amount and actual sum provided. Amounts follow the sign of the
+// category: expense budgets and sums are negative.
+func (m RolloverMode) CarriedOver(amount, sum decimal.Decimal) decimal.Decimal {
+	left := amount.Sub(sum)
+	switch m {
+	case RolloverSurplus:
+		// Spending less than budgeted, or earning more than budgeted, both
+		// leave a negative amount.
+		if !left.IsNegative() {
+			return decimal.Zero
+		}
+		return left
+	case RolloverSurplusAndDeficit:
+		return left
+	default:
+		return decimal.Zero
+	}
 }
 
 type CategoryBudgets struct {
 	db *sql.DB
+	d  dialect.Dialect
 	b  *budget.Budgets
 }
 
-func New(db *sql.DB, b *budget.Budgets) *CategoryBudgets {
-	return &CategoryBudgets{db: db, b: b}
+func New(db *sql.DB, d dialect.Dialect, b *budget.Budgets) *CategoryBudgets {
+	return &CategoryBudgets{db: db, d: d, b: b}
 }
 
 func (c *CategoryBudgets) Handle(w http.ResponseWriter, req *http.Request) {
@@ -72,9 +114,9 @@ func (c *CategoryBudgets) fetch(w http.ResponseWriter, req *http.Request) {
 }
 
 func (c *CategoryBudgets) Fetch(id string) ([]CategoryBudget, error) {
-	const q = "SELECT id, budget, category, amount FROM category_budgets WHERE id = ?;"
+	const q = "SELECT id, budget, category, amount, rollover FROM category_budgets WHERE id = ?;"
 
-	row := c.db.QueryRow(q, id)
+	row := c.db.QueryRow(c.d.Rebind(q), id)
 	if err := row.Err(); err != nil {
 		return nil, err
 	}
@@ -82,7 +124,7 @@ func (c *CategoryBudgets) Fetch(id string) ([]CategoryBudget, error) {
 	var categoryBudgets []CategoryBudget
 
 	var catBgt CategoryBudget
-	row.Scan(&catBgt.ID, &catBgt.Budget, &catBgt.Category, &catBgt.Amount)
+	row.Scan(&catBgt.ID, &catBgt.Budget, &catBgt.Category, &catBgt.Amount, &catBgt.Rollover)
 	categoryBudgets = append(categoryBudgets, catBgt)
 
 	return categoryBudgets, nil
@@ -92,42 +134,17 @@ func (c *CategoryBudgets) Fetch(id string) ([]CategoryBudget, error) {
 func (c *CategoryBudgets) list(w http.ResponseWriter, req *http.Request) {
 	// If a budget was not provided, fetch the current one.
 	var (
-		budget      int
-		maxBudgetID int
-		err         error
+		budget int
+		err    error
 	)
 	budgetStr, ok := req.URL.Query()["budget"]
 	if !ok || len(budgetStr) == 0 {
-		bgts, err := c.b.List()
+		bgt, err := c.b.Current(time.Now())
 		if err != nil {
-			httperror.Send(w, req, http.StatusBadRequest, fmt.Sprintf("Could not fetch budgets to find latest budget for list of category budgets: %s\n", err))
+			httperror.Send(w, req, http.StatusBadRequest, fmt.Sprintf("Could not find the current budget for list of category budgets: %s\n", err))
 			return
 		}
-		now := time.Now()
-		for _, b := range bgts {
-			if b.ID > maxBudgetID {
-				maxBudgetID = b.ID
-			}
-			if now.After(b.Start) && now.Before(b.End) {
-				budget = b.ID
-				break
-			}
-		}
-		// If no budget exists, create one for the current year.
-		if budget == 0 {
-			budget = maxBudgetID + 1
-			now := time.Now()
-			err = c.b.Upsert(
-				budget,
-				time.Date(now.Year(), time.January, 01, 0, 0, 0, 0, time.Local),
-				time.Date(now.Year(), time.December, 31, 23, 59, 59, 59, time.Local),
-				0,
-			)
-			if err != nil {
-				httperror.Send(w, req, http.StatusBadRequest, fmt.Sprintf("No budget existed, failed to create a new budget: %s", err))
-				return
-			}
-		}
+		budget = bgt.ID
 	} else if len(budgetStr) > 1 {
 		httperror.Send(w, req, http.StatusBadRequest, fmt.Sprintf("Got %d budget IDs, wanted 0 or 1", len(budgetStr)))
 		return
@@ -159,8 +176,8 @@ func (c *CategoryBudgets) list(w http.ResponseWriter, req *http.Request) {
 }
 
 func (c *CategoryBudgets) List() ([]CategoryBudget, error) {
-	const q = "SELECT id, budget, category, amount FROM category_budgets;"
-	rows, err := c.db.Query(q)
+	const q = "SELECT id, budget, category, amount, rollover FROM category_budgets;"
+	rows, err := c.db.Query(c.d.Rebind(q))
 	if err != nil {
 		return nil, err
 	}
@@ -170,7 +187,7 @@ func (c *CategoryBudgets) List() ([]CategoryBudget, error) {
 
 	for rows.Next() {
 		var catBgt CategoryBudget
-		rows.Scan(&catBgt.ID, &catBgt.Budget, &catBgt.Category, &catBgt.Amount)
+		rows.Scan(&catBgt.ID, &catBgt.Budget, &catBgt.Category, &catBgt.Amount, &catBgt.Rollover)
 		categoryBudgets = append(categoryBudgets, catBgt)
 	}
 
@@ -192,7 +209,7 @@ func (c *CategoryBudgets) delete(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	_, err = c.db.Exec(q, id)
+	_, err = c.db.Exec(c.d.Rebind(q), id)
 	if err != nil {
 		httperror.Send(w, req, http.StatusInternalServerError, fmt.Sprintf("Could not delete categorybudget: %s", err))
 		return
@@ -205,7 +222,7 @@ func (c *CategoryBudgets) delete(w http.ResponseWriter, req *http.Request) {
 // replacing them with the provided CategoryBudgets.
 func (c *CategoryBudgets) upsert(w http.ResponseWriter, req *http.Request) {
 	const (
-		q_create = "INSERT INTO category_budgets (budget, category, amount) VALUES(?, ?, ?);"
+		q_create = "INSERT INTO category_budgets (budget, category, amount, rollover) VALUES(?, ?, ?, ?);"
 		q_delete = "DELETE FROM category_budgets WHERE id = ?;"
 	)
 
@@ -232,23 +249,12 @@ func (c *CategoryBudgets) upsert(w http.ResponseWriter, req *http.Request) {
 	// All cb's in a request must refer to the same budget. If the budget is not
 	// provided, use the current one.
 	if cbs[0].Budget == 0 {
-		bgts, err := c.b.List()
+		bgt, err := c.b.Current(time.Now())
 		if err != nil {
-			httperror.Send(w, req, http.StatusInternalServerError, fmt.Sprintf("Could not list budgets: %s", err))
-			return
-		}
-		now := time.Now()
-		for _, b := range bgts {
-			if now.After(b.Start) && now.Before(b.End) {
-				budget = b.ID
-				break
-			}
-		}
-		if budget == 0 {
-			// TODO(davidschlachter): create a new budget if we cannot find an existing one for the current period
-			httperror.Send(w, req, http.StatusInternalServerError, "Could not identify the current budget")
+			httperror.Send(w, req, http.StatusInternalServerError, fmt.Sprintf("Could not identify the current budget: %s", err))
 			return
 		}
+		budget = bgt.ID
 	} else {
 		budget = cbs[0].Budget
 		for _, cb := range cbs {
@@ -267,7 +273,7 @@ func (c *CategoryBudgets) upsert(w http.ResponseWriter, req *http.Request) {
 	}
 	for _, p := range previous {
 		if p.Budget == budget {
-			_, err = tx.Exec(q_delete, p.ID)
+			_, err = tx.Exec(c.d.Rebind(q_delete), p.ID)
 			if err != nil {
 				log.Printf("failed to delete CategoryBudget: %s", err)
 				httperror.Send(w, req, http.StatusInternalServerError, fmt.Sprintf("Could not delete previous category budget: %s", err))
@@ -288,12 +294,19 @@ func (c *CategoryBudgets) upsert(w http.ResponseWriter, req *http.Request) {
 		}
 	}
 
+	for _, cb := range cbs {
+		if !cb.Rollover.Valid() {
+			httperror.Send(w, req, http.StatusBadRequest, fmt.Sprintf("Unknown rollover mode %d for category ID %d", cb.Rollover, cb.Category))
+			return
+		}
+	}
+
 	// Insert the new category budgets for the budget
 	for _, cb := range cbs {
 		if cb.Amount.IsZero() {
 			continue // skip empty category budgets
 		}
-		_, err = tx.Exec(q_create, budget, cb.Category, cb.Amount)
+		_, err = tx.Exec(c.d.Rebind(q_create), budget, cb.Category, cb.Amount, cb.Rollover)
 		if err != nil {
 			log.Printf("failed to upsert CategoryBudget: %s", err)
 			httperror.Send(w, req, http.StatusInternalServerError, fmt.Sprintf("Could not upsert categorybudget: %s", err))
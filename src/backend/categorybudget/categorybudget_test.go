@@ -2,22 +2,31 @@ package categorybudget_test
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
 	"encoding/json"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/shopspring/decimal"
 
 	"github.com/davidschlachter/lychnos/src/backend/budget"
 	"github.com/davidschlachter/lychnos/src/backend/categorybudget"
+	"github.com/davidschlachter/lychnos/src/backend/dialect"
 )
 
 func TestHandle(t *testing.T) {
+	for _, d := range dialect.All {
+		t.Run(d.String(), func(t *testing.T) { testHandle(t, d) })
+	}
+}
 
+func testHandle(t *testing.T, d dialect.Dialect) {
 	db, mock, err := sqlmock.New()
 	if err != nil {
 		t.Fatalf("Unexpected error opening mock database connection: %s\n", err)
@@ -26,36 +35,36 @@ func TestHandle(t *testing.T) {
 
 	// Insert
 	mock.ExpectBegin()
-	mock.ExpectQuery(`SELECT id, budget, category, amount FROM category_budgets;`).
+	mock.ExpectQuery(`SELECT id, budget, category, amount, rollover FROM category_budgets;`).
 		WillReturnError(sql.ErrNoRows)
 	mock.ExpectExec(`INSERT INTO category_budgets`).
-		WithArgs(1, 1, "1000").
+		WithArgs(1, 1, "1000", 0).
 		WillReturnResult(sqlmock.NewResult(1, 1))
 	mock.ExpectCommit()
 	// Find
-	mock.ExpectQuery(`SELECT id, budget, category, amount FROM category_budgets;`).
-		WillReturnRows(sqlmock.NewRows([]string{"id", "budget", "category", "amount"}).
-			AddRow(1, 1, 1, "1000"))
+	mock.ExpectQuery(`SELECT id, budget, category, amount, rollover FROM category_budgets;`).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "budget", "category", "amount", "rollover"}).
+			AddRow(1, 1, 1, "1000", 0))
 	// Fetch
-	mock.ExpectQuery(`SELECT id, budget, category, amount FROM category_budgets WHERE id = \?;`).
-		WithArgs("1").WillReturnRows(sqlmock.NewRows([]string{"id", "budget", "category", "amount"}).
-		AddRow(1, 1, 1, "1000"))
+	mock.ExpectQuery(`SELECT id, budget, category, amount, rollover FROM category_budgets WHERE id = (\?|\$1);`).
+		WithArgs("1").WillReturnRows(sqlmock.NewRows([]string{"id", "budget", "category", "amount", "rollover"}).
+		AddRow(1, 1, 1, "1000", 0))
 	// Delete
 	mock.ExpectExec(`DELETE FROM category_budgets WHERE id`).WithArgs(1).
 		WillReturnResult(sqlmock.NewResult(1, 1))
 	// Replace
 	mock.ExpectBegin()
-	mock.ExpectQuery(`SELECT id, budget, category, amount FROM category_budgets;`).
-		WillReturnRows(sqlmock.NewRows([]string{"id", "budget", "category", "amount"}).
-			AddRow(1, 1, 1, "1000"))
+	mock.ExpectQuery(`SELECT id, budget, category, amount, rollover FROM category_budgets;`).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "budget", "category", "amount", "rollover"}).
+			AddRow(1, 1, 1, "1000", 0))
 	mock.ExpectExec(`DELETE FROM category_budgets WHERE id`).WithArgs(1).
 		WillReturnResult(sqlmock.NewResult(1, 1))
 	mock.ExpectExec(`INSERT INTO category_budgets`).
-		WithArgs(1, 1, "25").
+		WithArgs(1, 1, "25", 0).
 		WillReturnResult(sqlmock.NewResult(1, 1))
 	mock.ExpectCommit()
 
-	c := categorybudget.New(db, budget.New(db))
+	c := categorybudget.New(db, d, budget.New(db, d))
 
 	// Create
 	w := httptest.NewRecorder()
@@ -121,3 +130,131 @@ func TestHandle(t *testing.T) {
 		t.Errorf("there were unfulfilled expectations: %s", err)
 	}
 }
+
+func TestRolloverCarriedOver(t *testing.T) {
+	tests := []struct {
+		mode                  categorybudget.RolloverMode
+		amount, sum, expected string
+	}{
+		// Expense category, under-spent
+		{categorybudget.RolloverNone, "-1000", "-800", "0"},
+		{categorybudget.RolloverSurplus, "-1000", "-800", "-200"},
+		{categorybudget.RolloverSurplusAndDeficit, "-1000", "-800", "-200"},
+		// Expense category, over-spent
+		{categorybudget.RolloverSurplus, "-1000", "-1100", "0"},
+		{categorybudget.RolloverSurplusAndDeficit, "-1000", "-1100", "100"},
+		// Income category
+		{categorybudget.RolloverSurplus, "500", "400", "0"},
+		{categorybudget.RolloverSurplus, "500", "600", "-100"},
+		{categorybudget.RolloverSurplusAndDeficit, "500", "400", "100"},
+	}
+
+	for _, test := range tests {
+		amount, _ := decimal.NewFromString(test.amount)
+		sum, _ := decimal.NewFromString(test.sum)
+		expected, _ := decimal.NewFromString(test.expected)
+		got := test.mode.CarriedOver(amount, sum)
+		if !got.Equal(expected) {
+			t.Fatalf("Mode %d with amount %s and sum %s: got %s, wanted %s", test.mode, test.amount, test.sum, got, expected)
+		}
+	}
+}
+
+func TestClone(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Unexpected error opening mock database connection: %s\n", err)
+	}
+	defer db.Close()
+
+	budgetColumns := []string{"id", "start", "end", "reporting_interval"}
+	mock.ExpectQuery(`SELECT id, start, .end., reporting_interval FROM budgets WHERE id = \?;`).
+		WithArgs("1").WillReturnRows(sqlmock.NewRows(budgetColumns).
+		AddRow(1, time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2025, 12, 31, 23, 59, 59, 0, time.UTC), 0))
+	mock.ExpectQuery(`SELECT id, budget, category, amount, rollover FROM category_budgets;`).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "budget", "category", "amount", "rollover"}).
+			AddRow(1, 1, 4, "-1000", 1).
+			AddRow(2, 1, 5, "-200", 0).
+			AddRow(3, 2, 4, "-50", 0))
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT id, start, .end., reporting_interval FROM budgets WHERE id <> \? AND start <= \? AND .end. >= \? ORDER BY start LIMIT 1;`).
+		WithArgs(0, "2026-12-31 23:59:59", "2026-01-01 00:00:00").
+		WillReturnRows(sqlmock.NewRows(budgetColumns))
+	mock.ExpectExec(`INSERT INTO budgets`).
+		WithArgs("2026-01-01 00:00:00", "2026-12-31 23:59:59", 0).
+		WillReturnResult(sqlmock.NewResult(3, 1))
+	mock.ExpectExec(`INSERT INTO category_budgets`).
+		WithArgs(3, 4, "-1030", 1).
+		WillReturnResult(sqlmock.NewResult(4, 1))
+	mock.ExpectExec(`INSERT INTO category_budgets`).
+		WithArgs(3, 5, "-206", 0).
+		WillReturnResult(sqlmock.NewResult(5, 1))
+	mock.ExpectCommit()
+
+	c := categorybudget.New(db, dialect.SQLite, budget.New(db, dialect.SQLite))
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/api/budgets/1/clone", strings.NewReader("start=2026-01-01%2000%3A00%3A00&end=2026-12-31%2023%3A59%3A59&percent=3"))
+	req.SetPathValue("id", "1")
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	c.HandleClone(nil)(w, req)
+	if w.Result().StatusCode != http.StatusCreated {
+		body, _ := ioutil.ReadAll(w.Body)
+		t.Fatalf("Status code = %d, want %d\n. Response body: %s", w.Result().StatusCode, http.StatusCreated, body)
+	}
+	var result budget.Budget
+	json.NewDecoder(w.Body).Decode(&result)
+	if result.ID != 3 {
+		t.Fatalf("Got budget ID %d, wanted 3", result.ID)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestCloneFromActuals(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Unexpected error opening mock database connection: %s\n", err)
+	}
+	defer db.Close()
+
+	budgetColumns := []string{"id", "start", "end", "reporting_interval"}
+	mock.ExpectQuery(`SELECT id, start, .end., reporting_interval FROM budgets WHERE id = \?;`).
+		WithArgs("1").WillReturnRows(sqlmock.NewRows(budgetColumns).
+		AddRow(1, time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2025, 12, 31, 23, 59, 59, 0, time.UTC), 0))
+	mock.ExpectQuery(`SELECT id, budget, category, amount, rollover FROM category_budgets;`).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "budget", "category", "amount", "rollover"}).
+			AddRow(1, 1, 4, "-1000", 0).
+			AddRow(2, 1, 5, "-200", 0))
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT id, start, .end., reporting_interval FROM budgets WHERE id <> \? AND start <= \? AND .end. >= \? ORDER BY start LIMIT 1;`).
+		WithArgs(0, "2026-12-31 23:59:59", "2026-01-01 00:00:00").
+		WillReturnRows(sqlmock.NewRows(budgetColumns))
+	mock.ExpectExec(`INSERT INTO budgets`).
+		WillReturnResult(sqlmock.NewResult(2, 1))
+	mock.ExpectExec(`INSERT INTO category_budgets`).
+		WithArgs(2, 4, "-1234.56", 0).
+		WillReturnResult(sqlmock.NewResult(3, 1))
+	mock.ExpectCommit()
+
+	c := categorybudget.New(db, dialect.SQLite, budget.New(db, dialect.SQLite))
+	sums := func(ctx context.Context, start, end time.Time) (map[int]decimal.Decimal, error) {
+		return map[int]decimal.Decimal{4: decimal.RequireFromString("-1234.56")}, nil
+	}
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/api/budgets/1/clone", strings.NewReader("start=2026-01-01%2000%3A00%3A00&end=2026-12-31%2023%3A59%3A59&from_actuals=true"))
+	req.SetPathValue("id", "1")
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	c.HandleClone(sums)(w, req)
+	if w.Result().StatusCode != http.StatusCreated {
+		body, _ := ioutil.ReadAll(w.Body)
+		t.Fatalf("Status code = %d, want %d\n. Response body: %s", w.Result().StatusCode, http.StatusCreated, body)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
@@ -0,0 +1,183 @@
+package categorybudget
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/davidschlachter/lychnos/src/backend/budget"
+	"github.com/davidschlachter/lychnos/src/backend/httperror"
+	"github.com/davidschlachter/lychnos/src/backend/interval"
+	"github.com/shopspring/decimal"
+)
+
+// SumsFunc returns the actual sum of transactions for each category ID between
+// start and end.
+type SumsFunc func(ctx context.Context, start, end time.Time) (map[int]decimal.Decimal, error)
+
+// CloneOptions determine the amounts of the cloned category budgets. If
+// neither option is set, amounts are copied unchanged.
+type CloneOptions struct {
+	// Percent scales every amount by a flat percentage, e.g. 3 for a 3%
+	// increase.
+	Percent decimal.Decimal
+	// FromActuals uses the actual sum for each category during the source
+	// budget as the new amount.
+	FromActuals bool
+}
+
+// HandleClone returns a handler for POST /api/budgets/{id}/clone, which creates
+// a new budget from the budget with the provided ID. Actual sums for the source
+// budget are fetched with sums.
+func (c *CategoryBudgets) HandleClone(sums SumsFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		log.Printf("%s %s", req.Method, req.RequestURI)
+		c.clone(w, req, sums)
+	}
+}
+
+func (c *CategoryBudgets) clone(w http.ResponseWriter, req *http.Request, sums SumsFunc) {
+	var opts CloneOptions
+
+	id, err := strconv.Atoi(req.PathValue("id"))
+	if err != nil {
+		httperror.Send(w, req, http.StatusBadRequest, fmt.Sprintf("Could not parse budget ID: %s", req.PathValue("id")))
+		return
+	}
+
+	err = req.ParseForm()
+	if err != nil {
+		httperror.Send(w, req, http.StatusInternalServerError, "Could not parse POST data")
+		return
+	}
+
+	// TODO(davidschlachter): as for budgets, if the client doesn't provide a
+	// time zone these will be created in UTC.
+	start, err := time.Parse(budget.DateFormat, req.Form.Get("start"))
+	if err != nil {
+		httperror.Send(w, req, http.StatusBadRequest, fmt.Sprintf("Could not parse start time: %s", err))
+		return
+	}
+	end, err := time.Parse(budget.DateFormat, req.Form.Get("end"))
+	if err != nil {
+		httperror.Send(w, req, http.StatusBadRequest, fmt.Sprintf("Could not parse end time: %s", err))
+		return
+	}
+
+	percentString := strings.TrimSpace(req.Form.Get("percent"))
+	if percentString != "" {
+		opts.Percent, err = decimal.NewFromString(percentString)
+		if err != nil {
+			httperror.Send(w, req, http.StatusBadRequest, fmt.Sprintf("Could not parse percent: %s", percentString))
+			return
+		}
+	}
+	opts.FromActuals = req.Form.Get("from_actuals") == "true"
+	if opts.FromActuals && !opts.Percent.IsZero() {
+		httperror.Send(w, req, http.StatusBadRequest, "Only one of percent or from_actuals may be provided")
+		return
+	}
+	if opts.FromActuals && sums == nil {
+		httperror.Send(w, req, http.StatusInternalServerError, "Actual sums are not available")
+		return
+	}
+
+	bgt, err := c.Clone(req.Context(), id, start, end, opts, sums)
+	var overlap *budget.OverlapError
+	if errors.Is(err, budget.ErrNoBudget) {
+		httperror.Send(w, req, http.StatusNotFound, fmt.Sprintf("Could not find budget with ID = %d", id))
+		return
+	}
+	if errors.As(err, &overlap) {
+		httperror.Send(w, req, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		httperror.Send(w, req, http.StatusInternalServerError, fmt.Sprintf("Could not clone budget: %s", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(bgt)
+}
+
+// Clone creates a new budget from start to end, copying every category budget
+// of the budget with the provided ID. The budget and its category budgets are
+// created in a single database transaction.
+func (c *CategoryBudgets) Clone(ctx context.Context, id int, start, end time.Time, opts CloneOptions, sums SumsFunc) (budget.Budget, error) {
+	const q_create = "INSERT INTO category_budgets (budget, category, amount, rollover) VALUES(?, ?, ?, ?);"
+
+	src, err := c.b.Fetch(strconv.Itoa(id))
+	if err != nil {
+		return budget.Budget{}, err
+	}
+	if len(src) != 1 || src[0].ID == 0 {
+		return budget.Budget{}, budget.ErrNoBudget
+	}
+
+	var actuals map[int]decimal.Decimal
+	if opts.FromActuals {
+		actuals, err = sums(ctx, src[0].Start.Local(), src[0].End.Local())
+		if err != nil {
+			return budget.Budget{}, fmt.Errorf("could not fetch actual sums for budget %d: %s", id, err)
+		}
+	}
+
+	previous, err := c.List()
+	if err != nil {
+		return budget.Budget{}, fmt.Errorf("could not list category budgets: %s", err)
+	}
+
+	tx, err := c.db.Begin()
+	if err != nil {
+		return budget.Budget{}, fmt.Errorf("failed to begin database transaction: %s", err)
+	}
+	defer tx.Rollback()
+
+	newBgt := budget.Budget{
+		Start:             start,
+		End:               end,
+		ReportingInterval: src[0].ReportingInterval,
+	}
+	if !newBgt.ReportingInterval.Valid() {
+		newBgt.ReportingInterval = interval.Monthly
+	}
+	newBgt.ID, err = c.b.CreateTx(tx, start, end, newBgt.ReportingInterval)
+	if err != nil {
+		return budget.Budget{}, err
+	}
+
+	hundred := decimal.NewFromInt(100)
+	for _, cb := range previous {
+		if cb.Budget != id {
+			continue
+		}
+		amount := cb.Amount
+		if opts.FromActuals {
+			amount = actuals[cb.Category]
+		} else if !opts.Percent.IsZero() {
+			amount = amount.Mul(hundred.Add(opts.Percent)).Div(hundred).Round(2)
+		}
+		if amount.IsZero() {
+			continue // skip empty category budgets
+		}
+		_, err = tx.Exec(c.d.Rebind(q_create), newBgt.ID, cb.Category, amount, cb.Rollover)
+		if err != nil {
+			return budget.Budget{}, fmt.Errorf("could not create category budget for category %d: %s", cb.Category, err)
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return budget.Budget{}, fmt.Errorf("could not commit changes to the database: %s", err)
+	}
+
+	return newBgt, nil
+}
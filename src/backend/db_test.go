@@ -1,24 +1,411 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/shopspring/decimal"
+
+	"github.com/davidschlachter/lychnos/src/backend/auth"
+	"github.com/davidschlachter/lychnos/src/backend/budget"
+	"github.com/davidschlachter/lychnos/src/backend/categorybudget"
+	"github.com/davidschlachter/lychnos/src/backend/dialect"
+	"github.com/davidschlachter/lychnos/src/backend/exchangerate"
+	"github.com/davidschlachter/lychnos/src/backend/firefly"
+	"github.com/davidschlachter/lychnos/src/backend/importer"
+	"github.com/davidschlachter/lychnos/src/backend/interval"
+	"github.com/davidschlachter/lychnos/src/backend/recurring"
+	"github.com/davidschlachter/lychnos/src/backend/rule"
+	"github.com/davidschlachter/lychnos/src/backend/template"
 )
 
-func TestSetupDB(t *testing.T) {
+func TestMigrate(t *testing.T) {
 	db, mock, err := sqlmock.New()
 	if err != nil {
 		t.Fatalf("Unexpected error opening mock database connection: %s\n", err)
 	}
 	defer db.Close()
 
+	mock.ExpectExec(`CREATE TABLE IF NOT EXISTS schema_migrations.*`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(`SELECT version FROM schema_migrations;`).
+		WillReturnRows(sqlmock.NewRows([]string{"version"}))
+	mock.ExpectBegin()
 	mock.ExpectExec(`CREATE TABLE IF NOT EXISTS budgets.*`).WillReturnResult(sqlmock.NewResult(1, 1))
 	mock.ExpectExec(`CREATE TABLE IF NOT EXISTS category_budgets.*`).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`INSERT INTO schema_migrations`).WithArgs(1, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectExec(`ALTER TABLE category_budgets ADD COLUMN rollover`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`INSERT INTO schema_migrations`).WithArgs(2, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectExec(`CREATE TABLE users`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`CREATE TABLE sessions`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`CREATE TABLE api_tokens`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`INSERT INTO schema_migrations`).WithArgs(3, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectExec(`CREATE TABLE cache_snapshots`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`INSERT INTO schema_migrations`).WithArgs(4, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectExec(`CREATE TABLE import_profiles`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`INSERT INTO schema_migrations`).WithArgs(5, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectExec(`CREATE TABLE rules`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`INSERT INTO schema_migrations`).WithArgs(6, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectExec(`CREATE TABLE recurrences`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`CREATE TABLE recurrence_occurrences`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`INSERT INTO schema_migrations`).WithArgs(7, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectExec(`CREATE TABLE templates`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`INSERT INTO schema_migrations`).WithArgs(8, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectExec(`CREATE TABLE exchange_rates`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`INSERT INTO schema_migrations`).WithArgs(9, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectExec(`ALTER TABLE recurrences ADD COLUMN catch_up_from`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`INSERT INTO schema_migrations`).WithArgs(10, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
 
-	setupDB(nil, db)
+	err = migrate(db, dialect.SQLite, false, io.Discard)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
 
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("there were unfulfilled expectations: %s", err)
 	}
 }
+
+func TestMigrateDryRun(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Unexpected error opening mock database connection: %s\n", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery(`SELECT COUNT\(\*\) FROM information_schema.tables`).WithArgs("schema_migrations").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+	mock.ExpectQuery(`SELECT version FROM schema_migrations;`).
+		WillReturnRows(sqlmock.NewRows([]string{"version"}).AddRow(1))
+
+	var out bytes.Buffer
+	err = migrate(db, dialect.MySQL, true, &out)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if strings.Contains(out.String(), "Migration 1:") {
+		t.Fatalf("Dry run printed an applied migration:\n%s", out.String())
+	}
+	if !strings.Contains(out.String(), "ALTER TABLE category_budgets ADD COLUMN rollover") {
+		t.Fatalf("Dry run did not print pending migration:\n%s", out.String())
+	}
+
+	// A new database is left without a schema_migrations table
+	mock.ExpectQuery(`SELECT COUNT\(\*\) FROM information_schema.tables`).WithArgs("schema_migrations").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+	out.Reset()
+	err = migrate(db, dialect.MySQL, true, &out)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	for _, want := range []string{"CREATE TABLE IF NOT EXISTS schema_migrations", "Migration 1:"} {
+		if !strings.Contains(out.String(), want) {
+			t.Fatalf("Dry run of a new database did not print %s:\n%s", want, out.String())
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestMigrateSQLite(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("Unexpected error opening database: %s", err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1) // each connection has its own in-memory database
+
+	// A database created before migrations were introduced
+	_, err = db.Exec(`CREATE TABLE budgets (id INTEGER PRIMARY KEY AUTOINCREMENT, start DATETIME NOT NULL, end DATETIME NOT NULL, reporting_interval INT NOT NULL);`)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	_, err = db.Exec(`CREATE TABLE category_budgets (id INTEGER PRIMARY KEY AUTOINCREMENT, budget INT, category INT, amount DECIMAL(12,4), FOREIGN KEY ( budget ) REFERENCES budgets( id ));`)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	_, err = db.Exec(`INSERT INTO category_budgets (budget, category, amount) VALUES(1, 4, 100);`)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	// Migrating twice should be a no-op the second time
+	for i := 0; i < 2; i++ {
+		err = migrate(db, dialect.SQLite, false, io.Discard)
+		if err != nil {
+			t.Fatalf("Unexpected error migrating (run %d): %s", i+1, err)
+		}
+	}
+
+	var rollover int
+	err = db.QueryRow(`SELECT rollover FROM category_budgets WHERE category = 4;`).Scan(&rollover)
+	if err != nil {
+		t.Fatalf("Unexpected error reading migrated column: %s", err)
+	}
+	if rollover != 0 {
+		t.Fatalf("Got rollover %d, wanted 0", rollover)
+	}
+}
+
+// TestDatabases runs migrations and budget operations against a real database
+// for each dialect. SQLite always runs; MySQL and Postgres run only if
+// LYCHNOS_TEST_MYSQL_DSN or LYCHNOS_TEST_POSTGRES_DSN is set. The tables are
+// dropped afterwards, so use a scratch database. MySQL DSNs need parseTime=true.
+func TestDatabases(t *testing.T) {
+	dsns := map[dialect.Dialect]string{
+		dialect.SQLite:   filepath.Join(t.TempDir(), "lychnos.sqlite3"),
+		dialect.MySQL:    os.Getenv("LYCHNOS_TEST_MYSQL_DSN"),
+		dialect.Postgres: os.Getenv("LYCHNOS_TEST_POSTGRES_DSN"),
+	}
+
+	for _, d := range dialect.All {
+		t.Run(d.String(), func(t *testing.T) {
+			if dsns[d] == "" {
+				t.Skipf("No DSN set for %s", d)
+			}
+			testDatabase(t, d, dsns[d])
+		})
+	}
+}
+
+func testDatabase(t *testing.T, d dialect.Dialect, dsn string) {
+	db, err := sql.Open(d.String(), dsn)
+	if err != nil {
+		t.Fatalf("Unexpected error opening database: %s", err)
+	}
+	defer db.Close()
+	t.Cleanup(func() {
+		for _, table := range []string{"exchange_rates", "templates", "recurrence_occurrences", "recurrences", "rules", "import_profiles", "cache_snapshots", "sessions", "api_tokens", "users", "category_budgets", "budgets", "schema_migrations"} {
+			db.Exec("DROP TABLE " + table + ";")
+		}
+	})
+
+	err = migrate(db, d, false, io.Discard)
+	if err != nil {
+		t.Fatalf("Unexpected error migrating: %s", err)
+	}
+
+	b := budget.New(db, d)
+	c := categorybudget.New(db, d, b)
+
+	// Create, then replace, a budget
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	end := time.Date(2025, 12, 31, 23, 59, 59, 0, time.UTC)
+	err = b.Upsert(0, start, end, interval.Monthly)
+	if err != nil {
+		t.Fatalf("Unexpected error creating budget: %s", err)
+	}
+	bgt, err := b.ForDate(start)
+	if err != nil {
+		t.Fatalf("Unexpected error finding created budget: %s", err)
+	}
+	err = b.Upsert(bgt.ID, start, end, interval.Quarterly)
+	if err != nil {
+		t.Fatalf("Unexpected error replacing budget: %s", err)
+	}
+	bgts, err := b.List()
+	if err != nil {
+		t.Fatalf("Unexpected error listing budgets: %s", err)
+	}
+	if len(bgts) != 1 || bgts[0].ReportingInterval != interval.Quarterly || !bgts[0].End.Equal(end) {
+		t.Fatalf("Got budgets %+v, wanted a single quarterly budget ending %s", bgts, end)
+	}
+
+	// Category budgets
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/api/categorybudgets/", strings.NewReader(`[{"budget": `+strconv.Itoa(bgt.ID)+`, "category": 4, "amount": "-100", "rollover": 1}]`))
+	c.Handle(w, req)
+	if w.Result().StatusCode != http.StatusCreated {
+		t.Fatalf("Status code = %d, want %d. Response body: %s", w.Result().StatusCode, http.StatusCreated, w.Body.String())
+	}
+
+	// Clone into the next year
+	cloned, err := c.Clone(t.Context(), bgt.ID, start.AddDate(1, 0, 0), end.AddDate(1, 0, 0), categorybudget.CloneOptions{Percent: decimal.NewFromInt(10)}, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error cloning budget: %s", err)
+	}
+	if cloned.ID == bgt.ID || cloned.ID == 0 {
+		t.Fatalf("Got cloned budget ID %d, wanted a new ID", cloned.ID)
+	}
+	cbs, err := c.List()
+	if err != nil {
+		t.Fatalf("Unexpected error listing category budgets: %s", err)
+	}
+	var found bool
+	for _, cb := range cbs {
+		if cb.Budget != cloned.ID {
+			continue
+		}
+		found = true
+		if cb.Category != 4 || !cb.Amount.Equal(decimal.NewFromInt(-110)) || cb.Rollover != categorybudget.RolloverSurplus {
+			t.Fatalf("Got cloned category budget %+v, wanted category 4 with amount -110", cb)
+		}
+	}
+	if !found {
+		t.Fatalf("No category budgets found for cloned budget %d", cloned.ID)
+	}
+
+	// Users
+	a := auth.New(db, d, auth.Config{Enabled: true})
+	for _, password := range []string{"hunter2", "hunter3"} {
+		err = a.SetPassword("david", password)
+		if err != nil {
+			t.Fatalf("Unexpected error setting password: %s", err)
+		}
+	}
+	_, err = a.Login("david", "hunter2")
+	if !errors.Is(err, auth.ErrInvalidCredentials) {
+		t.Fatalf("Got error %v logging in with old password, wanted ErrInvalidCredentials", err)
+	}
+	u, err := a.Login("david", "hunter3")
+	if err != nil || u.Username != "david" {
+		t.Fatalf("Got user %+v and error %v, wanted david", u, err)
+	}
+
+	// Import profiles
+	i := importer.New(db, d, nil)
+	p := importer.Profile{Name: "Chequing", Delimiter: ",", DateColumn: 1, DateFormat: "YYYY-MM-DD", DescriptionColumn: 2, AmountColumn: 3, AmountSign: importer.NegativeWithdrawals, DecimalSeparator: ".", AccountID: "1"}
+	id, err := i.UpsertProfile(p)
+	if err != nil {
+		t.Fatalf("Unexpected error creating import profile: %s", err)
+	}
+	p.ID, p.DateFormat = id, "DD/MM/YYYY"
+	_, err = i.UpsertProfile(p)
+	if err != nil {
+		t.Fatalf("Unexpected error replacing import profile: %s", err)
+	}
+	got, err := i.Profile(id)
+	if err != nil || got != p {
+		t.Fatalf("Got import profile %+v and error %v, wanted the replaced profile", got, err)
+	}
+
+	// Rules, including ones without amounts
+	rs := rule.New(db, d)
+	r := rule.Rule{Name: "Coffee", DestinationName: "Coffee Shop", MaxAmount: decimal.NewNullDecimal(decimal.NewFromInt(20)), CategoryID: 4}
+	r.ID, err = rs.Upsert(r)
+	if err != nil {
+		t.Fatalf("Unexpected error creating rule: %s", err)
+	}
+	gotRule, err := rs.Fetch(r.ID)
+	if err != nil || gotRule.MinAmount.Valid || !gotRule.MaxAmount.Decimal.Equal(r.MaxAmount.Decimal) || gotRule.DestinationName != r.DestinationName {
+		t.Fatalf("Got rule %+v and error %v, wanted %+v", gotRule, err, r)
+	}
+
+	// Recurring transactions, which are only created once
+	rec := recurring.New(db, d)
+	rc := recurring.Recurrence{Name: "Rent", Description: "Rent", Amount: decimal.NewFromInt(1500), SourceID: "1", DestinationName: "Landlord", CategoryID: "4", Schedule: "FREQ=MONTHLY;BYMONTHDAY=1", StartDate: "2025-01-01"}
+	rc.ID, err = rec.Upsert(rc)
+	if err != nil {
+		t.Fatalf("Unexpected error creating recurring transaction: %s", err)
+	}
+	gotRecurrence, err := rec.Fetch(rc.ID)
+	if err != nil || !gotRecurrence.Amount.Equal(rc.Amount) || gotRecurrence.Schedule != rc.Schedule || gotRecurrence.StartDate != rc.StartDate {
+		t.Fatalf("Got recurring transaction %+v and error %v, wanted %+v", gotRecurrence, err, rc)
+	}
+	var created int
+	create := func(ctx context.Context, form url.Values) (firefly.Transactions, int, error) {
+		created++
+		return firefly.Transactions{ID: strconv.Itoa(created)}, http.StatusCreated, nil
+	}
+	for range 2 {
+		err = rec.Run(t.Context(), time.Date(2025, 3, 15, 0, 0, 0, 0, time.UTC), create)
+		if err != nil {
+			t.Fatalf("Unexpected error creating recurring transactions: %s", err)
+		}
+	}
+	if created != 3 {
+		t.Fatalf("Created %d recurring transactions, wanted 3", created)
+	}
+
+	// Templates, including ones without an amount, most used first
+	ts := template.New(db, d, nil)
+	for _, tmpl := range []template.Template{
+		{Name: "Groceries", Description: "Groceries", SourceID: "1", DestinationName: "Grocery store", CategoryID: "4"},
+		{Name: "Coffee", Description: "Coffee", Amount: decimal.NewNullDecimal(decimal.RequireFromString("4.5")), SourceID: "1", DestinationName: "Cafe", CategoryID: "5", UseCount: 3},
+	} {
+		_, err = ts.Upsert(tmpl)
+		if err != nil {
+			t.Fatalf("Unexpected error creating template: %s", err)
+		}
+	}
+	templates, err := ts.List()
+	if err != nil || len(templates) != 2 || templates[0].Name != "Coffee" || !templates[0].Amount.Decimal.Equal(decimal.RequireFromString("4.5")) || templates[1].Amount.Valid {
+		t.Fatalf("Got templates %+v and error %v, wanted Coffee and then Groceries without an amount", templates, err)
+	}
+
+	// Exchange rates, which can be replaced
+	rates := exchangerate.New(db, d)
+	err = rates.UpsertAll([]exchangerate.Rate{{CurrencyCode: "USD", Rate: decimal.RequireFromString("1.25")}, {CurrencyCode: "EUR", Rate: decimal.RequireFromString("1.5")}})
+	if err != nil {
+		t.Fatalf("Unexpected error saving exchange rates: %s", err)
+	}
+	err = rates.Upsert(exchangerate.Rate{CurrencyCode: "USD", Rate: decimal.RequireFromString("1.37125")})
+	if err != nil {
+		t.Fatalf("Unexpected error saving exchange rate: %s", err)
+	}
+	rate, err := rates.Rate(t.Context(), "usd")
+	if err != nil || !rate.Equal(decimal.RequireFromString("1.37125")) {
+		t.Fatalf("Got rate %s and error %v for USD, wanted 1.37125", rate, err)
+	}
+	if list, err := rates.List(); err != nil || len(list) != 2 || list[0].CurrencyCode != "EUR" {
+		t.Fatalf("Got exchange rates %+v and error %v, wanted EUR and USD", list, err)
+	}
+	if _, err := rates.Rate(t.Context(), "GBP"); err == nil {
+		t.Fatalf("Got no error for a currency without an exchange rate")
+	}
+
+	// Overlapping budgets are still rejected
+	err = b.Upsert(0, start.AddDate(0, 6, 0), end.AddDate(0, 6, 0), interval.Monthly)
+	var overlap *budget.OverlapError
+	if !errors.As(err, &overlap) {
+		t.Fatalf("Got error %v, wanted *OverlapError", err)
+	}
+
+	// A current budget is created between the neighbouring budgets
+	err = b.Upsert(0, start.AddDate(2, 6, 0), end.AddDate(2, 6, 0), interval.Monthly)
+	if err != nil {
+		t.Fatalf("Unexpected error creating budget: %s", err)
+	}
+	current, err := b.Current(time.Date(2027, 3, 15, 12, 0, 0, 0, time.UTC))
+	// The year starts in local time, or after the previous budget if later
+	wantStart := time.Date(2027, 1, 1, 0, 0, 0, 0, time.Local)
+	if wantStart.Before(start.AddDate(2, 0, 0)) {
+		wantStart = start.AddDate(2, 0, 0)
+	}
+	if err != nil || !current.Start.Equal(wantStart) || !current.End.Equal(start.AddDate(2, 6, 0).Add(-time.Second)) {
+		t.Fatalf("Got budget %+v and error %v, wanted a budget from 2027-01-01 to 2027-06-30", current, err)
+	}
+}
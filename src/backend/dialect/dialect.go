@@ -0,0 +1,103 @@
+// Package dialect adapts SQL queries to the type of database in use.
+//
+// Queries are written once using ? placeholders and "double-quoted"
+// identifiers (needed for columns like "end", which Postgres reserves), then
+// adapted with Rebind.
+package dialect
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type Dialect int
+
+const (
+	SQLite Dialect = iota
+	MySQL
+	Postgres
+)
+
+// All lists every supported Dialect.
+var All = []Dialect{SQLite, MySQL, Postgres}
+
+var driverNames = [...]string{
+	SQLite:   "sqlite3",
+	MySQL:    "mysql",
+	Postgres: "postgres",
+}
+
+// String returns the name of the database/sql driver for the dialect.
+func (d Dialect) String() string {
+	if int(d) < 0 || int(d) >= len(driverNames) {
+		return ""
+	}
+	return driverNames[int(d)]
+}
+
+// Rebind adapts a query written with ? placeholders and double-quoted
+// identifiers to the dialect: Postgres uses numbered placeholders ($1, $2, ...)
+// and MySQL quotes identifiers with backticks.
+func (d Dialect) Rebind(q string) string {
+	switch d {
+	case Postgres:
+		var (
+			b strings.Builder
+			n int
+		)
+		for _, c := range q {
+			if c == '?' {
+				n++
+				b.WriteString("$" + strconv.Itoa(n))
+				continue
+			}
+			b.WriteRune(c)
+		}
+		return b.String()
+	case MySQL:
+		return strings.ReplaceAll(q, `"`, "`")
+	default:
+		return q
+	}
+}
+
+// Upsert returns a statement inserting the columns into table, replacing any
+// existing row with the same key. The key must be the first column. Column
+// names should be double-quoted where needed, as for Rebind.
+func (d Dialect) Upsert(table string, columns ...string) string {
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(columns)), ", ")
+	if d != Postgres {
+		return d.Rebind(fmt.Sprintf("REPLACE INTO %s (%s) VALUES(%s);", table, strings.Join(columns, ", "), placeholders))
+	}
+	updates := make([]string, 0, len(columns)-1)
+	for _, c := range columns[1:] {
+		updates = append(updates, fmt.Sprintf("%s = EXCLUDED.%s", c, c))
+	}
+	return d.Rebind(fmt.Sprintf("INSERT INTO %s (%s) VALUES(%s) ON CONFLICT (%s) DO UPDATE SET %s;", table, strings.Join(columns, ", "), placeholders, columns[0], strings.Join(updates, ", ")))
+}
+
+// Execer is implemented by *sql.DB and *sql.Tx.
+type Execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// InsertID runs an INSERT statement (written as for Rebind) and returns the
+// auto-incremented id of the new row. Postgres does not report the last
+// inserted id, so the id is returned by the statement instead.
+func (d Dialect) InsertID(e Execer, q string, args ...any) (int, error) {
+	q = strings.TrimSuffix(strings.TrimSpace(q), ";")
+	if d == Postgres {
+		var id int
+		err := e.QueryRow(d.Rebind(q+" RETURNING id;"), args...).Scan(&id)
+		return id, err
+	}
+	res, err := e.Exec(d.Rebind(q+";"), args...)
+	if err != nil {
+		return 0, err
+	}
+	id, err := res.LastInsertId()
+	return int(id), err
+}
@@ -0,0 +1,34 @@
+package dialect_test
+
+import (
+	"testing"
+
+	"github.com/davidschlachter/lychnos/src/backend/dialect"
+)
+
+func TestRebind(t *testing.T) {
+	const q = `SELECT id FROM budgets WHERE start <= ? AND "end" >= ?;`
+	tests := map[dialect.Dialect]string{
+		dialect.SQLite:   `SELECT id FROM budgets WHERE start <= ? AND "end" >= ?;`,
+		dialect.MySQL:    "SELECT id FROM budgets WHERE start <= ? AND `end` >= ?;",
+		dialect.Postgres: `SELECT id FROM budgets WHERE start <= $1 AND "end" >= $2;`,
+	}
+	for d, expected := range tests {
+		if got := d.Rebind(q); got != expected {
+			t.Errorf("%s: got %q, wanted %q", d, got, expected)
+		}
+	}
+}
+
+func TestUpsert(t *testing.T) {
+	tests := map[dialect.Dialect]string{
+		dialect.SQLite:   `REPLACE INTO budgets (id, start, "end") VALUES(?, ?, ?);`,
+		dialect.MySQL:    "REPLACE INTO budgets (id, start, `end`) VALUES(?, ?, ?);",
+		dialect.Postgres: `INSERT INTO budgets (id, start, "end") VALUES($1, $2, $3) ON CONFLICT (id) DO UPDATE SET start = EXCLUDED.start, "end" = EXCLUDED."end";`,
+	}
+	for d, expected := range tests {
+		if got := d.Upsert("budgets", "id", "start", `"end"`); got != expected {
+			t.Errorf("%s: got %q, wanted %q", d, got, expected)
+		}
+	}
+}
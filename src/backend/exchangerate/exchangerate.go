@@ -0,0 +1,292 @@
+// Package exchangerate stores the exchange rates used to convert amounts in
+// other currencies into the primary currency.
+package exchangerate
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/davidschlachter/lychnos/src/backend/dialect"
+	"github.com/davidschlachter/lychnos/src/backend/firefly"
+	"github.com/davidschlachter/lychnos/src/backend/httperror"
+	"github.com/shopspring/decimal"
+)
+
+// Rate is the value of one unit of a currency in the primary currency, e.g.
+// 1.37 for USD if the primary currency is CAD.
+type Rate struct {
+	CurrencyCode string          `json:"currency_code"`
+	Rate         decimal.Decimal `json:"rate"`
+}
+
+type Rates struct {
+	db *sql.DB
+	d  dialect.Dialect
+}
+
+func New(db *sql.DB, d dialect.Dialect) *Rates {
+	return &Rates{db: db, d: d}
+}
+
+const maxUploadSize = 1 << 20
+
+var (
+	hasCode      = regexp.MustCompile(`/[A-Za-z]{3}$`)
+	currencyCode = regexp.MustCompile(`^[A-Z]{3}$`)
+)
+
+// validate normalizes the currency code of the rate and checks the rate.
+func (r *Rate) validate() error {
+	r.CurrencyCode = strings.ToUpper(strings.TrimSpace(r.CurrencyCode))
+	if !currencyCode.MatchString(r.CurrencyCode) {
+		return fmt.Errorf("currency_code must be a three-letter currency code, got '%s'", r.CurrencyCode)
+	}
+	if !r.Rate.IsPositive() {
+		return fmt.Errorf("rate must be greater than 0")
+	}
+	return nil
+}
+
+// Rate returns the rate of the currency, implementing firefly.ExchangeRates.
+func (rs *Rates) Rate(ctx context.Context, currencyCode string) (decimal.Decimal, error) {
+	r, err := rs.Fetch(ctx, currencyCode)
+	if errors.Is(err, sql.ErrNoRows) {
+		return decimal.Zero, fmt.Errorf("%w for %s", firefly.ErrNoExchangeRate, strings.ToUpper(currencyCode))
+	}
+	return r.Rate, err
+}
+
+// Handle serves the exchange rates. Since totals are converted with the
+// rates, invalidate is called whenever they change, to clear any cached
+// totals.
+func (rs *Rates) Handle(invalidate func()) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		log.Printf("%s %s", req.Method, req.RequestURI)
+		switch req.Method {
+		case "GET":
+			if hasCode.MatchString(req.URL.Path) {
+				rs.fetch(w, req)
+			} else {
+				rs.list(w, req)
+			}
+		case "POST":
+			if strings.HasPrefix(req.Header.Get("Content-Type"), "application/json") {
+				rs.upsert(w, req, invalidate)
+			} else {
+				rs.importCSV(w, req, invalidate)
+			}
+		case "DELETE":
+			rs.delete(w, req, invalidate)
+		default:
+			w.WriteHeader(http.StatusNotImplemented)
+			fmt.Fprintf(w, "Unsupported method %s", req.Method)
+		}
+	}
+}
+
+func (rs *Rates) fetch(w http.ResponseWriter, req *http.Request) {
+	code := strings.ToUpper(req.URL.Path[strings.LastIndex(req.URL.Path, "/")+1:])
+	r, err := rs.Fetch(req.Context(), code)
+	if errors.Is(err, sql.ErrNoRows) {
+		httperror.Send(w, req, http.StatusNotFound, fmt.Sprintf("No exchange rate for %s", code))
+		return
+	}
+	if err != nil {
+		httperror.Send(w, req, http.StatusInternalServerError, fmt.Sprintf("Could not fetch exchange rate: %s", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(r)
+}
+
+// Fetch fetches the rate of the currency. If there is no such rate,
+// sql.ErrNoRows is returned.
+func (rs *Rates) Fetch(ctx context.Context, currencyCode string) (Rate, error) {
+	const q = "SELECT currency_code, rate FROM exchange_rates WHERE currency_code = ?;"
+
+	var r Rate
+	err := rs.db.QueryRowContext(ctx, rs.d.Rebind(q), strings.ToUpper(currencyCode)).Scan(&r.CurrencyCode, &r.Rate)
+	return r, err
+}
+
+func (rs *Rates) list(w http.ResponseWriter, req *http.Request) {
+	rates, err := rs.List()
+	if err != nil {
+		httperror.Send(w, req, http.StatusInternalServerError, fmt.Sprintf("Could not list exchange rates: %s", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rates)
+}
+
+// List lists the rates in order of currency code.
+func (rs *Rates) List() ([]Rate, error) {
+	const q = "SELECT currency_code, rate FROM exchange_rates ORDER BY currency_code;"
+
+	rows, err := rs.db.Query(q)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rates := []Rate{}
+	for rows.Next() {
+		var r Rate
+		if err := rows.Scan(&r.CurrencyCode, &r.Rate); err != nil {
+			return nil, err
+		}
+		rates = append(rates, r)
+	}
+	return rates, rows.Err()
+}
+
+// upsert sets the rate of a currency from a JSON body.
+func (rs *Rates) upsert(w http.ResponseWriter, req *http.Request, invalidate func()) {
+	var r Rate
+	err := json.NewDecoder(req.Body).Decode(&r)
+	if err != nil {
+		httperror.Send(w, req, http.StatusBadRequest, fmt.Sprintf("Could not parse JSON body: %s", err))
+		return
+	}
+	if err := r.validate(); err != nil {
+		httperror.Send(w, req, http.StatusBadRequest, fmt.Sprintf("Invalid exchange rate: %s", err))
+		return
+	}
+
+	err = rs.Upsert(r)
+	if err != nil {
+		httperror.Send(w, req, http.StatusInternalServerError, fmt.Sprintf("Could not save exchange rate: %s", err))
+		return
+	}
+	invalidate()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(r)
+}
+
+// importCSV sets the rates of several currencies from a multipart form with a
+// CSV file as "file". Each row holds a currency code and its rate, and a
+// header row is skipped. Either every rate is saved, or none are.
+func (rs *Rates) importCSV(w http.ResponseWriter, req *http.Request, invalidate func()) {
+	req.Body = http.MaxBytesReader(w, req.Body, maxUploadSize)
+	err := req.ParseMultipartForm(maxUploadSize)
+	if err != nil {
+		httperror.Send(w, req, http.StatusBadRequest, fmt.Sprintf("Could not parse upload: %s", err))
+		return
+	}
+	file, _, err := req.FormFile("file")
+	if err != nil {
+		httperror.Send(w, req, http.StatusBadRequest, fmt.Sprintf("Must provide exchange rates as file: %s", err))
+		return
+	}
+	defer file.Close()
+
+	rates, err := ParseCSV(file)
+	if err != nil {
+		httperror.Send(w, req, http.StatusBadRequest, fmt.Sprintf("Could not parse exchange rates: %s", err))
+		return
+	}
+
+	err = rs.UpsertAll(rates)
+	if err != nil {
+		httperror.Send(w, req, http.StatusInternalServerError, fmt.Sprintf("Could not save exchange rates: %s", err))
+		return
+	}
+	invalidate()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(rates)
+}
+
+// ParseCSV parses rows of currency codes and rates, skipping a header row
+// like "currency_code,rate".
+func ParseCSV(r io.Reader) ([]Rate, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = 2
+	cr.TrimLeadingSpace = true
+
+	rates := []Rate{}
+	for n := 1; ; n++ {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if n == 1 && strings.EqualFold(strings.TrimSpace(record[0]), "currency_code") {
+			continue
+		}
+		rate, err := decimal.NewFromString(strings.TrimSpace(record[1]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: could not parse rate '%s'", n, record[1])
+		}
+		r := Rate{CurrencyCode: record[0], Rate: rate}
+		if err := r.validate(); err != nil {
+			return nil, fmt.Errorf("line %d: %s", n, err)
+		}
+		rates = append(rates, r)
+	}
+	if len(rates) == 0 {
+		return nil, fmt.Errorf("no exchange rates provided")
+	}
+	return rates, nil
+}
+
+// Upsert creates or replaces the rate of a currency.
+func (rs *Rates) Upsert(r Rate) error {
+	q := rs.d.Upsert("exchange_rates", "currency_code", "rate")
+	_, err := rs.db.Exec(q, r.CurrencyCode, r.Rate)
+	return err
+}
+
+// UpsertAll creates or replaces the rates of several currencies in one
+// transaction.
+func (rs *Rates) UpsertAll(rates []Rate) error {
+	tx, err := rs.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	q := rs.d.Upsert("exchange_rates", "currency_code", "rate")
+	for _, r := range rates {
+		_, err := tx.Exec(q, r.CurrencyCode, r.Rate)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (rs *Rates) delete(w http.ResponseWriter, req *http.Request, invalidate func()) {
+	const q = "DELETE FROM exchange_rates WHERE currency_code = ?;"
+
+	if !hasCode.MatchString(req.URL.Path) {
+		httperror.Send(w, req, http.StatusBadRequest, "Must provide a currency code to delete")
+		return
+	}
+	code := strings.ToUpper(req.URL.Path[strings.LastIndex(req.URL.Path, "/")+1:])
+
+	_, err := rs.db.Exec(rs.d.Rebind(q), code)
+	if err != nil {
+		httperror.Send(w, req, http.StatusInternalServerError, fmt.Sprintf("Could not delete exchange rate: %s", err))
+		return
+	}
+	invalidate()
+
+	w.WriteHeader(http.StatusNoContent)
+}
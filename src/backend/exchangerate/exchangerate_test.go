@@ -0,0 +1,129 @@
+package exchangerate_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/shopspring/decimal"
+
+	"github.com/davidschlachter/lychnos/src/backend/dialect"
+	"github.com/davidschlachter/lychnos/src/backend/exchangerate"
+)
+
+func TestHandle(t *testing.T) {
+	for _, d := range dialect.All {
+		t.Run(d.String(), func(t *testing.T) { testHandle(t, d) })
+	}
+}
+
+func testHandle(t *testing.T, d dialect.Dialect) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Unexpected error opening mock database connection: %s\n", err)
+	}
+	defer db.Close()
+	rs := exchangerate.New(db, d)
+	var invalidated int
+	handle := rs.Handle(func() { invalidated++ })
+
+	// Invalid rates are rejected
+	for _, body := range []string{
+		`{"currency_code": "US", "rate": "1.37"}`,
+		`{"currency_code": "USD", "rate": "0"}`,
+		`{"currency_code": "USD"}`,
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/api/exchangerates/", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		handle(w, req)
+		if w.Result().StatusCode != http.StatusBadRequest {
+			t.Fatalf("Status code = %d for %s, want %d", w.Result().StatusCode, body, http.StatusBadRequest)
+		}
+	}
+
+	// Set one rate
+	upsert := `REPLACE INTO exchange_rates`
+	if d == dialect.Postgres {
+		upsert = `INSERT INTO exchange_rates .* ON CONFLICT \(currency_code\) DO UPDATE`
+	}
+	mock.ExpectExec(upsert).WithArgs("USD", "1.37").WillReturnResult(sqlmock.NewResult(0, 1))
+	req := httptest.NewRequest(http.MethodPost, "/api/exchangerates/", strings.NewReader(`{"currency_code": "usd", "rate": "1.37"}`))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	handle(w, req)
+	if w.Result().StatusCode != http.StatusCreated {
+		t.Fatalf("Status code = %d, want %d. Response body: %s", w.Result().StatusCode, http.StatusCreated, w.Body.String())
+	}
+	if invalidated != 1 {
+		t.Fatalf("Cached totals were cleared %d times, wanted once", invalidated)
+	}
+
+	// Set several rates from a CSV file
+	mock.ExpectBegin()
+	mock.ExpectExec(upsert).WithArgs("EUR", "1.5").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(upsert).WithArgs("USD", "1.38").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, _ := mw.CreateFormFile("file", "rates.csv")
+	fw.Write([]byte("currency_code,rate\nEUR,1.5\nusd, 1.38\n"))
+	mw.Close()
+	req = httptest.NewRequest(http.MethodPost, "/api/exchangerates/", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	w = httptest.NewRecorder()
+	handle(w, req)
+	if w.Result().StatusCode != http.StatusCreated {
+		t.Fatalf("Status code = %d, want %d. Response body: %s", w.Result().StatusCode, http.StatusCreated, w.Body.String())
+	}
+	var rates []exchangerate.Rate
+	json.NewDecoder(w.Body).Decode(&rates)
+	if len(rates) != 2 || rates[1].CurrencyCode != "USD" || !rates[1].Rate.Equal(decimal.RequireFromString("1.38")) {
+		t.Fatalf("Got rates %+v, wanted EUR and USD", rates)
+	}
+
+	// Fetch
+	mock.ExpectQuery(`SELECT currency_code, rate FROM exchange_rates WHERE currency_code`).
+		WithArgs("GBP").
+		WillReturnRows(sqlmock.NewRows([]string{"currency_code", "rate"}))
+	w = httptest.NewRecorder()
+	handle(w, httptest.NewRequest(http.MethodGet, "/api/exchangerates/gbp", nil))
+	if w.Result().StatusCode != http.StatusNotFound {
+		t.Fatalf("Status code = %d, want %d", w.Result().StatusCode, http.StatusNotFound)
+	}
+
+	// Delete
+	mock.ExpectExec(`DELETE FROM exchange_rates`).WithArgs("EUR").WillReturnResult(sqlmock.NewResult(0, 1))
+	w = httptest.NewRecorder()
+	handle(w, httptest.NewRequest(http.MethodDelete, "/api/exchangerates/EUR", nil))
+	if w.Result().StatusCode != http.StatusNoContent {
+		t.Fatalf("Status code = %d, want %d", w.Result().StatusCode, http.StatusNoContent)
+	}
+	if invalidated != 3 {
+		t.Fatalf("Cached totals were cleared %d times, wanted 3", invalidated)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestParseCSV(t *testing.T) {
+	for _, csv := range []string{
+		"",
+		"currency_code,rate\n",
+		"USD,lots\n",
+		"USD,-1\n",
+		"DOLLARS,1.37\n",
+		"USD,1.37,2025-01-01\n",
+	} {
+		if rates, err := exchangerate.ParseCSV(strings.NewReader(csv)); err == nil {
+			t.Fatalf("Got rates %+v for %q, wanted an error", rates, csv)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package firefly
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
@@ -27,6 +28,7 @@ type AccountAttributes struct {
 	Name            string          `json:"name"`
 	Type            string          `json:"type"`
 	CurrentBalance  decimal.Decimal `json:"current_balance"`
+	CurrencyCode    string          `json:"currency_code"`
 	IncludeNetWorth bool            `json:"include_net_worth"`
 }
 
@@ -47,7 +49,7 @@ func (f *Firefly) HandleAccount(w http.ResponseWriter, req *http.Request) {
 }
 
 func (f *Firefly) listAccounts(w http.ResponseWriter, req *http.Request) {
-	accounts, err := f.CachedAccounts()
+	accounts, err := f.CachedAccounts(req.Context())
 	if err != nil {
 		httperror.Send(w, req, http.StatusInternalServerError, fmt.Sprintf("Could not list accounts: %s", err))
 		return
@@ -68,11 +70,12 @@ func (f *Firefly) listAccounts(w http.ResponseWriter, req *http.Request) {
 		accounts = filtered_accounts
 	}
 
+	f.setCacheAge(w, accountsEntry)
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(accounts)
 }
 
-func (f *Firefly) ListAccounts(accountType string) ([]Account, error) {
+func (f *Firefly) ListAccounts(ctx context.Context, accountType string) ([]Account, error) {
 	const path = "/api/v1/accounts"
 
 	var (
@@ -87,20 +90,11 @@ func (f *Firefly) ListAccounts(accountType string) ([]Account, error) {
 
 	for more := true; more; page++ {
 		params := fmt.Sprintf("?type=%s&page=%d", accountType, page)
-		req, _ := http.NewRequest("GET", f.config.URL+path+params, nil)
-		req.Header.Add("Authorization", "Bearer "+f.config.Token)
-		resp, err := f.client.Do(req)
+		var accs accountsResponse
+		err := f.do(ctx, "GET", path+params, nil, http.StatusOK, &accs)
 		if err != nil {
 			return nil, fmt.Errorf("failed to fetch Accounts: %s", err)
 		}
-		defer resp.Body.Close()
-
-		if resp.StatusCode != http.StatusOK {
-			return nil, fmt.Errorf("got status %d", resp.StatusCode)
-		}
-
-		var accs accountsResponse
-		json.NewDecoder(resp.Body).Decode(&accs)
 
 		results = append(results, accs.Data...)
 
@@ -117,3 +111,17 @@ func (f *Firefly) ListAccounts(accountType string) ([]Account, error) {
 
 	return filteredResults, err
 }
+
+// FetchAccount fetches a single account by ID.
+func (f *Firefly) FetchAccount(ctx context.Context, id string) (Account, error) {
+	const path = "/api/v1/accounts/"
+
+	var result struct {
+		Data Account `json:"data"`
+	}
+	err := f.do(ctx, "GET", path+id, nil, http.StatusOK, &result)
+	if err != nil {
+		return Account{}, fmt.Errorf("failed to fetch Account: %s", err)
+	}
+	return result.Data, nil
+}
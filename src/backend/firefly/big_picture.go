@@ -1,6 +1,7 @@
 package firefly
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
@@ -20,13 +21,19 @@ type bigPicture struct {
 	Expenses3Months decimal.Decimal `json:"expenses_three_months"`
 
 	NetWorth decimal.Decimal `json:"net_worth"`
+
+	// CurrencyCode is the currency of the totals, which is the primary
+	// currency if one is configured. Unconverted are the currencies whose
+	// amounts could not be converted, and are left out of the totals.
+	CurrencyCode string   `json:"currency_code"`
+	Unconverted  []string `json:"unconverted"`
 }
 
 func (f *Firefly) HandleBigPicture(w http.ResponseWriter, req *http.Request) {
 	log.Printf("%s %s", req.Method, req.RequestURI)
 	switch req.Method {
 	case "GET":
-		if err := f.bigPicture(w); err != nil {
+		if err := f.bigPicture(req.Context(), w); err != nil {
 			httperror.Send(w, req, http.StatusInternalServerError, err.Error())
 			return
 		}
@@ -36,25 +43,26 @@ func (f *Firefly) HandleBigPicture(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
-func (f *Firefly) bigPicture(w http.ResponseWriter) error {
-	bp, err := f.CachedBigPicture()
+func (f *Firefly) bigPicture(ctx context.Context, w http.ResponseWriter) error {
+	bp, err := f.CachedBigPicture(ctx)
 	if err != nil {
 		return fmt.Errorf("loading big picture: %w", err)
 	}
 
+	f.setCacheAge(w, bigPictureEntry)
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(bp)
 
 	return nil
 }
 
-func (f *Firefly) fetchBigPicture() (*bigPicture, error) {
+func (f *Firefly) fetchBigPicture(ctx context.Context) (*bigPicture, error) {
 	// Note that any transactions without a category will be ignored in the 'Big
 	// Picture' summary.
-	var bp bigPicture
+	bp := bigPicture{Unconverted: []string{}}
 
 	// Get our current net worth.
-	accounts, err := f.CachedAccounts()
+	accounts, err := f.CachedAccounts(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("could not list accounts: %s", err)
 	}
@@ -63,10 +71,15 @@ func (f *Firefly) fetchBigPicture() (*bigPicture, error) {
 		if a.Attributes.Type != AcctTypeAsset || !a.Attributes.IncludeNetWorth {
 			continue
 		}
-		bp.NetWorth = bp.NetWorth.Add(a.Attributes.CurrentBalance)
+		balance, ok := f.toPrimary(ctx, a.Attributes.CurrentBalance, a.Attributes.CurrencyCode, &bp.CurrencyCode)
+		if !ok {
+			bp.Unconverted = addUnconverted(bp.Unconverted, a.Attributes.CurrencyCode)
+			continue
+		}
+		bp.NetWorth = bp.NetWorth.Add(balance)
 	}
 
-	categories, err := f.CachedCategories()
+	categories, err := f.CachedCategories(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("getting cached categories: %w", err)
 	}
@@ -82,7 +95,7 @@ func (f *Firefly) fetchBigPicture() (*bigPicture, error) {
 		_, alwaysIncome := f.config.BigPictureIncome[c.ID]
 
 		// Last three months
-		categoryTotalThreeMonths, err := f.FetchCategoryTotal(c.ID, threeMonthsAgo, now)
+		categoryTotalThreeMonths, err := f.FetchCategoryTotal(ctx, c.ID, threeMonthsAgo, now)
 		if err != nil {
 			return nil, fmt.Errorf("listing '%s' three-month totals: %s", c.Name, err)
 		}
@@ -91,7 +104,7 @@ func (f *Firefly) fetchBigPicture() (*bigPicture, error) {
 		}
 
 		// Last twelve months
-		categoryTotalTwelveMonths, err := f.FetchCategoryTotal(c.ID, twelveMonthsAgo, now)
+		categoryTotalTwelveMonths, err := f.FetchCategoryTotal(ctx, c.ID, twelveMonthsAgo, now)
 		if err != nil {
 			return nil, fmt.Errorf("listing '%s' twelve-month totals: %s", c.Name, err)
 		}
@@ -99,6 +112,22 @@ func (f *Firefly) fetchBigPicture() (*bigPicture, error) {
 			return nil, fmt.Errorf("expected '%s' array to contain 1 item, contained %d", c.Name, len(categoryTotalTwelveMonths))
 		}
 
+		// The totals are already in the primary currency, if one is
+		// configured. Otherwise, a category in another currency than the
+		// other totals is left out.
+		var skip bool
+		for _, t := range []CategoryTotal{categoryTotalThreeMonths[0], categoryTotalTwelveMonths[0]} {
+			for _, code := range t.Unconverted {
+				bp.Unconverted = addUnconverted(bp.Unconverted, code)
+			}
+			if _, ok := f.toPrimary(ctx, decimal.Zero, t.CurrencyCode, &bp.CurrencyCode); !ok {
+				bp.Unconverted = addUnconverted(bp.Unconverted, t.CurrencyCode)
+				skip = true
+			}
+		}
+		if skip {
+			continue
+		}
 		categorySum3Months := categoryTotalThreeMonths[0].Earned.Add(categoryTotalThreeMonths[0].Spent)
 		categorySum12Months := categoryTotalTwelveMonths[0].Earned.Add(categoryTotalTwelveMonths[0].Spent)
 
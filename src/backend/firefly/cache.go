@@ -1,14 +1,15 @@
 package firefly
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"slices"
 	"sync"
 	"time"
 
 	"github.com/davidschlachter/lychnos/src/backend/budget"
 	"github.com/davidschlachter/lychnos/src/backend/categorybudget"
-	"github.com/davidschlachter/lychnos/src/backend/interval"
 )
 
 // Since queries to firefly are slow (up to 5 seconds), keep a cache of these
@@ -23,6 +24,54 @@ type Cache struct {
 	CategoryTotals map[categoryTotalsKey][]CategoryTotal
 	Transactions   map[transactionsKey][]Transactions
 	mu             sync.Mutex
+
+	// updated records when each entry was last fetched from Firefly-III,
+	// keyed by a cacheEntry, categoryTotalsKey or transactionsKey.
+	updated map[any]time.Time
+	// stale holds the entries restored from a snapshot that have not been
+	// refreshed yet. They are served as-is, and refreshed in the background
+	// when first used.
+	stale map[any]struct{}
+	// inflight holds the entries that are being fetched because they were
+	// missing, so that concurrent callers can share the fetch.
+	inflight map[any]*inflightFetch
+	// refreshes runs refreshes in the background.
+	refreshes refreshPool
+	// hits and misses count lookups of each kind of entry, for reporting.
+	hits, misses map[string]int
+	// ratesVersion is incremented whenever the exchange rates change, so that
+	// totals fetched with the previous rates are not cached.
+	ratesVersion int
+}
+
+// cacheEntry identifies the cache entries that are not maps.
+type cacheEntry string
+
+const (
+	accountsEntry   cacheEntry = "accounts"
+	bigPictureEntry cacheEntry = "big picture"
+	categoriesEntry cacheEntry = "categories"
+)
+
+// touch records that the entry was just fetched from Firefly-III. The caller
+// is responsible for locking the mutex.
+func (c *Cache) touch(key any) {
+	if c.updated == nil {
+		c.updated = make(map[any]time.Time)
+	}
+	c.updated[key] = time.Now()
+	delete(c.stale, key)
+}
+
+// revalidate refreshes the entry in the background if it was restored from a
+// snapshot and has not been refreshed since. The caller is responsible for
+// locking the mutex.
+func (f *Firefly) revalidate(key any, refresh func(context.Context) error) {
+	if _, ok := f.cache.stale[key]; !ok {
+		return
+	}
+	delete(f.cache.stale, key)
+	f.cache.refreshes.add(key, refresh)
 }
 
 type categoryTotalsKey struct {
@@ -31,28 +80,37 @@ type categoryTotalsKey struct {
 	End        time.Time
 }
 
+// maxCachedSearches is the number of filtered transactions lists that are
+// cached. Searches may use any description or amount, so the lists fetched
+// longest ago are evicted beyond this.
+const maxCachedSearches = 50
+
 type transactionsKey struct {
 	Page  int
 	Start string
 	End   string
+	// Query is a normalized search query if the transactions are filtered,
+	// see searchQuery.
+	Query string
 }
 
-func (f *Firefly) CachedAccounts() ([]Account, error) {
+func (f *Firefly) CachedAccounts(ctx context.Context) ([]Account, error) {
 	f.cache.mu.Lock()
+	f.cache.count(string(accountsEntry), f.cache.Accounts != nil)
 	if f.cache.Accounts == nil {
-		f.cache.mu.Unlock()
-		err := f.refreshAccounts()
+		err := f.coalesce(ctx, accountsEntry, f.refreshAccounts)
 		if err != nil {
 			return nil, err
 		}
 		f.cache.mu.Lock()
 	}
 	defer f.cache.mu.Unlock()
+	f.revalidate(accountsEntry, f.refreshAccounts)
 	return f.cache.Accounts, nil
 }
 
-func (f *Firefly) refreshAccounts() error {
-	c, err := f.ListAccounts("")
+func (f *Firefly) refreshAccounts(ctx context.Context) error {
+	c, err := f.ListAccounts(ctx, "")
 	if err != nil {
 		return err
 	}
@@ -60,27 +118,59 @@ func (f *Firefly) refreshAccounts() error {
 	defer f.cache.mu.Unlock()
 	log.Printf("Cache: updating Accounts")
 	f.cache.Accounts = c
+	f.cache.touch(accountsEntry)
+	return nil
+}
+
+// refreshAccountBalances updates the cached balances of the accounts with the
+// provided IDs. If any account is not cached yet (e.g. it was just created),
+// all accounts are refreshed instead.
+func (f *Firefly) refreshAccountBalances(ctx context.Context, ids map[string]struct{}) error {
+	fresh := make(map[string]Account, len(ids))
+	for id := range ids {
+		a, err := f.FetchAccount(ctx, id)
+		if err != nil {
+			return err
+		}
+		fresh[id] = a
+	}
+
+	f.cache.mu.Lock()
+	found := 0
+	for i, a := range f.cache.Accounts {
+		if acct, ok := fresh[a.ID]; ok {
+			log.Printf("Cache: updating balance of Account %s", a.ID)
+			f.cache.Accounts[i] = acct
+			found++
+		}
+	}
+	f.cache.mu.Unlock()
+
+	if found < len(fresh) {
+		return f.refreshAccounts(ctx)
+	}
 	return nil
 }
 
-func (f *Firefly) CachedCategories() ([]Category, error) {
+func (f *Firefly) CachedCategories(ctx context.Context) ([]Category, error) {
 	f.cache.mu.Lock()
+	f.cache.count(string(categoriesEntry), f.cache.Categories != nil)
 	if f.cache.Categories == nil {
-		f.cache.mu.Unlock()
-		err := f.refreshCategories()
+		err := f.coalesce(ctx, categoriesEntry, f.refreshCategories)
 		if err != nil {
 			return nil, err
 		}
 		f.cache.mu.Lock()
 	}
 	defer f.cache.mu.Unlock()
+	f.revalidate(categoriesEntry, f.refreshCategories)
 	return f.cache.Categories, nil
 }
 
 // refreshCategories refreshes the cached Categories. The caller is responsible
 // for locking the mutex.
-func (f *Firefly) refreshCategories() error {
-	c, err := f.Categories()
+func (f *Firefly) refreshCategories(ctx context.Context) error {
+	c, err := f.Categories(ctx)
 	if err != nil {
 		return err
 	}
@@ -88,29 +178,31 @@ func (f *Firefly) refreshCategories() error {
 	defer f.cache.mu.Unlock()
 	log.Printf("Cache: updating Categories")
 	f.cache.Categories = c
+	f.cache.touch(categoriesEntry)
 	return nil
 }
 
-func (f *Firefly) CachedListCategoryTotals(start, end time.Time) ([]CategoryTotal, error) {
+func (f *Firefly) CachedListCategoryTotals(ctx context.Context, start, end time.Time) ([]CategoryTotal, error) {
 	f.cache.mu.Lock()
 	key := categoryTotalsKey{
 		Start: start,
 		End:   end,
 	}
 	_, ok := f.cache.CategoryTotals[key]
+	f.cache.count(categoryTotalsFamily, ok)
 	if !ok {
-		f.cache.mu.Unlock()
-		err := f.refreshCategoryTotals(key)
+		err := f.coalesce(ctx, key, func(ctx context.Context) error { return f.refreshCategoryTotals(ctx, key) })
 		if err != nil {
 			return nil, err
 		}
 		f.cache.mu.Lock()
 	}
 	defer f.cache.mu.Unlock()
+	f.revalidate(key, func(ctx context.Context) error { return f.refreshCategoryTotals(ctx, key) })
 	return f.cache.CategoryTotals[key], nil
 }
 
-func (f *Firefly) CachedFetchCategoryTotals(catID int, start, end time.Time) ([]CategoryTotal, error) {
+func (f *Firefly) CachedFetchCategoryTotals(ctx context.Context, catID int, start, end time.Time) ([]CategoryTotal, error) {
 	f.cache.mu.Lock()
 	key := categoryTotalsKey{
 		CategoryID: catID,
@@ -118,19 +210,20 @@ func (f *Firefly) CachedFetchCategoryTotals(catID int, start, end time.Time) ([]
 		End:        end,
 	}
 	_, ok := f.cache.CategoryTotals[key]
+	f.cache.count(categoryTotalsFamily, ok)
 	if !ok {
-		f.cache.mu.Unlock()
-		err := f.refreshCategoryTotals(key)
+		err := f.coalesce(ctx, key, func(ctx context.Context) error { return f.refreshCategoryTotals(ctx, key) })
 		if err != nil {
 			return nil, err
 		}
 		f.cache.mu.Lock()
 	}
 	defer f.cache.mu.Unlock()
+	f.revalidate(key, func(ctx context.Context) error { return f.refreshCategoryTotals(ctx, key) })
 	return f.cache.CategoryTotals[key], nil
 }
 
-func (f *Firefly) refreshCategoryTotals(key categoryTotalsKey) error {
+func (f *Firefly) refreshCategoryTotals(ctx context.Context, key categoryTotalsKey) error {
 	var (
 		c   []CategoryTotal
 		err error
@@ -139,11 +232,12 @@ func (f *Firefly) refreshCategoryTotals(key categoryTotalsKey) error {
 	if f.cache.CategoryTotals == nil {
 		f.cache.CategoryTotals = make(map[categoryTotalsKey][]CategoryTotal)
 	}
+	ratesVersion := f.cache.ratesVersion
 	f.cache.mu.Unlock()
 	if key.CategoryID == 0 {
-		c, err = f.ListCategoryTotals(key.Start, key.End)
+		c, err = f.ListCategoryTotals(ctx, key.Start, key.End)
 	} else {
-		c, err = f.FetchCategoryTotal(key.CategoryID, key.Start, key.End)
+		c, err = f.FetchCategoryTotal(ctx, key.CategoryID, key.Start, key.End)
 	}
 	if err != nil {
 		return fmt.Errorf("could not update category totals cache: %s", err)
@@ -156,24 +250,31 @@ func (f *Firefly) refreshCategoryTotals(key categoryTotalsKey) error {
 		return nil
 	}
 	f.cache.mu.Lock()
+	if f.cache.ratesVersion != ratesVersion {
+		f.cache.mu.Unlock()
+		log.Printf("Cache: exchange rates changed, fetching CategoryTotals for key %d, %s, %s again", key.CategoryID, key.Start, key.End)
+		return f.refreshCategoryTotals(ctx, key)
+	}
 	log.Printf("Cache: updating CategoryTotals for key %d, %s, %s", key.CategoryID, key.Start, key.End)
 	f.cache.CategoryTotals[key] = c
+	f.cache.touch(key)
 	f.cache.mu.Unlock()
 	return nil
 }
 
-func (f *Firefly) CachedTransactions(key transactionsKey) ([]Transactions, error) {
+func (f *Firefly) CachedTransactions(ctx context.Context, key transactionsKey) ([]Transactions, error) {
 	f.cache.mu.Lock()
 	_, ok := f.cache.Transactions[key]
+	f.cache.count(transactionsFamily, ok)
 	if !ok {
-		f.cache.mu.Unlock()
-		err := f.refreshTransactions(key)
+		err := f.coalesce(ctx, key, func(ctx context.Context) error { return f.refreshTransactions(ctx, key) })
 		if err != nil {
 			return nil, err
 		}
 		f.cache.mu.Lock()
 	}
 	defer f.cache.mu.Unlock()
+	f.revalidate(key, func(ctx context.Context) error { return f.refreshTransactions(ctx, key) })
 	return f.cache.Transactions[key], nil
 }
 
@@ -183,6 +284,10 @@ func (f *Firefly) invalidateTransactionsCache() {
 	f.cache.mu.Lock()
 	defer f.cache.mu.Unlock()
 	log.Print("Cache: clearing Transactions")
+	for k := range f.cache.Transactions {
+		delete(f.cache.updated, k)
+		delete(f.cache.stale, k)
+	}
 	f.cache.Transactions = nil
 }
 
@@ -196,69 +301,108 @@ func (f *Firefly) invalidateAllCaches() {
 	f.cache.Categories = make([]Category, 0, len(f.cache.Categories))
 	f.cache.CategoryTotals = map[categoryTotalsKey][]CategoryTotal{}
 	f.cache.Transactions = map[transactionsKey][]Transactions{}
+	f.cache.updated = nil
+	f.cache.stale = nil
 }
 
-func (f *Firefly) refreshTransactions(key transactionsKey) error {
+func (f *Firefly) refreshTransactions(ctx context.Context, key transactionsKey) error {
 	f.cache.mu.Lock()
 	if f.cache.Transactions == nil {
 		f.cache.Transactions = make(map[transactionsKey][]Transactions)
 	}
 	f.cache.mu.Unlock()
-	t, err := f.ListTransactions(key)
+	t, err := f.ListTransactions(ctx, key)
 	if err != nil {
 		return err
 	}
 	f.cache.mu.Lock()
-	log.Printf("Cache: updating Transactions for key %d, %s, %s", key.Page, key.Start, key.End)
+	log.Printf("Cache: updating Transactions for key %d, %s, %s, %q", key.Page, key.Start, key.End, key.Query)
 	if f.cache.Transactions == nil {
 		f.cache.Transactions = make(map[transactionsKey][]Transactions)
 	}
 	f.cache.Transactions[key] = t
+	f.cache.touch(key)
+	if key.Query != "" {
+		f.cache.evictSearches()
+	}
 	f.cache.mu.Unlock()
 	return nil
 }
 
-func (f *Firefly) CachedBigPicture() (*bigPicture, error) {
+// evictSearches evicts the filtered transactions lists that were fetched
+// longest ago, so that at most maxCachedSearches are cached. The caller is
+// responsible for locking the mutex.
+func (c *Cache) evictSearches() {
+	var searches []transactionsKey
+	for k := range c.Transactions {
+		if k.Query != "" {
+			searches = append(searches, k)
+		}
+	}
+	if len(searches) <= maxCachedSearches {
+		return
+	}
+	slices.SortFunc(searches, func(a, b transactionsKey) int { return c.updated[a].Compare(c.updated[b]) })
+	for _, k := range searches[:len(searches)-maxCachedSearches] {
+		log.Printf("Cache: evicting Transactions for key %d, %s, %s, %q", k.Page, k.Start, k.End, k.Query)
+		delete(c.Transactions, k)
+		delete(c.updated, k)
+		delete(c.stale, k)
+	}
+}
+
+func (f *Firefly) CachedBigPicture(ctx context.Context) (*bigPicture, error) {
 	f.cache.mu.Lock()
+	f.cache.count(string(bigPictureEntry), f.cache.BigPicture != nil)
 	if f.cache.BigPicture == nil {
-		f.cache.mu.Unlock()
-		err := f.refreshBigPicture()
+		err := f.coalesce(ctx, bigPictureEntry, f.refreshBigPicture)
 		if err != nil {
 			return nil, err
 		}
 		f.cache.mu.Lock()
 	}
 	defer f.cache.mu.Unlock()
+	f.revalidate(bigPictureEntry, f.refreshBigPicture)
 	return f.cache.BigPicture, nil
 }
 
-func (f *Firefly) refreshBigPicture() error {
-	bp, err := f.fetchBigPicture()
+func (f *Firefly) refreshBigPicture(ctx context.Context) error {
+	f.cache.mu.Lock()
+	ratesVersion := f.cache.ratesVersion
+	f.cache.mu.Unlock()
+	bp, err := f.fetchBigPicture(ctx)
 	if err != nil {
 		return err
 	}
 	f.cache.mu.Lock()
+	if f.cache.ratesVersion != ratesVersion {
+		f.cache.mu.Unlock()
+		log.Printf("Cache: exchange rates changed, fetching Big Picture again")
+		return f.refreshBigPicture(ctx)
+	}
 	log.Printf("Cache: updating Big Picture")
 	f.cache.BigPicture = bp
+	f.cache.touch(bigPictureEntry)
 	f.cache.mu.Unlock()
 	return nil
 }
 
 // RefreshCaches refreshes caches for the current budget and its related data.
 // This is intended to be run when lychnos launches.
-func (f *Firefly) RefreshCaches(c *categorybudget.CategoryBudgets, b *budget.Budgets) error {
-	err := f.refreshCategories()
+func (f *Firefly) RefreshCaches(ctx context.Context, c *categorybudget.CategoryBudgets, b *budget.Budgets) error {
+	err := f.refreshCategories(ctx)
 	if err != nil {
 		return fmt.Errorf("failed to refresh categories: %s", err)
 	}
-	err = f.refreshAccounts()
+	err = f.refreshAccounts(ctx)
 	if err != nil {
 		return fmt.Errorf("failed to refresh accounts: %s", err)
 	}
-	err = f.refreshBigPicture()
+	err = f.refreshBigPicture(ctx)
 	if err != nil {
 		return fmt.Errorf("failed to refresh big picture: %s", err)
 	}
+	f.refreshSuggestions()
 
 	bs, err := b.List()
 	if err != nil {
@@ -275,33 +419,27 @@ func (f *Firefly) RefreshCaches(c *categorybudget.CategoryBudgets, b *budget.Bud
 			continue // Only update the cache for the current budget.
 		}
 
-		go func(bgt budget.Budget) {
-			key := categoryTotalsKey{
-				Start: bgt.Start,
-				End:   bgt.End,
-			}
-			err := f.refreshCategoryTotals(key)
-			if err != nil {
-				log.Printf("Failed to seed category totals cache: %s", err)
-			}
-		}(bgt)
+		key := categoryTotalsKey{
+			Start: bgt.Start,
+			End:   bgt.End,
+		}
+		f.cache.refreshes.add(key, func(ctx context.Context) error { return f.refreshCategoryTotals(ctx, key) })
 		for _, cb := range cbs {
 			if cb.Budget != bgt.ID {
 				continue
 			}
-			intervals := interval.Get(bgt.Start, bgt.End, time.Now().Local().Location())
+			intervals, err := f.Intervals(bgt)
+			if err != nil {
+				log.Printf("Failed to seed category totals cache for budget %d: %s", bgt.ID, err)
+				continue
+			}
 			for _, i := range intervals {
-				go func(i interval.ReportingInterval, cb categorybudget.CategoryBudget) {
-					key := categoryTotalsKey{
-						CategoryID: cb.Category,
-						Start:      i.Start.Local(),
-						End:        i.End.Local(),
-					}
-					err := f.refreshCategoryTotals(key)
-					if err != nil {
-						log.Printf("Failed to seed category totals cache: %s", err)
-					}
-				}(i, cb)
+				key := categoryTotalsKey{
+					CategoryID: cb.Category,
+					Start:      i.Start.Local(),
+					End:        i.End.Local(),
+				}
+				f.cache.refreshes.add(key, func(ctx context.Context) error { return f.refreshCategoryTotals(ctx, key) })
 			}
 		}
 	}
@@ -318,12 +456,12 @@ func (f *Firefly) RefreshCaches(c *categorybudget.CategoryBudgets, b *budget.Bud
 // accounts in firefly-iii directly. This causes the lychnos cache to become
 // stale, and then I have to manually restart lychnos. Instead, we can call this
 // function on some interval to make sure that our caches are always fresh.
-func (f *Firefly) InvalidateCacheIfAccountBalancesHaveChanged(c *categorybudget.CategoryBudgets, b *budget.Budgets) error {
-	cachedAccounts, err := f.CachedAccounts()
+func (f *Firefly) InvalidateCacheIfAccountBalancesHaveChanged(ctx context.Context, c *categorybudget.CategoryBudgets, b *budget.Budgets) error {
+	cachedAccounts, err := f.CachedAccounts(ctx)
 	if err != nil {
 		return err
 	}
-	freshAssetAccounts, err := f.ListAccounts(AcctTypeAsset)
+	freshAssetAccounts, err := f.ListAccounts(ctx, AcctTypeAsset)
 	if err != nil {
 		return err
 	}
@@ -334,7 +472,7 @@ func (f *Firefly) InvalidateCacheIfAccountBalancesHaveChanged(c *categorybudget.
 		for _, cachedAccount := range cachedAccounts {
 			if freshAssetAccount.ID == cachedAccount.ID && !freshAssetAccount.Attributes.CurrentBalance.Equal(cachedAccount.Attributes.CurrentBalance) {
 				f.invalidateAllCaches()
-				return f.RefreshCaches(c, b)
+				return f.RefreshCaches(ctx, c, b)
 			}
 		}
 	}
@@ -346,20 +484,20 @@ func (f *Firefly) InvalidateCacheIfAccountBalancesHaveChanged(c *categorybudget.
 // initial setup easier, or invalidates the cache if you happen to edit the
 // categories. Since we validate that you're not creating new categories in the
 // lychnos frontend, it's important to keep the cache up-to-date.
-func (f *Firefly) InvalidateCacheIfCategoriesHaveChanged(c *categorybudget.CategoryBudgets, b *budget.Budgets) error {
-	cachedCategories, err := f.CachedCategories()
+func (f *Firefly) InvalidateCacheIfCategoriesHaveChanged(ctx context.Context, c *categorybudget.CategoryBudgets, b *budget.Budgets) error {
+	cachedCategories, err := f.CachedCategories(ctx)
 	if err != nil {
 		return err
 	}
 
-	freshCategories, err := f.Categories()
+	freshCategories, err := f.Categories(ctx)
 	if err != nil {
 		return err
 	}
 
 	if len(cachedCategories) != len(freshCategories) {
 		f.invalidateAllCaches()
-		return f.RefreshCaches(c, b)
+		return f.RefreshCaches(ctx, c, b)
 	}
 
 	for _, freshCategory := range freshCategories {
@@ -372,27 +510,42 @@ func (f *Firefly) InvalidateCacheIfCategoriesHaveChanged(c *categorybudget.Categ
 		}
 		if !found {
 			f.invalidateAllCaches()
-			return f.RefreshCaches(c, b)
+			return f.RefreshCaches(ctx, c, b)
 		}
 	}
 
 	return nil
 }
 
-// refreshCategoryTxnCache will invalidate cache entries related to a particular
-// category and time. This should be called after creating a transaction.
-func (f *Firefly) refreshCategoryTxnCache(tgt categoryTotalsKey) {
+// refreshCategoryTxnCache will invalidate cache entries related to particular
+// categories and times. This should be called after creating a transaction.
+// Each entry is refreshed at most once, even if it matches several targets.
+func (f *Firefly) refreshCategoryTxnCache(tgts ...categoryTotalsKey) {
 	f.cache.mu.Lock()
 	defer f.cache.mu.Unlock()
 
 	for k := range f.cache.CategoryTotals {
-		if (k.Start.Year() == tgt.Start.Year() && (k.CategoryID == 0 || k.CategoryID == tgt.CategoryID)) ||
-			(k.End.Year() == tgt.End.Year() && (k.CategoryID == 0 || k.CategoryID == tgt.CategoryID)) {
-			log.Printf("Cache: clearing CategoryTotals for key %d, %s, %s", k.CategoryID, k.Start, k.End)
-			delete(f.cache.CategoryTotals, k)
-			go func(k categoryTotalsKey) {
-				f.refreshCategoryTotals(k)
-			}(k)
+		for _, tgt := range tgts {
+			if (k.Start.Year() == tgt.Start.Year() && (k.CategoryID == 0 || k.CategoryID == tgt.CategoryID)) ||
+				(k.End.Year() == tgt.End.Year() && (k.CategoryID == 0 || k.CategoryID == tgt.CategoryID)) {
+				log.Printf("Cache: clearing CategoryTotals for key %d, %s, %s", k.CategoryID, k.Start, k.End)
+				delete(f.cache.CategoryTotals, k)
+				f.cache.refreshes.add(k, func(ctx context.Context) error { return f.refreshCategoryTotals(ctx, k) })
+				break
+			}
 		}
 	}
 }
+
+// invalidateTxnCaches clears the cached transactions and refreshes the caches
+// affected by a change to transactions with the provided category and date
+// keys. This should be called after creating, updating or deleting a
+// transaction.
+func (f *Firefly) invalidateTxnCaches(keys ...categoryTotalsKey) {
+	f.invalidateTransactionsCache() // since user is going to txns page next, update now
+	// The other caches are refreshed in the background, after returning
+	f.refreshCategoryTxnCache(keys...)
+	f.cache.refreshes.add(accountsEntry, f.refreshAccounts)     // Loads any new accounts created, updates balances
+	f.cache.refreshes.add(bigPictureEntry, f.refreshBigPicture) // Net worth probably changed
+	f.refreshSuggestions()
+}
@@ -0,0 +1,240 @@
+package firefly
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/davidschlachter/lychnos/src/backend/httperror"
+)
+
+// Names of the kinds of entries in the cache, for reporting.
+const (
+	categoryTotalsFamily = "category totals"
+	transactionsFamily   = "transactions"
+)
+
+// CacheFamily describes the cached entries of one kind.
+type CacheFamily struct {
+	Name    string `json:"name"`
+	Entries int    `json:"entries"`
+	// Start and End are the earliest and latest dates covered by the keys of
+	// the entries, if any are limited to a date range.
+	Start string `json:"start,omitempty"`
+	End   string `json:"end,omitempty"`
+	// OldestRefresh and LastRefresh are the times at which the least and most
+	// recently refreshed entries were fetched from Firefly-III.
+	OldestRefresh *time.Time `json:"oldest_refresh,omitempty"`
+	LastRefresh   *time.Time `json:"last_refresh,omitempty"`
+	Hits          int        `json:"hits"`
+	Misses        int        `json:"misses"`
+}
+
+// count records a cache hit or miss for the family. The caller is responsible
+// for locking the mutex.
+func (c *Cache) count(family string, hit bool) {
+	if c.hits == nil {
+		c.hits = make(map[string]int)
+		c.misses = make(map[string]int)
+	}
+	if hit {
+		c.hits[family]++
+	} else {
+		c.misses[family]++
+	}
+}
+
+// HandleCache reports the contents of the cache, and allows entries to be
+// evicted so that they are fetched again from Firefly-III.
+func (f *Firefly) HandleCache(w http.ResponseWriter, req *http.Request) {
+	log.Printf("%s %s", req.Method, req.RequestURI)
+	switch req.Method {
+	case "GET":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(f.cacheFamilies())
+	case "DELETE":
+		f.evictCache(w, req)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+		fmt.Fprintf(w, "Unsupported method %s", req.Method)
+	}
+}
+
+func (f *Firefly) cacheFamilies() []CacheFamily {
+	f.cache.mu.Lock()
+	defer f.cache.mu.Unlock()
+
+	family := func(name string, entries int) CacheFamily {
+		return CacheFamily{
+			Name:    name,
+			Entries: entries,
+			Hits:    f.cache.hits[name],
+			Misses:  f.cache.misses[name],
+		}
+	}
+	refreshed := func(fam *CacheFamily, key any) {
+		updated, ok := f.cache.updated[key]
+		if !ok {
+			return
+		}
+		if fam.OldestRefresh == nil || updated.Before(*fam.OldestRefresh) {
+			fam.OldestRefresh = &updated
+		}
+		if fam.LastRefresh == nil || updated.After(*fam.LastRefresh) {
+			fam.LastRefresh = &updated
+		}
+	}
+	dates := func(fam *CacheFamily, start, end string) {
+		if start != "" && (fam.Start == "" || start < fam.Start) {
+			fam.Start = start
+		}
+		if end != "" && (fam.End == "" || end > fam.End) {
+			fam.End = end
+		}
+	}
+
+	var families []CacheFamily
+	for _, e := range []struct {
+		entry  cacheEntry
+		cached bool
+	}{
+		{accountsEntry, len(f.cache.Accounts) > 0},
+		{bigPictureEntry, f.cache.BigPicture != nil},
+		{categoriesEntry, len(f.cache.Categories) > 0},
+	} {
+		fam := family(string(e.entry), 0)
+		if e.cached {
+			fam.Entries = 1
+			refreshed(&fam, e.entry)
+		}
+		families = append(families, fam)
+	}
+
+	totals := family(categoryTotalsFamily, len(f.cache.CategoryTotals))
+	for k := range f.cache.CategoryTotals {
+		refreshed(&totals, k)
+		dates(&totals, k.Start.Format(inputDateFormat), k.End.Format(inputDateFormat))
+	}
+	families = append(families, totals)
+
+	txns := family(transactionsFamily, len(f.cache.Transactions))
+	for k := range f.cache.Transactions {
+		refreshed(&txns, k)
+		dates(&txns, k.Start, k.End)
+	}
+	families = append(families, txns)
+
+	return families
+}
+
+// evictCache evicts entries from the cache. If a category ID or a date range
+// are provided, only the category totals and transactions lists that could
+// include them are evicted, along with the big picture. Otherwise, the whole
+// cache is evicted. Evicted entries are fetched again when next used.
+func (f *Firefly) evictCache(w http.ResponseWriter, req *http.Request) {
+	var (
+		catID      int
+		start, end time.Time
+		err        error
+	)
+	q := req.URL.Query()
+	if q.Get("category") != "" {
+		catID, err = strconv.Atoi(q.Get("category"))
+		if err != nil {
+			httperror.Send(w, req, http.StatusBadRequest, fmt.Sprintf("Invalid category ID: %s", err))
+			return
+		}
+	}
+	if q.Get("start") != "" {
+		start, err = time.ParseInLocation(inputDateFormat, q.Get("start"), time.Local)
+		if err != nil {
+			httperror.Send(w, req, http.StatusBadRequest, fmt.Sprintf("Invalid start date: %s", err))
+			return
+		}
+	}
+	if q.Get("end") != "" {
+		end, err = time.ParseInLocation(inputDateFormat, q.Get("end"), time.Local)
+		if err != nil {
+			httperror.Send(w, req, http.StatusBadRequest, fmt.Sprintf("Invalid end date: %s", err))
+			return
+		}
+		end = end.AddDate(0, 0, 1).Add(-time.Nanosecond)
+	}
+	if !start.IsZero() && !end.IsZero() && end.Before(start) {
+		httperror.Send(w, req, http.StatusBadRequest, "End date must not be before start date")
+		return
+	}
+
+	f.cache.mu.Lock()
+	evicted := 0
+	if catID == 0 && start.IsZero() && end.IsZero() {
+		log.Print("Cache: evicting all caches")
+		for _, cached := range []bool{len(f.cache.Accounts) > 0, f.cache.BigPicture != nil, len(f.cache.Categories) > 0} {
+			if cached {
+				evicted++
+			}
+		}
+		evicted += len(f.cache.CategoryTotals) + len(f.cache.Transactions)
+		f.cache.Accounts = nil
+		f.cache.BigPicture = nil
+		f.cache.Categories = nil
+		f.cache.CategoryTotals = map[categoryTotalsKey][]CategoryTotal{}
+		f.cache.Transactions = map[transactionsKey][]Transactions{}
+		f.cache.updated = nil
+		f.cache.stale = nil
+	} else {
+		for k := range f.cache.CategoryTotals {
+			if catID != 0 && k.CategoryID != 0 && k.CategoryID != catID {
+				continue
+			}
+			if (!start.IsZero() && k.End.Before(start)) || (!end.IsZero() && k.Start.After(end)) {
+				continue
+			}
+			log.Printf("Cache: evicting CategoryTotals for key %d, %s, %s", k.CategoryID, k.Start, k.End)
+			delete(f.cache.CategoryTotals, k)
+			delete(f.cache.updated, k)
+			delete(f.cache.stale, k)
+			evicted++
+		}
+		for k := range f.cache.Transactions {
+			if !overlapsTransactionsKey(k, start, end) {
+				continue
+			}
+			log.Printf("Cache: evicting Transactions for key %d, %s, %s", k.Page, k.Start, k.End)
+			delete(f.cache.Transactions, k)
+			delete(f.cache.updated, k)
+			delete(f.cache.stale, k)
+			evicted++
+		}
+		if f.cache.BigPicture != nil {
+			f.cache.BigPicture = nil
+			evicted++
+		}
+	}
+	f.cache.mu.Unlock()
+	f.refreshSuggestions()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"evicted": evicted})
+}
+
+// overlapsTransactionsKey reports whether the transactions list for k could
+// include transactions between start and end, either of which may be zero.
+func overlapsTransactionsKey(k transactionsKey, start, end time.Time) bool {
+	if k.Start == "" || k.End == "" {
+		return true
+	}
+	kStart, err := time.ParseInLocation(inputDateFormat, k.Start, time.Local)
+	if err != nil {
+		return true
+	}
+	kEnd, err := time.ParseInLocation(inputDateFormat, k.End, time.Local)
+	if err != nil {
+		return true
+	}
+	kEnd = kEnd.AddDate(0, 0, 1)
+	return (start.IsZero() || start.Before(kEnd)) && (end.IsZero() || !end.Before(kStart))
+}
@@ -0,0 +1,159 @@
+package firefly_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/davidschlachter/lychnos/src/backend/firefly"
+)
+
+func TestCoalesceCacheMisses(t *testing.T) {
+	const callers = 10
+
+	var hits atomic.Int32
+	arrived := make(chan struct{}, callers)
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		arrived <- struct{}{}
+		<-release
+		fmt.Fprint(w, `{"data":{"type":"categories","id":"4","attributes":{"name":"Apartment","spent":[{"sum":"-10.00","currency_code":"CAD"}],"earned":[]}}}`)
+	}))
+	defer server.Close()
+
+	f, err := firefly.New(server.Client(), firefly.Config{Token: "token", URL: server.URL})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	start := time.Date(2022, 1, 1, 0, 0, 0, 0, time.Local)
+	end := time.Date(2022, 1, 31, 23, 59, 59, 0, time.Local)
+	var wg sync.WaitGroup
+	errs := make(chan error, callers)
+	for range callers {
+		wg.Go(func() {
+			c, err := f.CachedFetchCategoryTotals(t.Context(), 4, start, end)
+			if err == nil && len(c) != 1 {
+				err = fmt.Errorf("got %d category totals, wanted 1", len(c))
+			}
+			errs <- err
+		})
+	}
+
+	// Hold the first request until the other callers have had a chance to
+	// miss the cache too
+	<-arrived
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Errorf("Unexpected error: %s", err)
+		}
+	}
+	if n := hits.Load(); n != 1 {
+		t.Errorf("Got %d requests to Firefly-III, wanted 1", n)
+	}
+}
+
+func TestHandleCache(t *testing.T) {
+	f, err := firefly.New(server.Client(), firefly.Config{Token: "token", URL: server.URL})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	for range 2 {
+		for _, month := range []time.Month{time.January, time.February} {
+			start := time.Date(2022, month, 1, 0, 0, 0, 0, time.Local)
+			_, err := f.CachedFetchCategoryTotals(t.Context(), 4, start, start.AddDate(0, 1, 0).Add(-time.Second))
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+		}
+	}
+
+	totals := func() firefly.CacheFamily {
+		w := httptest.NewRecorder()
+		f.HandleCache(w, httptest.NewRequest("GET", "/api/cache", nil))
+		var families []firefly.CacheFamily
+		err := json.NewDecoder(w.Body).Decode(&families)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		for _, fam := range families {
+			if fam.Name == "category totals" {
+				return fam
+			}
+		}
+		t.Fatalf("Category totals missing from %+v", families)
+		return firefly.CacheFamily{}
+	}
+	got := totals()
+	if got.Entries != 2 || got.Hits != 2 || got.Misses != 2 || got.Start != "2022-01-01" || got.End != "2022-02-28" || got.LastRefresh == nil {
+		t.Errorf("Got category totals %+v, wanted 2 entries from 2022-01-01 to 2022-02-28 with 2 hits and 2 misses", got)
+	}
+
+	tests := []struct {
+		query    string
+		expected int
+		entries  int
+	}{
+		{query: "?start=2022-02-01&end=2022-01-01", expected: http.StatusBadRequest, entries: 2},
+		{query: "?category=5&start=2022-02-01", expected: http.StatusOK, entries: 2},
+		{query: "?category=4&start=2022-02-01", expected: http.StatusOK, entries: 1},
+		{query: "", expected: http.StatusOK, entries: 0},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		f.HandleCache(w, httptest.NewRequest("DELETE", "/api/cache"+test.query, nil))
+		if w.Result().StatusCode != test.expected {
+			t.Fatalf("DELETE %s: status code = %d, want %d. Response body: %s", test.query, w.Result().StatusCode, test.expected, w.Body.String())
+		}
+		if got := totals(); got.Entries != test.entries {
+			t.Errorf("DELETE %s: got %d category totals, wanted %d", test.query, got.Entries, test.entries)
+		}
+	}
+}
+
+func TestCancelCacheMiss(t *testing.T) {
+	arrived := make(chan struct{})
+	aborted := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(arrived)
+		<-r.Context().Done()
+		close(aborted)
+	}))
+	defer server.Close()
+
+	f, err := firefly.New(server.Client(), firefly.Config{Token: "token", URL: server.URL})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(t.Context())
+	go func() {
+		<-arrived
+		cancel()
+	}()
+	start := time.Date(2022, 1, 1, 0, 0, 0, 0, time.Local)
+	_, err = f.CachedFetchCategoryTotals(ctx, 4, start, start.AddDate(0, 1, 0).Add(-time.Second))
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Got error %v, wanted %s", err, context.Canceled)
+	}
+
+	// Once its only caller is gone, the request to Firefly-III is aborted too
+	select {
+	case <-aborted:
+	case <-time.After(5 * time.Second):
+		t.Errorf("Request to Firefly-III was not aborted")
+	}
+}
@@ -0,0 +1,37 @@
+package firefly
+
+import (
+	"context"
+	"time"
+)
+
+// Categorizer assigns a category to a new transaction, e.g. with rules based
+// on its payee.
+type Categorizer interface {
+	// Categorize sets the category of t, and may change its description. If
+	// no category applies, t is unchanged.
+	Categorize(ctx context.Context, t *Transaction) error
+}
+
+// Categorize assigns a category to a transaction without one, with the
+// Categorizer of the config, if any. The destination name is filled in from
+// the destination ID, so that it can be matched.
+func (f *Firefly) Categorize(ctx context.Context, t *Transaction) error {
+	if f.config.Categorizer == nil || t.CategoryID != "" || t.CategoryName != "" {
+		return nil
+	}
+	c := *t
+	c.DestinationID, c.DestinationName = f.resolveAccount(ctx, t.DestinationID, t.DestinationName)
+	err := f.config.Categorizer.Categorize(ctx, &c)
+	if err != nil {
+		return err
+	}
+	t.CategoryID, t.CategoryName, t.Description = c.CategoryID, c.CategoryName, c.Description
+	return nil
+}
+
+// CachedTransactionsBetween returns the transactions between the start and end
+// dates, from the cache if possible.
+func (f *Firefly) CachedTransactionsBetween(ctx context.Context, start, end time.Time) ([]Transactions, error) {
+	return f.CachedTransactions(ctx, transactionsKey{Start: start.Format(inputDateFormat), End: end.Format(inputDateFormat)})
+}
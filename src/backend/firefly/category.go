@@ -1,6 +1,7 @@
 package firefly
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
@@ -35,36 +36,25 @@ func (f *Firefly) HandleCategory(w http.ResponseWriter, req *http.Request) {
 }
 
 func (f *Firefly) listCategories(w http.ResponseWriter, req *http.Request) {
-	categories, err := f.CachedCategories()
+	categories, err := f.CachedCategories(req.Context())
 	if err != nil {
 		httperror.Send(w, req, http.StatusInternalServerError, fmt.Sprintf("Could not list categories: %s", err))
 		return
 	}
 
+	f.setCacheAge(w, categoriesEntry)
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(categories)
 }
 
-func (f *Firefly) Categories() ([]Category, error) {
+func (f *Firefly) Categories(ctx context.Context) ([]Category, error) {
 	const path = "/api/v1/autocomplete/categories?limit=1000"
 
-	req, err := http.NewRequest("GET", f.config.URL+path, nil)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %s", err)
-	}
-	req.Header.Add("Authorization", "Bearer "+f.config.Token)
-	resp, err := f.client.Do(req)
+	var rawResults []rawCategory
+	err := f.do(ctx, "GET", path, nil, http.StatusOK, &rawResults)
 	if err != nil {
 		return nil, fmt.Errorf("failed to fetch Categories: %s", err)
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("got status %d", resp.StatusCode)
-	}
-
-	var rawResults []rawCategory
-	json.NewDecoder(resp.Body).Decode(&rawResults)
 
 	results := make([]Category, 0)
 
@@ -89,6 +79,14 @@ type CategoryTotal struct {
 	Earned decimal.Decimal `json:"earned"`
 	Start  time.Time       `json:"start"`
 	End    time.Time       `json:"end"`
+	// CurrencyCode is the currency of Spent and Earned, which is the primary
+	// currency if one is configured. Currencies are the totals in each
+	// currency before they were converted, and Unconverted are the currencies
+	// whose amounts could not be converted, and are left out of Spent and
+	// Earned.
+	CurrencyCode string          `json:"currency_code"`
+	Currencies   []CurrencyTotal `json:"currencies"`
+	Unconverted  []string        `json:"unconverted"`
 }
 
 type rawCategoryTotal struct {
@@ -103,29 +101,21 @@ type rawAttributes struct {
 }
 
 type rawTotal struct {
-	Sum string `json:"sum"`
+	Sum          string `json:"sum"`
+	CurrencyCode string `json:"currency_code"`
 }
 
-func (f *Firefly) ListCategoryTotals(start, end time.Time) ([]CategoryTotal, error) {
+func (f *Firefly) ListCategoryTotals(ctx context.Context, start, end time.Time) ([]CategoryTotal, error) {
 	const path = "/api/v1/categories/"
 	params := fmt.Sprintf("?start=%s&end=%s", start.Format("2006-01-02"), end.Format("2006-01-02"))
 
-	req, _ := http.NewRequest("GET", f.config.URL+path+params, nil)
-	req.Header.Add("Authorization", "Bearer "+f.config.Token)
-	resp, err := f.client.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("failed to fetch Categories: %s", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("got status %d", resp.StatusCode)
-	}
-
 	var rawResults struct {
 		Data []rawCategoryTotal `json:"data"`
 	}
-	json.NewDecoder(resp.Body).Decode(&rawResults)
+	err := f.do(ctx, "GET", path+params, nil, http.StatusOK, &rawResults)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch Categories: %s", err)
+	}
 
 	var results []CategoryTotal
 
@@ -133,90 +123,102 @@ func (f *Firefly) ListCategoryTotals(start, end time.Time) ([]CategoryTotal, err
 		if len(r.Attributes.Spent) == 0 && len(r.Attributes.Earned) == 0 {
 			continue
 		}
-		var c CategoryTotal
-		var spent, earned decimal.Decimal
-		id, err := strconv.Atoi(r.ID)
+		c, err := f.categoryTotal(ctx, r, start, end)
 		if err != nil {
-			return nil, fmt.Errorf("could not convert id to int: %s", err)
-		}
-		// TODO(davidschlachter): Maybe support multiple currencies one day
-		if len(r.Attributes.Spent) == 1 {
-			spent, err = decimal.NewFromString(r.Attributes.Spent[0].Sum)
-			if err != nil {
-				return nil, fmt.Errorf("could not convert spent sum to decimal: %s", err)
-			}
+			return nil, err
 		}
-		if len(r.Attributes.Earned) == 1 {
-			earned, err = decimal.NewFromString(r.Attributes.Earned[0].Sum)
-			if err != nil {
-				return nil, fmt.Errorf("could not convert earned sum to decimal: %s", err)
-			}
-		}
-
-		c.ID = id
-		c.Name = r.Attributes.Name
-		c.Spent = spent
-		c.Earned = earned
-		c.Start = start
-		c.End = end
-
 		results = append(results, c)
 	}
 
 	return results, nil
 }
 
-func (f *Firefly) FetchCategoryTotal(catID int, start, end time.Time) ([]CategoryTotal, error) {
+func (f *Firefly) FetchCategoryTotal(ctx context.Context, catID int, start, end time.Time) ([]CategoryTotal, error) {
 	const path = "/api/v1/categories/"
 	params := fmt.Sprintf("?start=%s&end=%s", start.Format("2006-01-02"), end.Format("2006-01-02"))
 
-	req, _ := http.NewRequest("GET", fmt.Sprintf("%s%s%d%s", f.config.URL, path, catID, params), nil)
-	req.Header.Add("Authorization", "Bearer "+f.config.Token)
-	resp, err := f.client.Do(req)
+	var rawResults struct {
+		Data rawCategoryTotal `json:"data"`
+	}
+	err := f.do(ctx, "GET", fmt.Sprintf("%s%d%s", path, catID, params), nil, http.StatusOK, &rawResults)
 	if err != nil {
 		return nil, fmt.Errorf("failed to fetch Category: %s", err)
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("got status %d", resp.StatusCode)
-	}
 
-	var rawResults struct {
-		Data rawCategoryTotal `json:"data"`
+	c, err := f.categoryTotal(ctx, rawResults.Data, start, end)
+	if err != nil {
+		return nil, err
 	}
-	json.NewDecoder(resp.Body).Decode(&rawResults)
 
-	var results []CategoryTotal
+	return []CategoryTotal{c}, nil
+}
 
-	r := &rawResults.Data
-	var c CategoryTotal
-	var spent, earned decimal.Decimal
+// categoryTotal converts the sums of a category in each currency into the
+// primary currency, and adds up the ones that could be converted.
+func (f *Firefly) categoryTotal(ctx context.Context, r rawCategoryTotal, start, end time.Time) (CategoryTotal, error) {
 	id, err := strconv.Atoi(r.ID)
 	if err != nil {
-		return nil, fmt.Errorf("could not convert id to int: %s", err)
-	}
-	if len(r.Attributes.Spent) == 1 {
-		spent, err = decimal.NewFromString(r.Attributes.Spent[0].Sum)
-		if err != nil {
-			return nil, fmt.Errorf("could not convert spent sum to decimal: %s", err)
-		}
-	}
-	if len(r.Attributes.Earned) == 1 {
-		earned, err = decimal.NewFromString(r.Attributes.Earned[0].Sum)
-		if err != nil {
-			return nil, fmt.Errorf("could not convert earned sum to decimal: %s", err)
+		return CategoryTotal{}, fmt.Errorf("could not convert id to int: %s", err)
+	}
+	c := CategoryTotal{
+		Category:    Category{ID: id, Name: r.Attributes.Name},
+		Start:       start,
+		End:         end,
+		Currencies:  []CurrencyTotal{},
+		Unconverted: []string{},
+	}
+
+	byCurrency := make(map[string]int)
+	for _, raw := range []struct {
+		name   string
+		totals []rawTotal
+	}{
+		{"spent", r.Attributes.Spent},
+		{"earned", r.Attributes.Earned},
+	} {
+		for _, t := range raw.totals {
+			sum, err := decimal.NewFromString(t.Sum)
+			if err != nil {
+				return CategoryTotal{}, fmt.Errorf("could not convert %s sum to decimal: %s", raw.name, err)
+			}
+			i, ok := byCurrency[t.CurrencyCode]
+			if !ok {
+				i = len(c.Currencies)
+				byCurrency[t.CurrencyCode] = i
+				c.Currencies = append(c.Currencies, CurrencyTotal{CurrencyCode: t.CurrencyCode})
+			}
+			if raw.name == "spent" {
+				c.Currencies[i].Spent = c.Currencies[i].Spent.Add(sum)
+			} else {
+				c.Currencies[i].Earned = c.Currencies[i].Earned.Add(sum)
+			}
+
+			converted, ok := f.toPrimary(ctx, sum, t.CurrencyCode, &c.CurrencyCode)
+			if !ok {
+				c.Unconverted = addUnconverted(c.Unconverted, t.CurrencyCode)
+				continue
+			}
+			if raw.name == "spent" {
+				c.Spent = c.Spent.Add(converted)
+			} else {
+				c.Earned = c.Earned.Add(converted)
+			}
 		}
 	}
 
-	c.ID = id
-	c.Name = r.Attributes.Name
-	c.Spent = spent
-	c.Earned = earned
-	c.Start = start
-	c.End = end
-
-	results = append(results, c)
+	return c, nil
+}
 
-	return results, nil
+// CategorySums returns the sum of earned and spent amounts for each category
+// ID between start and end.
+func (f *Firefly) CategorySums(ctx context.Context, start, end time.Time) (map[int]decimal.Decimal, error) {
+	totals, err := f.CachedListCategoryTotals(ctx, start, end)
+	if err != nil {
+		return nil, err
+	}
+	sums := make(map[int]decimal.Decimal, len(totals))
+	for _, t := range totals {
+		sums[t.ID] = t.Earned.Add(t.Spent)
+	}
+	return sums, nil
 }
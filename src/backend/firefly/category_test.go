@@ -41,7 +41,7 @@ func TestListCategoryTotals(t *testing.T) {
 	// (Interval not considered in test)
 	start := time.Now().Add(time.Hour * -1)
 	end := time.Now()
-	c, err := f.CachedListCategoryTotals(start, end)
+	c, err := f.CachedListCategoryTotals(t.Context(), start, end)
 	if err != nil {
 		t.Fatalf("Unexpected error: %s\n", err)
 	}
@@ -74,7 +74,7 @@ func TestFetchCategoryTotal(t *testing.T) {
 	// (Interval not considered in test)
 	start := time.Now().Add(time.Hour * -1)
 	end := time.Now()
-	c, err := f.CachedFetchCategoryTotals(4, start, end)
+	c, err := f.CachedFetchCategoryTotals(t.Context(), 4, start, end)
 	if err != nil {
 		t.Fatalf("Unexpected error: %s\n", err)
 	}
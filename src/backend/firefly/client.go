@@ -0,0 +1,127 @@
+package firefly
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Defaults for the Firefly-III client, if not set in the Config.
+const (
+	defaultMaxRetries            = 3
+	defaultRetryBackoff          = 500 * time.Millisecond
+	defaultMaxConcurrentRequests = 8
+)
+
+// StatusError is returned when Firefly-III responds with an unexpected status.
+type StatusError struct {
+	StatusCode int
+	Status     string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("got status %s", e.Status)
+}
+
+// retryable reports whether a request that failed with the status code may be
+// retried. Requests that create something are only retried if they were
+// rejected before being processed (429), so that they are never duplicated.
+// (For the same reason, they are not retried after network errors.)
+func retryable(method string, code int) bool {
+	if code == http.StatusTooManyRequests {
+		return true
+	}
+	return method != "POST" && code >= 500
+}
+
+// do sends a request to the Firefly-III API, encoding body as JSON (unless it
+// is nil), and decodes the JSON response into result (unless it is nil). The
+// response must have the expected status. Failed requests are retried with
+// exponential backoff, and the number of concurrent requests is limited so
+// that Firefly-III isn't overwhelmed.
+func (f *Firefly) do(ctx context.Context, method, path string, body any, expected int, result any) error {
+	var payload []byte
+	if body != nil {
+		var err error
+		payload, err = json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("could not encode request: %s", err)
+		}
+	}
+
+	backoff := f.config.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		retryAfter, err := f.attempt(ctx, method, path, payload, expected, result)
+		if err == nil || retryAfter < 0 || attempt >= f.config.MaxRetries {
+			return err
+		}
+
+		wait := max(backoff, retryAfter)
+		backoff *= 2
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%s (gave up retrying: %s)", err, ctx.Err())
+		case <-time.After(wait):
+		}
+	}
+}
+
+// attempt sends a single request. If it fails and may be retried, it returns
+// how long Firefly-III asked us to wait before retrying (or zero), and
+// otherwise it returns a negative duration.
+func (f *Firefly) attempt(ctx context.Context, method, path string, payload []byte, expected int, result any) (time.Duration, error) {
+	select {
+	case f.limiter <- struct{}{}:
+		defer func() { <-f.limiter }()
+	case <-ctx.Done():
+		return -1, ctx.Err()
+	}
+
+	var reqBody io.Reader
+	if payload != nil {
+		reqBody = bytes.NewReader(payload)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, f.config.URL+path, reqBody)
+	if err != nil {
+		return -1, fmt.Errorf("failed to create request: %s", err)
+	}
+	req.Header.Add("Authorization", "Bearer "+f.config.Token)
+	req.Header.Add("Accept", "application/json")
+	if payload != nil {
+		req.Header.Add("Content-Type", "application/json")
+	}
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		if ctx.Err() != nil || method == "POST" {
+			return -1, err
+		}
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != expected {
+		// Read (some of) the body so that the connection can be reused
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+		err := &StatusError{StatusCode: resp.StatusCode, Status: resp.Status}
+		if !retryable(method, resp.StatusCode) {
+			return -1, err
+		}
+		seconds, _ := strconv.Atoi(resp.Header.Get("Retry-After"))
+		return time.Duration(seconds) * time.Second, err
+	}
+
+	if result == nil {
+		return -1, nil
+	}
+	err = json.NewDecoder(resp.Body).Decode(result)
+	if err != nil {
+		return -1, fmt.Errorf("could not decode response: %s", err)
+	}
+	return -1, nil
+}
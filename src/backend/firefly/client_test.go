@@ -0,0 +1,101 @@
+package firefly_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/davidschlachter/lychnos/src/backend/firefly"
+)
+
+const accountBody = `{"data":{"type":"accounts","id":"3","attributes":{"active":true,"name":"Savings account","type":"asset","current_balance":"1.00"}}}`
+
+func TestRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []int // statuses of successive responses, then 200
+		body     string
+		hits     int32
+		wantErr  string
+	}{
+		{name: "success", body: accountBody, hits: 1},
+		{name: "retried bad gateway", statuses: []int{502, 503}, body: accountBody, hits: 3},
+		{name: "retried rate limit", statuses: []int{429}, body: accountBody, hits: 2},
+		{name: "gave up", statuses: []int{500, 500, 500, 500}, hits: 3, wantErr: "got status 500"},
+		{name: "not retried", statuses: []int{404}, hits: 1, wantErr: "got status 404"},
+		{name: "invalid response", body: `{"data":`, hits: 1, wantErr: "could not decode response"},
+	}
+	for _, test := range tests {
+		var hits atomic.Int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			n := int(hits.Add(1))
+			if n <= len(test.statuses) {
+				w.Header().Set("Retry-After", "0")
+				w.WriteHeader(test.statuses[n-1])
+				return
+			}
+			fmt.Fprint(w, test.body)
+		}))
+		f, err := firefly.New(server.Client(), firefly.Config{Token: "token", URL: server.URL, MaxRetries: 2, RetryBackoff: time.Millisecond})
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+
+		a, err := f.FetchAccount(t.Context(), "3")
+		server.Close()
+		if test.wantErr == "" && err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+		} else if test.wantErr == "" && a.ID != "3" {
+			t.Errorf("%s: got account %q, wanted 3", test.name, a.ID)
+		} else if test.wantErr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErr)) {
+			t.Errorf("%s: got error %v, wanted %q", test.name, err, test.wantErr)
+		}
+		if hits.Load() != test.hits {
+			t.Errorf("%s: got %d requests, wanted %d", test.name, hits.Load(), test.hits)
+		}
+	}
+}
+
+func TestConcurrencyLimit(t *testing.T) {
+	const limit = 2
+
+	var (
+		mu                sync.Mutex
+		inFlight, maxSeen int
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		inFlight++
+		maxSeen = max(maxSeen, inFlight)
+		mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+		fmt.Fprint(w, accountBody)
+	}))
+	defer server.Close()
+	f, err := firefly.New(server.Client(), firefly.Config{Token: "token", URL: server.URL, MaxConcurrentRequests: limit})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	var wg sync.WaitGroup
+	for range 3 * limit {
+		wg.Go(func() {
+			_, err := f.FetchAccount(t.Context(), "3")
+			if err != nil {
+				t.Errorf("Unexpected error: %s", err)
+			}
+		})
+	}
+	wg.Wait()
+	if maxSeen > limit {
+		t.Errorf("Got %d concurrent requests, wanted at most %d", maxSeen, limit)
+	}
+}
@@ -0,0 +1,98 @@
+package firefly
+
+import (
+	"context"
+	"errors"
+	"log"
+	"slices"
+	"strings"
+
+	"github.com/shopspring/decimal"
+)
+
+// ExchangeRates converts amounts into the primary currency.
+type ExchangeRates interface {
+	// Rate returns the value of one unit of the currency in the primary
+	// currency.
+	Rate(ctx context.Context, currencyCode string) (decimal.Decimal, error)
+}
+
+// CurrencyTotal is the part of a total in one currency, before it is
+// converted into the primary currency.
+type CurrencyTotal struct {
+	CurrencyCode string          `json:"currency_code"`
+	Spent        decimal.Decimal `json:"spent"`
+	Earned       decimal.Decimal `json:"earned"`
+}
+
+// ErrNoExchangeRate is returned by ExchangeRates if there is no rate for a
+// currency.
+var ErrNoExchangeRate = errors.New("no exchange rate")
+
+// toPrimary converts an amount in the currency into the primary currency,
+// for adding it to a sum in *sumCurrency. If no primary currency is
+// configured, amounts are not converted, and the currency of the sum is set
+// by the first amount, so that amounts in different currencies are never
+// added together. An empty currency code is assumed to be the currency of the
+// sum.
+//
+// If the amount can't be added to the sum (it is in another currency and
+// there is no primary currency or no exchange rate), ok is false, and the
+// amount should be left out and its currency flagged with addUnconverted.
+func (f *Firefly) toPrimary(ctx context.Context, amount decimal.Decimal, currencyCode string, sumCurrency *string) (converted decimal.Decimal, ok bool) {
+	currencyCode = strings.ToUpper(currencyCode)
+	primary := f.config.PrimaryCurrency
+	if primary == "" {
+		if *sumCurrency == "" {
+			*sumCurrency = currencyCode
+		}
+		return amount, currencyCode == "" || currencyCode == *sumCurrency
+	}
+
+	*sumCurrency = primary
+	if currencyCode == "" || currencyCode == primary {
+		return amount, true
+	}
+	if f.config.ExchangeRates == nil {
+		return decimal.Zero, false
+	}
+	rate, err := f.config.ExchangeRates.Rate(ctx, currencyCode)
+	if err != nil {
+		if !errors.Is(err, ErrNoExchangeRate) {
+			log.Printf("Could not convert %s into %s: %s", currencyCode, primary, err)
+		}
+		return decimal.Zero, false
+	}
+	return amount.Mul(rate), true
+}
+
+// addUnconverted adds a currency code to a sorted list of the currencies whose
+// amounts were left out of a sum, unless it is already listed.
+func addUnconverted(codes []string, currencyCode string) []string {
+	currencyCode = strings.ToUpper(currencyCode)
+	i, found := slices.BinarySearch(codes, currencyCode)
+	if found {
+		return codes
+	}
+	return slices.Insert(codes, i, currencyCode)
+}
+
+// ExchangeRatesChanged clears the cached totals, which were converted into
+// the primary currency with the previous exchange rates. Totals that are
+// being fetched while the rates change are fetched again, instead of being
+// cached with the previous rates.
+func (f *Firefly) ExchangeRatesChanged() {
+	f.cache.mu.Lock()
+	defer f.cache.mu.Unlock()
+	log.Print("Cache: clearing Category Totals and Big Picture for new exchange rates")
+
+	f.cache.ratesVersion++
+	f.cache.BigPicture = nil
+	for k := range f.cache.CategoryTotals {
+		delete(f.cache.updated, k)
+		delete(f.cache.stale, k)
+	}
+	f.cache.CategoryTotals = map[categoryTotalsKey][]CategoryTotal{}
+	delete(f.cache.updated, bigPictureEntry)
+	delete(f.cache.stale, bigPictureEntry)
+}
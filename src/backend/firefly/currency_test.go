@@ -0,0 +1,173 @@
+package firefly_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+
+	"github.com/davidschlachter/lychnos/src/backend/firefly"
+	"github.com/davidschlachter/lychnos/src/backend/firefly/fireflytest"
+)
+
+type testRates map[string]decimal.Decimal
+
+func (r testRates) Rate(ctx context.Context, currencyCode string) (decimal.Decimal, error) {
+	rate, ok := r[currencyCode]
+	if !ok {
+		return decimal.Zero, fmt.Errorf("%w for %s", firefly.ErrNoExchangeRate, currencyCode)
+	}
+	return rate, nil
+}
+
+func TestCurrencies(t *testing.T) {
+	const category = `{"type":"categories","id":"4","attributes":{"name":"Travel","spent":[{"sum":"-100.00","currency_code":"CAD"},{"sum":"-50.00","currency_code":"USD"}],"earned":[{"sum":"20.00","currency_code":"USD"}]}}`
+	stub := fireflytest.NewServer(t, map[string]http.HandlerFunc{
+		"/api/v1/categories/": func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/api/v1/categories/" {
+				fmt.Fprintf(w, `{"data":[%s]}`, category)
+			} else {
+				fmt.Fprintf(w, `{"data":%s}`, category)
+			}
+		},
+		"/api/v1/autocomplete/categories": func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`[{"id":"4","name":"Travel"}]`))
+		},
+		"/api/v1/accounts": func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"data":[{"type":"accounts","id":"3","attributes":{"active":true,"name":"Chequing","type":"asset","currency_code":"CAD","current_balance":"1000.00","include_net_worth":true}},{"type":"accounts","id":"5","attributes":{"active":true,"name":"US Chequing","type":"asset","currency_code":"USD","current_balance":"200.00","include_net_worth":true}}],"meta":{"pagination":{"total":2,"count":2,"per_page":2,"current_page":1,"total_pages":1}}}`))
+		},
+	})
+	newFirefly := func(primary string) *firefly.Firefly {
+		return stub.Firefly(t, firefly.Config{
+			PrimaryCurrency: primary,
+			ExchangeRates:   testRates{"USD": decimal.RequireFromString("1.4")},
+		})
+	}
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.Local)
+	end := time.Date(2025, 1, 31, 0, 0, 0, 0, time.Local)
+
+	// Totals are converted into the primary currency
+	f := newFirefly("CAD")
+	totals, err := f.ListCategoryTotals(t.Context(), start, end)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(totals) != 1 || totals[0].CurrencyCode != "CAD" || !totals[0].Spent.Equal(decimal.RequireFromString("-170")) || !totals[0].Earned.Equal(decimal.RequireFromString("28")) {
+		t.Fatalf("Got totals %+v, wanted -170 CAD spent and 28 CAD earned", totals)
+	}
+	if c := totals[0].Currencies; len(c) != 2 || c[1].CurrencyCode != "USD" || !c[1].Spent.Equal(decimal.RequireFromString("-50")) || !c[1].Earned.Equal(decimal.RequireFromString("20")) {
+		t.Fatalf("Got totals by currency %+v, wanted -50 USD spent and 20 USD earned", c)
+	}
+
+	w := httptest.NewRecorder()
+	f.HandleBigPicture(w, httptest.NewRequest(http.MethodGet, "/api/bigpicture/", nil))
+	var bp struct {
+		NetWorth        decimal.Decimal `json:"net_worth"`
+		Expenses3Months decimal.Decimal `json:"expenses_three_months"`
+		CurrencyCode    string          `json:"currency_code"`
+	}
+	json.NewDecoder(w.Body).Decode(&bp)
+	if w.Result().StatusCode != http.StatusOK || bp.CurrencyCode != "CAD" || !bp.NetWorth.Equal(decimal.RequireFromString("1280")) || !bp.Expenses3Months.Equal(decimal.RequireFromString("-142")) {
+		t.Fatalf("Status code = %d with big picture %+v, wanted a net worth of 1280 CAD and expenses of -142 CAD", w.Result().StatusCode, bp)
+	}
+
+	// Amounts without an exchange rate, or in another currency if there is no
+	// primary currency, are left out and flagged
+	f = newFirefly("EUR")
+	totals, err = f.ListCategoryTotals(t.Context(), start, end)
+	if err != nil || len(totals) != 1 || !totals[0].Spent.Equal(decimal.RequireFromString("-70")) || strings.Join(totals[0].Unconverted, ",") != "CAD" {
+		t.Fatalf("Got totals %+v and error %v, wanted -70 EUR spent without CAD", totals, err)
+	}
+	f = newFirefly("")
+	totals, err = f.ListCategoryTotals(t.Context(), start, end)
+	if err != nil || len(totals) != 1 || totals[0].CurrencyCode != "CAD" || !totals[0].Spent.Equal(decimal.RequireFromString("-100")) || !totals[0].Earned.IsZero() || strings.Join(totals[0].Unconverted, ",") != "USD" {
+		t.Fatalf("Got totals %+v and error %v, wanted -100 CAD spent without USD", totals, err)
+	}
+	w = httptest.NewRecorder()
+	f.HandleBigPicture(w, httptest.NewRequest(http.MethodGet, "/api/bigpicture/", nil))
+	var partial struct {
+		NetWorth        decimal.Decimal `json:"net_worth"`
+		Expenses3Months decimal.Decimal `json:"expenses_three_months"`
+		CurrencyCode    string          `json:"currency_code"`
+		Unconverted     []string        `json:"unconverted"`
+	}
+	json.NewDecoder(w.Body).Decode(&partial)
+	if w.Result().StatusCode != http.StatusOK || partial.CurrencyCode != "CAD" || !partial.NetWorth.Equal(decimal.RequireFromString("1000")) || !partial.Expenses3Months.Equal(decimal.RequireFromString("-100")) || strings.Join(partial.Unconverted, ",") != "USD" {
+		t.Fatalf("Status code = %d with big picture %+v, wanted a net worth of 1000 CAD and expenses of -100 CAD without USD", w.Result().StatusCode, partial)
+	}
+
+	// Foreign amounts are sent with their currency
+	f = newFirefly("CAD")
+	data := url.Values{
+		"date": {"2025-01-20"}, "amount": {"28,00"}, "description": {"Diner"}, "source_id": {"3"}, "destination_name": {"Diner"},
+		"currency_code": {"cad"}, "foreign_amount": {"20"}, "foreign_currency_code": {"usd"},
+	}
+	req := httptest.NewRequest(http.MethodPost, "/api/transactions/", strings.NewReader(data.Encode()))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	w = httptest.NewRecorder()
+	f.HandleTxn(w, req)
+	if w.Result().StatusCode != http.StatusFound {
+		t.Fatalf("Status code = %d, want %d. Response body: %s", w.Result().StatusCode, http.StatusFound, w.Body.String())
+	}
+	posted := stub.Posted()
+	for _, want := range []string{`"currency_code":"CAD"`, `"foreign_amount":"20"`, `"foreign_currency_code":"USD"`} {
+		if len(posted) != 1 || !strings.Contains(posted[0], want) {
+			t.Errorf("Created transactions %q, wanted one containing %s", posted, want)
+		}
+	}
+
+	data.Del("foreign_currency_code")
+	req = httptest.NewRequest(http.MethodPost, "/api/transactions/", strings.NewReader(data.Encode()))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	w = httptest.NewRecorder()
+	f.HandleTxn(w, req)
+	if w.Result().StatusCode != http.StatusBadRequest {
+		t.Fatalf("Status code = %d for a foreign amount without a currency, want %d", w.Result().StatusCode, http.StatusBadRequest)
+	}
+}
+
+// changingRates changes the rate of USD the first time it is requested, as if
+// it were updated while totals were being fetched.
+type changingRates struct {
+	f       *firefly.Firefly
+	changed bool
+}
+
+func (r *changingRates) Rate(ctx context.Context, currencyCode string) (decimal.Decimal, error) {
+	if !r.changed {
+		r.changed = true
+		r.f.ExchangeRatesChanged()
+		return decimal.RequireFromString("1.3"), nil
+	}
+	return decimal.RequireFromString("1.4"), nil
+}
+
+func TestExchangeRatesChanged(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/categories/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"data":[{"type":"categories","id":"4","attributes":{"name":"Travel","spent":[{"sum":"-50.00","currency_code":"USD"}],"earned":[]}}]}`))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	rates := &changingRates{}
+	f, err := firefly.New(server.Client(), firefly.Config{Token: "token", URL: server.URL, PrimaryCurrency: "CAD", ExchangeRates: rates})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	rates.f = f
+
+	// Totals fetched with the previous rate are fetched again
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.Local)
+	end := time.Date(2025, 1, 31, 0, 0, 0, 0, time.Local)
+	totals, err := f.CachedListCategoryTotals(t.Context(), start, end)
+	if err != nil || len(totals) != 1 || !totals[0].Spent.Equal(decimal.RequireFromString("-70")) {
+		t.Fatalf("Got totals %+v and error %v, wanted -70 CAD spent", totals, err)
+	}
+}
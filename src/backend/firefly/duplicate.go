@@ -0,0 +1,138 @@
+package firefly
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	defaultDuplicateWindowDays = 3
+	defaultDuplicateSimilarity = 0.8
+)
+
+// DuplicateError is returned when creating a transaction that looks like a
+// recent one, e.g. when the same purchase is entered twice. The transaction can
+// still be created by forcing it.
+type DuplicateError struct {
+	Existing Transactions `json:"duplicate"`
+}
+
+func (e *DuplicateError) Error() string {
+	return fmt.Sprintf("transaction looks like a duplicate of transaction %s, set force=true to create it anyway", e.Existing.ID)
+}
+
+// SendDuplicate responds with 409 Conflict if err is a *DuplicateError,
+// including the existing transaction as "duplicate", and reports whether it
+// did.
+func SendDuplicate(w http.ResponseWriter, err error) bool {
+	var dup *DuplicateError
+	if !errors.As(err, &dup) {
+		return false
+	}
+	log.Printf("Error (status %d): %s", http.StatusConflict, err)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusConflict)
+	json.NewEncoder(w).Encode(struct {
+		Error string `json:"error"`
+		*DuplicateError
+	}{err.Error(), dup})
+	return true
+}
+
+// findNearDuplicate looks through the transactions near the date of t for one
+// with the same amount and account, and a similar description. If there is
+// none, nil is returned. The transactions are fetched from Firefly-III rather
+// than cached, since each date would add an entry to the cache.
+func (f *Firefly) findNearDuplicate(ctx context.Context, t Transaction) (*DuplicateError, error) {
+	window := *f.config.DuplicateWindowDays
+	if window < 0 {
+		return nil, nil
+	}
+	date, err := time.Parse(fireflyAPIDateFormat, t.Date)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse date '%s': %s", t.Date, err)
+	}
+	key := transactionsKey{
+		Start: date.AddDate(0, 0, -window).Format(inputDateFormat),
+		End:   date.AddDate(0, 0, window).Format(inputDateFormat),
+	}
+	txns, err := f.ListTransactions(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	src, dest := f.accounts(ctx, t)
+	for _, existing := range txns {
+		for _, s := range existing.Attributes.Transactions {
+			if s.Amount.Equal(t.Amount) && sharesAccount(s, src, dest) && similarity(s.Description, t.Description) >= f.config.DuplicateSimilarity {
+				return &DuplicateError{Existing: existing}, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// account identifies an account by its ID, or by its name if the account
+// doesn't exist yet, since Firefly-III creates expense and revenue accounts
+// by name.
+type account struct {
+	id, name string
+}
+
+// accounts resolves the source and destination accounts of t.
+func (f *Firefly) accounts(ctx context.Context, t Transaction) (src, dest account) {
+	src.id, src.name = f.resolveAccount(ctx, t.SourceID, t.SourceName)
+	dest.id, dest.name = f.resolveAccount(ctx, t.DestinationID, t.DestinationName)
+	return src, dest
+}
+
+// sharesAccount returns true if either account of s is src or dest.
+func sharesAccount(s Transaction, src, dest account) bool {
+	for _, a := range []account{src, dest} {
+		if a.id != "" {
+			if s.SourceID == a.id || s.DestinationID == a.id {
+				return true
+			}
+		} else if a.name != "" && (strings.EqualFold(s.SourceName, a.name) || strings.EqualFold(s.DestinationName, a.name)) {
+			return true
+		}
+	}
+	return false
+}
+
+// similarity compares two descriptions, ignoring case and surrounding spaces,
+// returning 1 if they are the same and 0 if they have nothing in common. It is
+// based on the edit distance between them.
+func similarity(a, b string) float64 {
+	ra := []rune(strings.ToLower(strings.TrimSpace(a)))
+	rb := []rune(strings.ToLower(strings.TrimSpace(b)))
+	longest := max(len(ra), len(rb))
+	if longest == 0 {
+		return 1
+	}
+
+	// Levenshtein distance, keeping only the previous row
+	prev := make([]int, len(rb)+1)
+	curr := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		curr[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			curr[j] = min(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return 1 - float64(prev[len(rb)])/float64(longest)
+}
@@ -0,0 +1,97 @@
+package firefly_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/davidschlachter/lychnos/src/backend/firefly"
+	"github.com/davidschlachter/lychnos/src/backend/firefly/fireflytest"
+)
+
+func TestDuplicateDetection(t *testing.T) {
+	stub := fireflytest.NewServer(t, map[string]http.HandlerFunc{
+		"/api/v1/transactions": func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == "GET" {
+				// The existing transaction is on 2022-01-02
+				if q := r.URL.Query(); q.Get("start") > "2022-01-02" || q.Get("end") < "2022-01-02" {
+					w.Write([]byte(fireflytest.EmptyList))
+					return
+				}
+				w.Write([]byte(`{"data":[{"type":"transactions","id":"2800","attributes":{"transactions":[{"type":"withdrawal","date":"2022-01-02T08:00:00-05:00","amount":"4.50","description":"Coffee Shop","source_id":"3","source_name":"Chequing","destination_id":"529","destination_name":"Coffee Shop"}]}}],"meta":{"pagination":{"total":1,"count":1,"per_page":50,"current_page":1,"total_pages":1}}}`))
+				return
+			}
+			w.Write([]byte(`{"data":{"type":"transactions","id":"2801","attributes":{"transactions":[]}}}`))
+		},
+	})
+
+	tests := []struct {
+		name        string
+		description string
+		amount      string
+		date        string
+		force       bool
+		window      *int
+		want        int
+	}{
+		{name: "duplicate", description: "coffee shop ", amount: "4.5", date: "2022-01-05", want: http.StatusConflict},
+		{name: "similar description", description: "Coffee Shoppe", amount: "4.50", date: "2022-01-01", want: http.StatusConflict},
+		{name: "forced", description: "Coffee Shop", amount: "4.50", date: "2022-01-03", force: true, want: http.StatusFound},
+		{name: "different description", description: "Groceries", amount: "4.50", date: "2022-01-03", want: http.StatusFound},
+		{name: "different amount", description: "Coffee Shop", amount: "5.50", date: "2022-01-03", want: http.StatusFound},
+		{name: "outside the window", description: "Coffee Shop", amount: "4.50", date: "2022-01-06", want: http.StatusFound},
+		{name: "narrower window", description: "Coffee Shop", amount: "4.50", date: "2022-01-04", window: new(1), want: http.StatusFound},
+		{name: "same day", description: "Coffee Shop", amount: "4.50", date: "2022-01-02", window: new(0), want: http.StatusConflict},
+		{name: "next day", description: "Coffee Shop", amount: "4.50", date: "2022-01-03", window: new(0), want: http.StatusFound},
+		{name: "disabled", description: "Coffee Shop", amount: "4.50", date: "2022-01-03", window: new(-1), want: http.StatusFound},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := stub.Firefly(t, firefly.Config{DuplicateWindowDays: test.window})
+
+			data := url.Values{}
+			data.Set("date", test.date)
+			data.Set("amount", test.amount)
+			data.Set("description", test.description)
+			data.Set("source_id", "3")
+			data.Set("destination_name", "Coffee Shop")
+			target := "/api/transactions/"
+			if test.force {
+				target += "?force=true"
+			}
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, target, strings.NewReader(data.Encode()))
+			req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+			f.HandleTxn(w, req)
+
+			if w.Result().StatusCode != test.want {
+				t.Fatalf("Status code = %d, want %d. Response body: %s", w.Result().StatusCode, test.want, w.Body.String())
+			}
+			if test.want != http.StatusConflict {
+				return
+			}
+			var resp struct {
+				Error     string               `json:"error"`
+				Duplicate firefly.Transactions `json:"duplicate"`
+			}
+			err := json.NewDecoder(w.Body).Decode(&resp)
+			if err != nil || resp.Duplicate.ID != "2800" || resp.Error == "" {
+				t.Fatalf("Got response %+v and error %v, wanted transaction 2800 as the duplicate", resp, err)
+			}
+
+			// The transactions near the date are not cached
+			w = httptest.NewRecorder()
+			f.HandleCache(w, httptest.NewRequest(http.MethodGet, "/api/cache", nil))
+			var families []firefly.CacheFamily
+			json.NewDecoder(w.Body).Decode(&families)
+			for _, fam := range families {
+				if fam.Name == "transactions" && fam.Entries != 0 {
+					t.Errorf("Got %d cached transactions lists, wanted none", fam.Entries)
+				}
+			}
+		})
+	}
+}
@@ -4,6 +4,10 @@ package firefly
 import (
 	"fmt"
 	"net/http"
+	"time"
+
+	"github.com/davidschlachter/lychnos/src/backend/budget"
+	"github.com/davidschlachter/lychnos/src/backend/interval"
 )
 
 type Config struct {
@@ -19,24 +23,86 @@ type Config struct {
 	// AutocompleteIgnoredCategories is a set of category IDs that will be
 	// ignored when listing categories.
 	AutocompleteIgnoredCategories map[int]struct{}
+	// IntervalAnchor is the date on which weekly and bi-weekly reporting
+	// intervals begin, e.g. a pay date. If unset, these intervals begin on the
+	// start date of the budget.
+	IntervalAnchor time.Time
+	// WebhookSecrets are the secrets of the Firefly-III webhooks that notify
+	// lychnos of changes to transactions (Firefly-III generates a secret for
+	// each webhook). If unset, webhooks are rejected and the caches must be
+	// refreshed by polling.
+	WebhookSecrets []string
+
+	// MaxRetries is the number of times that a failed request to Firefly-III
+	// is retried, with a backoff starting at RetryBackoff and doubling after
+	// each attempt. MaxConcurrentRequests limits the number of requests to
+	// Firefly-III at once. If unset, defaults are used (set MaxRetries to a
+	// negative value to disable retries).
+	MaxRetries            int
+	RetryBackoff          time.Duration
+	MaxConcurrentRequests int
+
+	// DuplicateWindowDays is how many days apart a new transaction may be
+	// from an existing one with the same amount and account to be considered
+	// a duplicate, and DuplicateSimilarity is how similar (from 0 to 1) their
+	// descriptions must be. If unset, defaults are used (set
+	// DuplicateWindowDays to 0 to only compare transactions on the same day,
+	// or to a negative value to disable duplicate detection).
+	DuplicateWindowDays *int
+	DuplicateSimilarity float64
+
+	// Categorizer assigns categories to new transactions that are created
+	// without one. If unset, a category must always be provided.
+	Categorizer Categorizer
+
+	// PrimaryCurrency is the code of the currency (e.g. CAD) that totals are
+	// converted into with ExchangeRates. If unset, amounts are not converted,
+	// and totals of amounts in several currencies can't be calculated.
+	PrimaryCurrency string
+	ExchangeRates   ExchangeRates
 }
 
 type Firefly struct {
-	client *http.Client
-	config Config
-	cache  Cache
+	client  *http.Client
+	config  Config
+	cache   Cache
+	limiter chan struct{}
+
+	suggestions suggestIndex
 }
 
 func New(client *http.Client, c Config) (*Firefly, error) {
 	if len(c.Token) == 0 || len(c.URL) == 0 || client == nil {
 		return nil, fmt.Errorf("must provide valid client, token and url")
 	}
+	if c.MaxRetries == 0 {
+		c.MaxRetries = defaultMaxRetries
+	}
+	if c.RetryBackoff == 0 {
+		c.RetryBackoff = defaultRetryBackoff
+	}
+	if c.MaxConcurrentRequests == 0 {
+		c.MaxConcurrentRequests = defaultMaxConcurrentRequests
+	}
+	if c.DuplicateWindowDays == nil {
+		c.DuplicateWindowDays = new(defaultDuplicateWindowDays)
+	}
+	if c.DuplicateSimilarity == 0 {
+		c.DuplicateSimilarity = defaultDuplicateSimilarity
+	}
 	return &Firefly{
-		client: client,
-		config: c,
+		client:  client,
+		config:  c,
+		limiter: make(chan struct{}, c.MaxConcurrentRequests),
 	}, nil
 }
 
+// Intervals returns the reporting intervals of the budget, up to the current
+// time.
+func (f *Firefly) Intervals(bgt budget.Budget) ([]interval.ReportingInterval, error) {
+	return interval.Get(bgt.ReportingInterval, bgt.Start, bgt.End, f.config.IntervalAnchor, time.Now().Local().Location())
+}
+
 type meta struct {
 	Pagination pagination `json:"pagination"`
 }
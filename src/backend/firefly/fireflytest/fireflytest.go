@@ -0,0 +1,89 @@
+// Package fireflytest provides a stub Firefly-III server for tests.
+package fireflytest
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/davidschlachter/lychnos/src/backend/firefly"
+)
+
+const (
+	// Accounts lists a single asset account, Chequing, with ID 3.
+	Accounts = `{"data":[{"type":"accounts","id":"3","attributes":{"active":true,"name":"Chequing","type":"asset","current_balance":"100.00"}}],"meta":{"pagination":{"total":1,"count":1,"per_page":1,"current_page":1,"total_pages":1}}}`
+	// EmptyList is a list of transactions without any.
+	EmptyList = `{"data":[],"meta":{"pagination":{"total":0,"count":0,"per_page":50,"current_page":1,"total_pages":1}}}`
+	// Created is the response to creating a transaction, with ID 2774.
+	Created = `{"data":{"type":"transactions","id":"2774","attributes":{"transactions":[]}}}`
+)
+
+// Server is a stub Firefly-III server.
+type Server struct {
+	*httptest.Server
+
+	mu     sync.Mutex
+	posted []string
+}
+
+// NewServer starts a server with the Accounts, which lists no transactions and
+// records the bodies of the transactions created on it. The handlers are
+// added to these endpoints by pattern, replacing them if the pattern is the
+// same. The server is closed when the test ends.
+func NewServer(t testing.TB, handlers map[string]http.HandlerFunc) *Server {
+	s := &Server{}
+	defaults := map[string]http.HandlerFunc{
+		"/api/v1/accounts": func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(Accounts))
+		},
+		"/api/v1/transactions": func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == "GET" {
+				w.Write([]byte(EmptyList))
+				return
+			}
+			s.Record(r)
+			w.Write([]byte(Created))
+		},
+	}
+	mux := http.NewServeMux()
+	for pattern, h := range defaults {
+		if _, ok := handlers[pattern]; !ok {
+			mux.HandleFunc(pattern, h)
+		}
+	}
+	for pattern, h := range handlers {
+		mux.HandleFunc(pattern, h)
+	}
+	s.Server = httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+	return s
+}
+
+// Record records the body of a request that creates or updates a
+// transaction.
+func (s *Server) Record(r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	s.mu.Lock()
+	s.posted = append(s.posted, string(body))
+	s.mu.Unlock()
+}
+
+// Posted returns the recorded bodies, in order.
+func (s *Server) Posted() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.posted...)
+}
+
+// Firefly returns a client for the server, with the config's token and URL
+// set.
+func (s *Server) Firefly(t testing.TB, config firefly.Config) *firefly.Firefly {
+	config.Token, config.URL = "token", s.URL
+	f, err := firefly.New(s.Client(), config)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	return f
+}
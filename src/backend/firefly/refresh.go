@@ -0,0 +1,136 @@
+package firefly
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// refreshWorkers is the number of background refreshes that may run at once,
+// so that refreshing many cache entries doesn't overwhelm Firefly-III.
+const refreshWorkers = 4
+
+// refreshTimeout limits how long a fetch of a cache entry may take, including
+// retries, when it isn't bound to a single request.
+const refreshTimeout = 2 * time.Minute
+
+// inflightFetch is a fetch of a cache entry that other callers can wait for.
+type inflightFetch struct {
+	done    chan struct{}
+	err     error
+	waiters int
+	cancel  context.CancelFunc
+}
+
+// coalesce runs refresh to fetch a missing cache entry, unless the entry is
+// already being fetched, in which case it waits for that fetch instead. This
+// way, concurrent callers share a single request to Firefly-III. The fetch is
+// cancelled if every caller's context is cancelled before it completes. The
+// caller must lock the mutex, which is unlocked when coalesce returns.
+func (f *Firefly) coalesce(ctx context.Context, key any, refresh func(context.Context) error) error {
+	c, ok := f.cache.inflight[key]
+	if !ok {
+		if f.cache.inflight == nil {
+			f.cache.inflight = make(map[any]*inflightFetch)
+		}
+		// The fetch is shared, so it must not end with the context of the
+		// caller that happened to start it.
+		fetchCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), refreshTimeout)
+		c = &inflightFetch{done: make(chan struct{}), cancel: cancel}
+		f.cache.inflight[key] = c
+		go func() {
+			err := refresh(fetchCtx)
+			cancel()
+			f.cache.mu.Lock()
+			c.err = err
+			if f.cache.inflight[key] == c {
+				delete(f.cache.inflight, key)
+			}
+			f.cache.mu.Unlock()
+			close(c.done)
+		}()
+	}
+	c.waiters++
+	f.cache.mu.Unlock()
+
+	select {
+	case <-c.done:
+		return c.err
+	case <-ctx.Done():
+		f.cache.mu.Lock()
+		c.waiters--
+		if c.waiters == 0 {
+			c.cancel()
+			if f.cache.inflight[key] == c {
+				delete(f.cache.inflight, key)
+			}
+		}
+		f.cache.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+type refreshJob struct {
+	key     any
+	refresh func(context.Context) error
+}
+
+// refreshPool runs background refreshes of the cache on a fixed number of
+// workers, each with a deadline. Refreshes of an entry that is already queued
+// are skipped.
+type refreshPool struct {
+	once   sync.Once
+	mu     sync.Mutex
+	cond   *sync.Cond
+	queue  []refreshJob
+	queued map[any]struct{}
+}
+
+// add queues a refresh of the entry with the provided key. A nil key is never
+// skipped as a duplicate.
+func (p *refreshPool) add(key any, refresh func(context.Context) error) {
+	p.once.Do(p.start)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if key != nil {
+		if _, ok := p.queued[key]; ok {
+			return
+		}
+		p.queued[key] = struct{}{}
+	}
+	p.queue = append(p.queue, refreshJob{key: key, refresh: refresh})
+	p.cond.Signal()
+}
+
+func (p *refreshPool) start() {
+	p.cond = sync.NewCond(&p.mu)
+	p.queued = make(map[any]struct{})
+	for range refreshWorkers {
+		go p.work()
+	}
+}
+
+func (p *refreshPool) work() {
+	for {
+		p.mu.Lock()
+		for len(p.queue) == 0 {
+			p.cond.Wait()
+		}
+		j := p.queue[0]
+		p.queue = p.queue[1:]
+		if j.key != nil {
+			delete(p.queued, j.key)
+		}
+		p.mu.Unlock()
+
+		ctx, cancel := context.WithTimeout(context.Background(), refreshTimeout)
+		err := j.refresh(ctx)
+		cancel()
+		if err != nil && j.key != nil {
+			log.Printf("Cache: failed to refresh %v: %s", j.key, err)
+		} else if err != nil {
+			log.Printf("Cache: failed to refresh: %s", err)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package firefly
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/shopspring/decimal"
+)
+
+// Transaction types that transactions can be filtered by.
+var transactionTypes = map[string]struct{}{"withdrawal": {}, "deposit": {}, "transfer": {}}
+
+// searchQuery builds a Firefly-III search query from the filter parameters of
+// GET /api/transactions/, or returns an empty query if there are no filters.
+// The query is normalized, so that equivalent filters share a cache entry:
+// the operators are always in the same order, and the description is
+// lowercased, since Firefly-III ignores its case.
+//
+// The filters are category_id, account_id (either the source or destination),
+// type, min_amount and max_amount (inclusive), description (text that the
+// description contains) and tag (which may be repeated, and all must match).
+func (f *Firefly) searchQuery(ctx context.Context, params url.Values) (string, error) {
+	var ops []string
+
+	if s := strings.TrimSpace(params.Get("category_id")); s != "" {
+		id, err := strconv.Atoi(s)
+		if err != nil {
+			return "", fmt.Errorf("Could not parse category_id: %s", s)
+		}
+		// Firefly-III searches categories by name
+		cats, err := f.CachedCategories(ctx)
+		if err != nil {
+			return "", err
+		}
+		var name string
+		for _, c := range cats {
+			if c.ID == id {
+				name = c.Name
+				break
+			}
+		}
+		if name == "" {
+			return "", fmt.Errorf("Could not find Category with ID = '%d'", id)
+		}
+		ops = append(ops, fmt.Sprintf("category_is:%s", quoteSearch(name)))
+	}
+
+	if s := strings.TrimSpace(params.Get("account_id")); s != "" {
+		if _, err := strconv.Atoi(s); err != nil {
+			return "", fmt.Errorf("Could not parse account_id: %s", s)
+		}
+		ops = append(ops, "account_id:"+s)
+	}
+
+	if s := strings.ToLower(strings.TrimSpace(params.Get("type"))); s != "" {
+		if _, ok := transactionTypes[s]; !ok {
+			return "", fmt.Errorf("type must be withdrawal, deposit or transfer, got '%s'", s)
+		}
+		ops = append(ops, "type:"+s)
+	}
+
+	var amounts [2]decimal.NullDecimal
+	for i, name := range []string{"min_amount", "max_amount"} {
+		s := strings.TrimSpace(params.Get(name))
+		if s == "" {
+			continue
+		}
+		amt, err := decimal.NewFromString(s)
+		if err != nil {
+			return "", fmt.Errorf("Could not parse %s: %s", name, s)
+		}
+		amounts[i] = decimal.NewNullDecimal(amt.Abs())
+	}
+	if amounts[0].Valid && amounts[1].Valid && amounts[0].Decimal.GreaterThan(amounts[1].Decimal) {
+		return "", fmt.Errorf("min_amount must not be greater than max_amount")
+	}
+	if amounts[0].Valid {
+		ops = append(ops, "amount_more:"+amounts[0].Decimal.String())
+	}
+	if amounts[1].Valid {
+		ops = append(ops, "amount_less:"+amounts[1].Decimal.String())
+	}
+
+	if s := normalizeDescription(params.Get("description")); s != "" {
+		ops = append(ops, fmt.Sprintf("description_contains:%s", quoteSearch(s)))
+	}
+
+	var tags []string
+	seen := make(map[string]struct{})
+	for _, tag := range params["tag"] {
+		tag = strings.TrimSpace(tag)
+		if _, ok := seen[tag]; ok || tag == "" {
+			continue
+		}
+		seen[tag] = struct{}{}
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	for _, tag := range tags {
+		ops = append(ops, fmt.Sprintf("tag_is:%s", quoteSearch(tag)))
+	}
+
+	return strings.Join(ops, " "), nil
+}
+
+// quoteSearch quotes a value of a search operator. Firefly-III doesn't support
+// escaping quotes, so they are removed.
+func quoteSearch(s string) string {
+	return `"` + strings.ReplaceAll(s, `"`, "") + `"`
+}
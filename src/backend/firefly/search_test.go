@@ -0,0 +1,107 @@
+package firefly_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/davidschlachter/lychnos/src/backend/firefly"
+)
+
+func TestListTransactionsFiltered(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		queries []string
+	)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/autocomplete/categories", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[{"id":"5","name":"Dining"}]`))
+	})
+	mux.HandleFunc("/api/v1/search/transactions", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		queries = append(queries, r.URL.Query().Get("query"))
+		mu.Unlock()
+		w.Write([]byte(`{"data":[{"type":"transactions","id":"2770","attributes":{"transactions":[{"type":"withdrawal","date":"2025-02-14T00:00:00-05:00","amount":"64.10","description":"Costco","source_id":"3","destination_name":"Costco","category_id":"5","category_name":"Dining","tags":["vacation"]}]}}],"meta":{"pagination":{"total":1,"count":1,"per_page":50,"current_page":1,"total_pages":1}}}`))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	f, err := firefly.New(server.Client(), firefly.Config{Token: "token", URL: server.URL})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	// Equivalent filters share a cache entry
+	for _, path := range []string{
+		"/api/transactions/?start=2025-01-01&end=2025-03-31&category_id=5&min_amount=50&description=Costco%20%20Wholesale&tag=vacation&tag=work&type=withdrawal&account_id=3",
+		"/api/transactions/?tag=work&tag=vacation&tag=work&type=Withdrawal&account_id=3&description=costco+wholesale&min_amount=50.00&category_id=5&start=2025-01-01&end=2025-03-31",
+	} {
+		w := httptest.NewRecorder()
+		f.HandleTxn(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Result().StatusCode != http.StatusOK {
+			t.Fatalf("Status code = %d for %s, want %d. Response body: %s", w.Result().StatusCode, path, http.StatusOK, w.Body.String())
+		}
+		var txns []firefly.Transactions
+		json.NewDecoder(w.Body).Decode(&txns)
+		if len(txns) != 1 || txns[0].ID != "2770" {
+			t.Fatalf("Got transactions %+v for %s, wanted 2770", txns, path)
+		}
+	}
+	want := `category_is:"Dining" account_id:3 type:withdrawal amount_more:50 description_contains:"costco wholesale" tag_is:"vacation" tag_is:"work" date_after:2025-01-01 date_before:2025-03-31`
+	if len(queries) != 1 || queries[0] != want {
+		t.Fatalf("Got search queries %q, wanted only %q", queries, want)
+	}
+
+	// Without dates, filtered transactions are paginated like all transactions
+	w := httptest.NewRecorder()
+	f.HandleTxn(w, httptest.NewRequest(http.MethodGet, "/api/transactions/?description=costco&max_amount=100", nil))
+	if w.Result().StatusCode != http.StatusOK || len(queries) != 2 || queries[1] != `amount_less:100 description_contains:"costco"` {
+		t.Fatalf("Status code = %d with search queries %q, wanted %d and a search for costco", w.Result().StatusCode, queries, http.StatusOK)
+	}
+
+	// Only the most recent searches are cached, and none are kept in
+	// snapshots
+	for i := range 60 {
+		w := httptest.NewRecorder()
+		f.HandleTxn(w, httptest.NewRequest(http.MethodGet, fmt.Sprintf("/api/transactions/?start=2025-01-01&end=2025-03-31&description=store%d", i), nil))
+		if w.Result().StatusCode != http.StatusOK {
+			t.Fatalf("Status code = %d for search %d, want %d", w.Result().StatusCode, i, http.StatusOK)
+		}
+	}
+	for _, i := range []int{59, 0} {
+		w := httptest.NewRecorder()
+		f.HandleTxn(w, httptest.NewRequest(http.MethodGet, fmt.Sprintf("/api/transactions/?start=2025-01-01&end=2025-03-31&description=store%d", i), nil))
+		if w.Result().StatusCode != http.StatusOK {
+			t.Fatalf("Status code = %d for search %d, want %d", w.Result().StatusCode, i, http.StatusOK)
+		}
+	}
+	if len(queries) != 63 || queries[62] != `description_contains:"store0" date_after:2025-01-01 date_before:2025-03-31` {
+		t.Fatalf("Got %d search queries, ending with %q, wanted the first search to be fetched again", len(queries), queries[len(queries)-1])
+	}
+	data, err := f.Snapshot()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if strings.Contains(string(data), "store") {
+		t.Errorf("Got searches in the snapshot %s", data)
+	}
+
+	// Invalid filters
+	for _, path := range []string{
+		"/api/transactions/?category_id=6",
+		"/api/transactions/?category_id=dining",
+		"/api/transactions/?account_id=chequing",
+		"/api/transactions/?type=refund",
+		"/api/transactions/?min_amount=lots",
+		"/api/transactions/?min_amount=100&max_amount=50",
+	} {
+		w := httptest.NewRecorder()
+		f.HandleTxn(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Result().StatusCode != http.StatusBadRequest {
+			t.Fatalf("Status code = %d for %s, want %d", w.Result().StatusCode, path, http.StatusBadRequest)
+		}
+	}
+}
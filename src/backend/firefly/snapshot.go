@@ -0,0 +1,191 @@
+package firefly
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// SnapshotVersion is the version of the cache snapshot format. Increment it
+// whenever the cached types change, so that older snapshots are discarded
+// instead of being restored incorrectly.
+const SnapshotVersion = 4
+
+// snapshot is a copy of the cache that can be saved and restored, e.g. to
+// serve the cache immediately after a restart.
+type snapshot struct {
+	Version        int                                                 `json:"version"`
+	SavedAt        time.Time                                           `json:"saved_at"`
+	Accounts       *snapshotEntry[cacheEntry, []Account]               `json:"accounts,omitempty"`
+	BigPicture     *snapshotEntry[cacheEntry, *bigPicture]             `json:"big_picture,omitempty"`
+	Categories     *snapshotEntry[cacheEntry, []Category]              `json:"categories,omitempty"`
+	CategoryTotals []snapshotEntry[snapshotTotalsKey, []CategoryTotal] `json:"category_totals"`
+	Transactions   []snapshotEntry[transactionsKey, []Transactions]    `json:"transactions"`
+}
+
+type snapshotEntry[K, V any] struct {
+	Key     K         `json:"key"`
+	Value   V         `json:"value"`
+	Updated time.Time `json:"updated"`
+}
+
+// snapshotTotalsKey is a categoryTotalsKey along with the name of the location
+// of its times, since the location is lost when encoding times as JSON and
+// keys must match exactly.
+type snapshotTotalsKey struct {
+	categoryTotalsKey
+	Location string `json:"location"`
+}
+
+func (k snapshotTotalsKey) key() categoryTotalsKey {
+	var loc *time.Location
+	switch k.Location {
+	case time.Local.String():
+		loc = time.Local
+	case "UTC":
+		loc = time.UTC
+	default:
+		loc, _ = time.LoadLocation(k.Location)
+	}
+	if loc != nil {
+		k.Start = k.Start.In(loc)
+		k.End = k.End.In(loc)
+	}
+	return k.categoryTotalsKey
+}
+
+// Snapshot encodes the current contents of the cache.
+func (f *Firefly) Snapshot() ([]byte, error) {
+	f.cache.mu.Lock()
+	defer f.cache.mu.Unlock()
+
+	s := snapshot{
+		Version: SnapshotVersion,
+		SavedAt: time.Now(),
+	}
+	// Empty slices mark entries that were invalidated, which must be
+	// refetched instead of restored.
+	if len(f.cache.Accounts) > 0 {
+		s.Accounts = &snapshotEntry[cacheEntry, []Account]{accountsEntry, f.cache.Accounts, f.cache.updated[accountsEntry]}
+	}
+	if f.cache.BigPicture != nil {
+		s.BigPicture = &snapshotEntry[cacheEntry, *bigPicture]{bigPictureEntry, f.cache.BigPicture, f.cache.updated[bigPictureEntry]}
+	}
+	if len(f.cache.Categories) > 0 {
+		s.Categories = &snapshotEntry[cacheEntry, []Category]{categoriesEntry, f.cache.Categories, f.cache.updated[categoriesEntry]}
+	}
+	for k, v := range f.cache.CategoryTotals {
+		key := snapshotTotalsKey{categoryTotalsKey: k, Location: k.Start.Location().String()}
+		s.CategoryTotals = append(s.CategoryTotals, snapshotEntry[snapshotTotalsKey, []CategoryTotal]{key, v, f.cache.updated[k]})
+	}
+	// Searches are left out, since they are rarely repeated after a restart
+	for k, v := range f.cache.Transactions {
+		if k.Query != "" {
+			continue
+		}
+		s.Transactions = append(s.Transactions, snapshotEntry[transactionsKey, []Transactions]{k, v, f.cache.updated[k]})
+	}
+
+	return json.Marshal(s)
+}
+
+// Restore replaces the contents of the cache with a snapshot. Restored entries
+// are served immediately, but are refreshed in the background when first used.
+// Snapshots of a different version are rejected.
+func (f *Firefly) Restore(data []byte) error {
+	var s snapshot
+	err := json.Unmarshal(data, &s)
+	if err != nil {
+		return fmt.Errorf("could not decode cache snapshot: %s", err)
+	}
+	if s.Version != SnapshotVersion {
+		return fmt.Errorf("got cache snapshot version %d, expected %d", s.Version, SnapshotVersion)
+	}
+
+	f.cache.mu.Lock()
+	defer f.cache.mu.Unlock()
+
+	f.cache.updated = make(map[any]time.Time)
+	f.cache.stale = make(map[any]struct{})
+	restore := func(key any, updated time.Time) {
+		f.cache.updated[key] = updated
+		f.cache.stale[key] = struct{}{}
+	}
+
+	f.cache.Accounts, f.cache.BigPicture, f.cache.Categories = nil, nil, nil
+	if s.Accounts != nil {
+		f.cache.Accounts = s.Accounts.Value
+		restore(accountsEntry, s.Accounts.Updated)
+	}
+	if s.BigPicture != nil {
+		f.cache.BigPicture = s.BigPicture.Value
+		restore(bigPictureEntry, s.BigPicture.Updated)
+	}
+	if s.Categories != nil {
+		f.cache.Categories = s.Categories.Value
+		restore(categoriesEntry, s.Categories.Updated)
+	}
+	f.cache.CategoryTotals = make(map[categoryTotalsKey][]CategoryTotal, len(s.CategoryTotals))
+	for _, e := range s.CategoryTotals {
+		k := e.Key.key()
+		f.cache.CategoryTotals[k] = e.Value
+		restore(k, e.Updated)
+	}
+	f.cache.Transactions = make(map[transactionsKey][]Transactions, len(s.Transactions))
+	for _, e := range s.Transactions {
+		f.cache.Transactions[e.Key] = e.Value
+		restore(e.Key, e.Updated)
+	}
+
+	log.Printf("Cache: restored snapshot saved at %s", s.SavedAt)
+	return nil
+}
+
+// age returns how long ago the oldest of the entries was fetched from
+// Firefly-III. The caller is responsible for locking the mutex.
+func (c *Cache) age(keys ...any) time.Duration {
+	var oldest time.Time
+	for _, k := range keys {
+		updated, ok := c.updated[k]
+		if ok && (oldest.IsZero() || updated.Before(oldest)) {
+			oldest = updated
+		}
+	}
+	if oldest.IsZero() {
+		return 0
+	}
+	return time.Since(oldest)
+}
+
+// CategoryTotalsAge returns how long ago the oldest cached category totals
+// between start and end were fetched from Firefly-III.
+func (f *Firefly) CategoryTotalsAge(start, end time.Time) time.Duration {
+	f.cache.mu.Lock()
+	defer f.cache.mu.Unlock()
+
+	var keys []any
+	for k := range f.cache.CategoryTotals {
+		if !k.Start.Before(start) && !k.End.After(end) {
+			keys = append(keys, k)
+		}
+	}
+	return f.cache.age(keys...)
+}
+
+// SetAgeHeader sets the Age header of the response to the age of cached data,
+// in seconds, so that clients can tell how stale the response may be.
+func SetAgeHeader(w http.ResponseWriter, age time.Duration) {
+	w.Header().Set("Age", strconv.Itoa(int(age.Seconds())))
+}
+
+// setCacheAge sets the Age header of the response to the age of the cache
+// entries.
+func (f *Firefly) setCacheAge(w http.ResponseWriter, keys ...any) {
+	f.cache.mu.Lock()
+	age := f.cache.age(keys...)
+	f.cache.mu.Unlock()
+	SetAgeHeader(w, age)
+}
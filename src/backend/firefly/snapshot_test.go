@@ -0,0 +1,55 @@
+package firefly_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/davidschlachter/lychnos/src/backend/firefly"
+)
+
+func TestSnapshot(t *testing.T) {
+	start := time.Date(2022, 1, 1, 0, 0, 0, 0, time.Local)
+	end := time.Date(2022, 1, 31, 23, 59, 59, 0, time.Local)
+	expected, err := f.CachedFetchCategoryTotals(t.Context(), 4, start, end)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	data, err := f.Snapshot()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	// Restored entries must be served without waiting for Firefly-III, which
+	// is unavailable here
+	unavailable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer unavailable.Close()
+	restored, err := firefly.New(unavailable.Client(), firefly.Config{Token: "token", URL: unavailable.URL})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	err = restored.Restore(data)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	c, err := restored.CachedFetchCategoryTotals(t.Context(), 4, start, end)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(c) != 1 || c[0].Category != expected[0].Category || !c[0].Spent.Equal(expected[0].Spent) || !c[0].Start.Equal(expected[0].Start) {
+		t.Errorf("Got restored totals %+v, wanted %+v", c, expected)
+	}
+	if age := restored.CategoryTotalsAge(start, end); age <= 0 {
+		t.Errorf("Got age %s for restored totals, wanted a positive age", age)
+	}
+
+	err = restored.Restore([]byte(strings.Replace(string(data), fmt.Sprintf(`"version":%d`, firefly.SnapshotVersion), `"version":0`, 1)))
+	if err == nil {
+		t.Errorf("Expected an error restoring a snapshot of a different version")
+	}
+}
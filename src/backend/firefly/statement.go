@@ -0,0 +1,223 @@
+package firefly
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// StatementEntry is a transaction parsed from a bank statement, before its
+// accounts and category are assigned. Amount is negative for withdrawals.
+type StatementEntry struct {
+	Date        time.Time
+	Amount      decimal.Decimal
+	Description string
+	Memo        string
+	// ExternalID identifies the entry across imports of the same statement,
+	// and should be used as the ExternalID of the created transaction.
+	ExternalID string
+}
+
+// ParseOFX parses the transactions of an OFX (or QFX) statement. Both OFX 1.x,
+// which is SGML and doesn't close its elements, and OFX 2.x, which is XML, are
+// supported: the closing tags of elements with values are simply ignored. The
+// FITID of each transaction is used as its external ID.
+func ParseOFX(r io.Reader) ([]StatementEntry, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	body := string(data)
+	start := strings.Index(strings.ToUpper(body), "<OFX>")
+	if start < 0 {
+		return nil, fmt.Errorf("no <OFX> element found")
+	}
+	body = body[start:]
+
+	var (
+		entries []StatementEntry
+		fields  map[string]string
+	)
+	for len(body) > 0 {
+		open := strings.IndexByte(body, '<')
+		if open < 0 {
+			break
+		}
+		end := strings.IndexByte(body[open:], '>')
+		if end < 0 {
+			return nil, fmt.Errorf("unterminated tag in statement")
+		}
+		tag := strings.ToUpper(strings.TrimSpace(body[open+1 : open+end]))
+		body = body[open+end+1:]
+		next := strings.IndexByte(body, '<')
+		if next < 0 {
+			next = len(body)
+		}
+		value := strings.TrimSpace(html.UnescapeString(body[:next]))
+
+		switch {
+		case tag == "STMTTRN":
+			fields = make(map[string]string)
+		case tag == "/STMTTRN":
+			if fields == nil {
+				return nil, fmt.Errorf("unexpected </STMTTRN> in statement")
+			}
+			e, err := ofxEntry(fields)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, e)
+			fields = nil
+		case fields != nil && value != "" && !strings.HasPrefix(tag, "/"):
+			fields[tag] = value
+		}
+	}
+	if fields != nil {
+		return nil, fmt.Errorf("unterminated <STMTTRN> in statement")
+	}
+	return entries, nil
+}
+
+func ofxEntry(fields map[string]string) (StatementEntry, error) {
+	e := StatementEntry{
+		Description: fields["NAME"],
+		Memo:        fields["MEMO"],
+		ExternalID:  fields["FITID"],
+	}
+	if e.Description == "" {
+		e.Description = e.Memo
+	}
+	if e.ExternalID == "" {
+		return e, fmt.Errorf("transaction '%s' has no FITID", e.Description)
+	}
+
+	// Dates are like 20250301120000.000[-5:EST], and only the day is kept.
+	date := fields["DTPOSTED"]
+	if len(date) < 8 {
+		return e, fmt.Errorf("could not parse date '%s' of transaction %s", date, e.ExternalID)
+	}
+	var err error
+	e.Date, err = time.Parse("20060102", date[:8])
+	if err != nil {
+		return e, fmt.Errorf("could not parse date '%s' of transaction %s", date, e.ExternalID)
+	}
+	// OFX allows a comma as the decimal separator
+	e.Amount, err = decimal.NewFromString(strings.Replace(fields["TRNAMT"], ",", ".", 1))
+	if err != nil {
+		return e, fmt.Errorf("could not parse amount '%s' of transaction %s", fields["TRNAMT"], e.ExternalID)
+	}
+	return e, nil
+}
+
+// ParseQIF parses the transactions of a QIF statement. QIF dates don't say
+// whether the day or month comes first, so dayFirst must be set for statements
+// with dates like DD/MM/YYYY. Likewise, decimalSeparator must be "," for
+// statements with amounts like 1.500,00, or "." otherwise.
+//
+// QIF has no transaction IDs, so the external ID is a hash of the date,
+// amount and payee, along with a count of identical entries before it, which
+// is the same each time the statement is imported.
+func ParseQIF(r io.Reader, dayFirst bool, decimalSeparator string) ([]StatementEntry, error) {
+	if decimalSeparator != "." && decimalSeparator != "," {
+		return nil, fmt.Errorf("decimal separator must be . or ,")
+	}
+	var (
+		entries []StatementEntry
+		e       StatementEntry
+		hasData bool
+		seen    = make(map[string]int)
+		line    int
+	)
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line++
+		text := strings.TrimSpace(s.Text())
+		if text == "" || strings.HasPrefix(text, "!") {
+			continue
+		}
+		value := strings.TrimSpace(text[1:])
+		var err error
+		switch text[0] {
+		case 'D':
+			e.Date, err = parseQIFDate(value, dayFirst)
+		case 'T', 'U':
+			e.Amount, err = ParseAmount(value, decimalSeparator)
+		case 'P':
+			e.Description = value
+		case 'M':
+			e.Memo = value
+		case '^':
+			if !hasData {
+				continue
+			}
+			if e.Date.IsZero() {
+				return nil, fmt.Errorf("line %d: transaction has no date", line)
+			}
+			if e.Description == "" {
+				e.Description = e.Memo
+			}
+			sum := sha256.Sum256([]byte(e.Date.Format(inputDateFormat) + "|" + e.Amount.String() + "|" + e.Description))
+			hash := hex.EncodeToString(sum[:8])
+			e.ExternalID = "qif-" + hash + "-" + strconv.Itoa(seen[hash])
+			seen[hash]++
+			entries = append(entries, e)
+			e, hasData = StatementEntry{}, false
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", line, err)
+		}
+		hasData = true
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	if hasData {
+		return nil, fmt.Errorf("line %d: unterminated transaction, expected ^", line)
+	}
+	return entries, nil
+}
+
+// parseQIFDate parses dates like 03/01/2025, 3/ 1'25 or 2025-03-01.
+func parseQIFDate(s string, dayFirst bool) (time.Time, error) {
+	fields := strings.FieldsFunc(strings.ReplaceAll(s, " ", ""), func(c rune) bool {
+		return c == '/' || c == '-' || c == '.' || c == '\''
+	})
+	if len(fields) != 3 {
+		return time.Time{}, fmt.Errorf("could not parse date '%s'", s)
+	}
+	var n [3]int
+	for i, f := range fields {
+		var err error
+		n[i], err = strconv.Atoi(f)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("could not parse date '%s'", s)
+		}
+	}
+
+	var year, month, day int
+	switch {
+	case len(fields[0]) == 4:
+		year, month, day = n[0], n[1], n[2]
+	case dayFirst:
+		day, month, year = n[0], n[1], n[2]
+	default:
+		month, day, year = n[0], n[1], n[2]
+	}
+	if year < 100 {
+		year += 2000
+	}
+	d := time.Date(year, time.Month(month), day, 0, 0, 0, 0, time.UTC)
+	if d.Month() != time.Month(month) || d.Day() != day {
+		return time.Time{}, fmt.Errorf("could not parse date '%s'", s)
+	}
+	return d, nil
+}
@@ -0,0 +1,124 @@
+package firefly_test
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+
+	"github.com/davidschlachter/lychnos/src/backend/firefly"
+)
+
+func TestParseStatements(t *testing.T) {
+	date := func(day int) time.Time { return time.Date(2025, 3, day, 0, 0, 0, 0, time.UTC) }
+	amount := func(s string) decimal.Decimal { return decimal.RequireFromString(s) }
+
+	tests := []struct {
+		file  string
+		parse func(f *os.File) ([]firefly.StatementEntry, error)
+		want  []firefly.StatementEntry
+	}{
+		{
+			file:  "testdata/statement-v1.ofx",
+			parse: func(f *os.File) ([]firefly.StatementEntry, error) { return firefly.ParseOFX(f) },
+			want: []firefly.StatementEntry{
+				{Date: date(1), Amount: amount("-42.10"), Description: "GROCERY STORE", Memo: "Point of sale", ExternalID: "90000010001"},
+				{Date: date(3), Amount: amount("1500"), Description: "PAYROLL & BENEFITS", ExternalID: "90000010002"},
+			},
+		},
+		{
+			file:  "testdata/statement-v2.ofx",
+			parse: func(f *os.File) ([]firefly.StatementEntry, error) { return firefly.ParseOFX(f) },
+			want: []firefly.StatementEntry{
+				{Date: date(2), Amount: amount("-12.99"), Description: "STREAMING SERVICE", Memo: "STREAMING SERVICE", ExternalID: "2025030200001"},
+				{Date: date(4), Amount: amount("5"), Description: "Café refund", ExternalID: "2025030400001"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			f, err := os.Open(tt.file)
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+			defer f.Close()
+			got, err := tt.parse(f)
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("Got %d entries, wanted %d: %+v", len(got), len(tt.want), got)
+			}
+			for i := range got {
+				if !got[i].Amount.Equal(tt.want[i].Amount) {
+					t.Errorf("Got amount %s for entry %d, wanted %s", got[i].Amount, i, tt.want[i].Amount)
+				}
+				got[i].Amount, tt.want[i].Amount = decimal.Decimal{}, decimal.Decimal{}
+				if !reflect.DeepEqual(got[i], tt.want[i]) {
+					t.Errorf("Got entry %+v, wanted %+v", got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestParseQIF(t *testing.T) {
+	f, err := os.Open("testdata/statement.qif")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer f.Close()
+	got, err := firefly.ParseQIF(f, false, ".")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(got) != 4 {
+		t.Fatalf("Got %d entries, wanted 4: %+v", len(got), got)
+	}
+	if !got[1].Date.Equal(time.Date(2025, 3, 3, 0, 0, 0, 0, time.UTC)) || !got[1].Amount.Equal(decimal.NewFromInt(1500)) || got[1].Description != "Payroll" {
+		t.Errorf("Got entry %+v, wanted a deposit of 1500 from Payroll on 2025-03-03", got[1])
+	}
+	if got[0].Memo != "Point of sale" || got[0].ExternalID == "" {
+		t.Errorf("Got entry %+v, wanted a memo and an external ID", got[0])
+	}
+	// Identical entries must still have distinct IDs
+	if got[2].ExternalID == got[3].ExternalID {
+		t.Errorf("Got the same external ID %s for two entries", got[2].ExternalID)
+	}
+
+	// The IDs must be the same when importing the statement again
+	f.Seek(0, 0)
+	again, err := firefly.ParseQIF(f, false, ".")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	for i := range got {
+		if got[i].ExternalID != again[i].ExternalID {
+			t.Errorf("Got external ID %s for entry %d on the second import, wanted %s", again[i].ExternalID, i, got[i].ExternalID)
+		}
+	}
+
+	// Dates may also put the day first
+	f.Seek(0, 0)
+	dayFirst, err := firefly.ParseQIF(f, true, ".")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !dayFirst[0].Date.Equal(time.Date(2025, 1, 3, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("Got date %s, wanted 2025-01-03", dayFirst[0].Date)
+	}
+
+	// Amounts may use a comma as the decimal separator
+	const qif = "!Type:Bank\nD03/01/2025\nT-1.212,50\nPRent\n^\n"
+	comma, err := firefly.ParseQIF(strings.NewReader(qif), false, ",")
+	if err != nil || len(comma) != 1 || !comma[0].Amount.Equal(decimal.RequireFromString("-1212.5")) {
+		t.Errorf("Got entries %+v and error %v, wanted -1212.50", comma, err)
+	}
+	if _, err := firefly.ParseQIF(strings.NewReader(qif), false, "'"); err == nil {
+		t.Errorf("Got no error for an invalid decimal separator")
+	}
+}
@@ -0,0 +1,306 @@
+package firefly
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/davidschlachter/lychnos/src/backend/httperror"
+	"github.com/shopspring/decimal"
+)
+
+const (
+	// suggestHistoryDays is how far back transactions are used for
+	// suggestions.
+	suggestHistoryDays = 365
+	// suggestHalfLifeDays is the age at which a transaction counts half as
+	// much as one from today.
+	suggestHalfLifeDays = 90
+	// suggestMinMatch is how closely a description must match the query to be
+	// used for suggestions, from 0 to 1.
+	suggestMinMatch = 0.7
+)
+
+// Suggestion is the most likely category, destination account and amount of
+// a new transaction, based on previous transactions with similar descriptions.
+// Fields are empty if there is no suggestion.
+type Suggestion struct {
+	Description     string          `json:"description"`
+	CategoryID      string          `json:"category_id"`
+	CategoryName    string          `json:"category_name"`
+	DestinationID   string          `json:"destination_id"`
+	DestinationName string          `json:"destination_name"`
+	Amount          decimal.Decimal `json:"amount"`
+	// Matches is the number of previous transactions that the suggestion is
+	// based on.
+	Matches int `json:"matches"`
+}
+
+// suggestIndex groups the transaction history by description, so that each
+// query only compares each distinct description once. It is rebuilt when the
+// cached history changes.
+type suggestIndex struct {
+	mu      sync.Mutex
+	key     transactionsKey
+	updated time.Time
+	groups  []suggestGroup
+}
+
+type suggestGroup struct {
+	// key is the normalized description
+	key         string
+	description string
+	latest      time.Time
+	count       int
+	// weight sums the recency weights of the transactions, and each map
+	// sums them by value.
+	weight       float64
+	categories   map[[2]string]float64
+	destinations map[[2]string]float64
+	amounts      map[string]float64
+}
+
+func normalizeDescription(s string) string {
+	return strings.Join(strings.Fields(strings.ToLower(s)), " ")
+}
+
+// suggestionsKey is the cache key of the transactions used for suggestions.
+func suggestionsKey(now time.Time) transactionsKey {
+	return transactionsKey{
+		Start: now.AddDate(0, 0, -suggestHistoryDays).Format(inputDateFormat),
+		End:   now.Format(inputDateFormat),
+	}
+}
+
+// refreshSuggestions fetches the history used for suggestions in the
+// background if it isn't cached, since it is large and suggestions are
+// requested as the user types. This should be called whenever it may have
+// been evicted.
+func (f *Firefly) refreshSuggestions() {
+	key := suggestionsKey(time.Now())
+	f.cache.mu.Lock()
+	_, ok := f.cache.Transactions[key]
+	if !ok {
+		f.evictOldSuggestions(key)
+	}
+	f.cache.mu.Unlock()
+	if !ok {
+		f.cache.refreshes.add(key, func(ctx context.Context) error { return f.refreshTransactions(ctx, key) })
+	}
+}
+
+// evictOldSuggestions evicts the history cached for suggestions on days other
+// than the one of key, which would otherwise never be used or evicted again.
+// The caller is responsible for locking the mutex.
+func (f *Firefly) evictOldSuggestions(key transactionsKey) {
+	for k := range f.cache.Transactions {
+		end, err := time.ParseInLocation(inputDateFormat, k.End, time.Local)
+		if err != nil || k == key || k != suggestionsKey(end) {
+			continue
+		}
+		log.Printf("Cache: evicting Transactions for key %d, %s, %s", k.Page, k.Start, k.End)
+		delete(f.cache.Transactions, k)
+		delete(f.cache.updated, k)
+		delete(f.cache.stale, k)
+	}
+}
+
+// HandleSuggest suggests the details of a new transaction from its
+// description, e.g. GET /api/suggest?description=coffee.
+func (f *Firefly) HandleSuggest(w http.ResponseWriter, req *http.Request) {
+	log.Printf("%s %s", req.Method, req.RequestURI)
+	if req.Method != "GET" {
+		w.WriteHeader(http.StatusNotImplemented)
+		fmt.Fprintf(w, "Unsupported method %s", req.Method)
+		return
+	}
+
+	description := req.URL.Query().Get("description")
+	if strings.TrimSpace(description) == "" {
+		httperror.Send(w, req, http.StatusBadRequest, "Must provide a description")
+		return
+	}
+	s, err := f.Suggest(req.Context(), description)
+	if err != nil {
+		httperror.Send(w, req, http.StatusInternalServerError, fmt.Sprintf("Could not suggest transaction details: %s", err))
+		return
+	}
+
+	f.setCacheAge(w, suggestionsKey(time.Now()))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s)
+}
+
+// Suggest ranks the categories, destination accounts and amounts of previous
+// transactions with descriptions like the provided one. Each transaction is
+// weighted by how closely its description matches and by how recent it is, so
+// that frequent and recent choices are preferred. Categories ignored for
+// autocomplete are never suggested.
+func (f *Firefly) Suggest(ctx context.Context, description string) (Suggestion, error) {
+	groups, err := f.suggestGroups(ctx)
+	if err != nil {
+		return Suggestion{}, err
+	}
+
+	query := normalizeDescription(description)
+	var (
+		s                        Suggestion
+		bestDescription          float64
+		categories, destinations = make(map[[2]string]float64), make(map[[2]string]float64)
+		amounts                  = make(map[string]float64)
+	)
+	for _, g := range groups {
+		match := descriptionMatch(query, g.key)
+		if match < suggestMinMatch {
+			continue
+		}
+		s.Matches += g.count
+		if score := match * g.weight; score > bestDescription {
+			bestDescription = score
+			s.Description = g.description
+		}
+		for k, v := range g.categories {
+			categories[k] += match * v
+		}
+		for k, v := range g.destinations {
+			destinations[k] += match * v
+		}
+		for k, v := range g.amounts {
+			amounts[k] += match * v
+		}
+	}
+
+	if c, ok := best(categories); ok {
+		s.CategoryID, s.CategoryName = c[0], c[1]
+	}
+	if d, ok := best(destinations); ok {
+		s.DestinationID, s.DestinationName = d[0], d[1]
+	}
+	if a, ok := best(amounts); ok {
+		s.Amount, _ = decimal.NewFromString(a)
+	}
+	return s, nil
+}
+
+// best returns the key with the highest score, breaking ties by key so that
+// suggestions are stable. If there are no keys, false is returned.
+func best[K [2]string | string](scores map[K]float64) (K, bool) {
+	keys := make([]K, 0, len(scores))
+	for k := range scores {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if scores[keys[i]] != scores[keys[j]] {
+			return scores[keys[i]] > scores[keys[j]]
+		}
+		return fmt.Sprint(keys[i]) < fmt.Sprint(keys[j])
+	})
+	if len(keys) == 0 {
+		var zero K
+		return zero, false
+	}
+	return keys[0], true
+}
+
+// descriptionMatch returns how well a previous description matches the query,
+// which may be a partial description that is still being typed.
+func descriptionMatch(query, description string) float64 {
+	switch {
+	case query == description:
+		return 1
+	case strings.HasPrefix(description, query):
+		return 0.95
+	case strings.Contains(description, query):
+		return 0.85
+	}
+	match := similarity(query, description)
+	if r := []rune(description); len(r) > len([]rune(query)) {
+		// A partial description can't match as well as an exact prefix
+		match = max(match, min(0.9, similarity(query, string(r[:len([]rune(query))]))))
+	}
+	return match
+}
+
+// suggestGroups returns the transaction history grouped by description,
+// rebuilding the index only if the cached history has changed.
+func (f *Firefly) suggestGroups(ctx context.Context) ([]suggestGroup, error) {
+	now := time.Now()
+	key := suggestionsKey(now)
+	txns, err := f.CachedTransactions(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	f.cache.mu.Lock()
+	updated := f.cache.updated[key]
+	f.cache.mu.Unlock()
+
+	f.suggestions.mu.Lock()
+	defer f.suggestions.mu.Unlock()
+	if f.suggestions.key == key && f.suggestions.updated.Equal(updated) && !updated.IsZero() {
+		return f.suggestions.groups, nil
+	}
+	if f.suggestions.key != key {
+		f.cache.mu.Lock()
+		f.evictOldSuggestions(key)
+		f.cache.mu.Unlock()
+	}
+
+	byKey := make(map[string]*suggestGroup)
+	var groups []*suggestGroup
+	for _, t := range txns {
+		for _, s := range t.Attributes.Transactions {
+			date, err := time.Parse(fireflyAPIDateFormat, s.Date)
+			if err != nil {
+				continue
+			}
+			k := normalizeDescription(s.Description)
+			if k == "" {
+				continue
+			}
+			g, ok := byKey[k]
+			if !ok {
+				g = &suggestGroup{
+					key:          k,
+					categories:   make(map[[2]string]float64),
+					destinations: make(map[[2]string]float64),
+					amounts:      make(map[string]float64),
+				}
+				byKey[k] = g
+				groups = append(groups, g)
+			}
+			if date.After(g.latest) {
+				g.latest, g.description = date, s.Description
+			}
+
+			age := max(now.Sub(date).Hours()/24, 0)
+			weight := math.Pow(0.5, age/suggestHalfLifeDays)
+			g.count++
+			g.weight += weight
+			if s.CategoryID != "" && s.CategoryID != "0" {
+				id, _ := strconv.Atoi(s.CategoryID)
+				if _, ignored := f.config.AutocompleteIgnoredCategories[id]; !ignored {
+					g.categories[[2]string{s.CategoryID, s.CategoryName}] += weight
+				}
+			}
+			if s.DestinationID != "" || s.DestinationName != "" {
+				g.destinations[[2]string{s.DestinationID, s.DestinationName}] += weight
+			}
+			g.amounts[s.Amount.String()] += weight
+		}
+	}
+
+	f.suggestions.key, f.suggestions.updated = key, updated
+	f.suggestions.groups = make([]suggestGroup, len(groups))
+	for i, g := range groups {
+		f.suggestions.groups[i] = *g
+	}
+	return f.suggestions.groups, nil
+}
@@ -0,0 +1,124 @@
+package firefly_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+
+	"github.com/davidschlachter/lychnos/src/backend/firefly"
+)
+
+func TestSuggest(t *testing.T) {
+	daysAgo := func(n int) string { return time.Now().AddDate(0, 0, -n).Format("2006-01-02T15:04:05-07:00") }
+	split := func(date, description, amount, categoryID, categoryName, destinationID, destinationName string) string {
+		return fmt.Sprintf(`{"type":"withdrawal","date":%q,"amount":%q,"description":%q,"category_id":%q,"category_name":%q,"source_id":"3","destination_id":%q,"destination_name":%q}`, date, amount, description, categoryID, categoryName, destinationID, destinationName)
+	}
+	splits := []string{
+		// Coffee was Dining out long ago, but has recently been Groceries,
+		// which should win. The misspelling should still be matched.
+		split(daysAgo(300), "Coffee Shop", "4.50", "5", "Dining out", "529", "Coffee Shop"),
+		split(daysAgo(280), "Coffee Shop", "4.50", "5", "Dining out", "529", "Coffee Shop"),
+		split(daysAgo(3), "coffee shop", "5.25", "6", "Groceries", "529", "Coffee Shop"),
+		split(daysAgo(2), "Coffee shop", "5.25", "6", "Groceries", "529", "Coffee Shop"),
+		split(daysAgo(1), "Cofee shop", "5.25", "6", "Groceries", "529", "Coffee Shop"),
+		// Reimbursable is ignored for autocomplete
+		split(daysAgo(1), "Conference", "300", "8", "Reimbursable", "600", "Hotel"),
+		split(daysAgo(10), "Hardware store", "40", "7", "Home", "530", "Hardware store"),
+	}
+	var hits atomic.Int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/transactions", func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		var data []string
+		for i, s := range splits {
+			data = append(data, fmt.Sprintf(`{"type":"transactions","id":"%d","attributes":{"transactions":[%s]}}`, i+1, s))
+		}
+		fmt.Fprintf(w, `{"data":[%s],"meta":{"pagination":{"total":%d,"count":%d,"per_page":50,"current_page":1,"total_pages":1}}}`, strings.Join(data, ","), len(data), len(data))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	f, err := firefly.New(server.Client(), firefly.Config{Token: "token", URL: server.URL, AutocompleteIgnoredCategories: map[int]struct{}{8: {}}})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	tests := []struct {
+		query string
+		want  firefly.Suggestion
+	}{
+		{query: "coffee", want: firefly.Suggestion{Description: "Coffee shop", CategoryID: "6", CategoryName: "Groceries", DestinationID: "529", DestinationName: "Coffee Shop", Amount: decimal.RequireFromString("5.25"), Matches: 5}},
+		{query: "cofe", want: firefly.Suggestion{Description: "Coffee shop", CategoryID: "6", CategoryName: "Groceries", DestinationID: "529", DestinationName: "Coffee Shop", Amount: decimal.RequireFromString("5.25"), Matches: 5}},
+		{query: "hardwre", want: firefly.Suggestion{Description: "Hardware store", CategoryID: "7", CategoryName: "Home", DestinationID: "530", DestinationName: "Hardware store", Amount: decimal.NewFromInt(40), Matches: 1}},
+		{query: "conference", want: firefly.Suggestion{Description: "Conference", DestinationID: "600", DestinationName: "Hotel", Amount: decimal.NewFromInt(300), Matches: 1}},
+		{query: "xyz", want: firefly.Suggestion{}},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		f.HandleSuggest(w, httptest.NewRequest(http.MethodGet, "/api/suggest?description="+test.query, nil))
+		if w.Result().StatusCode != http.StatusOK {
+			t.Fatalf("Status code = %d, want %d. Response body: %s", w.Result().StatusCode, http.StatusOK, w.Body.String())
+		}
+		var got firefly.Suggestion
+		json.NewDecoder(w.Body).Decode(&got)
+		if !got.Amount.Equal(test.want.Amount) {
+			t.Errorf("%s: got amount %s, wanted %s", test.query, got.Amount, test.want.Amount)
+		}
+		got.Amount, test.want.Amount = decimal.Decimal{}, decimal.Decimal{}
+		if got != test.want {
+			t.Errorf("%s: got suggestion %+v, wanted %+v", test.query, got, test.want)
+		}
+	}
+	// The history is fetched once, and then served from the cache.
+	if hits.Load() != 1 {
+		t.Errorf("Got %d requests for transactions, wanted 1", hits.Load())
+	}
+
+	w := httptest.NewRecorder()
+	f.HandleSuggest(w, httptest.NewRequest(http.MethodGet, "/api/suggest", nil))
+	if w.Result().StatusCode != http.StatusBadRequest {
+		t.Errorf("Status code = %d without a description, want %d", w.Result().StatusCode, http.StatusBadRequest)
+	}
+}
+
+func TestSuggestEvictsOldHistory(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/transactions", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"data":[],"meta":{"pagination":{"total":0,"count":0,"per_page":50,"current_page":1,"total_pages":1}}}`))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	f, err := firefly.New(server.Client(), firefly.Config{Token: "token", URL: server.URL})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	// Restore the history used for suggestions yesterday, along with another
+	// list of transactions
+	yesterday := time.Now().AddDate(0, 0, -1)
+	old := fmt.Sprintf(`{"Page":0,"Start":%q,"End":%q,"Query":""}`, yesterday.AddDate(0, 0, -365).Format("2006-01-02"), yesterday.Format("2006-01-02"))
+	other := `{"Page":0,"Start":"2025-01-01","End":"2025-01-31","Query":""}`
+	err = f.Restore(fmt.Appendf(nil, `{"version":%d,"transactions":[{"key":%s,"value":[]},{"key":%s,"value":[]}]}`, firefly.SnapshotVersion, old, other))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	w := httptest.NewRecorder()
+	f.HandleSuggest(w, httptest.NewRequest(http.MethodGet, "/api/suggest?description=coffee", nil))
+	if w.Result().StatusCode != http.StatusOK {
+		t.Fatalf("Status code = %d, want %d. Response body: %s", w.Result().StatusCode, http.StatusOK, w.Body.String())
+	}
+	data, err := f.Snapshot()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if strings.Contains(string(data), old) || !strings.Contains(string(data), other) {
+		t.Errorf("Got snapshot %s, wanted only yesterday's history to be evicted", data)
+	}
+}
@@ -0,0 +1,107 @@
+package firefly
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/davidschlachter/lychnos/src/backend/httperror"
+	"github.com/shopspring/decimal"
+)
+
+// TagTotal sums the transactions with a tag. As for categories, Spent is
+// negative, the sums are in the primary currency if one is configured, and
+// Unconverted are the currencies whose amounts are left out of the sums.
+// Transfers are counted, but not included in the sums.
+type TagTotal struct {
+	Tag          string          `json:"tag"`
+	Spent        decimal.Decimal `json:"spent"`
+	Earned       decimal.Decimal `json:"earned"`
+	CurrencyCode string          `json:"currency_code"`
+	Unconverted  []string        `json:"unconverted"`
+	Count        int             `json:"count"`
+}
+
+// HandleTags lists the tags used between the start and end dates (inclusive,
+// formatted like 2006-01-02), with the totals of their transactions, e.g.
+// GET /api/tags?start=2025-01-01&end=2025-12-31.
+func (f *Firefly) HandleTags(w http.ResponseWriter, req *http.Request) {
+	log.Printf("%s %s", req.Method, req.RequestURI)
+	if req.Method != "GET" {
+		w.WriteHeader(http.StatusNotImplemented)
+		fmt.Fprintf(w, "Unsupported method %s", req.Method)
+		return
+	}
+
+	start, err := time.ParseInLocation(inputDateFormat, req.URL.Query().Get("start"), time.Local)
+	if err != nil {
+		httperror.Send(w, req, http.StatusBadRequest, fmt.Sprintf("Could not parse start date '%s'", req.URL.Query().Get("start")))
+		return
+	}
+	end, err := time.ParseInLocation(inputDateFormat, req.URL.Query().Get("end"), time.Local)
+	if err != nil {
+		httperror.Send(w, req, http.StatusBadRequest, fmt.Sprintf("Could not parse end date '%s'", req.URL.Query().Get("end")))
+		return
+	}
+	if end.Before(start) {
+		httperror.Send(w, req, http.StatusBadRequest, "end must not be before start")
+		return
+	}
+
+	totals, err := f.TagTotals(req.Context(), start, end)
+	if err != nil {
+		httperror.Send(w, req, http.StatusInternalServerError, fmt.Sprintf("Could not list tags: %s", err))
+		return
+	}
+
+	f.setCacheAge(w, transactionsKey{Start: start.Format(inputDateFormat), End: end.Format(inputDateFormat)})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(totals)
+}
+
+// TagTotals sums the cached transactions between start and end by tag, in
+// order of tag.
+func (f *Firefly) TagTotals(ctx context.Context, start, end time.Time) ([]TagTotal, error) {
+	txns, err := f.CachedTransactionsBetween(ctx, start, end)
+	if err != nil {
+		return nil, err
+	}
+
+	byTag := make(map[string]*TagTotal)
+	for _, t := range txns {
+		for _, s := range t.Attributes.Transactions {
+			for _, tag := range s.Tags {
+				total, ok := byTag[tag]
+				if !ok {
+					total = &TagTotal{Tag: tag, Unconverted: []string{}}
+					byTag[tag] = total
+				}
+				total.Count++
+				if s.Type != "withdrawal" && s.Type != "deposit" {
+					continue
+				}
+				amt, ok := f.toPrimary(ctx, s.Amount, s.CurrencyCode, &total.CurrencyCode)
+				if !ok {
+					total.Unconverted = addUnconverted(total.Unconverted, s.CurrencyCode)
+					continue
+				}
+				if s.Type == "withdrawal" {
+					total.Spent = total.Spent.Sub(amt)
+				} else {
+					total.Earned = total.Earned.Add(amt)
+				}
+			}
+		}
+	}
+
+	totals := make([]TagTotal, 0, len(byTag))
+	for _, total := range byTag {
+		totals = append(totals, *total)
+	}
+	sort.Slice(totals, func(i, j int) bool { return totals[i].Tag < totals[j].Tag })
+	return totals, nil
+}
@@ -0,0 +1,132 @@
+package firefly_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/shopspring/decimal"
+
+	"github.com/davidschlachter/lychnos/src/backend/firefly"
+	"github.com/davidschlachter/lychnos/src/backend/firefly/fireflytest"
+)
+
+func TestTags(t *testing.T) {
+	split := func(txnType, amount, tags string) string {
+		return fmt.Sprintf(`{"type":%q,"date":"2025-02-14T00:00:00-05:00","amount":%q,"description":"Trip","source_id":"3","destination_name":"Hotel","tags":[%s],"notes":"Receipt in email"}`, txnType, amount, tags)
+	}
+	splits := []string{
+		split("withdrawal", "100.00", `"vacation","work"`),
+		split("withdrawal", "20.50", `"vacation"`),
+		split("deposit", "100.00", `"work"`),
+		split("transfer", "50.00", `"vacation"`),
+		split("withdrawal", "10.00", ``),
+	}
+	var stub *fireflytest.Server
+	stub = fireflytest.NewServer(t, map[string]http.HandlerFunc{
+		"/api/v1/transactions": func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == "POST" {
+				stub.Record(r)
+				w.Write([]byte(fireflytest.Created))
+				return
+			}
+			var data []string
+			for i, s := range splits {
+				data = append(data, fmt.Sprintf(`{"type":"transactions","id":"%d","attributes":{"transactions":[%s]}}`, i+1, s))
+			}
+			fmt.Fprintf(w, `{"data":[%s],"meta":{"pagination":{"total":%d,"count":%d,"per_page":50,"current_page":1,"total_pages":1}}}`, strings.Join(data, ","), len(data), len(data))
+		},
+		"/api/v1/search/transactions": func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(fireflytest.EmptyList))
+		},
+		"/api/v1/transactions/1": func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == "PUT" {
+				stub.Record(r)
+			}
+			fmt.Fprintf(w, `{"data":{"type":"transactions","id":"1","attributes":{"transactions":[%s]}}}`, splits[0])
+		},
+	})
+	f := stub.Firefly(t, firefly.Config{})
+
+	// Totals
+	w := httptest.NewRecorder()
+	f.HandleTags(w, httptest.NewRequest(http.MethodGet, "/api/tags?start=2025-02-01&end=2025-02-28", nil))
+	if w.Result().StatusCode != http.StatusOK {
+		t.Fatalf("Status code = %d, want %d. Response body: %s", w.Result().StatusCode, http.StatusOK, w.Body.String())
+	}
+	var totals []firefly.TagTotal
+	json.NewDecoder(w.Body).Decode(&totals)
+	want := []firefly.TagTotal{
+		{Tag: "vacation", Spent: decimal.RequireFromString("-120.50"), Earned: decimal.Zero, Count: 3},
+		{Tag: "work", Spent: decimal.RequireFromString("-100"), Earned: decimal.RequireFromString("100"), Count: 2},
+	}
+	if len(totals) != len(want) {
+		t.Fatalf("Got tag totals %+v, wanted %+v", totals, want)
+	}
+	for i := range want {
+		if totals[i].Tag != want[i].Tag || !totals[i].Spent.Equal(want[i].Spent) || !totals[i].Earned.Equal(want[i].Earned) || totals[i].Count != want[i].Count {
+			t.Fatalf("Got tag total %+v, wanted %+v", totals[i], want[i])
+		}
+	}
+	w = httptest.NewRecorder()
+	f.HandleTags(w, httptest.NewRequest(http.MethodGet, "/api/tags?start=2025-02-01", nil))
+	if w.Result().StatusCode != http.StatusBadRequest {
+		t.Fatalf("Status code = %d without an end date, want %d", w.Result().StatusCode, http.StatusBadRequest)
+	}
+
+	// Listed transactions include their tags and notes
+	w = httptest.NewRecorder()
+	f.HandleTxn(w, httptest.NewRequest(http.MethodGet, "/api/transactions/?start=2025-02-01&end=2025-02-28", nil))
+	var txns []firefly.Transactions
+	json.NewDecoder(w.Body).Decode(&txns)
+	if s := txns[0].Attributes.Transactions[0]; strings.Join(s.Tags, ",") != "vacation,work" || s.Notes != "Receipt in email" {
+		t.Fatalf("Got transaction %+v, wanted its tags and notes", s)
+	}
+
+	// Tags may be comma-separated or repeated
+	data := url.Values{
+		"date": {"2025-02-20"}, "amount": {"42"}, "description": {"Taxi"}, "source_id": {"3"}, "destination_name": {"Taxi"},
+		"tags": {"vacation, work", "vacation"}, "notes": {"Airport"}, "external_id": {"receipt-7"},
+	}
+	req := httptest.NewRequest(http.MethodPost, "/api/transactions/", strings.NewReader(data.Encode()))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	w = httptest.NewRecorder()
+	f.HandleTxn(w, req)
+	if w.Result().StatusCode != http.StatusFound {
+		t.Fatalf("Status code = %d, want %d. Response body: %s", w.Result().StatusCode, http.StatusFound, w.Body.String())
+	}
+	posted := stub.Posted()
+	for _, want := range []string{`"tags":["vacation","work"]`, `"notes":"Airport"`, `"external_id":"receipt-7"`} {
+		if !strings.Contains(posted[0], want) {
+			t.Errorf("Created transaction %s, wanted it to contain %s", posted[0], want)
+		}
+	}
+
+	// Updates keep tags and notes that are not submitted, and remove them if
+	// they are submitted empty
+	for i, test := range []struct {
+		data url.Values
+		want []string
+	}{
+		{url.Values{"amount": {"99"}}, []string{`"tags":["vacation","work"]`, `"notes":"Receipt in email"`}},
+		{url.Values{"tags": {""}, "notes": {""}}, []string{`"tags":[]`, `"notes":""`}},
+	} {
+		req := httptest.NewRequest(http.MethodPatch, "/api/transactions/1", strings.NewReader(test.data.Encode()))
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		w = httptest.NewRecorder()
+		f.HandleTxn(w, req)
+		if w.Result().StatusCode != http.StatusOK {
+			t.Fatalf("Status code = %d, want %d. Response body: %s", w.Result().StatusCode, http.StatusOK, w.Body.String())
+		}
+		posted := stub.Posted()
+		for _, want := range test.want {
+			if !strings.Contains(posted[i+1], want) {
+				t.Errorf("Updated transaction %s, wanted it to contain %s", posted[i+1], want)
+			}
+		}
+	}
+}
@@ -1,25 +1,31 @@
 package firefly
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"regexp"
 	"strconv"
 	"strings"
 	"time"
+	"unicode"
 
 	"github.com/davidschlachter/lychnos/src/backend/httperror"
 	"github.com/shopspring/decimal"
 )
 
+// ErrDuplicate is returned when creating a transaction that already exists.
+var ErrDuplicate = errors.New("transaction already exists")
+
 func (f *Firefly) HandleTxn(w http.ResponseWriter, req *http.Request) {
 	log.Printf("%s %s", req.Method, req.RequestURI)
+	hasID := regexp.MustCompile(`/[0-9]+$`)
 	switch req.Method {
 	case "GET":
-		hasID := regexp.MustCompile(`/[0-9]+$`)
 		if hasID.MatchString(req.URL.Path) {
 			f.fetchTxn(w, req)
 		} else {
@@ -27,6 +33,18 @@ func (f *Firefly) HandleTxn(w http.ResponseWriter, req *http.Request) {
 		}
 	case "POST":
 		f.createTxn(w, req)
+	case "PUT", "PATCH":
+		if !hasID.MatchString(req.URL.Path) {
+			httperror.Send(w, req, http.StatusBadRequest, "Must provide a transaction ID to update")
+			return
+		}
+		f.updateTxn(w, req)
+	case "DELETE":
+		if !hasID.MatchString(req.URL.Path) {
+			httperror.Send(w, req, http.StatusBadRequest, "Must provide a transaction ID to delete")
+			return
+		}
+		f.deleteTxn(w, req)
 	default:
 		w.WriteHeader(http.StatusNotImplemented)
 	}
@@ -49,19 +67,35 @@ type TransactionAttributes struct {
 }
 
 type Transaction struct {
-	Type            string          `json:"type"`
-	Date            string          `json:"date"` // "2018-09-17T12:46:47+01:00"
-	Amount          decimal.Decimal `json:"amount"`
-	Description     string          `json:"description"`
-	CategoryID      string          `json:"category_id,omitempty"`
-	CategoryName    string          `json:"category_name"`
-	SourceID        string          `json:"source_id,omitempty"`
-	SourceName      string          `json:"source_name,omitempty"`
-	DestinationID   string          `json:"destination_id,omitempty"`
-	DestinationName string          `json:"destination_name,omitempty"`
+	TransactionJournalID string          `json:"transaction_journal_id,omitempty"`
+	Type                 string          `json:"type"`
+	Date                 string          `json:"date"` // "2018-09-17T12:46:47+01:00"
+	Amount               decimal.Decimal `json:"amount"`
+	Description          string          `json:"description"`
+	CategoryID           string          `json:"category_id,omitempty"`
+	CategoryName         string          `json:"category_name"`
+	SourceID             string          `json:"source_id,omitempty"`
+	SourceName           string          `json:"source_name,omitempty"`
+	DestinationID        string          `json:"destination_id,omitempty"`
+	DestinationName      string          `json:"destination_name,omitempty"`
+	// ExternalID identifies the transaction in another system, e.g. the
+	// FITID of an imported bank statement.
+	ExternalID string `json:"external_id,omitempty"`
+	// Tags and Notes are always sent to Firefly-III, so that updating a
+	// transaction can remove them.
+	Tags  []string `json:"tags"`
+	Notes string   `json:"notes"`
+	// CurrencyCode is the currency of Amount. If it isn't set when creating
+	// a transaction, Firefly-III uses the currency of the source account.
+	// ForeignAmount is the amount in ForeignCurrencyCode, e.g. the amount in
+	// US dollars of a withdrawal from a Canadian dollar credit card.
+	CurrencyCode        string              `json:"currency_code,omitempty"`
+	ForeignAmount       decimal.NullDecimal `json:"foreign_amount,omitzero"`
+	ForeignCurrencyCode string              `json:"foreign_currency_code,omitempty"`
 }
 
 type createRequest struct {
+	GroupTitle   string        `json:"group_title,omitempty"`
 	Transactions []Transaction `json:"transactions"`
 }
 
@@ -70,43 +104,36 @@ const (
 	fireflyAPIDateFormat = "2006-01-02T15:04:05-07:00"
 )
 
-func (f *Firefly) createTxn(w http.ResponseWriter, req *http.Request) {
-	err := req.ParseForm()
+// txnFromForm builds a Transaction from the submitted form values and
+// validates it. If the transaction is not valid, the returned status code and
+// error should be sent to the client. The parsed transaction date is returned
+// for invalidating caches.
+func (f *Firefly) txnFromForm(ctx context.Context, form url.Values) (Transaction, time.Time, int, error) {
+	// Build the transaction struct
+	amt, err := parseAmount("amount", form.Get("amount"))
 	if err != nil {
-		httperror.Send(w, req, http.StatusInternalServerError, "Could not parse POST data")
-		return
+		return Transaction{}, time.Time{}, http.StatusInternalServerError, err
 	}
 
-	// Build the transaction struct
-	// The amount may use a period or a comma as the decimal separator.
-	var nPer, nCom, posSep int
-	amtStr := strings.TrimSpace(req.Form.Get("amount"))
-	for i, c := range amtStr { // Assume no multibyte characters
-		if c == '.' {
-			nPer++
-			posSep = i
-		} else if c == ',' {
-			nCom++
-			posSep = i
+	// A foreign amount is optional, but must have a currency.
+	var foreignAmt decimal.NullDecimal
+	foreignCurrency := strings.ToUpper(strings.TrimSpace(form.Get("foreign_currency_code")))
+	if strings.TrimSpace(form.Get("foreign_amount")) != "" {
+		a, err := parseAmount("foreign_amount", form.Get("foreign_amount"))
+		if err != nil {
+			return Transaction{}, time.Time{}, http.StatusBadRequest, err
 		}
-	}
-	if nPer > 0 && nCom > 0 {
-		httperror.Send(w, req, http.StatusInternalServerError, fmt.Sprintf("Could not parse amount. More than one decimal separator provided in: %s", amtStr))
-		return
-	}
-	if nCom == 1 {
-		amtStr = amtStr[:posSep] + "." + amtStr[posSep+1:]
-	}
-	amt, err := decimal.NewFromString(amtStr)
-	if err != nil {
-		httperror.Send(w, req, http.StatusInternalServerError, fmt.Sprintf("Could not parse amount: %s", req.Form.Get("amount")))
-		return
+		if foreignCurrency == "" {
+			return Transaction{}, time.Time{}, http.StatusBadRequest, fmt.Errorf("foreign_currency_code must be provided with foreign_amount")
+		}
+		foreignAmt = decimal.NewNullDecimal(a)
+	} else if foreignCurrency != "" {
+		return Transaction{}, time.Time{}, http.StatusBadRequest, fmt.Errorf("foreign_amount must be provided with foreign_currency_code")
 	}
 
-	txnDate, err := time.Parse(inputDateFormat, strings.TrimSpace(req.Form.Get("date")))
+	txnDate, err := time.Parse(inputDateFormat, strings.TrimSpace(form.Get("date")))
 	if err != nil {
-		httperror.Send(w, req, http.StatusBadRequest, fmt.Sprintf("Could not parse date '%s'", strings.TrimSpace(req.Form.Get("date"))))
-		return
+		return Transaction{}, time.Time{}, http.StatusBadRequest, fmt.Errorf("Could not parse date '%s'", strings.TrimSpace(form.Get("date")))
 	}
 	// Clients only provide the date. If the date is today, we want to add the
 	// current time to it. This helps transactions stay in the expected order.
@@ -117,13 +144,27 @@ func (f *Firefly) createTxn(w http.ResponseWriter, req *http.Request) {
 	t := Transaction{
 		Date:            txnDate.Format(fireflyAPIDateFormat),
 		Amount:          amt,
-		Description:     strings.TrimSpace(req.Form.Get("description")),
-		CategoryID:      strings.TrimSpace(req.Form.Get("category_id")),
-		CategoryName:    strings.TrimSpace(req.Form.Get("category_name")),
-		SourceID:        strings.TrimSpace(req.Form.Get("source_id")),
-		SourceName:      strings.TrimSpace(req.Form.Get("source_name")),
-		DestinationID:   strings.TrimSpace(req.Form.Get("destination_id")),
-		DestinationName: strings.TrimSpace(req.Form.Get("destination_name")),
+		Description:     strings.TrimSpace(form.Get("description")),
+		CategoryID:      strings.TrimSpace(form.Get("category_id")),
+		CategoryName:    strings.TrimSpace(form.Get("category_name")),
+		SourceID:        strings.TrimSpace(form.Get("source_id")),
+		SourceName:      strings.TrimSpace(form.Get("source_name")),
+		DestinationID:   strings.TrimSpace(form.Get("destination_id")),
+		DestinationName: strings.TrimSpace(form.Get("destination_name")),
+		ExternalID:      strings.TrimSpace(form.Get("external_id")),
+		Tags:            parseTags(form["tags"]),
+		Notes:           strings.TrimSpace(form.Get("notes")),
+
+		CurrencyCode:        strings.ToUpper(strings.TrimSpace(form.Get("currency_code"))),
+		ForeignAmount:       foreignAmt,
+		ForeignCurrencyCode: foreignCurrency,
+	}
+
+	// Transactions created without a category may be categorized
+	// automatically, e.g. by rules.
+	err = f.Categorize(ctx, &t)
+	if err != nil {
+		return Transaction{}, time.Time{}, http.StatusInternalServerError, fmt.Errorf("Could not categorize transaction: %s", err)
 	}
 
 	//
@@ -132,7 +173,7 @@ func (f *Firefly) createTxn(w http.ResponseWriter, req *http.Request) {
 	// Verify that a provided category ID is valid. If only a category name is
 	// provided, add the ID. Allow an empty category (e.g. for a transfer).
 	if t.CategoryID != "" || t.CategoryName != "" {
-		cats, _ := f.CachedCategories()
+		cats, _ := f.CachedCategories(ctx)
 		var ok bool
 		for _, c := range cats {
 			if strconv.Itoa(c.ID) == t.CategoryID {
@@ -146,111 +187,554 @@ func (f *Firefly) createTxn(w http.ResponseWriter, req *http.Request) {
 			}
 		}
 		if !ok {
-			httperror.Send(w, req, http.StatusBadRequest, fmt.Sprintf("Could not find Category with ID = '%s' or Name = '%s'", t.CategoryID, t.CategoryName))
-			return
+			return Transaction{}, time.Time{}, http.StatusBadRequest, fmt.Errorf("Could not find Category with ID = '%s' or Name = '%s'", t.CategoryID, t.CategoryName)
 		}
 	}
 
 	if t.Description == "" {
-		httperror.Send(w, req, http.StatusBadRequest, "description must be provided")
-		return
+		return Transaction{}, time.Time{}, http.StatusBadRequest, fmt.Errorf("description must be provided")
 	}
 
 	if t.SourceID == "" && t.SourceName == "" {
-		httperror.Send(w, req, http.StatusBadRequest, "source_id or source_name must be provided")
-		return
+		return Transaction{}, time.Time{}, http.StatusBadRequest, fmt.Errorf("source_id or source_name must be provided")
 	}
 
 	if t.DestinationID == "" && t.DestinationName == "" {
-		httperror.Send(w, req, http.StatusBadRequest, "destination_id or destination_name must be provided")
-		return
+		return Transaction{}, time.Time{}, http.StatusBadRequest, fmt.Errorf("destination_id or destination_name must be provided")
 	}
 
 	// If the user accidentally enters the same account for the source and
 	// destination, we will have an expense and a revenue account with the same
 	// name, and won't be able to create new transactions for either one!
 	if (t.DestinationID != "" && t.DestinationID == t.SourceID) || (t.DestinationName != "" && t.DestinationName == t.SourceName) {
-		httperror.Send(w, req, http.StatusBadRequest, fmt.Sprintf("source and destination accounts cannot be the same (got '%s' for both!)", t.DestinationName))
-		return
+		return Transaction{}, time.Time{}, http.StatusBadRequest, fmt.Errorf("source and destination accounts cannot be the same (got '%s' for both!)", t.DestinationName)
 	}
 
 	if t.Amount.IsZero() {
-		httperror.Send(w, req, http.StatusBadRequest, "amount must be provided")
-		return
+		return Transaction{}, time.Time{}, http.StatusBadRequest, fmt.Errorf("amount must be provided")
 	}
 
 	// Determine the transaction type
-	t.Type = f.calcTxnType(t.SourceID, t.SourceName, t.DestinationID, t.DestinationName)
+	t.Type = f.calcTxnType(ctx, t.SourceID, t.SourceName, t.DestinationID, t.DestinationName)
 	if t.Type == "" {
-		httperror.Send(w, req, http.StatusInternalServerError, fmt.Sprintf("Could not determine transaction type with provided account information: sourceID: %s, sourceName: %s; destID: %s, destName: %s\n", t.SourceID, t.SourceName, t.DestinationID, t.DestinationName))
+		return Transaction{}, time.Time{}, http.StatusInternalServerError, fmt.Errorf("Could not determine transaction type with provided account information: sourceID: %s, sourceName: %s; destID: %s, destName: %s\n", t.SourceID, t.SourceName, t.DestinationID, t.DestinationName)
+	}
+
+	return t, txnDate, http.StatusOK, nil
+}
+
+// parseAmount parses the amount submitted as the named form value, which may
+// use a period or a comma as the decimal separator.
+func parseAmount(name, s string) (decimal.Decimal, error) {
+	amtStr := strings.TrimSpace(s)
+	if strings.Contains(amtStr, ".") && strings.Contains(amtStr, ",") {
+		return decimal.Zero, fmt.Errorf("Could not parse %s. More than one decimal separator provided in: %s", name, amtStr)
+	}
+	decimalSeparator := "."
+	if strings.Contains(amtStr, ",") {
+		decimalSeparator = ","
+	}
+	amt, err := ParseAmount(amtStr, decimalSeparator)
+	if err != nil {
+		return decimal.Zero, fmt.Errorf("Could not parse %s: %s", name, s)
+	}
+	return amt, nil
+}
+
+// ParseAmount parses an amount with the decimal separator, ignoring the
+// thousands separator, currency symbols and spaces. Amounts in parentheses are
+// negative, as is common in statements.
+func ParseAmount(s, decimalSeparator string) (decimal.Decimal, error) {
+	raw := strings.TrimSpace(s)
+	negative := strings.HasPrefix(raw, "(") && strings.HasSuffix(raw, ")")
+	if negative {
+		raw = raw[1 : len(raw)-1]
+	}
+	thousandsSeparator := ","
+	if decimalSeparator == "," {
+		thousandsSeparator = "."
+	}
+	var b strings.Builder
+	for _, c := range raw {
+		switch {
+		case c >= '0' && c <= '9', c == '-', c == '+':
+			b.WriteRune(c)
+		case string(c) == decimalSeparator:
+			b.WriteRune('.')
+		case string(c) == thousandsSeparator, unicode.IsSpace(c), unicode.Is(unicode.Sc, c):
+		default:
+			return decimal.Decimal{}, fmt.Errorf("could not parse amount '%s'", s)
+		}
+	}
+	amt, err := decimal.NewFromString(b.String())
+	if err != nil {
+		return decimal.Decimal{}, fmt.Errorf("could not parse amount '%s'", s)
+	}
+	if negative {
+		amt = amt.Neg()
+	}
+	return amt, nil
+}
+
+// parseTags returns the tags of the form values, which may each hold several
+// comma-separated tags, without duplicates. The result is never nil, so that
+// an empty list of tags is sent to Firefly-III.
+func parseTags(values []string) []string {
+	tags := []string{}
+	seen := make(map[string]struct{})
+	for _, v := range values {
+		for _, tag := range strings.Split(v, ",") {
+			tag = strings.TrimSpace(tag)
+			if _, ok := seen[tag]; ok || tag == "" {
+				continue
+			}
+			seen[tag] = struct{}{}
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// splitRequest is the JSON body accepted when creating a transaction group with
+// several splits, e.g. a single receipt covering several categories. The date
+// and accounts are shared by every split.
+type splitRequest struct {
+	GroupTitle      string  `json:"group_title"`
+	Date            string  `json:"date"`
+	SourceID        string  `json:"source_id"`
+	SourceName      string  `json:"source_name"`
+	DestinationID   string  `json:"destination_id"`
+	DestinationName string  `json:"destination_name"`
+	Splits          []split `json:"splits"`
+	// Force creates the transaction even if it looks like a duplicate.
+	Force bool `json:"force"`
+}
+
+type split struct {
+	// Amount is a string so that either decimal separator may be used, as
+	// for form submissions.
+	Amount       string   `json:"amount"`
+	Description  string   `json:"description"`
+	CategoryID   string   `json:"category_id"`
+	CategoryName string   `json:"category_name"`
+	Tags         []string `json:"tags"`
+	Notes        string   `json:"notes"`
+	ExternalID   string   `json:"external_id"`
+}
+
+// txnsFromSplitRequest validates each split in the request in the same way as
+// a single transaction, returning the transaction group to send to Firefly and
+// the cache keys for every category and date touched.
+func (f *Firefly) txnsFromSplitRequest(ctx context.Context, s splitRequest) (createRequest, []categoryTotalsKey, int, error) {
+	var (
+		doc  createRequest
+		keys []categoryTotalsKey
+	)
+	if len(s.Splits) == 0 {
+		return doc, nil, http.StatusBadRequest, fmt.Errorf("at least one split must be provided")
+	}
+	doc.GroupTitle = strings.TrimSpace(s.GroupTitle)
+	if len(s.Splits) > 1 && doc.GroupTitle == "" {
+		return doc, nil, http.StatusBadRequest, fmt.Errorf("group_title must be provided for transactions with more than one split")
+	}
+
+	for i, sp := range s.Splits {
+		if strings.TrimSpace(sp.CategoryID) == "" && strings.TrimSpace(sp.CategoryName) == "" {
+			return doc, nil, http.StatusBadRequest, fmt.Errorf("split %d: category_id or category_name must be provided", i+1)
+		}
+		form := url.Values{}
+		form.Set("date", s.Date)
+		form.Set("amount", sp.Amount)
+		form.Set("description", sp.Description)
+		form.Set("category_id", sp.CategoryID)
+		form.Set("category_name", sp.CategoryName)
+		form.Set("source_id", s.SourceID)
+		form.Set("source_name", s.SourceName)
+		form.Set("destination_id", s.DestinationID)
+		form.Set("destination_name", s.DestinationName)
+		form["tags"] = sp.Tags
+		form.Set("notes", sp.Notes)
+		form.Set("external_id", sp.ExternalID)
+		t, txnDate, status, err := f.txnFromForm(ctx, form)
+		if err != nil {
+			return doc, nil, status, fmt.Errorf("split %d: %s", i+1, err)
+		}
+		// All splits in a group share the same date and time.
+		if i > 0 {
+			t.Date = doc.Transactions[0].Date
+		}
+		doc.Transactions = append(doc.Transactions, t)
+
+		catID, _ := strconv.Atoi(t.CategoryID)
+		keys = append(keys, categoryTotalsKey{
+			CategoryID: catID,
+			Start:      txnDate,
+			End:        txnDate,
+		})
+	}
+
+	return doc, keys, http.StatusOK, nil
+}
+
+// createTxn creates a new transaction. Clients may either submit a form for a
+// transaction with a single split, or a JSON splitRequest for a transaction
+// group with several splits.
+func (f *Firefly) createTxn(w http.ResponseWriter, req *http.Request) {
+	var (
+		doc   createRequest
+		keys  []categoryTotalsKey
+		force = req.URL.Query().Get("force") == "true"
+	)
+
+	isJSON := strings.HasPrefix(req.Header.Get("Content-Type"), "application/json")
+	if isJSON {
+		var s splitRequest
+		err := json.NewDecoder(req.Body).Decode(&s)
+		if err != nil {
+			httperror.Send(w, req, http.StatusBadRequest, fmt.Sprintf("Could not parse JSON body: %s", err))
+			return
+		}
+		force = force || s.Force
+		var status int
+		doc, keys, status, err = f.txnsFromSplitRequest(req.Context(), s)
+		if err != nil {
+			httperror.Send(w, req, status, err.Error())
+			return
+		}
+	} else {
+		err := req.ParseForm()
+		if err != nil {
+			httperror.Send(w, req, http.StatusInternalServerError, "Could not parse POST data")
+			return
+		}
+
+		t, txnDate, status, err := f.txnFromForm(req.Context(), req.Form)
+		if err != nil {
+			httperror.Send(w, req, status, err.Error())
+			return
+		}
+		doc.Transactions = []Transaction{t}
+		force = req.Form.Get("force") == "true"
+
+		// Since the transaction will only be created if the category is
+		// valid, the conversion should not raise errors
+		catID, _ := strconv.Atoi(t.CategoryID)
+		keys = append(keys, categoryTotalsKey{
+			CategoryID: catID,
+			Start:      txnDate,
+			End:        txnDate,
+		})
+	}
+
+	created, err := f.create(req.Context(), doc, keys, force)
+	if SendDuplicate(w, err) {
+		return
+	}
+	if errors.Is(err, ErrDuplicate) {
+		httperror.Send(w, req, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		httperror.Send(w, req, http.StatusInternalServerError, err.Error())
 		return
 	}
 
-	// Send to the firefly API
-	doc := createRequest{
-		Transactions: []Transaction{t},
+	if isJSON {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(created)
+		return
 	}
 
+	// Successful txn creation should redirect the client to the transactions page
+	http.Redirect(w, req, "/app/txns", http.StatusFound)
+}
+
+// CreateTransaction validates the form values of a transaction with a single
+// split, as submitted to createTxn, and creates it in Firefly-III. If the
+// transaction is not valid, the returned status code and error should be sent
+// to the client. Like createTxn, a transaction that looks like a duplicate
+// returns a *DuplicateError unless the "force" value is true.
+func (f *Firefly) CreateTransaction(ctx context.Context, form url.Values) (Transactions, int, error) {
+	t, txnDate, status, err := f.txnFromForm(ctx, form)
+	if err != nil {
+		return Transactions{}, status, err
+	}
+	catID, _ := strconv.Atoi(t.CategoryID)
+	key := categoryTotalsKey{CategoryID: catID, Start: txnDate, End: txnDate}
+
+	created, err := f.create(ctx, createRequest{Transactions: []Transaction{t}}, []categoryTotalsKey{key}, form.Get("force") == "true")
+	var dup *DuplicateError
+	if errors.Is(err, ErrDuplicate) || errors.As(err, &dup) {
+		return Transactions{}, http.StatusConflict, err
+	}
+	if err != nil {
+		return Transactions{}, http.StatusInternalServerError, err
+	}
+	return created, http.StatusCreated, nil
+}
+
+// ValidateTransaction validates the form values of a transaction like
+// CreateTransaction, without creating it. If the transaction is not valid, the
+// returned status code and error should be sent to the client.
+func (f *Firefly) ValidateTransaction(ctx context.Context, form url.Values) (int, error) {
+	_, _, status, err := f.txnFromForm(ctx, form)
+	return status, err
+}
+
+// create sends a validated transaction group to Firefly-III, and invalidates
+// the cache entries for the provided keys. If a split has an external ID that
+// was already imported, ErrDuplicate is returned instead. Unless force is set, a
+// *DuplicateError is returned if a split looks like a recent transaction.
+func (f *Firefly) create(ctx context.Context, doc createRequest, keys []categoryTotalsKey, force bool) (Transactions, error) {
 	const path = "/api/v1/transactions"
 
-	body, err := json.Marshal(doc)
+	for _, t := range doc.Transactions {
+		if t.ExternalID != "" {
+			existing, err := f.findExternalID(ctx, t)
+			if err != nil {
+				return Transactions{}, fmt.Errorf("Could not check for duplicate transactions: %s", err)
+			}
+			if existing != "" {
+				return Transactions{}, fmt.Errorf("%w: external ID %s was already imported as transaction %s", ErrDuplicate, t.ExternalID, existing)
+			}
+		}
+		if !force {
+			dup, err := f.findNearDuplicate(ctx, t)
+			if err != nil {
+				return Transactions{}, fmt.Errorf("Could not check for duplicate transactions: %s", err)
+			}
+			if dup != nil {
+				return Transactions{}, dup
+			}
+		}
+	}
+
+	var result struct {
+		Data Transactions `json:"data"`
+	}
+	err := f.do(ctx, "POST", path, doc, http.StatusOK, &result)
 	if err != nil {
-		httperror.Send(w, req, http.StatusInternalServerError, fmt.Sprintf("Could not marshal CreateRequest: %s", err))
+		return Transactions{}, fmt.Errorf("Could not create transaction: %s", err)
+	}
+
+	// Check for successful response
+	if result.Data.ID == "" {
+		return Transactions{}, fmt.Errorf("Could not create transaction: no transaction in response")
+	}
+
+	// Invalidate any matching cache entries, for every split.
+	f.invalidateTxnCaches(keys...)
+
+	return result.Data, nil
+}
+
+// findExternalID returns the ID of an existing transaction with the same
+// external ID as t, or an empty string if there is none. Bank statement IDs are
+// only unique per account, so the existing transaction must also share an
+// account with t.
+func (f *Firefly) findExternalID(ctx context.Context, t Transaction) (string, error) {
+	const path = "/api/v1/search/transactions"
+
+	src, dest := f.accounts(ctx, t)
+	query := url.QueryEscape(fmt.Sprintf(`external_id_is:"%s"`, t.ExternalID))
+	for page, more := 1, true; more; page++ {
+		var txns txnsResponse
+		err := f.do(ctx, "GET", fmt.Sprintf("%s?query=%s&page=%d", path, query, page), nil, http.StatusOK, &txns)
+		if err != nil {
+			return "", err
+		}
+		for _, existing := range txns.Data {
+			for _, s := range existing.Attributes.Transactions {
+				if s.ExternalID != t.ExternalID {
+					continue
+				}
+				if sharesAccount(s, src, dest) {
+					return existing.ID, nil
+				}
+			}
+		}
+		more = txns.Meta.Pagination.CurrentPage < txns.Meta.Pagination.TotalPages
+	}
+	return "", nil
+}
+
+// updateTxn replaces the transaction with the provided ID. Any fields that are
+// not provided by the client keep their current values, so PUT and PATCH
+// requests are handled identically.
+func (f *Firefly) updateTxn(w http.ResponseWriter, req *http.Request) {
+	id := req.URL.Path[strings.LastIndex(req.URL.Path, "/")+1:]
+	if _, err := strconv.Atoi(id); err != nil {
+		httperror.Send(w, req, http.StatusBadRequest, fmt.Sprintf("Could not parse transaction ID: %s", id))
 		return
 	}
-	r, _ := http.NewRequest("POST", f.config.URL+path, bytes.NewBuffer(body))
-	r.Header.Add("Authorization", "Bearer "+f.config.Token)
-	r.Header.Add("Content-Type", "application/json")
-	resp, err := f.client.Do(r)
+
+	err := req.ParseForm()
 	if err != nil {
-		httperror.Send(w, req, http.StatusInternalServerError, fmt.Sprintf("Could not create transaction: %s", err))
+		httperror.Send(w, req, http.StatusInternalServerError, "Could not parse request data")
 		return
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		httperror.Send(w, req, http.StatusInternalServerError, fmt.Sprintf("Could not create transaction, got status %d %s", resp.StatusCode, resp.Status))
+	existing, err := f.FetchTransaction(req.Context(), id)
+	if err != nil {
+		httperror.Send(w, req, txnErrorStatus(err), fmt.Sprintf("Could not fetch transaction: %s", err))
+		return
+	}
+	if len(existing.Attributes.Transactions) != 1 {
+		httperror.Send(w, req, http.StatusBadRequest, fmt.Sprintf("Transaction %s has %d splits, only transactions with a single split can be updated", id, len(existing.Attributes.Transactions)))
+		return
+	}
+	prev := existing.Attributes.Transactions[0]
+	prevDate, err := time.Parse(fireflyAPIDateFormat, prev.Date)
+	if err != nil {
+		httperror.Send(w, req, http.StatusInternalServerError, fmt.Sprintf("Could not parse date of existing transaction: %s", err))
 		return
 	}
 
-	// Check for successful response
+	// Fill in any fields that were not provided with their current values.
+	// Account and category fields are only filled if neither the ID nor the
+	// name was provided, since a new name should not be overridden by the old
+	// ID.
+	keepDate := strings.TrimSpace(req.Form.Get("date")) == ""
+	if keepDate {
+		req.Form.Set("date", prevDate.Format(inputDateFormat))
+	}
+	if strings.TrimSpace(req.Form.Get("amount")) == "" {
+		req.Form.Set("amount", prev.Amount.String())
+	}
+	if strings.TrimSpace(req.Form.Get("description")) == "" {
+		req.Form.Set("description", prev.Description)
+	}
+	// Tags and notes can be removed, so they are only kept if they were not
+	// submitted at all.
+	if _, ok := req.Form["tags"]; !ok {
+		req.Form["tags"] = prev.Tags
+	}
+	if _, ok := req.Form["notes"]; !ok {
+		req.Form.Set("notes", prev.Notes)
+	}
+	if _, ok := req.Form["external_id"]; !ok {
+		req.Form.Set("external_id", prev.ExternalID)
+	}
+	if strings.TrimSpace(req.Form.Get("currency_code")) == "" {
+		req.Form.Set("currency_code", prev.CurrencyCode)
+	}
+	// As for tags, a foreign amount is removed by submitting it empty.
+	_, hasForeignAmt := req.Form["foreign_amount"]
+	_, hasForeignCurrency := req.Form["foreign_currency_code"]
+	if !hasForeignAmt && !hasForeignCurrency && prev.ForeignAmount.Valid {
+		req.Form.Set("foreign_amount", prev.ForeignAmount.Decimal.String())
+		req.Form.Set("foreign_currency_code", prev.ForeignCurrencyCode)
+	}
+	pairs := [][4]string{
+		{"category_id", "category_name", prev.CategoryID, prev.CategoryName},
+		{"source_id", "source_name", prev.SourceID, prev.SourceName},
+		{"destination_id", "destination_name", prev.DestinationID, prev.DestinationName},
+	}
+	for _, p := range pairs {
+		if strings.TrimSpace(req.Form.Get(p[0])) == "" && strings.TrimSpace(req.Form.Get(p[1])) == "" {
+			req.Form.Set(p[0], p[2])
+			req.Form.Set(p[1], p[3])
+		}
+	}
+
+	t, txnDate, status, err := f.txnFromForm(req.Context(), req.Form)
+	if err != nil {
+		httperror.Send(w, req, status, err.Error())
+		return
+	}
+	if keepDate {
+		// Preserve the time of the existing transaction
+		t.Date = prev.Date
+		txnDate = prevDate
+	}
+	t.TransactionJournalID = prev.TransactionJournalID
+
+	const path = "/api/v1/transactions/"
+
 	var result struct {
 		Data Transactions `json:"data"`
 	}
-	json.NewDecoder(resp.Body).Decode(&result)
+	err = f.do(req.Context(), "PUT", path+id, createRequest{Transactions: []Transaction{t}}, http.StatusOK, &result)
+	if err != nil {
+		httperror.Send(w, req, txnErrorStatus(err), fmt.Sprintf("Could not update transaction: %s", err))
+		return
+	}
 	if result.Data.ID == "" {
-		httperror.Send(w, req, http.StatusInternalServerError, fmt.Sprintf("Could not create transaction: %s", err))
+		httperror.Send(w, req, http.StatusInternalServerError, "Could not update transaction: no transaction in response")
 		return
 	}
 
-	// Invalidate any matching cache entries. Since the transaction was
-	// successfully created, the conversions should not raise errors
+	// Both the old and new category and date may have changed.
+	prevCatID, _ := strconv.Atoi(prev.CategoryID)
 	catID, _ := strconv.Atoi(t.CategoryID)
-	key := categoryTotalsKey{
-		CategoryID: catID,
-		Start:      txnDate,
-		End:        txnDate,
-	}
-	f.invalidateTransactionsCache() // since user is going to txns page next, update now
-	go func() {                     // we can update other caches after returning
-		f.refreshCategoryTxnCache(key)
-		_ = f.refreshAccounts()   // Loads any new accounts created, updates balances
-		_ = f.refreshBigPicture() // Net worth probably changed
-	}()
+	f.invalidateTxnCaches(
+		categoryTotalsKey{CategoryID: prevCatID, Start: prevDate, End: prevDate},
+		categoryTotalsKey{CategoryID: catID, Start: txnDate, End: txnDate},
+	)
 
-	// Successful txn creation should redirect the client to the transactions page
-	http.Redirect(w, r, "/app/txns", http.StatusFound)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result.Data)
+}
+
+func (f *Firefly) deleteTxn(w http.ResponseWriter, req *http.Request) {
+	id := req.URL.Path[strings.LastIndex(req.URL.Path, "/")+1:]
+	if _, err := strconv.Atoi(id); err != nil {
+		httperror.Send(w, req, http.StatusBadRequest, fmt.Sprintf("Could not parse transaction ID: %s", id))
+		return
+	}
+
+	// Fetch the transaction first, so that we know which cache entries to
+	// invalidate.
+	existing, err := f.FetchTransaction(req.Context(), id)
+	if err != nil {
+		httperror.Send(w, req, txnErrorStatus(err), fmt.Sprintf("Could not fetch transaction: %s", err))
+		return
+	}
+
+	const path = "/api/v1/transactions/"
+
+	err = f.do(req.Context(), "DELETE", path+id, nil, http.StatusNoContent, nil)
+	if err != nil {
+		httperror.Send(w, req, txnErrorStatus(err), fmt.Sprintf("Could not delete transaction: %s", err))
+		return
+	}
+
+	var keys []categoryTotalsKey
+	for _, t := range existing.Attributes.Transactions {
+		catID, _ := strconv.Atoi(t.CategoryID)
+		date, err := time.Parse(fireflyAPIDateFormat, t.Date)
+		if err != nil {
+			log.Printf("Could not parse date of deleted transaction %s: %s", id, err)
+			continue
+		}
+		keys = append(keys, categoryTotalsKey{CategoryID: catID, Start: date, End: date})
+	}
+	f.invalidateTxnCaches(keys...)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// txnErrorStatus returns the status to respond with when a request to
+// Firefly-III for a transaction fails: 404 if there is no such transaction,
+// or 500 otherwise.
+func txnErrorStatus(err error) int {
+	var se *StatusError
+	if errors.As(err, &se) && se.StatusCode == http.StatusNotFound {
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
 }
 
 // resolveAccount will determine the ID of an account, provided a name; or the
 // name, provided an ID.
-func (f *Firefly) resolveAccount(id, name string) (string, string) {
+func (f *Firefly) resolveAccount(ctx context.Context, id, name string) (string, string) {
 	// Both name and ID missing or provided
 	if (id == "" && name == "") || (id != "" && name != "") {
 		return id, name
 	}
 
-	accts, _ := f.CachedAccounts()
+	accts, _ := f.CachedAccounts(ctx)
 
 	// Name provided, ID missing
 	if id == "" && name != "" {
@@ -288,11 +772,11 @@ const (
 //
 // TODO(davidschlachter): this may be confused if we have two accounts with the
 // same name but different types, e.g. expense and revenue
-func (f *Firefly) calcTxnType(srcID, srcName, destID, destName string) string {
-	srcID, srcName = f.resolveAccount(srcID, srcName)
-	destID, destName = f.resolveAccount(destID, destName)
+func (f *Firefly) calcTxnType(ctx context.Context, srcID, srcName, destID, destName string) string {
+	srcID, srcName = f.resolveAccount(ctx, srcID, srcName)
+	destID, destName = f.resolveAccount(ctx, destID, destName)
 	var srcType, destType string
-	accts, _ := f.CachedAccounts()
+	accts, _ := f.CachedAccounts(ctx)
 	// Find type of existing accounts
 	for _, a := range accts {
 		switch a.ID {
@@ -344,32 +828,54 @@ func (f *Firefly) listTxns(w http.ResponseWriter, req *http.Request) {
 		end = endStr[0]
 	}
 
+	query, err := f.searchQuery(req.Context(), req.URL.Query())
+	if err != nil {
+		httperror.Send(w, req, http.StatusBadRequest, err.Error())
+		return
+	}
+
 	key := transactionsKey{
 		Page:  page,
 		Start: start,
 		End:   end,
+		Query: query,
 	}
 
-	txns, err := f.CachedTransactions(key)
+	txns, err := f.CachedTransactions(req.Context(), key)
 	if err != nil {
 		httperror.Send(w, req, http.StatusInternalServerError, fmt.Sprintf("Could not list transactions: %s", err))
 		return
 	}
 
+	f.setCacheAge(w, key)
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(txns)
 }
 
-func (f *Firefly) ListTransactions(key transactionsKey) ([]Transactions, error) {
-	const path = "/api/v1/transactions"
+// ListTransactions lists the transactions between the dates of the key, or
+// the page of the key if it has no dates. If the key has a search query, the
+// matching transactions are searched for instead.
+func (f *Firefly) ListTransactions(ctx context.Context, key transactionsKey) ([]Transactions, error) {
 	var (
+		path               = "/api/v1/transactions"
 		page               int
 		results            []Transactions
 		params, dateParams string
 	)
 
+	if key.Query != "" {
+		path = "/api/v1/search/transactions"
+		query := key.Query
+		if key.Start != "" && key.End != "" {
+			// Both dates are inclusive, as for listing transactions
+			query += fmt.Sprintf(" date_after:%s date_before:%s", key.Start, key.End)
+		}
+		dateParams = "query=" + url.QueryEscape(query)
+	}
 	if key.Start != "" && key.End != "" {
-		dateParams = fmt.Sprintf("start=%s&end=%s", key.Start, key.End)
+		if key.Query == "" {
+			dateParams = fmt.Sprintf("start=%s&end=%s", key.Start, key.End)
+		}
 		page = 1
 	} else {
 		if key.Page == 0 {
@@ -384,20 +890,11 @@ func (f *Firefly) ListTransactions(key transactionsKey) ([]Transactions, error)
 		} else {
 			params = fmt.Sprintf("page=%d", page)
 		}
-		req, _ := http.NewRequest("GET", f.config.URL+path+"?"+params, nil)
-		req.Header.Add("Authorization", "Bearer "+f.config.Token)
-		resp, err := f.client.Do(req)
+		var txns txnsResponse
+		err := f.do(ctx, "GET", path+"?"+params, nil, http.StatusOK, &txns)
 		if err != nil {
 			return nil, fmt.Errorf("failed to fetch Transactions: %s", err)
 		}
-		defer resp.Body.Close()
-
-		if resp.StatusCode != http.StatusOK {
-			return nil, fmt.Errorf("got status %d", resp.StatusCode)
-		}
-
-		var txns txnsResponse
-		json.NewDecoder(resp.Body).Decode(&txns)
 
 		results = append(results, txns.Data...)
 		more = txns.Meta.Pagination.CurrentPage < txns.Meta.Pagination.TotalPages
@@ -413,7 +910,7 @@ func (f *Firefly) fetchTxn(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	txn, err := f.FetchTransaction(id)
+	txn, err := f.FetchTransaction(req.Context(), id)
 	if err != nil {
 		httperror.Send(w, req, http.StatusInternalServerError, fmt.Sprintf("Could not fetch transaction: %s", err))
 		return
@@ -423,25 +920,16 @@ func (f *Firefly) fetchTxn(w http.ResponseWriter, req *http.Request) {
 	json.NewEncoder(w).Encode(txn)
 }
 
-func (f *Firefly) FetchTransaction(id string) (*Transactions, error) {
+func (f *Firefly) FetchTransaction(ctx context.Context, id string) (*Transactions, error) {
 	const path = "/api/v1/transactions/"
 
-	req, _ := http.NewRequest("GET", f.config.URL+path+id, nil)
-	req.Header.Add("Authorization", "Bearer "+f.config.Token)
-	resp, err := f.client.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("failed to fetch Transaction: %s", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("got status %d", resp.StatusCode)
-	}
-
 	var result struct {
 		Data Transactions `json:"data"`
 	}
-	json.NewDecoder(resp.Body).Decode(&result)
+	err := f.do(ctx, "GET", path+id, nil, http.StatusOK, &result)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch Transaction: %w", err)
+	}
 
 	if result.Data.ID == "" {
 		return nil, fmt.Errorf("no transaction found")
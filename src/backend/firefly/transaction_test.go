@@ -1,7 +1,9 @@
 package firefly_test
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"io"
 	"net/http"
 	"net/http/httptest"
@@ -145,3 +147,222 @@ func TestCreateTransaction(t *testing.T) {
 		t.Fatalf("Status code = %d, want %d\n. Response body: %s", w.Result().StatusCode, http.StatusOK, body)
 	}
 }
+
+func TestCreateTransactionExternalID(t *testing.T) {
+	data := url.Values{}
+	data.Set("date", "2022-01-01")
+	data.Set("amount", "13.37")
+	data.Set("description", "Mirror")
+	data.Set("category_id", "4")
+	data.Set("source_name", "Savings accounts")
+	data.Set("destination_name", "Structube")
+
+	// A transaction with a new external ID is created
+	data.Set("external_id", "imported-2")
+	created, status, err := f.CreateTransaction(t.Context(), data)
+	if err != nil || status != http.StatusCreated || created.ID != "2774" {
+		t.Fatalf("Got transaction %+v, status %d and error %v, wanted transaction 2774 to be created", created, status, err)
+	}
+
+	// A transaction that was already imported is rejected
+	data.Set("external_id", "imported-1")
+	_, status, err = f.CreateTransaction(t.Context(), data)
+	if !errors.Is(err, firefly.ErrDuplicate) || status != http.StatusConflict {
+		t.Fatalf("Got status %d and error %v, wanted %d and ErrDuplicate", status, err, http.StatusConflict)
+	}
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/api/transactions/", strings.NewReader(data.Encode()))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	f.HandleTxn(w, req)
+	if w.Result().StatusCode != http.StatusConflict {
+		t.Fatalf("Status code = %d, want %d\n", w.Result().StatusCode, http.StatusConflict)
+	}
+}
+
+type categorizer struct {
+	categoryID string
+	seen       firefly.Transaction
+}
+
+func (c *categorizer) Categorize(ctx context.Context, t *firefly.Transaction) error {
+	c.seen = *t
+	t.CategoryID = c.categoryID
+	return nil
+}
+
+func TestCreateTransactionCategorized(t *testing.T) {
+	for _, test := range []struct {
+		categoryID string
+		want       int
+	}{
+		{categoryID: "4", want: http.StatusFound},
+		{categoryID: "99", want: http.StatusBadRequest},
+	} {
+		c := &categorizer{categoryID: test.categoryID}
+		f, err := firefly.New(server.Client(), firefly.Config{Token: "token", URL: server.URL, Categorizer: c})
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+
+		data := url.Values{}
+		data.Set("date", "2022-01-01")
+		data.Set("amount", "13.37")
+		data.Set("description", "Mirror")
+		data.Set("source_name", "Savings accounts")
+		data.Set("destination_name", "Structube")
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/api/transactions/", strings.NewReader(data.Encode()))
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		f.HandleTxn(w, req)
+
+		if w.Result().StatusCode != test.want {
+			t.Fatalf("Status code = %d for category %s, want %d. Response body: %s", w.Result().StatusCode, test.categoryID, test.want, w.Body.String())
+		}
+		if c.seen.DestinationName != "Structube" || !c.seen.Amount.Equal(decimal.RequireFromString("13.37")) {
+			t.Fatalf("Categorizer got transaction %+v, wanted the submitted transaction", c.seen)
+		}
+	}
+}
+
+func TestUpdateTransaction(t *testing.T) {
+	data := url.Values{}
+	data.Set("amount", "5.25")
+	data.Set("description", "Mirror (corrected)")
+	data.Set("category_name", "Apartment")
+	data.Set("source_name", "Savings accounts")
+	data.Set("destination_name", "Structube")
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPut, "/api/transactions/2763", strings.NewReader(data.Encode()))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	f.HandleTxn(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(res.Body)
+		t.Fatalf("Status code = %d, want %d\n. Response body: %s", res.StatusCode, http.StatusOK, body)
+	}
+	var x firefly.Transactions
+	json.NewDecoder(res.Body).Decode(&x)
+	if x.ID != "2763" {
+		t.Fatalf("Got transaction ID %s, wanted 2763", x.ID)
+	}
+}
+
+func TestUpdateTransactionUnknownCategory(t *testing.T) {
+	data := url.Values{}
+	data.Set("category_name", "Not a category")
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPatch, "/api/transactions/2763", strings.NewReader(data.Encode()))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	f.HandleTxn(w, req)
+
+	if w.Result().StatusCode != http.StatusBadRequest {
+		t.Fatalf("Status code = %d, want %d\n", w.Result().StatusCode, http.StatusBadRequest)
+	}
+}
+
+func TestDeleteTransaction(t *testing.T) {
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodDelete, "/api/transactions/2763", nil)
+	f.HandleTxn(w, req)
+
+	if w.Result().StatusCode != http.StatusNoContent {
+		body, _ := io.ReadAll(w.Result().Body)
+		t.Fatalf("Status code = %d, want %d\n. Response body: %s", w.Result().StatusCode, http.StatusNoContent, body)
+	}
+}
+
+func TestTransactionNotFound(t *testing.T) {
+	for _, method := range []string{http.MethodPatch, http.MethodDelete} {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, "/api/transactions/9999", strings.NewReader("amount=1"))
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		f.HandleTxn(w, req)
+
+		if w.Result().StatusCode != http.StatusNotFound {
+			t.Fatalf("%s: status code = %d, want %d\n", method, w.Result().StatusCode, http.StatusNotFound)
+		}
+	}
+}
+
+func TestCreateSplitTransaction(t *testing.T) {
+	body := `{
+		"group_title": "Grocery store",
+		"date": "2022-01-01",
+		"source_name": "Savings accounts",
+		"destination_name": "Structube",
+		"splits": [
+			{"amount": "10.00", "description": "Mirror", "category_name": "Apartment"},
+			{"amount": "3,37", "description": "Hooks", "category_id": "4"}
+		]
+	}`
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/api/transactions/", strings.NewReader(body))
+	req.Header.Add("Content-Type", "application/json")
+	f.HandleTxn(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusCreated {
+		body, _ := io.ReadAll(res.Body)
+		t.Fatalf("Status code = %d, want %d\n. Response body: %s", res.StatusCode, http.StatusCreated, body)
+	}
+}
+
+func TestCreateSplitTransactionUnknownCategory(t *testing.T) {
+	body := `{
+		"group_title": "Grocery store",
+		"date": "2022-01-01",
+		"source_name": "Savings accounts",
+		"destination_name": "Structube",
+		"splits": [
+			{"amount": "10.00", "description": "Mirror", "category_name": "Apartment"},
+			{"amount": "3.37", "description": "Aspirin", "category_name": "Pharmacy"}
+		]
+	}`
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/api/transactions/", strings.NewReader(body))
+	req.Header.Add("Content-Type", "application/json")
+	f.HandleTxn(w, req)
+
+	if w.Result().StatusCode != http.StatusBadRequest {
+		t.Fatalf("Status code = %d, want %d\n", w.Result().StatusCode, http.StatusBadRequest)
+	}
+}
+
+func TestParseAmount(t *testing.T) {
+	tests := []struct {
+		amount           string
+		decimalSeparator string
+		want             string
+	}{
+		{"1,500.00", ".", "1500"},
+		{"1.234,50", ",", "1234.5"},
+		{"(3,00)", ",", "-3"},
+		{"$ -12.99", ".", "-12.99"},
+		{"1 234,50 €", ",", "1234.5"},
+		{"+5", ".", "5"},
+	}
+	for _, tt := range tests {
+		got, err := firefly.ParseAmount(tt.amount, tt.decimalSeparator)
+		if err != nil || !got.Equal(decimal.RequireFromString(tt.want)) {
+			t.Errorf("Got %s and error %v for '%s', wanted %s", got, err, tt.amount, tt.want)
+		}
+	}
+
+	// Anything other than the thousands separator, spaces and currency
+	// symbols must be rejected rather than dropped
+	for _, amount := range []string{"1e5", "12abc", "4.50 x2", "abc", "", "1.2.3", "12-3", "(4.50", "CAD 5.00"} {
+		if got, err := firefly.ParseAmount(amount, "."); err == nil {
+			t.Errorf("Got %s for '%s', wanted an error", got, amount)
+		}
+	}
+}
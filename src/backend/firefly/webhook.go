@@ -0,0 +1,277 @@
+package firefly
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha3"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/davidschlachter/lychnos/src/backend/httperror"
+	"github.com/shopspring/decimal"
+)
+
+// Webhook triggers sent by Firefly-III for changes to transactions.
+const (
+	TriggerStoreTransaction   = "STORE_TRANSACTION"
+	TriggerUpdateTransaction  = "UPDATE_TRANSACTION"
+	TriggerDestroyTransaction = "DESTROY_TRANSACTION"
+)
+
+// webhookMessage is the body of a webhook from Firefly-III, with the
+// "Transactions" response selected.
+type webhookMessage struct {
+	Trigger  string `json:"trigger"`
+	Response string `json:"response"`
+	Content  struct {
+		ID           webhookID            `json:"id"`
+		Transactions []webhookTransaction `json:"transactions"`
+	} `json:"content"`
+}
+
+type webhookTransaction struct {
+	Date          string          `json:"date"`
+	Amount        decimal.Decimal `json:"amount"`
+	CategoryID    webhookID       `json:"category_id"`
+	SourceID      webhookID       `json:"source_id"`
+	DestinationID webhookID       `json:"destination_id"`
+}
+
+// webhookID accepts IDs sent either as strings or numbers, since this differs
+// between versions of Firefly-III.
+type webhookID string
+
+func (id *webhookID) UnmarshalJSON(b []byte) error {
+	if string(b) == "null" {
+		*id = ""
+		return nil
+	}
+	s, err := strconv.Unquote(string(b))
+	if err != nil {
+		s = string(b)
+	}
+	*id = webhookID(s)
+	return nil
+}
+
+// HasWebhookSecret reports whether webhooks from Firefly-III are configured.
+// If not, caches must be refreshed by polling instead.
+func (f *Firefly) HasWebhookSecret() bool {
+	return len(f.config.WebhookSecrets) > 0
+}
+
+// HandleWebhook receives webhooks from Firefly-III for stored, updated or
+// destroyed transactions, and evicts only the cache entries affected by the
+// transaction.
+func (f *Firefly) HandleWebhook(w http.ResponseWriter, req *http.Request) {
+	log.Printf("%s %s", req.Method, req.RequestURI)
+	if req.Method != "POST" {
+		w.WriteHeader(http.StatusNotImplemented)
+		fmt.Fprintf(w, "Unsupported method %s", req.Method)
+		return
+	}
+	if !f.HasWebhookSecret() {
+		httperror.Send(w, req, http.StatusNotFound, "Webhooks are not configured")
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(req.Body, 10<<20))
+	if err != nil {
+		httperror.Send(w, req, http.StatusBadRequest, fmt.Sprintf("Could not read webhook: %s", err))
+		return
+	}
+	valid := false
+	for _, secret := range f.config.WebhookSecrets {
+		valid = valid || validSignature(req.Header.Get("Signature"), body, secret)
+	}
+	if !valid {
+		httperror.Send(w, req, http.StatusUnauthorized, "Invalid webhook signature")
+		return
+	}
+
+	var msg webhookMessage
+	err = json.Unmarshal(body, &msg)
+	if err != nil {
+		httperror.Send(w, req, http.StatusBadRequest, fmt.Sprintf("Could not parse webhook: %s", err))
+		return
+	}
+
+	switch msg.Trigger {
+	case TriggerStoreTransaction, TriggerUpdateTransaction, TriggerDestroyTransaction:
+	default:
+		httperror.Send(w, req, http.StatusBadRequest, fmt.Sprintf("Unsupported webhook trigger %s", msg.Trigger))
+		return
+	}
+
+	accounts := f.evictWebhookTransactions(msg)
+	f.refreshSuggestions()
+	f.cache.refreshes.add(nil, func(ctx context.Context) error {
+		err := f.refreshAccountBalances(ctx, accounts)
+		if err != nil {
+			return fmt.Errorf("could not refresh account balances after webhook: %s", err)
+		}
+		return nil
+	})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// validSignature checks the Signature header of a webhook, which has the form
+// "t=<timestamp>,v1=<signature>". The signature is the HMAC-SHA3-256 of the
+// timestamp and body, joined by a period.
+func validSignature(header string, body []byte, secret string) bool {
+	var timestamp, signature string
+	for _, part := range strings.Split(header, ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch k {
+		case "t":
+			timestamp = v
+		case "v1":
+			signature = v
+		}
+	}
+	if timestamp == "" || signature == "" {
+		return false
+	}
+	expected, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(func() hash.Hash { return sha3.New256() }, []byte(secret))
+	mac.Write([]byte(timestamp + "." + string(body)))
+	return hmac.Equal(mac.Sum(nil), expected)
+}
+
+// evictWebhookTransactions removes the cache entries affected by the
+// transactions in the webhook, and returns the IDs of the accounts involved.
+// For updates, the previous version of the transaction is also evicted if it
+// is cached; if not, all category totals are evicted, since the previous
+// category and date are unknown.
+func (f *Firefly) evictWebhookTransactions(msg webhookMessage) map[string]struct{} {
+	var (
+		dates    []time.Time
+		keys     []categoryTotalsKey
+		accounts = make(map[string]struct{})
+	)
+
+	for _, t := range msg.Content.Transactions {
+		date, err := time.Parse(time.RFC3339, t.Date)
+		if err != nil {
+			log.Printf("Could not parse date of transaction %s in webhook: %s", msg.Content.ID, err)
+			continue
+		}
+		catID, _ := strconv.Atoi(string(t.CategoryID))
+		keys = append(keys, categoryTotalsKey{CategoryID: catID, Start: date, End: date})
+		dates = append(dates, date)
+		for _, a := range []webhookID{t.SourceID, t.DestinationID} {
+			if a != "" {
+				accounts[string(a)] = struct{}{}
+			}
+		}
+	}
+
+	f.cache.mu.Lock()
+	defer f.cache.mu.Unlock()
+
+	allCategories := false
+	if msg.Trigger == TriggerUpdateTransaction {
+		prev, ok := f.cachedTransactionGroup(string(msg.Content.ID))
+		if ok {
+			for _, t := range prev.Attributes.Transactions {
+				date, err := time.Parse(fireflyAPIDateFormat, t.Date)
+				if err != nil {
+					allCategories = true
+					continue
+				}
+				catID, _ := strconv.Atoi(t.CategoryID)
+				keys = append(keys, categoryTotalsKey{CategoryID: catID, Start: date, End: date})
+				dates = append(dates, date)
+				for _, a := range []string{t.SourceID, t.DestinationID} {
+					if a != "" {
+						accounts[a] = struct{}{}
+					}
+				}
+			}
+		} else {
+			allCategories = true
+		}
+	}
+
+	for k := range f.cache.CategoryTotals {
+		if allCategories || matchesCategoryTotalsKey(k, keys) {
+			log.Printf("Cache: clearing CategoryTotals for key %d, %s, %s", k.CategoryID, k.Start, k.End)
+			delete(f.cache.CategoryTotals, k)
+		}
+	}
+	for k := range f.cache.Transactions {
+		if matchesTransactionsKey(k, dates) {
+			log.Printf("Cache: clearing Transactions for key %d, %s, %s", k.Page, k.Start, k.End)
+			delete(f.cache.Transactions, k)
+		}
+	}
+	f.cache.BigPicture = nil // net worth probably changed
+
+	return accounts
+}
+
+// cachedTransactionGroup finds the transaction group with the provided ID in
+// the cached transaction lists. The caller is responsible for locking the
+// mutex.
+func (f *Firefly) cachedTransactionGroup(id string) (Transactions, bool) {
+	for _, txns := range f.cache.Transactions {
+		for _, t := range txns {
+			if t.ID == id {
+				return t, true
+			}
+		}
+	}
+	return Transactions{}, false
+}
+
+// matchesCategoryTotalsKey reports whether the category totals for k include
+// any of the transactions described by tgts, whose Start and End are the date
+// of the transaction.
+func matchesCategoryTotalsKey(k categoryTotalsKey, tgts []categoryTotalsKey) bool {
+	for _, tgt := range tgts {
+		if k.CategoryID != 0 && k.CategoryID != tgt.CategoryID {
+			continue
+		}
+		if !tgt.Start.Before(k.Start) && !tgt.Start.After(k.End) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesTransactionsKey reports whether the transactions list for k could
+// include a transaction on any of the dates. Lists that are not limited to a
+// date range are paginated, so any change could shift their pages.
+func matchesTransactionsKey(k transactionsKey, dates []time.Time) bool {
+	if k.Start == "" || k.End == "" {
+		return true
+	}
+	start, err := time.ParseInLocation(inputDateFormat, k.Start, time.Local)
+	if err != nil {
+		return true
+	}
+	end, err := time.ParseInLocation(inputDateFormat, k.End, time.Local)
+	if err != nil {
+		return true
+	}
+	end = end.AddDate(0, 0, 1)
+	for _, d := range dates {
+		if !d.Before(start) && d.Before(end) {
+			return true
+		}
+	}
+	return false
+}
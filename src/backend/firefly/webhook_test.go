@@ -0,0 +1,108 @@
+package firefly_test
+
+import (
+	"crypto/hmac"
+	"crypto/sha3"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/davidschlachter/lychnos/src/backend/firefly"
+)
+
+const webhookBody = `{"uuid":"0f9e1d6c","user_id":1,"trigger":"STORE_TRANSACTION","response":"TRANSACTIONS","url":"http://lychnos/api/webhooks/firefly","version":"v0","content":{"id":2775,"user":1,"group_title":null,"transactions":[{"transaction_journal_id":2821,"type":"withdrawal","date":"2022-01-15T00:00:00-05:00","amount":"13.37","description":"Mirror","source_id":3,"source_name":"Savings accounts","destination_id":529,"destination_name":"Structube","category_id":4,"category_name":"Apartment"}]}}`
+
+func sign(body, secret string) string {
+	timestamp := "1642222800"
+	mac := hmac.New(func() hash.Hash { return sha3.New256() }, []byte(secret))
+	mac.Write([]byte(timestamp + "." + body))
+	return fmt.Sprintf("t=%s,v1=%s", timestamp, hex.EncodeToString(mac.Sum(nil)))
+}
+
+func TestWebhook(t *testing.T) {
+	var (
+		mu   sync.Mutex
+		hits = make(map[string]int)
+	)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/categories/", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		hits[r.URL.Path+"?"+r.URL.RawQuery]++
+		mu.Unlock()
+		id := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+		fmt.Fprintf(w, `{"data":{"type":"categories","id":"%s","attributes":{"name":"Category %s","spent":[{"sum":"-10.00","currency_code":"CAD"}],"earned":[]}}}`, id, id)
+	})
+	mux.HandleFunc("/api/v1/accounts/", func(w http.ResponseWriter, r *http.Request) {
+		id := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+		fmt.Fprintf(w, `{"data":{"type":"accounts","id":"%s","attributes":{"active":true,"name":"Account %s","type":"asset","current_balance":"1.00"}}}`, id, id)
+	})
+	mux.HandleFunc("/api/v1/accounts", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"data":[],"meta":{"pagination":{"current_page":1,"total_pages":1}}}`))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	f, err := firefly.New(server.Client(), firefly.Config{Token: "token", URL: server.URL, WebhookSecrets: []string{"other", "secret"}})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	janStart := time.Date(2022, 1, 1, 0, 0, 0, 0, time.Local)
+	janEnd := time.Date(2022, 1, 31, 23, 59, 59, 0, time.Local)
+	febStart := time.Date(2022, 2, 1, 0, 0, 0, 0, time.Local)
+	febEnd := time.Date(2022, 2, 28, 23, 59, 59, 0, time.Local)
+	fetchAll := func() {
+		for _, k := range []struct {
+			catID      int
+			start, end time.Time
+		}{{4, janStart, janEnd}, {5, janStart, janEnd}, {4, febStart, febEnd}} {
+			_, err := f.CachedFetchCategoryTotals(t.Context(), k.catID, k.start, k.end)
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+		}
+	}
+	fetchAll()
+
+	tests := []struct {
+		name      string
+		signature string
+		expected  int
+	}{
+		{name: "wrong secret", signature: sign(webhookBody, "wrong"), expected: http.StatusUnauthorized},
+		{name: "missing signature", expected: http.StatusUnauthorized},
+		{name: "valid signature", signature: sign(webhookBody, "secret"), expected: http.StatusNoContent},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/api/webhooks/firefly", strings.NewReader(webhookBody))
+		if test.signature != "" {
+			req.Header.Set("Signature", test.signature)
+		}
+		f.HandleWebhook(w, req)
+		if w.Result().StatusCode != test.expected {
+			t.Fatalf("%s: status code = %d, want %d. Response body: %s", test.name, w.Result().StatusCode, test.expected, w.Body.String())
+		}
+	}
+
+	// Only the January totals for category 4 include the transaction
+	fetchAll()
+	mu.Lock()
+	defer mu.Unlock()
+	expected := map[string]int{
+		"/api/v1/categories/4?start=2022-01-01&end=2022-01-31": 2,
+		"/api/v1/categories/5?start=2022-01-01&end=2022-01-31": 1,
+		"/api/v1/categories/4?start=2022-02-01&end=2022-02-28": 1,
+	}
+	for k, v := range expected {
+		if hits[k] != v {
+			t.Errorf("Got %d requests for %s, wanted %d", hits[k], k, v)
+		}
+	}
+}
@@ -7,8 +7,10 @@ toolchain go1.26.1
 require (
 	github.com/DATA-DOG/go-sqlmock v1.5.2
 	github.com/go-sql-driver/mysql v1.10.0
+	github.com/lib/pq v1.12.3
 	github.com/mattn/go-sqlite3 v1.14.44
 	github.com/shopspring/decimal v1.4.0
+	golang.org/x/crypto v0.57.0
 )
 
 require filippo.io/edwards25519 v1.2.0 // indirect
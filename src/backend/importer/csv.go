@@ -0,0 +1,160 @@
+package importer
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/davidschlachter/lychnos/src/backend/firefly"
+	"github.com/davidschlachter/lychnos/src/backend/httperror"
+	"github.com/shopspring/decimal"
+)
+
+// HandleCSV imports transactions from a CSV statement in two steps. First, a
+// multipart form with the statement as "file" and the ID of a mapping profile
+// as "profile" is parsed, and the rows are returned as a preview without
+// creating anything. Then, the (possibly edited) rows are submitted as a JSON
+// createRequest to create the transactions.
+func (i *Importer) HandleCSV(w http.ResponseWriter, req *http.Request) {
+	log.Printf("%s %s", req.Method, req.RequestURI)
+	switch req.Method {
+	case "POST":
+		if strings.HasPrefix(req.Header.Get("Content-Type"), "application/json") {
+			i.create(w, req)
+		} else {
+			i.previewCSV(w, req)
+		}
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+		fmt.Fprintf(w, "Unsupported method %s", req.Method)
+	}
+}
+
+func (i *Importer) previewCSV(w http.ResponseWriter, req *http.Request) {
+	req.Body = http.MaxBytesReader(w, req.Body, maxUploadSize)
+	err := req.ParseMultipartForm(maxUploadSize)
+	if err != nil {
+		httperror.Send(w, req, http.StatusBadRequest, fmt.Sprintf("Could not parse upload: %s", err))
+		return
+	}
+	id, err := strconv.Atoi(req.FormValue("profile"))
+	if err != nil {
+		httperror.Send(w, req, http.StatusBadRequest, "Must provide the ID of a mapping profile")
+		return
+	}
+	p, err := i.Profile(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		httperror.Send(w, req, http.StatusBadRequest, fmt.Sprintf("No profile with ID %d", id))
+		return
+	}
+	if err != nil {
+		httperror.Send(w, req, http.StatusInternalServerError, fmt.Sprintf("Could not fetch profile: %s", err))
+		return
+	}
+	file, _, err := req.FormFile("file")
+	if err != nil {
+		httperror.Send(w, req, http.StatusBadRequest, fmt.Sprintf("Must provide a statement as file: %s", err))
+		return
+	}
+	defer file.Close()
+
+	rows, err := p.ParseCSV(file)
+	if err != nil {
+		httperror.Send(w, req, http.StatusBadRequest, fmt.Sprintf("Could not parse statement: %s", err))
+		return
+	}
+	err = i.categorize(req.Context(), rows)
+	if err != nil {
+		httperror.Send(w, req, http.StatusInternalServerError, fmt.Sprintf("Could not categorize transactions: %s", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(createRequest{Rows: rows})
+}
+
+// ParseCSV parses a CSV statement with the profile. Rows that can't be parsed
+// are returned with an Error, so that the rest of the statement can still be
+// imported.
+func (p Profile) ParseCSV(r io.Reader) ([]Row, error) {
+	cr := csv.NewReader(r)
+	cr.Comma = []rune(p.Delimiter)[0]
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+
+	layout := dateLayout(p.DateFormat)
+	rows := []Row{}
+	for n := 0; ; n++ {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if n < p.SkipRows || (len(record) == 1 && strings.TrimSpace(record[0]) == "") {
+			continue
+		}
+		line, _ := cr.FieldPos(0)
+		rows = append(rows, p.parseRecord(line, record, layout))
+	}
+	return rows, nil
+}
+
+func (p Profile) parseRecord(line int, record []string, layout string) Row {
+	row := Row{Line: line}
+	if max(p.DateColumn, p.DescriptionColumn, p.AmountColumn) > len(record) {
+		row.Error = fmt.Sprintf("expected at least %d columns, got %d", max(p.DateColumn, p.DescriptionColumn, p.AmountColumn), len(record))
+		return row
+	}
+
+	row.Description = strings.TrimSpace(record[p.DescriptionColumn-1])
+	date, err := time.Parse(layout, strings.TrimSpace(record[p.DateColumn-1]))
+	if err != nil {
+		row.Error = fmt.Sprintf("could not parse date '%s' as %s", record[p.DateColumn-1], p.DateFormat)
+		return row
+	}
+	row.Date = date.Format("2006-01-02")
+	amt, err := firefly.ParseAmount(record[p.AmountColumn-1], p.DecimalSeparator)
+	if err != nil {
+		row.Error = err.Error()
+		return row
+	}
+	if amt.IsZero() {
+		row.Error = "amount is zero"
+		return row
+	}
+	withdrawal := amt.IsNegative()
+	if p.AmountSign == PositiveWithdrawals {
+		withdrawal = !withdrawal
+	}
+	assignAccounts(&row, amt, withdrawal, p.AccountID)
+	return row
+}
+
+// assignAccounts sets the amount of the row, and assigns the account as the
+// source of withdrawals or the destination of deposits. The other account is
+// named after the description, which the client will often want to change.
+func assignAccounts(row *Row, amt decimal.Decimal, withdrawal bool, accountID string) {
+	row.Amount = amt.Abs().String()
+	if withdrawal {
+		row.SourceID = accountID
+		row.DestinationName = row.Description
+	} else {
+		row.SourceName = row.Description
+		row.DestinationID = accountID
+	}
+}
+
+// dateLayout converts a date format like DD/MM/YYYY to a Go time layout.
+func dateLayout(format string) string {
+	return strings.NewReplacer("YYYY", "2006", "YY", "06", "MM", "01", "M", "1", "DD", "02", "D", "2").Replace(format)
+}
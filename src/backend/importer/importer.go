@@ -0,0 +1,173 @@
+// Package importer creates Firefly-III transactions from bank statements.
+package importer
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+
+	"github.com/davidschlachter/lychnos/src/backend/dialect"
+	"github.com/davidschlachter/lychnos/src/backend/firefly"
+	"github.com/davidschlachter/lychnos/src/backend/httperror"
+	"github.com/shopspring/decimal"
+)
+
+// maxUploadSize limits the size of uploaded statements.
+const maxUploadSize = 10 << 20
+
+var hasID = regexp.MustCompile(`/[0-9]+$`)
+
+type Importer struct {
+	db *sql.DB
+	d  dialect.Dialect
+	f  *firefly.Firefly
+}
+
+func New(db *sql.DB, d dialect.Dialect, f *firefly.Firefly) *Importer {
+	return &Importer{db: db, d: d, f: f}
+}
+
+// Row is a transaction parsed from a statement. When previewing an import, the
+// accounts are assigned from the profile and the description, and the client
+// may change them (and assign categories) before creating the transactions.
+type Row struct {
+	// Line is the line of the statement that the row was parsed from, or for
+	// OFX and QIF statements, the position of its transaction.
+	Line int `json:"line"`
+	// Date is formatted as YYYY-MM-DD, and Amount is always positive, with a
+	// period as the decimal separator.
+	Date            string `json:"date"`
+	Amount          string `json:"amount"`
+	Description     string `json:"description"`
+	SourceID        string `json:"source_id,omitempty"`
+	SourceName      string `json:"source_name,omitempty"`
+	DestinationID   string `json:"destination_id,omitempty"`
+	DestinationName string `json:"destination_name,omitempty"`
+	CategoryID      string `json:"category_id,omitempty"`
+	CategoryName    string `json:"category_name,omitempty"`
+	// ExternalID identifies the transaction in the statement, if the format
+	// has IDs, so that importing the same statement twice doesn't create
+	// duplicates.
+	ExternalID string `json:"external_id,omitempty"`
+	// Force creates the transaction even if it looks like a duplicate of a
+	// recent one.
+	Force bool `json:"force,omitempty"`
+	// Error describes why the row could not be parsed, if it couldn't.
+	Error string `json:"error,omitempty"`
+}
+
+// Result is the outcome of creating the transaction for a Row. Rows that were
+// already imported are skipped, rather than failed.
+type Result struct {
+	Line    int    `json:"line"`
+	Created bool   `json:"created"`
+	Skipped bool   `json:"skipped,omitempty"`
+	ID      string `json:"id,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+type createRequest struct {
+	Rows []Row `json:"rows"`
+}
+
+type createResponse struct {
+	Created int      `json:"created"`
+	Skipped int      `json:"skipped"`
+	Failed  int      `json:"failed"`
+	Results []Result `json:"results"`
+}
+
+// categorize assigns categories to the previewed rows, in the same way as when
+// creating them, so that the client can review the categories.
+func (i *Importer) categorize(ctx context.Context, rows []Row) error {
+	for n := range rows {
+		row := &rows[n]
+		if row.Error != "" {
+			continue
+		}
+		t := firefly.Transaction{
+			Description:     row.Description,
+			DestinationID:   row.DestinationID,
+			DestinationName: row.DestinationName,
+		}
+		t.Amount, _ = decimal.NewFromString(row.Amount)
+		err := i.f.Categorize(ctx, &t)
+		if err != nil {
+			return err
+		}
+		row.CategoryID, row.Description = t.CategoryID, t.Description
+	}
+	return nil
+}
+
+// create creates the transactions for the rows of a JSON createRequest, one at
+// a time, and reports the result for each row.
+func (i *Importer) create(w http.ResponseWriter, req *http.Request) {
+	var r createRequest
+	err := json.NewDecoder(req.Body).Decode(&r)
+	if err != nil {
+		httperror.Send(w, req, http.StatusBadRequest, fmt.Sprintf("Could not parse JSON body: %s", err))
+		return
+	}
+	if len(r.Rows) == 0 {
+		httperror.Send(w, req, http.StatusBadRequest, "At least one row must be provided")
+		return
+	}
+
+	resp := createResponse{Results: make([]Result, 0, len(r.Rows))}
+	for _, row := range r.Rows {
+		result := i.createRow(req.Context(), row)
+		switch {
+		case result.Created:
+			resp.Created++
+		case result.Skipped:
+			resp.Skipped++
+		default:
+			resp.Failed++
+		}
+		resp.Results = append(resp.Results, result)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (i *Importer) createRow(ctx context.Context, row Row) Result {
+	result := Result{Line: row.Line}
+	if row.Error != "" {
+		result.Error = row.Error
+		return result
+	}
+
+	form := url.Values{}
+	form.Set("date", row.Date)
+	form.Set("amount", row.Amount)
+	form.Set("description", row.Description)
+	form.Set("source_id", row.SourceID)
+	form.Set("source_name", row.SourceName)
+	form.Set("destination_id", row.DestinationID)
+	form.Set("destination_name", row.DestinationName)
+	form.Set("category_id", row.CategoryID)
+	form.Set("category_name", row.CategoryName)
+	form.Set("external_id", row.ExternalID)
+	form.Set("force", strconv.FormatBool(row.Force))
+	created, _, err := i.f.CreateTransaction(ctx, form)
+	if errors.Is(err, firefly.ErrDuplicate) {
+		result.Skipped = true
+		result.Error = err.Error()
+		return result
+	}
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	result.Created = true
+	result.ID = created.ID
+	return result
+}
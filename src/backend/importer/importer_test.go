@@ -0,0 +1,210 @@
+package importer_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+
+	"github.com/davidschlachter/lychnos/src/backend/dialect"
+	"github.com/davidschlachter/lychnos/src/backend/firefly"
+	"github.com/davidschlachter/lychnos/src/backend/firefly/fireflytest"
+	"github.com/davidschlachter/lychnos/src/backend/importer"
+)
+
+func TestParseCSV(t *testing.T) {
+	tests := []struct {
+		name    string
+		profile importer.Profile
+		csv     string
+		want    []importer.Row
+	}{
+		{
+			name:    "negative withdrawals with a header",
+			profile: importer.Profile{Delimiter: ",", SkipRows: 1, DateColumn: 1, DateFormat: "YYYY-MM-DD", DescriptionColumn: 2, AmountColumn: 3, AmountSign: importer.NegativeWithdrawals, DecimalSeparator: ".", AccountID: "3"},
+			csv:     "Date,Description,Amount\n2025-03-01,Grocery store,-42.10\n2025-03-02,\"Payroll, Inc.\",\"1,500.00\"\n",
+			want: []importer.Row{
+				{Line: 2, Date: "2025-03-01", Amount: "42.1", Description: "Grocery store", SourceID: "3", DestinationName: "Grocery store"},
+				{Line: 3, Date: "2025-03-02", Amount: "1500", Description: "Payroll, Inc.", SourceName: "Payroll, Inc.", DestinationID: "3"},
+			},
+		},
+		{
+			name:    "positive withdrawals with a comma decimal separator",
+			profile: importer.Profile{Delimiter: ";", DateColumn: 2, DateFormat: "DD/MM/YYYY", DescriptionColumn: 1, AmountColumn: 3, AmountSign: importer.PositiveWithdrawals, DecimalSeparator: ",", AccountID: "5"},
+			csv:     "Café;01/03/2025;1.234,50\nRefund;2/3/2025;(3,00)\n",
+			want: []importer.Row{
+				{Line: 1, Date: "2025-03-01", Amount: "1234.5", Description: "Café", SourceID: "5", DestinationName: "Café"},
+				{Line: 2, Error: "could not parse date '2/3/2025' as DD/MM/YYYY", Description: "Refund"},
+			},
+		},
+		{
+			name:    "invalid rows are reported",
+			profile: importer.Profile{Delimiter: ",", DateColumn: 1, DateFormat: "M/D/YY", DescriptionColumn: 2, AmountColumn: 3, AmountSign: importer.NegativeWithdrawals, DecimalSeparator: ".", AccountID: "3"},
+			csv:     "3/1/25,Interest,(0.50)\n3/2/25,Nothing\n3/3/25,Free,0.00\n3/4/25,Typo,abc\n",
+			want: []importer.Row{
+				{Line: 1, Date: "2025-03-01", Amount: "0.5", Description: "Interest", SourceID: "3", DestinationName: "Interest"},
+				{Line: 2, Error: "expected at least 3 columns, got 2"},
+				{Line: 3, Date: "2025-03-03", Description: "Free", Error: "amount is zero"},
+				{Line: 4, Date: "2025-03-04", Description: "Typo", Error: "could not parse amount 'abc'"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.profile.ParseCSV(strings.NewReader(tt.csv))
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("Got rows %+v, wanted %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// newFirefly returns a client for a Firefly-III server with a single asset
+// account, which has already imported the transaction with external ID 1, and
+// the server, which records the transactions created.
+func newFirefly(t *testing.T) (*firefly.Firefly, *fireflytest.Server) {
+	server := fireflytest.NewServer(t, map[string]http.HandlerFunc{
+		"/api/v1/search/transactions": func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Query().Get("query") != `external_id_is:"1"` {
+				w.Write([]byte(fireflytest.EmptyList))
+				return
+			}
+			w.Write([]byte(`{"data":[{"type":"transactions","id":"2770","attributes":{"transactions":[{"type":"withdrawal","amount":"42.10","description":"Grocery store","source_id":"3","destination_name":"Grocery store","external_id":"1"}]}}],"meta":{"pagination":{"total":1,"count":1,"per_page":50,"current_page":1,"total_pages":1}}}`))
+		},
+	})
+	return server.Firefly(t, firefly.Config{}), server
+}
+
+func TestHandleCSV(t *testing.T) {
+	f, server := newFirefly(t)
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Unexpected error opening mock database connection: %s\n", err)
+	}
+	defer db.Close()
+	mock.ExpectQuery(`SELECT id, name, delimiter, skip_rows, date_column, date_format, description_column, amount_column, amount_sign, decimal_separator, account_id FROM import_profiles WHERE id = (\?|\$1);`).
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "delimiter", "skip_rows", "date_column", "date_format", "description_column", "amount_column", "amount_sign", "decimal_separator", "account_id"}).
+			AddRow(1, "Chequing", ",", 1, 1, "YYYY-MM-DD", 2, 3, "negative", ".", "3"))
+	i := importer.New(db, dialect.SQLite, f)
+
+	// Preview
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("profile", "1")
+	fw, _ := mw.CreateFormFile("file", "statement.csv")
+	fw.Write([]byte("Date,Description,Amount\n2025-03-01,Grocery store,-42.10\n03/02/2025,Bad date,-1\n"))
+	mw.Close()
+	req := httptest.NewRequest(http.MethodPost, "/api/import/csv", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	w := httptest.NewRecorder()
+	i.HandleCSV(w, req)
+	if w.Result().StatusCode != http.StatusOK {
+		t.Fatalf("Status code = %d, want %d. Response body: %s", w.Result().StatusCode, http.StatusOK, w.Body.String())
+	}
+	var preview struct {
+		Rows []importer.Row `json:"rows"`
+	}
+	err = json.NewDecoder(w.Body).Decode(&preview)
+	if err != nil {
+		t.Fatalf("Unexpected error decoding preview: %s", err)
+	}
+	if len(preview.Rows) != 2 || preview.Rows[0].SourceID != "3" || preview.Rows[1].Error == "" || len(server.Posted()) != 0 {
+		t.Fatalf("Got preview %+v with %d transactions created, wanted a valid and an invalid row, and none created", preview.Rows, len(server.Posted()))
+	}
+
+	// Create, with a row that is missing its accounts instead of the invalid row
+	preview.Rows[1] = importer.Row{Line: 3, Date: "2025-03-02", Amount: "1", Description: "Missing accounts"}
+	data, _ := json.Marshal(preview)
+	req = httptest.NewRequest(http.MethodPost, "/api/import/csv", bytes.NewReader(data))
+	req.Header.Set("Content-Type", "application/json")
+	w = httptest.NewRecorder()
+	i.HandleCSV(w, req)
+	if w.Result().StatusCode != http.StatusOK {
+		t.Fatalf("Status code = %d, want %d. Response body: %s", w.Result().StatusCode, http.StatusOK, w.Body.String())
+	}
+	var got struct {
+		Created int               `json:"created"`
+		Failed  int               `json:"failed"`
+		Results []importer.Result `json:"results"`
+	}
+	err = json.NewDecoder(w.Body).Decode(&got)
+	if err != nil {
+		t.Fatalf("Unexpected error decoding results: %s", err)
+	}
+	if got.Created != 1 || got.Failed != 1 || got.Results[0].ID != "2774" || got.Results[1].Error == "" || len(server.Posted()) != 1 {
+		t.Fatalf("Got results %+v, wanted one created and one failed", got)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestHandleOFX(t *testing.T) {
+	f, server := newFirefly(t)
+	i := importer.New(nil, dialect.SQLite, f)
+
+	// Preview
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("account_id", "3")
+	fw, _ := mw.CreateFormFile("file", "statement.ofx")
+	fw.Write([]byte(`<OFX><BANKTRANLIST>
+<STMTTRN><DTPOSTED>20250301<TRNAMT>-42.10<FITID>1<NAME>Grocery store</STMTTRN>
+<STMTTRN><DTPOSTED>20250302<TRNAMT>1500.00<FITID>2<NAME>Payroll</STMTTRN>
+</BANKTRANLIST></OFX>`))
+	mw.Close()
+	req := httptest.NewRequest(http.MethodPost, "/api/import/ofx", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	w := httptest.NewRecorder()
+	i.HandleOFX(w, req)
+	if w.Result().StatusCode != http.StatusOK {
+		t.Fatalf("Status code = %d, want %d. Response body: %s", w.Result().StatusCode, http.StatusOK, w.Body.String())
+	}
+	var preview struct {
+		Rows []importer.Row `json:"rows"`
+	}
+	err := json.NewDecoder(w.Body).Decode(&preview)
+	if err != nil {
+		t.Fatalf("Unexpected error decoding preview: %s", err)
+	}
+	want := []importer.Row{
+		{Line: 1, Date: "2025-03-01", Amount: "42.1", Description: "Grocery store", SourceID: "3", DestinationName: "Grocery store", ExternalID: "1"},
+		{Line: 2, Date: "2025-03-02", Amount: "1500", Description: "Payroll", SourceName: "Payroll", DestinationID: "3", ExternalID: "2"},
+	}
+	if !reflect.DeepEqual(preview.Rows, want) {
+		t.Fatalf("Got rows %+v, wanted %+v", preview.Rows, want)
+	}
+
+	// Create, skipping the transaction that was already imported
+	data, _ := json.Marshal(preview)
+	req = httptest.NewRequest(http.MethodPost, "/api/import/ofx", bytes.NewReader(data))
+	req.Header.Set("Content-Type", "application/json")
+	w = httptest.NewRecorder()
+	i.HandleOFX(w, req)
+	var got struct {
+		Created int               `json:"created"`
+		Skipped int               `json:"skipped"`
+		Failed  int               `json:"failed"`
+		Results []importer.Result `json:"results"`
+	}
+	err = json.NewDecoder(w.Body).Decode(&got)
+	if err != nil {
+		t.Fatalf("Unexpected error decoding results: %s", err)
+	}
+	if got.Created != 1 || got.Skipped != 1 || got.Failed != 0 || !got.Results[0].Skipped || len(server.Posted()) != 1 {
+		t.Fatalf("Got results %+v, wanted the first row skipped and the second created", got)
+	}
+}
@@ -0,0 +1,220 @@
+package importer
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/davidschlachter/lychnos/src/backend/httperror"
+)
+
+// Amount sign conventions of bank statements.
+const (
+	// NegativeWithdrawals means that withdrawals have negative amounts, as
+	// for most chequing accounts.
+	NegativeWithdrawals = "negative"
+	// PositiveWithdrawals means that withdrawals have positive amounts, as for
+	// most credit card statements.
+	PositiveWithdrawals = "positive"
+)
+
+// Profile maps the columns of a bank's CSV statements to transactions. Column
+// numbers start at 1.
+type Profile struct {
+	ID        int    `json:"id"`
+	Name      string `json:"name"`
+	Delimiter string `json:"delimiter"`
+	// SkipRows is the number of rows before the first transaction, e.g. 1
+	// for a header row.
+	SkipRows          int `json:"skip_rows"`
+	DateColumn        int `json:"date_column"`
+	DescriptionColumn int `json:"description_column"`
+	AmountColumn      int `json:"amount_column"`
+	// DateFormat is written with YYYY, YY, MM, M, DD and D, e.g. DD/MM/YYYY.
+	DateFormat string `json:"date_format"`
+	// AmountSign is NegativeWithdrawals or PositiveWithdrawals.
+	AmountSign       string `json:"amount_sign"`
+	DecimalSeparator string `json:"decimal_separator"`
+	// AccountID is the Firefly-III asset account of the statements.
+	AccountID string `json:"account_id"`
+}
+
+// validate checks the profile, filling in defaults for optional fields.
+func (p *Profile) validate() error {
+	if p.Name == "" {
+		return fmt.Errorf("name must be provided")
+	}
+	if p.Delimiter == "" {
+		p.Delimiter = ","
+	}
+	if p.DateFormat == "" {
+		p.DateFormat = "YYYY-MM-DD"
+	}
+	if p.AmountSign == "" {
+		p.AmountSign = NegativeWithdrawals
+	}
+	if p.DecimalSeparator == "" {
+		p.DecimalSeparator = "."
+	}
+	if len([]rune(p.Delimiter)) != 1 {
+		return fmt.Errorf("delimiter must be a single character")
+	}
+	if p.SkipRows < 0 {
+		return fmt.Errorf("skip_rows must not be negative")
+	}
+	if p.DateColumn < 1 || p.DescriptionColumn < 1 || p.AmountColumn < 1 {
+		return fmt.Errorf("date_column, description_column and amount_column must be provided, starting at 1")
+	}
+	if p.AmountSign != NegativeWithdrawals && p.AmountSign != PositiveWithdrawals {
+		return fmt.Errorf("amount_sign must be %s or %s", NegativeWithdrawals, PositiveWithdrawals)
+	}
+	if p.DecimalSeparator != "." && p.DecimalSeparator != "," {
+		return fmt.Errorf("decimal_separator must be . or ,")
+	}
+	if _, err := strconv.Atoi(p.AccountID); err != nil {
+		return fmt.Errorf("account_id must be the ID of a Firefly-III account")
+	}
+	return nil
+}
+
+const profileColumns = "id, name, delimiter, skip_rows, date_column, date_format, description_column, amount_column, amount_sign, decimal_separator, account_id"
+
+// HandleProfiles lists, creates, replaces and deletes mapping profiles.
+func (i *Importer) HandleProfiles(w http.ResponseWriter, req *http.Request) {
+	log.Printf("%s %s", req.Method, req.RequestURI)
+	switch req.Method {
+	case "GET":
+		if hasID.MatchString(req.URL.Path) {
+			i.fetchProfile(w, req)
+		} else {
+			i.listProfiles(w, req)
+		}
+	case "POST":
+		i.upsertProfile(w, req)
+	case "DELETE":
+		i.deleteProfile(w, req)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+		fmt.Fprintf(w, "Unsupported method %s", req.Method)
+	}
+}
+
+func (i *Importer) fetchProfile(w http.ResponseWriter, req *http.Request) {
+	id, _ := strconv.Atoi(req.URL.Path[strings.LastIndex(req.URL.Path, "/")+1:])
+	p, err := i.Profile(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		httperror.Send(w, req, http.StatusNotFound, fmt.Sprintf("No profile with ID %d", id))
+		return
+	}
+	if err != nil {
+		httperror.Send(w, req, http.StatusInternalServerError, fmt.Sprintf("Could not fetch profile: %s", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p)
+}
+
+// Profile fetches the mapping profile with the provided ID. If there is no
+// such profile, sql.ErrNoRows is returned.
+func (i *Importer) Profile(id int) (Profile, error) {
+	const q = "SELECT " + profileColumns + " FROM import_profiles WHERE id = ?;"
+
+	var p Profile
+	err := i.db.QueryRow(i.d.Rebind(q), id).Scan(&p.ID, &p.Name, &p.Delimiter, &p.SkipRows, &p.DateColumn, &p.DateFormat, &p.DescriptionColumn, &p.AmountColumn, &p.AmountSign, &p.DecimalSeparator, &p.AccountID)
+	return p, err
+}
+
+func (i *Importer) listProfiles(w http.ResponseWriter, req *http.Request) {
+	profiles, err := i.Profiles()
+	if err != nil {
+		httperror.Send(w, req, http.StatusInternalServerError, fmt.Sprintf("Could not list profiles: %s", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(profiles)
+}
+
+// Profiles lists the mapping profiles.
+func (i *Importer) Profiles() ([]Profile, error) {
+	const q = "SELECT " + profileColumns + " FROM import_profiles ORDER BY name;"
+
+	rows, err := i.db.Query(q)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	profiles := []Profile{}
+	for rows.Next() {
+		var p Profile
+		err := rows.Scan(&p.ID, &p.Name, &p.Delimiter, &p.SkipRows, &p.DateColumn, &p.DateFormat, &p.DescriptionColumn, &p.AmountColumn, &p.AmountSign, &p.DecimalSeparator, &p.AccountID)
+		if err != nil {
+			return nil, err
+		}
+		profiles = append(profiles, p)
+	}
+	return profiles, rows.Err()
+}
+
+// upsertProfile creates a profile from a JSON body, or replaces it if an ID is
+// provided.
+func (i *Importer) upsertProfile(w http.ResponseWriter, req *http.Request) {
+	var p Profile
+	err := json.NewDecoder(req.Body).Decode(&p)
+	if err != nil {
+		httperror.Send(w, req, http.StatusBadRequest, fmt.Sprintf("Could not parse JSON body: %s", err))
+		return
+	}
+	if err := p.validate(); err != nil {
+		httperror.Send(w, req, http.StatusBadRequest, fmt.Sprintf("Invalid profile: %s", err))
+		return
+	}
+
+	p.ID, err = i.UpsertProfile(p)
+	if err != nil {
+		httperror.Send(w, req, http.StatusInternalServerError, fmt.Sprintf("Could not save profile: %s", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(p)
+}
+
+// UpsertProfile creates or replaces the mapping profile with the provided ID,
+// returning its ID. If the ID is 0, a new profile is created.
+func (i *Importer) UpsertProfile(p Profile) (int, error) {
+	const q_create = "INSERT INTO import_profiles (name, delimiter, skip_rows, date_column, date_format, description_column, amount_column, amount_sign, decimal_separator, account_id) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?);"
+
+	if p.ID == 0 {
+		return i.d.InsertID(i.db, q_create, p.Name, p.Delimiter, p.SkipRows, p.DateColumn, p.DateFormat, p.DescriptionColumn, p.AmountColumn, p.AmountSign, p.DecimalSeparator, p.AccountID)
+	}
+	q := i.d.Upsert("import_profiles", strings.Split(profileColumns, ", ")...)
+	_, err := i.db.Exec(q, p.ID, p.Name, p.Delimiter, p.SkipRows, p.DateColumn, p.DateFormat, p.DescriptionColumn, p.AmountColumn, p.AmountSign, p.DecimalSeparator, p.AccountID)
+	return p.ID, err
+}
+
+func (i *Importer) deleteProfile(w http.ResponseWriter, req *http.Request) {
+	const q = "DELETE FROM import_profiles WHERE id = ?;"
+
+	if !hasID.MatchString(req.URL.Path) {
+		httperror.Send(w, req, http.StatusBadRequest, "Must provide a profile ID to delete")
+		return
+	}
+	id, _ := strconv.Atoi(req.URL.Path[strings.LastIndex(req.URL.Path, "/")+1:])
+
+	_, err := i.db.Exec(i.d.Rebind(q), id)
+	if err != nil {
+		httperror.Send(w, req, http.StatusInternalServerError, fmt.Sprintf("Could not delete profile: %s", err))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
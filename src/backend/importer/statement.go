@@ -0,0 +1,103 @@
+package importer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/davidschlachter/lychnos/src/backend/firefly"
+	"github.com/davidschlachter/lychnos/src/backend/httperror"
+)
+
+// HandleOFX imports transactions from an OFX or QFX statement, in the same two
+// steps as HandleCSV. The preview is requested with a multipart form with the
+// statement as "file" and the ID of the Firefly-III asset account as
+// "account_id".
+func (i *Importer) HandleOFX(w http.ResponseWriter, req *http.Request) {
+	i.handleStatement(w, req, func(r io.Reader, _ *http.Request) ([]firefly.StatementEntry, error) {
+		return firefly.ParseOFX(r)
+	})
+}
+
+// HandleQIF imports transactions from a QIF statement, like HandleOFX. If the
+// dates of the statement put the day first, "day_first" must be set to true,
+// and if its amounts use a comma as the decimal separator, "decimal_separator"
+// must be set to ",".
+func (i *Importer) HandleQIF(w http.ResponseWriter, req *http.Request) {
+	i.handleStatement(w, req, func(r io.Reader, req *http.Request) ([]firefly.StatementEntry, error) {
+		sep := req.FormValue("decimal_separator")
+		if sep == "" {
+			sep = "."
+		}
+		return firefly.ParseQIF(r, req.FormValue("day_first") == "true", sep)
+	})
+}
+
+func (i *Importer) handleStatement(w http.ResponseWriter, req *http.Request, parse func(io.Reader, *http.Request) ([]firefly.StatementEntry, error)) {
+	log.Printf("%s %s", req.Method, req.RequestURI)
+	switch req.Method {
+	case "POST":
+		if strings.HasPrefix(req.Header.Get("Content-Type"), "application/json") {
+			i.create(w, req)
+		} else {
+			i.previewStatement(w, req, parse)
+		}
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+		fmt.Fprintf(w, "Unsupported method %s", req.Method)
+	}
+}
+
+func (i *Importer) previewStatement(w http.ResponseWriter, req *http.Request, parse func(io.Reader, *http.Request) ([]firefly.StatementEntry, error)) {
+	req.Body = http.MaxBytesReader(w, req.Body, maxUploadSize)
+	err := req.ParseMultipartForm(maxUploadSize)
+	if err != nil {
+		httperror.Send(w, req, http.StatusBadRequest, fmt.Sprintf("Could not parse upload: %s", err))
+		return
+	}
+	accountID := req.FormValue("account_id")
+	if _, err := strconv.Atoi(accountID); err != nil {
+		httperror.Send(w, req, http.StatusBadRequest, "Must provide the ID of a Firefly-III account as account_id")
+		return
+	}
+	file, _, err := req.FormFile("file")
+	if err != nil {
+		httperror.Send(w, req, http.StatusBadRequest, fmt.Sprintf("Must provide a statement as file: %s", err))
+		return
+	}
+	defer file.Close()
+
+	entries, err := parse(file, req)
+	if err != nil {
+		httperror.Send(w, req, http.StatusBadRequest, fmt.Sprintf("Could not parse statement: %s", err))
+		return
+	}
+
+	rows := make([]Row, 0, len(entries))
+	for n, e := range entries {
+		row := Row{
+			Line:        n + 1,
+			Date:        e.Date.Format("2006-01-02"),
+			Description: e.Description,
+			ExternalID:  e.ExternalID,
+		}
+		if e.Amount.IsZero() {
+			row.Error = "amount is zero"
+		} else {
+			assignAccounts(&row, e.Amount, e.Amount.IsNegative(), accountID)
+		}
+		rows = append(rows, row)
+	}
+	err = i.categorize(req.Context(), rows)
+	if err != nil {
+		httperror.Send(w, req, http.StatusInternalServerError, fmt.Sprintf("Could not categorize transactions: %s", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(createRequest{Rows: rows})
+}
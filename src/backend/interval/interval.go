@@ -2,48 +2,150 @@
 // the stand and end date of a budget.
 package interval
 
-import "time"
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Kind is the length of the reporting intervals of a budget. It is stored as
+// the budget's reporting_interval.
+type Kind int
+
+const (
+	Monthly Kind = iota
+	Weekly
+	BiWeekly
+	SemiMonthly
+	Quarterly
+	Yearly
+)
+
+var kindStrings = [...]string{
+	Monthly:     "monthly",
+	Weekly:      "weekly",
+	BiWeekly:    "biweekly",
+	SemiMonthly: "semimonthly",
+	Quarterly:   "quarterly",
+	Yearly:      "yearly",
+}
+
+func (k Kind) String() string {
+	if !k.Valid() {
+		return ""
+	}
+	return kindStrings[int(k)]
+}
+
+// Valid reports whether k is a known Kind.
+func (k Kind) Valid() bool {
+	return int(k) >= 0 && int(k) < len(kindStrings)
+}
+
+// Parse returns the Kind for either its name (e.g. "biweekly") or its integer
+// value.
+func Parse(s string) (Kind, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	for i, name := range kindStrings {
+		if s == name {
+			return Kind(i), nil
+		}
+	}
+	i, err := strconv.Atoi(s)
+	if err != nil || !Kind(i).Valid() {
+		return 0, fmt.Errorf("unknown reporting interval '%s'", s)
+	}
+	return Kind(i), nil
+}
 
 type ReportingInterval struct {
 	Start, End time.Time
 }
 
 // Get returns a ReportingInterval slice, which contains the Start and End of
-// each reporting interval between the provided start and end time
-func Get(start, end time.Time, location *time.Location) []ReportingInterval {
+// each reporting interval between the provided start and end time, up to the
+// current time. Weekly and bi-weekly intervals begin on the same weekday as
+// anchor (e.g. a pay date); if anchor is zero, they begin on the same weekday
+// as start.
+func Get(kind Kind, start, end, anchor time.Time, location *time.Location) ([]ReportingInterval, error) {
 	var intervals []ReportingInterval
 
-	now := time.Now()
-	currentYear, currentMonth, _ := now.Date()
-	lastDayThisMonth := time.Date(currentYear, currentMonth, daysInMonth(int(currentMonth), currentYear), 23, 59, 59, 0, location)
+	if anchor.IsZero() {
+		anchor = start
+	}
+
+	var next func(d time.Time) time.Time
+	switch kind {
+	case Monthly:
+		next = func(d time.Time) time.Time {
+			year, month, _ := d.In(location).Date()
+			return time.Date(year, month+1, 1, 0, 0, 0, 0, location)
+		}
+	case Weekly:
+		next = anchoredNext(anchor, 7, location)
+	case BiWeekly:
+		next = anchoredNext(anchor, 14, location)
+	case SemiMonthly:
+		next = func(d time.Time) time.Time {
+			year, month, day := d.In(location).Date()
+			if day < 16 {
+				return time.Date(year, month, 16, 0, 0, 0, 0, location)
+			}
+			return time.Date(year, month+1, 1, 0, 0, 0, 0, location)
+		}
+	case Quarterly:
+		next = func(d time.Time) time.Time {
+			year, month, _ := d.In(location).Date()
+			nextQuarter := (int(month)-1)/3*3 + 4
+			return time.Date(year, time.Month(nextQuarter), 1, 0, 0, 0, 0, location)
+		}
+	case Yearly:
+		next = func(d time.Time) time.Time {
+			return time.Date(d.In(location).Year()+1, time.January, 1, 0, 0, 0, 0, location)
+		}
+	default:
+		return nil, fmt.Errorf("unknown reporting interval %d", kind)
+	}
 
-	var bgtYear int
-	var bgtMonth time.Month
+	now := time.Now()
 
 	// d is the first day in each summary reporting period
-	for d := start; d.Before(end) && d.Before(lastDayThisMonth); d = time.Date(bgtYear, bgtMonth+1, 1, 0, 0, 0, 0, location) {
-		bgtYear, bgtMonth, _ = d.Date()
-		// l is the last day of each reporting period
-		l := time.Date(bgtYear, bgtMonth, daysInMonth(int(bgtMonth), bgtYear), 23, 59, 59, 0, location)
+	for d := start; d.Before(end) && !d.After(now); d = next(d) {
+		// l is the last second of each reporting period
+		l := next(d).Add(-time.Second)
+		if l.After(end) {
+			l = end
+		}
 
 		r := ReportingInterval{Start: d, End: l}
 		intervals = append(intervals, r)
 	}
 
-	return intervals
+	return intervals, nil
 }
 
-// via https://stackoverflow.com/a/35182930
-func daysInMonth(month, year int) int {
-	switch time.Month(month) {
-	case time.April, time.June, time.September, time.November:
-		return 30
-	case time.February:
-		if year%4 == 0 && (year%100 != 0 || year%400 == 0) { // leap year
-			return 29
+// anchoredNext returns a function giving the start of the next interval of
+// period days, where intervals begin on anchor.
+func anchoredNext(anchor time.Time, period int, location *time.Location) func(time.Time) time.Time {
+	ay, am, ad := anchor.In(location).Date()
+	a := time.Date(ay, am, ad, 0, 0, 0, 0, location)
+	return func(d time.Time) time.Time {
+		days := daysBetween(a, d.In(location))
+		n := days / period
+		if days < 0 && days%period != 0 {
+			n-- // round towards negative infinity
 		}
-		return 28
-	default:
-		return 31
+		return a.AddDate(0, 0, (n+1)*period)
 	}
 }
+
+// daysBetween returns the number of calendar days from a to b, ignoring the
+// time of day (and so any daylight saving time changes).
+func daysBetween(a, b time.Time) int {
+	ay, am, ad := a.Date()
+	by, bm, bd := b.Date()
+	au := time.Date(ay, am, ad, 0, 0, 0, 0, time.UTC)
+	bu := time.Date(by, bm, bd, 0, 0, 0, 0, time.UTC)
+	return int(bu.Sub(au).Hours() / 24)
+}
@@ -31,7 +31,10 @@ func TestIntervals(t *testing.T) {
 	}
 	start := time.Date(2020, 1, 1, 5, 0, 0, 0, time.Now().UTC().Location())
 	end := time.Date(2021, 1, 1, 4, 59, 59, 0, time.Now().UTC().Location())
-	intervals := interval.Get(start, end, location)
+	intervals, err := interval.Get(interval.Monthly, start, end, time.Time{}, location)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
 
 	if len(intervals) != len(expectedIntervals) {
 		t.Fatalf("len(intervals) = %d, wanted %d\n", len(intervals), len(expectedIntervals))
@@ -48,3 +51,68 @@ func TestIntervals(t *testing.T) {
 		}
 	}
 }
+
+func TestIntervalKinds(t *testing.T) {
+	location, err := time.LoadLocation("America/Toronto")
+	if err != nil {
+		t.Fatalf("Failed to load location 'America/Toronto': %s", err)
+	}
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, location)
+	end := time.Date(2020, 12, 31, 23, 59, 59, 0, location)
+	payDate := time.Date(2019, 12, 27, 0, 0, 0, 0, location) // a Friday
+
+	tests := []struct {
+		kind      interval.Kind
+		anchor    time.Time
+		count     int
+		secondEnd string
+		lastStart string
+	}{
+		{interval.Weekly, time.Time{}, 53, "2020-01-14 23:59:59 -0500", "2020-12-30 00:00:00 -0500"},
+		{interval.BiWeekly, payDate, 27, "2020-01-23 23:59:59 -0500", "2020-12-25 00:00:00 -0500"},
+		{interval.SemiMonthly, time.Time{}, 24, "2020-01-31 23:59:59 -0500", "2020-12-16 00:00:00 -0500"},
+		{interval.Quarterly, time.Time{}, 4, "2020-06-30 23:59:59 -0400", "2020-10-01 00:00:00 -0400"},
+		{interval.Yearly, time.Time{}, 1, "", "2020-01-01 00:00:00 -0500"},
+	}
+
+	for _, test := range tests {
+		intervals, err := interval.Get(test.kind, start, end, test.anchor, location)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", test.kind, err)
+		}
+		if len(intervals) != test.count {
+			t.Fatalf("%s: len(intervals) = %d, wanted %d\n", test.kind, len(intervals), test.count)
+		}
+		if test.secondEnd != "" {
+			expEnd, _ := time.Parse(timeFormat, test.secondEnd)
+			if !intervals[1].End.Equal(expEnd) {
+				t.Fatalf("%s: second End = %s, wanted %s\n", test.kind, intervals[1].End, expEnd)
+			}
+		}
+		expStart, _ := time.Parse(timeFormat, test.lastStart)
+		if !intervals[len(intervals)-1].Start.Equal(expStart) {
+			t.Fatalf("%s: last Start = %s, wanted %s\n", test.kind, intervals[len(intervals)-1].Start, expStart)
+		}
+		if !intervals[len(intervals)-1].End.Equal(end) {
+			t.Fatalf("%s: last End = %s, wanted %s\n", test.kind, intervals[len(intervals)-1].End, end)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	for _, s := range []string{"biweekly", "BiWeekly", "2"} {
+		k, err := interval.Parse(s)
+		if err != nil {
+			t.Fatalf("Unexpected error parsing '%s': %s", s, err)
+		}
+		if k != interval.BiWeekly {
+			t.Fatalf("Parse('%s') = %s, wanted biweekly", s, k)
+		}
+	}
+	if _, err := interval.Parse("fortnightly"); err == nil {
+		t.Fatalf("Expected error parsing unknown interval")
+	}
+	if _, err := interval.Parse("17"); err == nil {
+		t.Fatalf("Expected error parsing unknown interval")
+	}
+}
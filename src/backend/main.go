@@ -1,27 +1,71 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
+	"github.com/davidschlachter/lychnos/src/backend/auth"
 	"github.com/davidschlachter/lychnos/src/backend/budget"
 	"github.com/davidschlachter/lychnos/src/backend/categorybudget"
+	"github.com/davidschlachter/lychnos/src/backend/exchangerate"
 	"github.com/davidschlachter/lychnos/src/backend/firefly"
+	"github.com/davidschlachter/lychnos/src/backend/importer"
+	"github.com/davidschlachter/lychnos/src/backend/recurring"
 	"github.com/davidschlachter/lychnos/src/backend/report"
+	"github.com/davidschlachter/lychnos/src/backend/rule"
+	"github.com/davidschlachter/lychnos/src/backend/template"
 )
 
 func main() {
-	db, err := connect()
+	migrateOnly := flag.Bool("migrate-only", false, "apply any pending database migrations, then exit")
+	dryRun := flag.Bool("dry-run", false, "print any pending database migrations without applying them, then exit")
+	addUser := flag.String("add-user", "", "create a user with this username (or reset their password), reading the password from stdin, then exit")
+	flag.Parse()
+
+	db, dbType, err := connect()
 	if err != nil {
 		log.Fatalf("Failed to initialize database: %s", err)
 	}
 	defer db.Close()
 
+	err = migrate(db, dbType, *dryRun, os.Stdout)
+	if err != nil {
+		log.Fatalf("Failed to migrate database: %s", err)
+	}
+	if *migrateOnly || *dryRun {
+		return
+	}
+
+	var authAdmins []string
+	authAdminsString := os.Getenv("AUTH_ADMINS")
+	if authAdminsString != "" {
+		authAdmins = strings.Split(authAdminsString, ",")
+	}
+	a := auth.New(db, dbType, auth.Config{Enabled: os.Getenv("AUTH_ENABLED") == "true", Admins: authAdmins})
+	if *addUser != "" {
+		password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && err != io.EOF {
+			log.Fatalf("Failed to read password: %s", err)
+		}
+		err = a.SetPassword(*addUser, strings.TrimRight(password, "\r\n"))
+		if err != nil {
+			log.Fatalf("Failed to set password for %s: %s", *addUser, err)
+		}
+		log.Printf("Set password for %s", *addUser)
+		return
+	}
+
 	token := os.Getenv("FIREFLY_TOKEN")
 	if token == "" {
 		log.Fatal("Got empty FIREFLY_TOKEN, expected a value to be set.")
@@ -80,6 +124,45 @@ func main() {
 		}
 	}
 
+	var intervalAnchor time.Time
+	intervalAnchorString := os.Getenv("INTERVAL_ANCHOR")
+	if intervalAnchorString != "" {
+		intervalAnchor, err = time.ParseInLocation("2006-01-02", intervalAnchorString, time.Local)
+		if err != nil {
+			log.Fatalf("Invalid INTERVAL_ANCHOR, expected a date like 2006-01-02: %s", err)
+		}
+	}
+
+	var webhookSecrets []string
+	webhookSecretsString := os.Getenv("FIREFLY_WEBHOOK_SECRETS")
+	if webhookSecretsString != "" {
+		webhookSecrets = strings.Split(webhookSecretsString, ",")
+	}
+
+	var duplicateWindowDays *int // 0 only compares transactions on the same day
+	duplicateWindowDaysString := os.Getenv("DUPLICATE_WINDOW_DAYS")
+	if duplicateWindowDaysString != "" {
+		days, err := strconv.Atoi(duplicateWindowDaysString)
+		if err != nil {
+			log.Fatalf("Invalid DUPLICATE_WINDOW_DAYS, expected an integer: %s", err)
+		}
+		duplicateWindowDays = &days
+	}
+
+	var duplicateSimilarity float64
+	duplicateSimilarityString := os.Getenv("DUPLICATE_SIMILARITY")
+	if duplicateSimilarityString != "" {
+		duplicateSimilarity, err = strconv.ParseFloat(duplicateSimilarityString, 64)
+		if err != nil || duplicateSimilarity <= 0 || duplicateSimilarity > 1 {
+			log.Fatalf("Invalid DUPLICATE_SIMILARITY, expected a number greater than 0 and at most 1")
+		}
+	}
+
+	primaryCurrency := strings.ToUpper(strings.TrimSpace(os.Getenv("PRIMARY_CURRENCY")))
+
+	rules := rule.New(db, dbType)
+	rates := exchangerate.New(db, dbType)
+
 	f, err := firefly.New(
 		&http.Client{Timeout: time.Second * 30},
 		firefly.Config{
@@ -89,53 +172,162 @@ func main() {
 			BigPictureIgnore:              bigPictureIgnore,
 			BigPictureIncome:              bigPictureIncome,
 			AutocompleteIgnoredCategories: autocompleteIgnoredCategories,
+			IntervalAnchor:                intervalAnchor,
+			WebhookSecrets:                webhookSecrets,
+			DuplicateWindowDays:           duplicateWindowDays,
+			DuplicateSimilarity:           duplicateSimilarity,
+			Categorizer:                   rules,
+			PrimaryCurrency:               primaryCurrency,
+			ExchangeRates:                 rates,
 		},
 	)
 	if err != nil {
 		log.Fatalf("Could not initialize Firefly-III client: %s", err)
 	}
 
-	http.HandleFunc("/api/transactions/", f.HandleTxn)
-	http.HandleFunc("/api/accounts/", f.HandleAccount)
-	http.HandleFunc("/api/categories/", f.HandleCategory)
-	http.HandleFunc("/api/bigpicture/", f.HandleBigPicture)
+	http.HandleFunc("/api/transactions/", a.Require(f.HandleTxn))
+	http.HandleFunc("/api/accounts/", a.Require(f.HandleAccount))
+	http.HandleFunc("/api/categories/", a.Require(f.HandleCategory))
+	http.HandleFunc("/api/bigpicture/", a.Require(f.HandleBigPicture))
+	http.HandleFunc("/api/cache", a.RequireAdmin(f.HandleCache))
+	http.HandleFunc("/api/suggest", a.Require(f.HandleSuggest))
+	http.HandleFunc("/api/tags", a.Require(f.HandleTags))
+	http.HandleFunc("/api/exchangerates/", a.Require(rates.Handle(f.ExchangeRatesChanged)))
+	// Webhooks are authenticated by their signature instead
+	http.HandleFunc("/api/webhooks/firefly", f.HandleWebhook)
+
+	b := budget.New(db, dbType)
+	http.HandleFunc("/api/budgets/", a.Require(b.Handle))
+
+	c := categorybudget.New(db, dbType, b)
+	http.HandleFunc("/api/categorybudgets/", a.Require(c.Handle))
+	http.HandleFunc("POST /api/budgets/{id}/clone", a.Require(c.HandleClone(f.CategorySums)))
+
+	http.HandleFunc("/api/rules/", a.Require(rules.Handle))
+	http.HandleFunc("GET /api/rules/dryrun", a.Require(rules.HandleDryRun(f.CachedTransactionsBetween)))
 
-	b := budget.New(db)
-	http.HandleFunc("/api/budgets/", b.Handle)
+	recurrences := recurring.New(db, dbType)
+	http.HandleFunc("/api/recurring/", a.Require(recurrences.Handle))
+	http.HandleFunc("GET /api/recurring/upcoming", a.Require(recurrences.HandleUpcoming))
 
-	c := categorybudget.New(db, b)
-	http.HandleFunc("/api/categorybudgets/", c.Handle)
+	templates := template.New(db, dbType, f)
+	http.HandleFunc("/api/templates/", a.Require(templates.Handle))
+	http.HandleFunc("POST /api/templates/{id}/apply", a.Require(templates.HandleApply))
+
+	i := importer.New(db, dbType, f)
+	http.HandleFunc("/api/import/csv", a.Require(i.HandleCSV))
+	http.HandleFunc("/api/import/ofx", a.Require(i.HandleOFX))
+	http.HandleFunc("/api/import/qif", a.Require(i.HandleQIF))
+	http.HandleFunc("/api/import/profiles/", a.Require(i.HandleProfiles))
 
 	r, err := report.New(f, c, b)
 	if err != nil {
 		fmt.Printf("Could not initialize reports: %s\n", err)
 		os.Exit(1)
 	}
-	http.HandleFunc("/api/reports/", r.Handle)
+	http.HandleFunc("/api/reports/", a.Require(r.Handle))
+
+	if a.Enabled() {
+		http.HandleFunc("/api/auth/login", a.HandleLogin)
+		http.HandleFunc("/api/auth/logout", a.HandleLogout)
+		http.HandleFunc("/api/auth/me", a.Require(a.HandleMe))
+		http.HandleFunc("/api/tokens/", a.Require(a.HandleTokens))
+	}
 
 	http.HandleFunc("/health", func(w http.ResponseWriter, req *http.Request) {
 		log.Printf("%s %s", req.Method, req.RequestURI)
 		fmt.Fprintf(w, "ok\n")
 	})
 
-	err = f.RefreshCaches(c, b)
-	if err != nil {
-		log.Fatalf("Failed to update caches: %s", err)
+	// Refreshes that aren't tied to a request are given their own deadline.
+	refreshCaches := func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+		defer cancel()
+		return f.RefreshCaches(ctx, c, b)
+	}
+	snapshots := newSnapshotStore(os.Getenv("CACHE_SNAPSHOT"), db, dbType)
+	if restoreSnapshot(f, snapshots) {
+		// Serve the restored cache immediately, and refresh it in the
+		// background.
+		go func() {
+			err := refreshCaches()
+			if err != nil {
+				log.Printf("Failed to update caches: %s", err)
+			}
+			saveSnapshot(f, snapshots)
+		}()
+	} else if err := refreshCaches(); err != nil {
+		// Firefly-III may be briefly unavailable, so serve requests anyway
+		// (the caches are filled as they are used), and keep trying to
+		// refresh the caches.
+		log.Printf("Failed to update caches, retrying in the background: %s", err)
+		go func() {
+			for range time.Tick(time.Minute) {
+				err := refreshCaches()
+				if err != nil {
+					log.Printf("Failed to update caches: %s", err)
+					continue
+				}
+				saveSnapshot(f, snapshots)
+				return
+			}
+		}()
+	} else {
+		saveSnapshot(f, snapshots)
+	}
+	if snapshots != nil {
+		go func() {
+			for range time.Tick(5 * time.Minute) {
+				saveSnapshot(f, snapshots)
+			}
+		}()
+		go func() {
+			sig := make(chan os.Signal, 1)
+			signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+			<-sig
+			saveSnapshot(f, snapshots)
+			// os.Exit skips the deferred Close
+			db.Close()
+			os.Exit(0)
+		}()
 	}
 
 	go func(c *categorybudget.CategoryBudgets, b *budget.Budgets) {
 		for range time.Tick(time.Minute) {
-			err = f.InvalidateCacheIfAccountBalancesHaveChanged(c, b)
-			if err != nil {
-				log.Printf("Failed to check for stale cache: %s", err)
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+			// With webhooks, changes to transactions are evicted as they
+			// happen, so only poll for them without.
+			if !f.HasWebhookSecret() {
+				err := f.InvalidateCacheIfAccountBalancesHaveChanged(ctx, c, b)
+				if err != nil {
+					log.Printf("Failed to check for stale cache: %s", err)
+				}
 			}
-			err = f.InvalidateCacheIfCategoriesHaveChanged(c, b)
+			err := f.InvalidateCacheIfCategoriesHaveChanged(ctx, c, b)
 			if err != nil {
 				log.Printf("Failed to check for stale categories: %s", err)
 			}
+			cancel()
 		}
 	}(c, b)
 
+	// Recurring transactions are created when they are due, and any that were
+	// missed while lychnos was stopped are created at startup.
+	go func() {
+		createRecurring := func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+			defer cancel()
+			err := recurrences.Run(ctx, time.Now(), f.CreateTransaction)
+			if err != nil {
+				log.Printf("Failed to create recurring transactions: %s", err)
+			}
+		}
+		createRecurring()
+		for range time.Tick(time.Hour) {
+			createRecurring()
+		}
+	}()
+
 	log.Println("Listening for connections...")
 	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", listenPort), nil))
 }
@@ -0,0 +1,546 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/davidschlachter/lychnos/src/backend/dialect"
+)
+
+// migration is a versioned change to the database schema. Each migration
+// provides the statements for every supported database type.
+type migration struct {
+	version     int
+	description string
+	statements  map[dialect.Dialect][]string
+}
+
+// migrations must be kept in order of version, and must never be changed once
+// released: add a new migration instead.
+var migrations = []migration{
+	{
+		version:     1,
+		description: "create budgets and category_budgets",
+		// Databases created before migrations were introduced already have
+		// these tables, so they are only created if they do not exist.
+		statements: map[dialect.Dialect][]string{
+			dialect.SQLite: {`
+CREATE TABLE IF NOT EXISTS budgets (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	start DATETIME NOT NULL,
+	end DATETIME NOT NULL,
+	reporting_interval INT NOT NULL
+);`, `
+CREATE TABLE IF NOT EXISTS category_budgets (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	budget INT,
+	category INT,
+	amount DECIMAL(12,4),
+	FOREIGN KEY ( budget ) REFERENCES budgets( id )
+);`},
+			dialect.MySQL: {`
+CREATE TABLE IF NOT EXISTS budgets (
+	id INT NOT NULL AUTO_INCREMENT,
+	start DATETIME NOT NULL,
+	end DATETIME NOT NULL,
+	reporting_interval INT NOT NULL,
+	PRIMARY KEY ( id )
+);`, `
+CREATE TABLE IF NOT EXISTS category_budgets (
+	id INT NOT NULL AUTO_INCREMENT,
+	budget INT,
+	category INT,
+	amount DECIMAL(12,4),
+	PRIMARY KEY ( id ),
+	FOREIGN KEY ( budget ) REFERENCES budgets( id )
+);`},
+			dialect.Postgres: {`
+CREATE TABLE IF NOT EXISTS budgets (
+	id SERIAL PRIMARY KEY,
+	start TIMESTAMP NOT NULL,
+	"end" TIMESTAMP NOT NULL,
+	reporting_interval INT NOT NULL
+);`, `
+CREATE TABLE IF NOT EXISTS category_budgets (
+	id SERIAL PRIMARY KEY,
+	budget INT REFERENCES budgets( id ),
+	category INT,
+	amount DECIMAL(12,4)
+);`},
+		},
+	},
+	{
+		version:     2,
+		description: "add rollover to category_budgets",
+		statements: map[dialect.Dialect][]string{
+			dialect.SQLite:   {`ALTER TABLE category_budgets ADD COLUMN rollover INT NOT NULL DEFAULT 0;`},
+			dialect.MySQL:    {`ALTER TABLE category_budgets ADD COLUMN rollover INT NOT NULL DEFAULT 0;`},
+			dialect.Postgres: {`ALTER TABLE category_budgets ADD COLUMN rollover INT NOT NULL DEFAULT 0;`},
+		},
+	},
+	{
+		version:     3,
+		description: "create users, sessions and api_tokens",
+		statements: map[dialect.Dialect][]string{
+			dialect.SQLite: {`
+CREATE TABLE users (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	username VARCHAR(255) NOT NULL UNIQUE,
+	password_hash VARCHAR(255) NOT NULL
+);`, `
+CREATE TABLE sessions (
+	token_hash CHAR(64) NOT NULL PRIMARY KEY,
+	user_id INT NOT NULL,
+	expires_at DATETIME NOT NULL,
+	FOREIGN KEY ( user_id ) REFERENCES users( id )
+);`, `
+CREATE TABLE api_tokens (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id INT NOT NULL,
+	name VARCHAR(255) NOT NULL,
+	token_hash CHAR(64) NOT NULL UNIQUE,
+	created_at DATETIME NOT NULL,
+	FOREIGN KEY ( user_id ) REFERENCES users( id )
+);`},
+			dialect.MySQL: {`
+CREATE TABLE users (
+	id INT NOT NULL AUTO_INCREMENT,
+	username VARCHAR(255) NOT NULL UNIQUE,
+	password_hash VARCHAR(255) NOT NULL,
+	PRIMARY KEY ( id )
+);`, `
+CREATE TABLE sessions (
+	token_hash CHAR(64) NOT NULL,
+	user_id INT NOT NULL,
+	expires_at DATETIME NOT NULL,
+	PRIMARY KEY ( token_hash ),
+	FOREIGN KEY ( user_id ) REFERENCES users( id )
+);`, `
+CREATE TABLE api_tokens (
+	id INT NOT NULL AUTO_INCREMENT,
+	user_id INT NOT NULL,
+	name VARCHAR(255) NOT NULL,
+	token_hash CHAR(64) NOT NULL UNIQUE,
+	created_at DATETIME NOT NULL,
+	PRIMARY KEY ( id ),
+	FOREIGN KEY ( user_id ) REFERENCES users( id )
+);`},
+			dialect.Postgres: {`
+CREATE TABLE users (
+	id SERIAL PRIMARY KEY,
+	username VARCHAR(255) NOT NULL UNIQUE,
+	password_hash VARCHAR(255) NOT NULL
+);`, `
+CREATE TABLE sessions (
+	token_hash CHAR(64) NOT NULL PRIMARY KEY,
+	user_id INT NOT NULL REFERENCES users( id ),
+	expires_at TIMESTAMP NOT NULL
+);`, `
+CREATE TABLE api_tokens (
+	id SERIAL PRIMARY KEY,
+	user_id INT NOT NULL REFERENCES users( id ),
+	name VARCHAR(255) NOT NULL,
+	token_hash CHAR(64) NOT NULL UNIQUE,
+	created_at TIMESTAMP NOT NULL
+);`},
+		},
+	},
+	{
+		version:     4,
+		description: "create cache_snapshots",
+		statements: map[dialect.Dialect][]string{
+			dialect.SQLite: {`
+CREATE TABLE cache_snapshots (
+	id INTEGER PRIMARY KEY,
+	saved_at DATETIME NOT NULL,
+	data TEXT NOT NULL
+);`},
+			dialect.MySQL: {`
+CREATE TABLE cache_snapshots (
+	id INT NOT NULL,
+	saved_at DATETIME NOT NULL,
+	data LONGTEXT NOT NULL,
+	PRIMARY KEY ( id )
+);`},
+			dialect.Postgres: {`
+CREATE TABLE cache_snapshots (
+	id INT PRIMARY KEY,
+	saved_at TIMESTAMP NOT NULL,
+	data TEXT NOT NULL
+);`},
+		},
+	},
+	{
+		version:     5,
+		description: "create import_profiles",
+		statements: map[dialect.Dialect][]string{
+			dialect.SQLite: {`
+CREATE TABLE import_profiles (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	name VARCHAR(255) NOT NULL,
+	delimiter VARCHAR(1) NOT NULL,
+	skip_rows INT NOT NULL,
+	date_column INT NOT NULL,
+	date_format VARCHAR(32) NOT NULL,
+	description_column INT NOT NULL,
+	amount_column INT NOT NULL,
+	amount_sign VARCHAR(16) NOT NULL,
+	decimal_separator VARCHAR(1) NOT NULL,
+	account_id VARCHAR(32) NOT NULL
+);`},
+			dialect.MySQL: {`
+CREATE TABLE import_profiles (
+	id INT NOT NULL AUTO_INCREMENT,
+	name VARCHAR(255) NOT NULL,
+	delimiter VARCHAR(1) NOT NULL,
+	skip_rows INT NOT NULL,
+	date_column INT NOT NULL,
+	date_format VARCHAR(32) NOT NULL,
+	description_column INT NOT NULL,
+	amount_column INT NOT NULL,
+	amount_sign VARCHAR(16) NOT NULL,
+	decimal_separator VARCHAR(1) NOT NULL,
+	account_id VARCHAR(32) NOT NULL,
+	PRIMARY KEY ( id )
+);`},
+			dialect.Postgres: {`
+CREATE TABLE import_profiles (
+	id SERIAL PRIMARY KEY,
+	name VARCHAR(255) NOT NULL,
+	delimiter VARCHAR(1) NOT NULL,
+	skip_rows INT NOT NULL,
+	date_column INT NOT NULL,
+	date_format VARCHAR(32) NOT NULL,
+	description_column INT NOT NULL,
+	amount_column INT NOT NULL,
+	amount_sign VARCHAR(16) NOT NULL,
+	decimal_separator VARCHAR(1) NOT NULL,
+	account_id VARCHAR(32) NOT NULL
+);`},
+		},
+	},
+	{
+		version:     6,
+		description: "create rules",
+		statements: map[dialect.Dialect][]string{
+			dialect.SQLite: {`
+CREATE TABLE rules (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	name VARCHAR(255) NOT NULL,
+	destination_name VARCHAR(255) NOT NULL,
+	description_pattern VARCHAR(255) NOT NULL,
+	min_amount DECIMAL(12,4),
+	max_amount DECIMAL(12,4),
+	category_id INT NOT NULL,
+	description VARCHAR(255) NOT NULL
+);`},
+			dialect.MySQL: {`
+CREATE TABLE rules (
+	id INT NOT NULL AUTO_INCREMENT,
+	name VARCHAR(255) NOT NULL,
+	destination_name VARCHAR(255) NOT NULL,
+	description_pattern VARCHAR(255) NOT NULL,
+	min_amount DECIMAL(12,4),
+	max_amount DECIMAL(12,4),
+	category_id INT NOT NULL,
+	description VARCHAR(255) NOT NULL,
+	PRIMARY KEY ( id )
+);`},
+			dialect.Postgres: {`
+CREATE TABLE rules (
+	id SERIAL PRIMARY KEY,
+	name VARCHAR(255) NOT NULL,
+	destination_name VARCHAR(255) NOT NULL,
+	description_pattern VARCHAR(255) NOT NULL,
+	min_amount DECIMAL(12,4),
+	max_amount DECIMAL(12,4),
+	category_id INT NOT NULL,
+	description VARCHAR(255) NOT NULL
+);`},
+		},
+	},
+	{
+		version:     7,
+		description: "create recurrences and recurrence_occurrences",
+		// Occurrences are keyed by date, so that each one is only recorded
+		// once.
+		statements: map[dialect.Dialect][]string{
+			dialect.SQLite: {`
+CREATE TABLE recurrences (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	name VARCHAR(255) NOT NULL,
+	description VARCHAR(255) NOT NULL,
+	amount DECIMAL(12,4) NOT NULL,
+	source_id VARCHAR(32) NOT NULL,
+	source_name VARCHAR(255) NOT NULL,
+	destination_id VARCHAR(32) NOT NULL,
+	destination_name VARCHAR(255) NOT NULL,
+	category_id VARCHAR(32) NOT NULL,
+	category_name VARCHAR(255) NOT NULL,
+	schedule VARCHAR(255) NOT NULL,
+	start_date VARCHAR(10) NOT NULL
+);`, `
+CREATE TABLE recurrence_occurrences (
+	recurrence_id INT NOT NULL,
+	occurrence VARCHAR(10) NOT NULL,
+	transaction_id VARCHAR(32) NOT NULL,
+	created_at DATETIME NOT NULL,
+	PRIMARY KEY ( recurrence_id, occurrence ),
+	FOREIGN KEY ( recurrence_id ) REFERENCES recurrences( id )
+);`},
+			dialect.MySQL: {`
+CREATE TABLE recurrences (
+	id INT NOT NULL AUTO_INCREMENT,
+	name VARCHAR(255) NOT NULL,
+	description VARCHAR(255) NOT NULL,
+	amount DECIMAL(12,4) NOT NULL,
+	source_id VARCHAR(32) NOT NULL,
+	source_name VARCHAR(255) NOT NULL,
+	destination_id VARCHAR(32) NOT NULL,
+	destination_name VARCHAR(255) NOT NULL,
+	category_id VARCHAR(32) NOT NULL,
+	category_name VARCHAR(255) NOT NULL,
+	schedule VARCHAR(255) NOT NULL,
+	start_date VARCHAR(10) NOT NULL,
+	PRIMARY KEY ( id )
+);`, `
+CREATE TABLE recurrence_occurrences (
+	recurrence_id INT NOT NULL,
+	occurrence VARCHAR(10) NOT NULL,
+	transaction_id VARCHAR(32) NOT NULL,
+	created_at DATETIME NOT NULL,
+	PRIMARY KEY ( recurrence_id, occurrence ),
+	FOREIGN KEY ( recurrence_id ) REFERENCES recurrences( id )
+);`},
+			dialect.Postgres: {`
+CREATE TABLE recurrences (
+	id SERIAL PRIMARY KEY,
+	name VARCHAR(255) NOT NULL,
+	description VARCHAR(255) NOT NULL,
+	amount DECIMAL(12,4) NOT NULL,
+	source_id VARCHAR(32) NOT NULL,
+	source_name VARCHAR(255) NOT NULL,
+	destination_id VARCHAR(32) NOT NULL,
+	destination_name VARCHAR(255) NOT NULL,
+	category_id VARCHAR(32) NOT NULL,
+	category_name VARCHAR(255) NOT NULL,
+	schedule VARCHAR(255) NOT NULL,
+	start_date VARCHAR(10) NOT NULL
+);`, `
+CREATE TABLE recurrence_occurrences (
+	recurrence_id INT NOT NULL,
+	occurrence VARCHAR(10) NOT NULL,
+	transaction_id VARCHAR(32) NOT NULL,
+	created_at TIMESTAMP NOT NULL,
+	PRIMARY KEY ( recurrence_id, occurrence ),
+	FOREIGN KEY ( recurrence_id ) REFERENCES recurrences( id )
+);`},
+		},
+	},
+	{
+		version:     8,
+		description: "create templates",
+		statements: map[dialect.Dialect][]string{
+			dialect.SQLite: {`
+CREATE TABLE templates (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	name VARCHAR(255) NOT NULL,
+	description VARCHAR(255) NOT NULL,
+	amount DECIMAL(12,4),
+	source_id VARCHAR(32) NOT NULL,
+	source_name VARCHAR(255) NOT NULL,
+	destination_id VARCHAR(32) NOT NULL,
+	destination_name VARCHAR(255) NOT NULL,
+	category_id VARCHAR(32) NOT NULL,
+	category_name VARCHAR(255) NOT NULL,
+	use_count INT NOT NULL
+);`},
+			dialect.MySQL: {`
+CREATE TABLE templates (
+	id INT NOT NULL AUTO_INCREMENT,
+	name VARCHAR(255) NOT NULL,
+	description VARCHAR(255) NOT NULL,
+	amount DECIMAL(12,4),
+	source_id VARCHAR(32) NOT NULL,
+	source_name VARCHAR(255) NOT NULL,
+	destination_id VARCHAR(32) NOT NULL,
+	destination_name VARCHAR(255) NOT NULL,
+	category_id VARCHAR(32) NOT NULL,
+	category_name VARCHAR(255) NOT NULL,
+	use_count INT NOT NULL,
+	PRIMARY KEY ( id )
+);`},
+			dialect.Postgres: {`
+CREATE TABLE templates (
+	id SERIAL PRIMARY KEY,
+	name VARCHAR(255) NOT NULL,
+	description VARCHAR(255) NOT NULL,
+	amount DECIMAL(12,4),
+	source_id VARCHAR(32) NOT NULL,
+	source_name VARCHAR(255) NOT NULL,
+	destination_id VARCHAR(32) NOT NULL,
+	destination_name VARCHAR(255) NOT NULL,
+	category_id VARCHAR(32) NOT NULL,
+	category_name VARCHAR(255) NOT NULL,
+	use_count INT NOT NULL
+);`},
+		},
+	},
+	{
+		version:     9,
+		description: "create exchange_rates",
+		statements: map[dialect.Dialect][]string{
+			dialect.SQLite: {`
+CREATE TABLE exchange_rates (
+	currency_code VARCHAR(3) NOT NULL PRIMARY KEY,
+	rate DECIMAL(18,8) NOT NULL
+);`},
+			dialect.MySQL: {`
+CREATE TABLE exchange_rates (
+	currency_code VARCHAR(3) NOT NULL,
+	rate DECIMAL(18,8) NOT NULL,
+	PRIMARY KEY ( currency_code )
+);`},
+			dialect.Postgres: {`
+CREATE TABLE exchange_rates (
+	currency_code VARCHAR(3) PRIMARY KEY,
+	rate DECIMAL(18,8) NOT NULL
+);`},
+		},
+	},
+	{
+		version:     10,
+		description: "add catch_up_from to recurrences",
+		// Existing recurring transactions have already created their
+		// occurrences, so they catch up from their start dates as before.
+		statements: map[dialect.Dialect][]string{
+			dialect.SQLite:   {`ALTER TABLE recurrences ADD COLUMN catch_up_from VARCHAR(10) NOT NULL DEFAULT '';`},
+			dialect.MySQL:    {`ALTER TABLE recurrences ADD COLUMN catch_up_from VARCHAR(10) NOT NULL DEFAULT '';`},
+			dialect.Postgres: {`ALTER TABLE recurrences ADD COLUMN catch_up_from VARCHAR(10) NOT NULL DEFAULT '';`},
+		},
+	},
+}
+
+// migrate applies any migrations that have not yet been applied to the
+// database. Each migration is applied in its own transaction, along with
+// recording its version in schema_migrations. (Note that MySQL implicitly
+// commits most schema changes, so a failed migration may be partially applied
+// there.)
+//
+// If dryRun is true, the pending statements are written to out instead of
+// being applied.
+func migrate(db *sql.DB, d dialect.Dialect, dryRun bool, out io.Writer) error {
+	const (
+		q_create = `
+CREATE TABLE IF NOT EXISTS schema_migrations (
+	version INT NOT NULL PRIMARY KEY,
+	applied_at TIMESTAMP NOT NULL
+);`
+		q_list   = "SELECT version FROM schema_migrations;"
+		q_insert = "INSERT INTO schema_migrations (version, applied_at) VALUES(?, ?);"
+	)
+
+	// A dry run must not change the database, so if there is no
+	// schema_migrations table yet, no migrations have been applied.
+	exists := true
+	if dryRun {
+		var err error
+		exists, err = hasTable(db, d, "schema_migrations")
+		if err != nil {
+			return fmt.Errorf("could not check for schema_migrations table: %s", err)
+		}
+		if !exists {
+			fmt.Fprintln(out, "-- Record applied migrations")
+			fmt.Fprintln(out, strings.TrimSpace(q_create))
+		}
+	} else {
+		_, err := db.Exec(q_create)
+		if err != nil {
+			return fmt.Errorf("could not create schema_migrations table: %s", err)
+		}
+	}
+
+	applied := make(map[int]struct{})
+	if exists {
+		rows, err := db.Query(q_list)
+		if err != nil {
+			return fmt.Errorf("could not list applied migrations: %s", err)
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var version int
+			if err := rows.Scan(&version); err != nil {
+				return fmt.Errorf("could not read applied migration: %s", err)
+			}
+			applied[version] = struct{}{}
+		}
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("could not list applied migrations: %s", err)
+		}
+	}
+
+	for _, m := range migrations {
+		if _, ok := applied[m.version]; ok {
+			continue
+		}
+		statements, ok := m.statements[d]
+		if !ok {
+			return fmt.Errorf("migration %d has no statements for %s", m.version, d)
+		}
+
+		if dryRun {
+			fmt.Fprintf(out, "-- Migration %d: %s\n", m.version, m.description)
+			for _, s := range statements {
+				fmt.Fprintln(out, s)
+			}
+			continue
+		}
+
+		log.Printf("Applying database migration %d: %s", m.version, m.description)
+		tx, err := db.Begin()
+		if err != nil {
+			return fmt.Errorf("failed to begin transaction for migration %d: %s", m.version, err)
+		}
+		for _, s := range statements {
+			_, err = tx.Exec(s)
+			if err != nil {
+				tx.Rollback()
+				return fmt.Errorf("migration %d failed: %s", m.version, err)
+			}
+		}
+		_, err = tx.Exec(d.Rebind(q_insert), m.version, time.Now().UTC().Format("2006-01-02 15:04:05"))
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("could not record migration %d: %s", m.version, err)
+		}
+		err = tx.Commit()
+		if err != nil {
+			return fmt.Errorf("could not commit migration %d: %s", m.version, err)
+		}
+	}
+
+	return nil
+}
+
+// hasTable reports whether the table exists.
+func hasTable(db *sql.DB, d dialect.Dialect, table string) (bool, error) {
+	var q string
+	switch d {
+	case dialect.SQLite:
+		q = "SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?;"
+	case dialect.MySQL:
+		q = "SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = DATABASE() AND table_name = ?;"
+	case dialect.Postgres:
+		q = "SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = current_schema() AND table_name = ?;"
+	default:
+		return false, fmt.Errorf("unsupported database type %s", d)
+	}
+
+	var n int
+	err := db.QueryRow(d.Rebind(q), table).Scan(&n)
+	return n > 0, err
+}
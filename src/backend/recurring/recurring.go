@@ -0,0 +1,260 @@
+// Package recurring creates transactions that repeat on a schedule, such as
+// rent, subscriptions and transit passes.
+package recurring
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/davidschlachter/lychnos/src/backend/dialect"
+	"github.com/davidschlachter/lychnos/src/backend/httperror"
+	"github.com/shopspring/decimal"
+)
+
+// DateFormat is the format of start dates and occurrences.
+const DateFormat = "2006-01-02"
+
+// Recurrence is a transaction that is created on each date of its schedule.
+type Recurrence struct {
+	ID              int             `json:"id"`
+	Name            string          `json:"name"`
+	Description     string          `json:"description"`
+	Amount          decimal.Decimal `json:"amount"`
+	SourceID        string          `json:"source_id"`
+	SourceName      string          `json:"source_name"`
+	DestinationID   string          `json:"destination_id"`
+	DestinationName string          `json:"destination_name"`
+	CategoryID      string          `json:"category_id"`
+	CategoryName    string          `json:"category_name"`
+	// Schedule is a recurrence rule, see ParseSchedule.
+	Schedule string `json:"schedule"`
+	// StartDate is the first date of the schedule, formatted as DateFormat.
+	StartDate string `json:"start_date"`
+	// CatchUpFrom is the first date on which missed occurrences are created,
+	// which is the date the recurring transaction was created or last
+	// changed, so that saving it doesn't create the occurrences of the past
+	// unless Backfill is requested. If empty, it is the start date.
+	CatchUpFrom string `json:"catch_up_from"`
+	// Backfill, when saving a recurring transaction, creates every
+	// occurrence since the start date that hasn't been created yet.
+	Backfill bool `json:"backfill,omitempty"`
+}
+
+type Recurrences struct {
+	db *sql.DB
+	d  dialect.Dialect
+}
+
+func New(db *sql.DB, d dialect.Dialect) *Recurrences {
+	return &Recurrences{db: db, d: d}
+}
+
+var hasID = regexp.MustCompile(`/[0-9]+$`)
+
+// validate checks the recurrence, returning its parsed schedule and start
+// date.
+func (r Recurrence) validate() (Schedule, time.Time, error) {
+	if r.Name == "" {
+		return Schedule{}, time.Time{}, fmt.Errorf("name must be provided")
+	}
+	if !r.Amount.IsPositive() {
+		return Schedule{}, time.Time{}, fmt.Errorf("amount must be greater than zero")
+	}
+	if r.SourceID == "" && r.SourceName == "" {
+		return Schedule{}, time.Time{}, fmt.Errorf("source_id or source_name must be provided")
+	}
+	if r.DestinationID == "" && r.DestinationName == "" {
+		return Schedule{}, time.Time{}, fmt.Errorf("destination_id or destination_name must be provided")
+	}
+	s, err := ParseSchedule(r.Schedule)
+	if err != nil {
+		return Schedule{}, time.Time{}, fmt.Errorf("could not parse schedule: %s", err)
+	}
+	start, err := time.Parse(DateFormat, r.StartDate)
+	if err != nil {
+		return Schedule{}, time.Time{}, fmt.Errorf("could not parse start_date, expected a date like %s", DateFormat)
+	}
+	return s, start, nil
+}
+
+// catchUpFrom returns the first date on which missed occurrences are created,
+// given the start date of the schedule.
+func (r Recurrence) catchUpFrom(start time.Time) time.Time {
+	from, err := time.Parse(DateFormat, r.CatchUpFrom)
+	if err != nil || from.Before(start) {
+		return start
+	}
+	return from
+}
+
+func (rs *Recurrences) Handle(w http.ResponseWriter, req *http.Request) {
+	log.Printf("%s %s", req.Method, req.RequestURI)
+	switch req.Method {
+	case "GET":
+		if hasID.MatchString(req.URL.Path) {
+			rs.fetch(w, req)
+		} else {
+			rs.list(w, req)
+		}
+	case "POST":
+		rs.upsert(w, req)
+	case "DELETE":
+		rs.delete(w, req)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+		fmt.Fprintf(w, "Unsupported method %s", req.Method)
+	}
+}
+
+const columns = "id, name, description, amount, source_id, source_name, destination_id, destination_name, category_id, category_name, schedule, start_date, catch_up_from"
+
+func (r *Recurrence) scan(row interface{ Scan(...any) error }) error {
+	return row.Scan(&r.ID, &r.Name, &r.Description, &r.Amount, &r.SourceID, &r.SourceName, &r.DestinationID, &r.DestinationName, &r.CategoryID, &r.CategoryName, &r.Schedule, &r.StartDate, &r.CatchUpFrom)
+}
+
+func (rs *Recurrences) fetch(w http.ResponseWriter, req *http.Request) {
+	id, _ := strconv.Atoi(req.URL.Path[strings.LastIndex(req.URL.Path, "/")+1:])
+	r, err := rs.Fetch(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		httperror.Send(w, req, http.StatusNotFound, fmt.Sprintf("No recurring transaction with ID %d", id))
+		return
+	}
+	if err != nil {
+		httperror.Send(w, req, http.StatusInternalServerError, fmt.Sprintf("Could not fetch recurring transaction: %s", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(r)
+}
+
+// Fetch fetches the recurring transaction with the provided ID. If there is
+// no such recurring transaction, sql.ErrNoRows is returned.
+func (rs *Recurrences) Fetch(id int) (Recurrence, error) {
+	const q = "SELECT " + columns + " FROM recurrences WHERE id = ?;"
+
+	var r Recurrence
+	err := r.scan(rs.db.QueryRow(rs.d.Rebind(q), id))
+	return r, err
+}
+
+func (rs *Recurrences) list(w http.ResponseWriter, req *http.Request) {
+	recurrences, err := rs.List()
+	if err != nil {
+		httperror.Send(w, req, http.StatusInternalServerError, fmt.Sprintf("Could not list recurring transactions: %s", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(recurrences)
+}
+
+// List lists the recurring transactions in order of ID.
+func (rs *Recurrences) List() ([]Recurrence, error) {
+	const q = "SELECT " + columns + " FROM recurrences ORDER BY id;"
+
+	rows, err := rs.db.Query(q)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	recurrences := []Recurrence{}
+	for rows.Next() {
+		var r Recurrence
+		if err := r.scan(rows); err != nil {
+			return nil, err
+		}
+		recurrences = append(recurrences, r)
+	}
+	return recurrences, rows.Err()
+}
+
+// upsert creates a recurring transaction from a JSON body, or replaces it if an
+// ID is provided.
+func (rs *Recurrences) upsert(w http.ResponseWriter, req *http.Request) {
+	var r Recurrence
+	err := json.NewDecoder(req.Body).Decode(&r)
+	if err != nil {
+		httperror.Send(w, req, http.StatusBadRequest, fmt.Sprintf("Could not parse JSON body: %s", err))
+		return
+	}
+	if _, _, err := r.validate(); err != nil {
+		httperror.Send(w, req, http.StatusBadRequest, fmt.Sprintf("Invalid recurring transaction: %s", err))
+		return
+	}
+	if r.Description == "" {
+		r.Description = r.Name
+	}
+	r.CatchUpFrom = time.Now().Format(DateFormat)
+	if r.Backfill {
+		r.CatchUpFrom = r.StartDate
+	}
+
+	r.ID, err = rs.Upsert(r)
+	if err != nil {
+		httperror.Send(w, req, http.StatusInternalServerError, fmt.Sprintf("Could not save recurring transaction: %s", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(r)
+}
+
+// Upsert creates or replaces the recurring transaction with the provided ID,
+// returning its ID. If the ID is 0, a new recurring transaction is created.
+func (rs *Recurrences) Upsert(r Recurrence) (int, error) {
+	const q_create = "INSERT INTO recurrences (name, description, amount, source_id, source_name, destination_id, destination_name, category_id, category_name, schedule, start_date, catch_up_from) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);"
+
+	if r.ID == 0 {
+		return rs.d.InsertID(rs.db, q_create, r.Name, r.Description, r.Amount, r.SourceID, r.SourceName, r.DestinationID, r.DestinationName, r.CategoryID, r.CategoryName, r.Schedule, r.StartDate, r.CatchUpFrom)
+	}
+	q := rs.d.Upsert("recurrences", strings.Split(columns, ", ")...)
+	_, err := rs.db.Exec(q, r.ID, r.Name, r.Description, r.Amount, r.SourceID, r.SourceName, r.DestinationID, r.DestinationName, r.CategoryID, r.CategoryName, r.Schedule, r.StartDate, r.CatchUpFrom)
+	return r.ID, err
+}
+
+// delete deletes a recurring transaction, along with the record of which of
+// its occurrences were created. The created transactions are kept.
+func (rs *Recurrences) delete(w http.ResponseWriter, req *http.Request) {
+	const (
+		q_occurrences = "DELETE FROM recurrence_occurrences WHERE recurrence_id = ?;"
+		q             = "DELETE FROM recurrences WHERE id = ?;"
+	)
+
+	if !hasID.MatchString(req.URL.Path) {
+		httperror.Send(w, req, http.StatusBadRequest, "Must provide a recurring transaction ID to delete")
+		return
+	}
+	id, _ := strconv.Atoi(req.URL.Path[strings.LastIndex(req.URL.Path, "/")+1:])
+
+	tx, err := rs.db.Begin()
+	if err != nil {
+		httperror.Send(w, req, http.StatusInternalServerError, fmt.Sprintf("Could not delete recurring transaction: %s", err))
+		return
+	}
+	defer tx.Rollback()
+	for _, q := range []string{q_occurrences, q} {
+		_, err = tx.Exec(rs.d.Rebind(q), id)
+		if err != nil {
+			httperror.Send(w, req, http.StatusInternalServerError, fmt.Sprintf("Could not delete recurring transaction: %s", err))
+			return
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		httperror.Send(w, req, http.StatusInternalServerError, fmt.Sprintf("Could not delete recurring transaction: %s", err))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
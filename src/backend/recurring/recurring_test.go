@@ -0,0 +1,216 @@
+package recurring_test
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+
+	"github.com/davidschlachter/lychnos/src/backend/dialect"
+	"github.com/davidschlachter/lychnos/src/backend/firefly"
+	"github.com/davidschlachter/lychnos/src/backend/recurring"
+)
+
+var recurrenceColumns = []string{"id", "name", "description", "amount", "source_id", "source_name", "destination_id", "destination_name", "category_id", "category_name", "schedule", "start_date", "catch_up_from"}
+
+func rentRows() *sqlmock.Rows {
+	return sqlmock.NewRows(recurrenceColumns).AddRow(1, "Rent", "Rent", "1500", "1", "", "", "Landlord", "4", "", "FREQ=MONTHLY", "2025-01-01", "")
+}
+
+func TestHandle(t *testing.T) {
+	for _, d := range dialect.All {
+		t.Run(d.String(), func(t *testing.T) { testHandle(t, d) })
+	}
+}
+
+func testHandle(t *testing.T, d dialect.Dialect) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Unexpected error opening mock database connection: %s\n", err)
+	}
+	defer db.Close()
+	rs := recurring.New(db, d)
+
+	// Invalid recurring transactions are rejected
+	for _, body := range []string{
+		`{"name": "Rent", "amount": "1500", "source_id": "1", "destination_name": "Landlord", "start_date": "2025-01-01"}`,
+		`{"name": "Rent", "amount": "1500", "source_id": "1", "destination_name": "Landlord", "schedule": "FREQ=MONTHLY", "start_date": "January 1"}`,
+		`{"name": "Rent", "amount": "-1500", "source_id": "1", "destination_name": "Landlord", "schedule": "FREQ=MONTHLY", "start_date": "2025-01-01"}`,
+		`{"name": "Rent", "amount": "1500", "source_id": "1", "schedule": "FREQ=MONTHLY", "start_date": "2025-01-01"}`,
+	} {
+		w := httptest.NewRecorder()
+		rs.Handle(w, httptest.NewRequest(http.MethodPost, "/api/recurring/", strings.NewReader(body)))
+		if w.Result().StatusCode != http.StatusBadRequest {
+			t.Fatalf("Status code = %d for %s, want %d", w.Result().StatusCode, body, http.StatusBadRequest)
+		}
+	}
+
+	// Create, with the name as the default description, catching up from
+	// today, or from the start date if backfilled
+	const body = `{"name": "Rent", "amount": "1500", "source_id": "1", "destination_name": "Landlord", "category_id": "4", "schedule": "FREQ=MONTHLY", "start_date": "2025-01-01"`
+	for i, test := range []struct {
+		body        string
+		catchUpFrom string
+	}{
+		{body + "}", time.Now().Format(recurring.DateFormat)},
+		{body + `, "backfill": true}`, "2025-01-01"},
+	} {
+		args := []driver.Value{"Rent", "Rent", "1500", "1", "", "", "Landlord", "4", "", "FREQ=MONTHLY", "2025-01-01", test.catchUpFrom}
+		if d == dialect.Postgres {
+			mock.ExpectQuery(`INSERT INTO recurrences .* RETURNING id`).WithArgs(args...).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(i + 1))
+		} else {
+			mock.ExpectExec(`INSERT INTO recurrences`).WithArgs(args...).WillReturnResult(sqlmock.NewResult(int64(i+1), 1))
+		}
+		w := httptest.NewRecorder()
+		rs.Handle(w, httptest.NewRequest(http.MethodPost, "/api/recurring/", strings.NewReader(test.body)))
+		if w.Result().StatusCode != http.StatusCreated {
+			t.Fatalf("Status code = %d, want %d. Response body: %s", w.Result().StatusCode, http.StatusCreated, w.Body.String())
+		}
+		var created recurring.Recurrence
+		json.NewDecoder(w.Body).Decode(&created)
+		if created.ID != i+1 || created.Description != "Rent" || created.CatchUpFrom != test.catchUpFrom {
+			t.Fatalf("Got recurring transaction %+v, wanted ID %d described as Rent catching up from %s", created, i+1, test.catchUpFrom)
+		}
+	}
+
+	// Fetch
+	mock.ExpectQuery(`SELECT .* FROM recurrences WHERE id = (\?|\$1);`).WithArgs(1).WillReturnRows(rentRows())
+	w := httptest.NewRecorder()
+	rs.Handle(w, httptest.NewRequest(http.MethodGet, "/api/recurring/1", nil))
+	var fetched recurring.Recurrence
+	json.NewDecoder(w.Body).Decode(&fetched)
+	if fetched.Name != "Rent" || fetched.Schedule != "FREQ=MONTHLY" {
+		t.Fatalf("Got recurring transaction %+v, wanted Rent", fetched)
+	}
+
+	// Delete, along with its occurrences
+	mock.ExpectBegin()
+	mock.ExpectExec(`DELETE FROM recurrence_occurrences WHERE recurrence_id = (\?|\$1);`).WithArgs(1).WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(`DELETE FROM recurrences WHERE id = (\?|\$1);`).WithArgs(1).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	w = httptest.NewRecorder()
+	rs.Handle(w, httptest.NewRequest(http.MethodDelete, "/api/recurring/1", nil))
+	if w.Result().StatusCode != http.StatusNoContent {
+		t.Fatalf("Status code = %d, want %d", w.Result().StatusCode, http.StatusNoContent)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestRun(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Unexpected error opening mock database connection: %s\n", err)
+	}
+	defer db.Close()
+	rs := recurring.New(db, dialect.SQLite)
+	now := time.Date(2025, 4, 15, 12, 0, 0, 0, time.Local)
+
+	// January was created before, February was created but not recorded,
+	// March is created, and April fails, so it is retried on the next run.
+	// Groceries were saved on April 8, so only the occurrence on April 9 is
+	// created.
+	var forms []url.Values
+	create := func(ctx context.Context, form url.Values) (firefly.Transactions, int, error) {
+		forms = append(forms, form)
+		switch form.Get("date") {
+		case "2025-02-01":
+			return firefly.Transactions{}, http.StatusConflict, fmt.Errorf("%w: external ID %s was already imported", firefly.ErrDuplicate, form.Get("external_id"))
+		case "2025-04-01":
+			return firefly.Transactions{}, http.StatusInternalServerError, fmt.Errorf("Firefly-III is unavailable")
+		}
+		return firefly.Transactions{ID: "2774"}, http.StatusCreated, nil
+	}
+	mock.ExpectQuery(`SELECT .* FROM recurrences ORDER BY id;`).
+		WillReturnRows(rentRows().AddRow(2, "Groceries", "Groceries", "100", "1", "", "", "Grocer", "", "", "FREQ=WEEKLY", "2025-01-01", "2025-04-08"))
+	mock.ExpectQuery(`SELECT occurrence FROM recurrence_occurrences WHERE recurrence_id = \?;`).WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"occurrence"}).AddRow("2025-01-01"))
+	for _, date := range []string{"2025-02-01", "2025-03-01", "2025-04-01"} {
+		// Each occurrence is recorded before it is created
+		mock.ExpectExec(`INSERT INTO recurrence_occurrences`).WithArgs(1, date, "", sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+		switch date {
+		case "2025-03-01":
+			mock.ExpectExec(`UPDATE recurrence_occurrences SET transaction_id = \?`).WithArgs("2774", 1, date).WillReturnResult(sqlmock.NewResult(0, 1))
+		case "2025-04-01":
+			mock.ExpectExec(`DELETE FROM recurrence_occurrences WHERE recurrence_id = \? AND occurrence = \?;`).WithArgs(1, date).WillReturnResult(sqlmock.NewResult(0, 1))
+		}
+	}
+	mock.ExpectQuery(`SELECT occurrence FROM recurrence_occurrences WHERE recurrence_id = \?;`).WithArgs(2).
+		WillReturnRows(sqlmock.NewRows([]string{"occurrence"}))
+	mock.ExpectExec(`INSERT INTO recurrence_occurrences`).WithArgs(2, "2025-04-09", "", sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`UPDATE recurrence_occurrences SET transaction_id = \?`).WithArgs("2774", 2, "2025-04-09").WillReturnResult(sqlmock.NewResult(0, 1))
+
+	err = rs.Run(t.Context(), now, create)
+	if err == nil || !strings.Contains(err.Error(), "2025-04-01") {
+		t.Fatalf("Got error %v, wanted an error creating the April occurrence", err)
+	}
+	if len(forms) != 4 {
+		t.Fatalf("Got %d transactions, wanted 4", len(forms))
+	}
+	if f := forms[1]; f.Get("amount") != "1500" || f.Get("destination_name") != "Landlord" || f.Get("category_id") != "4" || f.Get("external_id") != "recurring-1-2025-03-01" || f.Get("force") != "true" {
+		t.Fatalf("Got form %v, wanted the March rent", f)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestHandleUpcoming(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Unexpected error opening mock database connection: %s\n", err)
+	}
+	defer db.Close()
+	rs := recurring.New(db, dialect.SQLite)
+
+	w := httptest.NewRecorder()
+	rs.HandleUpcoming(w, httptest.NewRequest(http.MethodGet, "/api/recurring/upcoming?days=soon", nil))
+	if w.Result().StatusCode != http.StatusBadRequest {
+		t.Fatalf("Status code = %d, want %d", w.Result().StatusCode, http.StatusBadRequest)
+	}
+
+	// Only the first month has been created, so the next one is overdue, and
+	// this month's is overdue unless it is today
+	today := time.Now()
+	start := time.Date(today.Year(), today.Month()-2, 1, 0, 0, 0, 0, time.UTC)
+	mock.ExpectQuery(`SELECT .* FROM recurrences ORDER BY id;`).
+		WillReturnRows(sqlmock.NewRows(recurrenceColumns).AddRow(1, "Rent", "Rent", "1500", "1", "", "", "Landlord", "4", "", "FREQ=MONTHLY", start.Format(recurring.DateFormat), ""))
+	mock.ExpectQuery(`SELECT occurrence FROM recurrence_occurrences WHERE recurrence_id = \?;`).WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"occurrence"}).AddRow(start.Format(recurring.DateFormat)))
+	days := int(start.AddDate(0, 3, 0).Sub(time.Date(today.Year(), today.Month(), today.Day(), 0, 0, 0, 0, time.UTC)).Hours() / 24)
+	w = httptest.NewRecorder()
+	rs.HandleUpcoming(w, httptest.NewRequest(http.MethodGet, fmt.Sprintf("/api/recurring/upcoming?days=%d", days), nil))
+	if w.Result().StatusCode != http.StatusOK {
+		t.Fatalf("Status code = %d, want %d. Response body: %s", w.Result().StatusCode, http.StatusOK, w.Body.String())
+	}
+	var got []recurring.Occurrence
+	json.NewDecoder(w.Body).Decode(&got)
+	want := []recurring.Occurrence{
+		{Date: start.AddDate(0, 1, 0).Format(recurring.DateFormat), Overdue: true},
+		{Date: start.AddDate(0, 2, 0).Format(recurring.DateFormat), Overdue: today.Day() > 1},
+		{Date: start.AddDate(0, 3, 0).Format(recurring.DateFormat)},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("Got occurrences %+v, wanted %+v", got, want)
+	}
+	for i := range want {
+		if got[i].Date != want[i].Date || got[i].Overdue != want[i].Overdue || got[i].RecurrenceID != 1 || got[i].Amount.String() != "1500" {
+			t.Fatalf("Got occurrence %+v, wanted %+v", got[i], want[i])
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
@@ -0,0 +1,197 @@
+package recurring
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Frequencies of a Schedule, as in RFC 5545 recurrence rules.
+const (
+	Daily   = "DAILY"
+	Weekly  = "WEEKLY"
+	Monthly = "MONTHLY"
+	Yearly  = "YEARLY"
+)
+
+// maxPeriods bounds the number of periods that a schedule is expanded to, in
+// case of a schedule that never reaches the end of the requested range.
+const maxPeriods = 100000
+
+var weekdays = map[string]time.Weekday{
+	"MO": time.Monday, "TU": time.Tuesday, "WE": time.Wednesday, "TH": time.Thursday,
+	"FR": time.Friday, "SA": time.Saturday, "SU": time.Sunday,
+}
+
+// Schedule is a subset of an RFC 5545 recurrence rule, e.g.
+// FREQ=MONTHLY;BYMONTHDAY=1 or FREQ=WEEKLY;INTERVAL=2;BYDAY=FR;COUNT=10.
+// Supported parts are FREQ, INTERVAL, BYDAY (for weekly schedules),
+// BYMONTHDAY (for monthly schedules, where negative days count from the end
+// of the month), COUNT and UNTIL (formatted as YYYYMMDD).
+//
+// Unlike RFC 5545, days that don't exist in a month (e.g. the 31st) fall on the
+// last day of the month instead of being skipped, since a monthly bill is
+// still due in short months.
+type Schedule struct {
+	Freq       string
+	Interval   int
+	ByDay      []time.Weekday
+	ByMonthDay []int
+	Count      int
+	Until      time.Time
+}
+
+// ParseSchedule parses a recurrence rule.
+func ParseSchedule(rule string) (Schedule, error) {
+	s := Schedule{Interval: 1}
+	for _, part := range strings.Split(strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(rule)), "RRULE:"), ";") {
+		name, value, ok := strings.Cut(part, "=")
+		if !ok {
+			return s, fmt.Errorf("could not parse '%s', expected NAME=VALUE", part)
+		}
+		var err error
+		switch name {
+		case "FREQ":
+			s.Freq = value
+		case "INTERVAL":
+			s.Interval, err = strconv.Atoi(value)
+			if err == nil && s.Interval < 1 {
+				err = fmt.Errorf("must be at least 1")
+			}
+		case "BYDAY":
+			for _, d := range strings.Split(value, ",") {
+				wd, ok := weekdays[d]
+				if !ok {
+					return s, fmt.Errorf("could not parse BYDAY: unknown day '%s'", d)
+				}
+				s.ByDay = append(s.ByDay, wd)
+			}
+		case "BYMONTHDAY":
+			for _, d := range strings.Split(value, ",") {
+				day, err := strconv.Atoi(d)
+				if err != nil || day == 0 || day < -31 || day > 31 {
+					return s, fmt.Errorf("could not parse BYMONTHDAY: invalid day '%s'", d)
+				}
+				s.ByMonthDay = append(s.ByMonthDay, day)
+			}
+		case "COUNT":
+			s.Count, err = strconv.Atoi(value)
+			if err == nil && s.Count < 1 {
+				err = fmt.Errorf("must be at least 1")
+			}
+		case "UNTIL":
+			if len(value) < 8 {
+				err = fmt.Errorf("expected YYYYMMDD")
+				break
+			}
+			s.Until, err = time.Parse("20060102", value[:8])
+		default:
+			return s, fmt.Errorf("unsupported part %s", name)
+		}
+		if err != nil {
+			return s, fmt.Errorf("could not parse %s: %s", name, err)
+		}
+	}
+
+	switch s.Freq {
+	case Daily, Weekly, Monthly, Yearly:
+	case "":
+		return s, fmt.Errorf("FREQ must be provided")
+	default:
+		return s, fmt.Errorf("unsupported FREQ %s", s.Freq)
+	}
+	if len(s.ByDay) > 0 && s.Freq != Weekly {
+		return s, fmt.Errorf("BYDAY is only supported for weekly schedules")
+	}
+	if len(s.ByMonthDay) > 0 && s.Freq != Monthly {
+		return s, fmt.Errorf("BYMONTHDAY is only supported for monthly schedules")
+	}
+	return s, nil
+}
+
+// Occurrences returns the dates of the schedule, beginning on start, that are
+// between from and to (inclusive). Dates are at midnight UTC, and only their
+// year, month and day are used.
+func (s Schedule) Occurrences(start, from, to time.Time) []time.Time {
+	start, from, to = date(start), date(from), date(to)
+	if !s.Until.IsZero() && s.Until.Before(to) {
+		to = date(s.Until)
+	}
+
+	var (
+		dates []time.Time
+		n     int
+	)
+	for k := 0; k < maxPeriods; k++ {
+		for _, d := range s.period(start, k) {
+			if d.Before(start) {
+				continue
+			}
+			if d.After(to) {
+				return dates
+			}
+			n++
+			if s.Count > 0 && n > s.Count {
+				return dates
+			}
+			if !d.Before(from) {
+				dates = append(dates, d)
+			}
+		}
+	}
+	return dates
+}
+
+// period returns the candidate dates, in order, of the kth period of the
+// schedule after start.
+func (s Schedule) period(start time.Time, k int) []time.Time {
+	switch s.Freq {
+	case Daily:
+		return []time.Time{start.AddDate(0, 0, k*s.Interval)}
+	case Weekly:
+		if len(s.ByDay) == 0 {
+			return []time.Time{start.AddDate(0, 0, 7*k*s.Interval)}
+		}
+		// Weeks begin on Monday
+		monday := start.AddDate(0, 0, -(int(start.Weekday())+6)%7+7*k*s.Interval)
+		var dates []time.Time
+		for _, wd := range s.ByDay {
+			dates = append(dates, monday.AddDate(0, 0, (int(wd)+6)%7))
+		}
+		sort.Slice(dates, func(i, j int) bool { return dates[i].Before(dates[j]) })
+		return dates
+	case Monthly:
+		first := time.Date(start.Year(), start.Month()+time.Month(k*s.Interval), 1, 0, 0, 0, 0, time.UTC)
+		last := first.AddDate(0, 1, -1).Day()
+		days := s.ByMonthDay
+		if len(days) == 0 {
+			days = []int{start.Day()}
+		}
+		seen := make(map[int]struct{})
+		var dates []time.Time
+		for _, d := range days {
+			if d < 0 {
+				d = max(last+1+d, 1)
+			}
+			d = min(d, last)
+			if _, ok := seen[d]; ok {
+				continue
+			}
+			seen[d] = struct{}{}
+			dates = append(dates, first.AddDate(0, 0, d-1))
+		}
+		sort.Slice(dates, func(i, j int) bool { return dates[i].Before(dates[j]) })
+		return dates
+	case Yearly:
+		first := time.Date(start.Year()+k*s.Interval, start.Month(), 1, 0, 0, 0, 0, time.UTC)
+		return []time.Time{first.AddDate(0, 0, min(start.Day(), first.AddDate(0, 1, -1).Day())-1)}
+	}
+	return nil
+}
+
+// date returns the date of t at midnight UTC.
+func date(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
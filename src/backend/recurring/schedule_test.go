@@ -0,0 +1,68 @@
+package recurring_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/davidschlachter/lychnos/src/backend/recurring"
+)
+
+func TestOccurrences(t *testing.T) {
+	tests := []struct {
+		schedule string
+		start    string
+		from, to string
+		want     []string
+	}{
+		{"FREQ=DAILY;INTERVAL=3", "2025-01-01", "2025-01-01", "2025-01-10", []string{"2025-01-01", "2025-01-04", "2025-01-07", "2025-01-10"}},
+		// 2025-01-01 is a Wednesday
+		{"FREQ=WEEKLY", "2025-01-01", "2025-01-01", "2025-01-20", []string{"2025-01-01", "2025-01-08", "2025-01-15"}},
+		{"FREQ=WEEKLY;INTERVAL=2;BYDAY=FR,MO", "2025-01-01", "2025-01-01", "2025-01-20", []string{"2025-01-03", "2025-01-13", "2025-01-17"}},
+		// Days that don't exist fall on the last day of the month
+		{"FREQ=MONTHLY", "2025-01-31", "2025-01-01", "2025-04-30", []string{"2025-01-31", "2025-02-28", "2025-03-31", "2025-04-30"}},
+		{"FREQ=MONTHLY;BYMONTHDAY=1,-1", "2025-01-15", "2025-01-01", "2025-03-01", []string{"2025-01-31", "2025-02-01", "2025-02-28", "2025-03-01"}},
+		{"FREQ=MONTHLY;BYMONTHDAY=30,31", "2025-02-01", "2025-02-01", "2025-02-28", []string{"2025-02-28"}},
+		{"FREQ=MONTHLY;INTERVAL=3", "2025-01-15", "2025-01-01", "2025-12-31", []string{"2025-01-15", "2025-04-15", "2025-07-15", "2025-10-15"}},
+		{"FREQ=YEARLY", "2024-02-29", "2024-01-01", "2026-12-31", []string{"2024-02-29", "2025-02-28", "2026-02-28"}},
+		// COUNT includes occurrences before from
+		{"FREQ=MONTHLY;COUNT=3", "2025-01-01", "2025-02-01", "2025-12-31", []string{"2025-02-01", "2025-03-01"}},
+		{"RRULE:FREQ=MONTHLY;UNTIL=20250301T000000Z", "2025-01-01", "2025-01-01", "2025-12-31", []string{"2025-01-01", "2025-02-01", "2025-03-01"}},
+		{"freq=monthly", "2025-01-01", "2024-01-01", "2024-12-31", nil},
+	}
+
+	for _, test := range tests {
+		s, err := recurring.ParseSchedule(test.schedule)
+		if err != nil {
+			t.Fatalf("Unexpected error parsing %s: %s", test.schedule, err)
+		}
+		start, _ := time.Parse(recurring.DateFormat, test.start)
+		from, _ := time.Parse(recurring.DateFormat, test.from)
+		to, _ := time.Parse(recurring.DateFormat, test.to)
+		var got []string
+		for _, d := range s.Occurrences(start, from, to) {
+			got = append(got, d.Format(recurring.DateFormat))
+		}
+		if strings.Join(got, ",") != strings.Join(test.want, ",") {
+			t.Errorf("Got occurrences %v for %s from %s, wanted %v", got, test.schedule, test.start, test.want)
+		}
+	}
+}
+
+func TestParseScheduleErrors(t *testing.T) {
+	for _, schedule := range []string{
+		"",
+		"FREQ=HOURLY",
+		"FREQ=MONTHLY;INTERVAL=0",
+		"FREQ=WEEKLY;BYDAY=XX",
+		"FREQ=MONTHLY;BYDAY=MO",
+		"FREQ=WEEKLY;BYMONTHDAY=1",
+		"FREQ=MONTHLY;BYMONTHDAY=32",
+		"FREQ=MONTHLY;UNTIL=2025",
+		"FREQ=MONTHLY;BYSETPOS=1",
+	} {
+		if _, err := recurring.ParseSchedule(schedule); err == nil {
+			t.Errorf("Got no error parsing '%s'", schedule)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package recurring
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/davidschlachter/lychnos/src/backend/firefly"
+	"github.com/davidschlachter/lychnos/src/backend/httperror"
+	"github.com/shopspring/decimal"
+)
+
+// CreateFunc creates a transaction from form values, as submitted to
+// POST /api/transactions/.
+type CreateFunc func(ctx context.Context, form url.Values) (firefly.Transactions, int, error)
+
+// defaultUpcomingDays is how far ahead upcoming occurrences are listed by
+// default.
+const defaultUpcomingDays = 30
+
+// Occurrence is a date on which a recurring transaction is created.
+type Occurrence struct {
+	RecurrenceID int             `json:"recurrence_id"`
+	Name         string          `json:"name"`
+	Description  string          `json:"description"`
+	Amount       decimal.Decimal `json:"amount"`
+	Date         string          `json:"date"`
+	// Overdue is true if the date has passed but the transaction has not
+	// been created yet, e.g. because creating it failed.
+	Overdue bool `json:"overdue"`
+}
+
+// externalID identifies the transaction created for an occurrence in
+// Firefly-III.
+func externalID(id int, date string) string {
+	return fmt.Sprintf("recurring-%d-%s", id, date)
+}
+
+// Run creates the transactions of every occurrence up to and including the
+// date of now that has not been created yet, including occurrences that were
+// missed while lychnos was not running (but not ones before the recurring
+// transaction was saved, unless it was backfilled). Each occurrence is
+// recorded before its transaction is created, so that it is never created
+// twice, even if lychnos stops while creating it.
+func (rs *Recurrences) Run(ctx context.Context, now time.Time, create CreateFunc) error {
+	recurrences, err := rs.List()
+	if err != nil {
+		return fmt.Errorf("could not list recurring transactions: %s", err)
+	}
+
+	var errs []error
+	for _, r := range recurrences {
+		s, start, err := r.validate()
+		if err != nil {
+			log.Printf("Skipping invalid recurring transaction %d: %s", r.ID, err)
+			continue
+		}
+		posted, err := rs.posted(r.ID)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("could not list occurrences of recurring transaction %d: %s", r.ID, err))
+			continue
+		}
+		for _, d := range s.Occurrences(start, r.catchUpFrom(start), now) {
+			date := d.Format(DateFormat)
+			if _, ok := posted[date]; ok {
+				continue
+			}
+			err := rs.createOccurrence(ctx, r, date, create)
+			if err != nil {
+				// Later occurrences are retried with this one on the next
+				// run, to keep them in order.
+				errs = append(errs, fmt.Errorf("could not create recurring transaction %d on %s: %s", r.ID, date, err))
+				break
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// createOccurrence records an occurrence, then creates its transaction. If
+// the transaction can't be created, the occurrence is removed again, so that
+// it is retried on the next run. If lychnos stops before then, the occurrence
+// stays recorded without a transaction ID, and is not retried: it is better
+// to miss an occurrence than to create it twice.
+func (rs *Recurrences) createOccurrence(ctx context.Context, r Recurrence, date string, create CreateFunc) error {
+	const (
+		q_pending = "INSERT INTO recurrence_occurrences (recurrence_id, occurrence, transaction_id, created_at) VALUES(?, ?, ?, ?);"
+		q_created = "UPDATE recurrence_occurrences SET transaction_id = ? WHERE recurrence_id = ? AND occurrence = ?;"
+		q_failed  = "DELETE FROM recurrence_occurrences WHERE recurrence_id = ? AND occurrence = ?;"
+	)
+
+	// The occurrence is the primary key, so if another run is creating it,
+	// this fails.
+	_, err := rs.db.Exec(rs.d.Rebind(q_pending), r.ID, date, "", time.Now())
+	if err != nil {
+		return fmt.Errorf("could not record occurrence: %s", err)
+	}
+
+	form := url.Values{}
+	form.Set("date", date)
+	form.Set("amount", r.Amount.String())
+	form.Set("description", r.Description)
+	form.Set("source_id", r.SourceID)
+	form.Set("source_name", r.SourceName)
+	form.Set("destination_id", r.DestinationID)
+	form.Set("destination_name", r.DestinationName)
+	form.Set("category_id", r.CategoryID)
+	form.Set("category_name", r.CategoryName)
+	form.Set("external_id", externalID(r.ID, date))
+	// Recurring transactions look like each other by design
+	form.Set("force", "true")
+	created, _, err := create(ctx, form)
+	if errors.Is(err, firefly.ErrDuplicate) {
+		log.Printf("Recurring transaction %d on %s was already created, recording it", r.ID, date)
+		return nil
+	}
+	if err != nil {
+		if _, dbErr := rs.db.Exec(rs.d.Rebind(q_failed), r.ID, date); dbErr != nil {
+			log.Printf("Could not remove occurrence %s of recurring transaction %d, it will not be retried: %s", date, r.ID, dbErr)
+		}
+		return err
+	}
+	log.Printf("Created transaction %s for recurring transaction %d on %s", created.ID, r.ID, date)
+
+	_, err = rs.db.Exec(rs.d.Rebind(q_created), created.ID, r.ID, date)
+	if err != nil {
+		// The occurrence is still recorded, so it won't be created again
+		log.Printf("Could not record transaction %s of recurring transaction %d on %s: %s", created.ID, r.ID, date, err)
+	}
+	return nil
+}
+
+// posted returns the dates of the occurrences of a recurring transaction that
+// have been created.
+func (rs *Recurrences) posted(id int) (map[string]struct{}, error) {
+	const q = "SELECT occurrence FROM recurrence_occurrences WHERE recurrence_id = ?;"
+
+	rows, err := rs.db.Query(rs.d.Rebind(q), id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	posted := make(map[string]struct{})
+	for rows.Next() {
+		var date string
+		if err := rows.Scan(&date); err != nil {
+			return nil, err
+		}
+		posted[date] = struct{}{}
+	}
+	return posted, rows.Err()
+}
+
+// Upcoming lists the occurrences, in order of date, that have not been created
+// yet and are at most days after the date of now.
+func (rs *Recurrences) Upcoming(now time.Time, days int) ([]Occurrence, error) {
+	recurrences, err := rs.List()
+	if err != nil {
+		return nil, err
+	}
+
+	today := date(now)
+	occurrences := []Occurrence{}
+	for _, r := range recurrences {
+		s, start, err := r.validate()
+		if err != nil {
+			continue
+		}
+		posted, err := rs.posted(r.ID)
+		if err != nil {
+			return nil, err
+		}
+		for _, d := range s.Occurrences(start, r.catchUpFrom(start), today.AddDate(0, 0, days)) {
+			o := Occurrence{
+				RecurrenceID: r.ID,
+				Name:         r.Name,
+				Description:  r.Description,
+				Amount:       r.Amount,
+				Date:         d.Format(DateFormat),
+				Overdue:      d.Before(today),
+			}
+			if _, ok := posted[o.Date]; ok {
+				continue
+			}
+			occurrences = append(occurrences, o)
+		}
+	}
+	sort.SliceStable(occurrences, func(i, j int) bool { return occurrences[i].Date < occurrences[j].Date })
+	return occurrences, nil
+}
+
+// HandleUpcoming handles GET /api/recurring/upcoming, which lists the
+// occurrences in the number of days set by the days parameter that have not
+// been created yet.
+func (rs *Recurrences) HandleUpcoming(w http.ResponseWriter, req *http.Request) {
+	log.Printf("%s %s", req.Method, req.RequestURI)
+	if req.Method != "GET" {
+		w.WriteHeader(http.StatusNotImplemented)
+		fmt.Fprintf(w, "Unsupported method %s", req.Method)
+		return
+	}
+
+	days := defaultUpcomingDays
+	if daysString := req.URL.Query().Get("days"); daysString != "" {
+		var err error
+		days, err = strconv.Atoi(daysString)
+		if err != nil || days < 0 {
+			httperror.Send(w, req, http.StatusBadRequest, fmt.Sprintf("Could not parse days: %s", daysString))
+			return
+		}
+	}
+
+	occurrences, err := rs.Upcoming(time.Now(), days)
+	if err != nil {
+		httperror.Send(w, req, http.StatusInternalServerError, fmt.Sprintf("Could not list upcoming occurrences: %s", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(occurrences)
+}
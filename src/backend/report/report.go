@@ -1,7 +1,9 @@
 package report
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -14,7 +16,6 @@ import (
 	"github.com/davidschlachter/lychnos/src/backend/categorybudget"
 	"github.com/davidschlachter/lychnos/src/backend/firefly"
 	"github.com/davidschlachter/lychnos/src/backend/httperror"
-	"github.com/davidschlachter/lychnos/src/backend/interval"
 	"github.com/shopspring/decimal"
 )
 
@@ -61,58 +62,63 @@ type CategorySummary struct {
 	CategoryBudgetID int             `json:"category_budget_id"`
 	Amount           decimal.Decimal `json:"amount"`
 	Sum              decimal.Decimal `json:"sum"`
+	CarriedOver      decimal.Decimal `json:"carried_over"`
 	Start            time.Time       `json:"start"`
 	End              time.Time       `json:"end"`
 }
 
 func (r *Reports) listCategorySummaries(w http.ResponseWriter, req *http.Request) {
 	var (
-		budget int
-		err    error
+		budgetID int
+		err      error
 	)
 
 	// If a budget was not provided, fetch the current one.
 	budgetStr, ok := req.URL.Query()["budget"]
 	if !ok || len(budgetStr) == 0 {
-		// get the current budget
-		bgts, err := r.b.List()
-		if err != nil {
-			httperror.Send(w, req, http.StatusBadRequest, fmt.Sprintf("Could not fetch budgets to find latest budget for report: %s\n", err))
+		bgt, err := r.b.ForDate(time.Now())
+		if errors.Is(err, budget.ErrNoBudget) {
+			httperror.Send(w, req, http.StatusBadRequest, "Could not identify a current budget for summary")
 			return
 		}
-		now := time.Now()
-		for _, b := range bgts {
-			if now.After(b.Start) && now.Before(b.End) {
-				budget = b.ID
-				break
-			}
-		}
-		if budget == 0 {
-			httperror.Send(w, req, http.StatusBadRequest, "Could not identify a current budget for summary")
+		if err != nil {
+			httperror.Send(w, req, http.StatusBadRequest, fmt.Sprintf("Could not fetch budgets to find latest budget for report: %s\n", err))
 			return
 		}
+		budgetID = bgt.ID
 	} else if len(budgetStr) > 1 {
 		httperror.Send(w, req, http.StatusBadRequest, fmt.Sprintf("Got %d budget IDs, wanted 0 or 1", len(budgetStr)))
 		return
 	} else {
-		budget, err = strconv.Atoi(budgetStr[0])
+		budgetID, err = strconv.Atoi(budgetStr[0])
 		if err != nil {
 			httperror.Send(w, req, http.StatusBadRequest, fmt.Sprintf("Could not parse budget ID: %s\n", budgetStr[0]))
 			return
 		}
 	}
 
-	summaries, err := r.ListCategorySummaries(budget)
+	summaries, err := r.ListCategorySummaries(req.Context(), budgetID)
 	if err != nil {
 		httperror.Send(w, req, http.StatusInternalServerError, fmt.Sprintf("Could not generate CategorySummaries: %s\n", err))
 		return
 	}
 
+	r.setCacheAge(w, budgetID)
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(summaries)
 }
 
-func (r *Reports) ListCategorySummaries(budgetID int) ([]CategorySummary, error) {
+// setCacheAge sets the Age header of the response to the age of the oldest
+// cached category totals for the budget.
+func (r *Reports) setCacheAge(w http.ResponseWriter, budgetID int) {
+	bgt, err := r.b.Fetch(strconv.Itoa(budgetID))
+	if err != nil || len(bgt) != 1 {
+		return
+	}
+	firefly.SetAgeHeader(w, r.f.CategoryTotalsAge(bgt[0].Start, bgt[0].End))
+}
+
+func (r *Reports) ListCategorySummaries(ctx context.Context, budgetID int) ([]CategorySummary, error) {
 	budget, err := r.b.Fetch(strconv.Itoa(budgetID))
 	if err != nil || len(budget) != 1 {
 		return nil, fmt.Errorf("could not find budget with ID = %d", budgetID)
@@ -121,15 +127,20 @@ func (r *Reports) ListCategorySummaries(budgetID int) ([]CategorySummary, error)
 	if err != nil {
 		return nil, fmt.Errorf("could not list categorybudgets: %s", err)
 	}
-	categorytotals, err := r.f.CachedListCategoryTotals(budget[0].Start.Local(), budget[0].End.Local())
+	categorytotals, err := r.f.CachedListCategoryTotals(ctx, budget[0].Start.Local(), budget[0].End.Local())
 	if err != nil {
 		return nil, fmt.Errorf("could not list Category Totals: %s", err)
 	}
-	categories, err := r.f.CachedCategories()
+	categories, err := r.f.CachedCategories(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("could not list Categories: %s", err)
 	}
 
+	carriedOver, err := r.carriedOver(ctx, budget[0], categorybudgets)
+	if err != nil {
+		return nil, fmt.Errorf("could not calculate amounts carried over: %s", err)
+	}
+
 	var results []CategorySummary
 
 	for _, c := range categorybudgets {
@@ -140,6 +151,7 @@ func (r *Reports) ListCategorySummaries(budgetID int) ([]CategorySummary, error)
 		cs.ID = c.Category
 		cs.CategoryBudgetID = c.ID
 		cs.Amount = c.Amount
+		cs.CarriedOver = carriedOver[c.Category]
 		cs.Start = budget[0].Start
 		cs.End = budget[0].End
 		results = append(results, cs)
@@ -179,22 +191,25 @@ func (r *Reports) fetchCategorySummaries(w http.ResponseWriter, req *http.Reques
 		return
 	}
 
-	summary, err := r.FetchCategorySummary(id)
+	summary, err := r.FetchCategorySummary(req.Context(), id)
 	if err != nil {
 		httperror.Send(w, req, http.StatusInternalServerError, fmt.Sprintf("Could not generate CategorySummary: %s\n", err))
 		return
 	}
 
+	if catBgt, err := r.c.Fetch(idStr); err == nil && len(catBgt) == 1 {
+		r.setCacheAge(w, catBgt[0].Budget)
+	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(summary)
 }
 
-func (r *Reports) FetchCategorySummary(catBgtID int) ([]CategorySummaryDetail, error) {
+func (r *Reports) FetchCategorySummary(ctx context.Context, catBgtID int) ([]CategorySummaryDetail, error) {
 	catBgt, err := r.c.Fetch(strconv.Itoa(catBgtID))
 	if err != nil || len(catBgt) != 1 {
 		return nil, fmt.Errorf("could not fetch categorybudgets: %s", err)
 	}
-	categories, err := r.f.CachedCategories()
+	categories, err := r.f.CachedCategories(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("could not list Categories: %s", err)
 	}
@@ -219,18 +234,29 @@ func (r *Reports) FetchCategorySummary(catBgtID int) ([]CategorySummaryDetail, e
 		return nil, fmt.Errorf("could not find categorysummary")
 	}
 	cs.Amount = catBgt[0].Amount
+	cs.CategoryBudgetID = catBgt[0].ID
+	if catBgt[0].Rollover != categorybudget.RolloverNone {
+		categorybudgets, err := r.c.List()
+		if err != nil {
+			return nil, fmt.Errorf("could not list categorybudgets: %s", err)
+		}
+		carriedOver, err := r.carriedOver(ctx, budget[0], categorybudgets)
+		if err != nil {
+			return nil, fmt.Errorf("could not calculate amount carried over: %s", err)
+		}
+		cs.CarriedOver = carriedOver[cs.ID]
+	}
 	results := []CategorySummaryDetail{{CategorySummary: cs}}
 
-	// Fetch the summaries for each month, from the start of the budget to the
-	// current month
-	if budget[0].ReportingInterval != 0 {
-		return nil, fmt.Errorf("unknown reporting interval %d, only monthly is supported", budget[0].ReportingInterval)
+	// Fetch the summaries for each reporting interval, from the start of the
+	// budget to the current interval
+	intervals, err := r.f.Intervals(budget[0])
+	if err != nil {
+		return nil, fmt.Errorf("could not generate category summary: %s", err)
 	}
 
-	intervals := interval.Get(budget[0].Start, budget[0].End, time.Now().Local().Location())
-
 	for _, i := range intervals {
-		ct, err := r.f.CachedFetchCategoryTotals(cs.ID, i.Start.Local(), i.End.Local())
+		ct, err := r.f.CachedFetchCategoryTotals(ctx, cs.ID, i.Start.Local(), i.End.Local())
 		if err != nil {
 			return nil, fmt.Errorf("could not generate category summary: %s", err)
 		}
@@ -245,3 +271,47 @@ func (r *Reports) FetchCategorySummary(catBgtID int) ([]CategorySummaryDetail, e
 
 	return results, nil
 }
+
+// carriedOver returns the amount carried over into bgt for each category,
+// keyed by category ID. The amount is the previous budget's Amount minus its
+// actual Sum for the category, limited by the rollover mode of the category
+// budget in bgt. Categories without a rollover mode are omitted.
+func (r *Reports) carriedOver(ctx context.Context, bgt budget.Budget, categorybudgets []categorybudget.CategoryBudget) (map[int]decimal.Decimal, error) {
+	results := make(map[int]decimal.Decimal)
+
+	modes := make(map[int]categorybudget.RolloverMode)
+	for _, c := range categorybudgets {
+		if c.Budget == bgt.ID && c.Rollover != categorybudget.RolloverNone {
+			modes[c.Category] = c.Rollover
+		}
+	}
+	if len(modes) == 0 {
+		return results, nil
+	}
+
+	prev, err := r.b.Previous(bgt)
+	if errors.Is(err, budget.ErrNoBudget) {
+		return results, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not find previous budget: %s", err)
+	}
+
+	sums, err := r.f.CategorySums(ctx, prev.Start.Local(), prev.End.Local())
+	if err != nil {
+		return nil, fmt.Errorf("could not list Category Totals for previous budget: %s", err)
+	}
+
+	for _, c := range categorybudgets {
+		if c.Budget != prev.ID {
+			continue
+		}
+		mode, ok := modes[c.Category]
+		if !ok {
+			continue
+		}
+		results[c.Category] = mode.CarriedOver(c.Amount, sums[c.Category])
+	}
+
+	return results, nil
+}
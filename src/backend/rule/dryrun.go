@@ -0,0 +1,91 @@
+package rule
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/davidschlachter/lychnos/src/backend/firefly"
+	"github.com/davidschlachter/lychnos/src/backend/httperror"
+)
+
+// TransactionsFunc returns the transactions between start and end.
+type TransactionsFunc func(ctx context.Context, start, end time.Time) ([]firefly.Transactions, error)
+
+// defaultDryRunDays is how far back a dry run looks by default.
+const defaultDryRunDays = 30
+
+// DryRun is the result of testing a rule against recent transactions.
+type DryRun struct {
+	Rule    Rule                   `json:"rule"`
+	Matches []firefly.Transactions `json:"matches"`
+	Error   string                 `json:"error,omitempty"`
+}
+
+// HandleDryRun returns a handler for GET /api/rules/dryrun, which lists the
+// recent transactions that each rule would match, without changing anything.
+// Each rule is tested on its own, although only the first matching rule
+// categorizes a new transaction. The number of days to look back is set with
+// the days parameter, and the transactions are fetched with txns.
+func (rs *Rules) HandleDryRun(txns TransactionsFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		log.Printf("%s %s", req.Method, req.RequestURI)
+		if req.Method != "GET" {
+			w.WriteHeader(http.StatusNotImplemented)
+			fmt.Fprintf(w, "Unsupported method %s", req.Method)
+			return
+		}
+		rs.dryRun(w, req, txns)
+	}
+}
+
+func (rs *Rules) dryRun(w http.ResponseWriter, req *http.Request, txns TransactionsFunc) {
+	days := defaultDryRunDays
+	if daysString := req.URL.Query().Get("days"); daysString != "" {
+		var err error
+		days, err = strconv.Atoi(daysString)
+		if err != nil || days <= 0 {
+			httperror.Send(w, req, http.StatusBadRequest, fmt.Sprintf("Could not parse days: %s", daysString))
+			return
+		}
+	}
+
+	rules, err := rs.List()
+	if err != nil {
+		httperror.Send(w, req, http.StatusInternalServerError, fmt.Sprintf("Could not list rules: %s", err))
+		return
+	}
+	end := time.Now()
+	recent, err := txns(req.Context(), end.AddDate(0, 0, -days), end)
+	if err != nil {
+		httperror.Send(w, req, http.StatusInternalServerError, fmt.Sprintf("Could not list transactions: %s", err))
+		return
+	}
+
+	results := make([]DryRun, 0, len(rules))
+	for _, r := range rules {
+		result := DryRun{Rule: r, Matches: []firefly.Transactions{}}
+		re, err := r.validate()
+		if err != nil {
+			result.Error = err.Error()
+			results = append(results, result)
+			continue
+		}
+		for _, t := range recent {
+			for _, s := range t.Attributes.Transactions {
+				if r.matches(s, re) {
+					result.Matches = append(result.Matches, t)
+					break
+				}
+			}
+		}
+		results = append(results, result)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
@@ -0,0 +1,298 @@
+// Package rule assigns categories to new transactions with user-defined rules.
+package rule
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/davidschlachter/lychnos/src/backend/dialect"
+	"github.com/davidschlachter/lychnos/src/backend/firefly"
+	"github.com/davidschlachter/lychnos/src/backend/httperror"
+	"github.com/shopspring/decimal"
+)
+
+// Rule assigns a category to transactions that match all of its conditions.
+// Empty conditions match any transaction, but at least one condition must be
+// set.
+type Rule struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+	// DestinationName matches the name of the destination account (e.g. the
+	// payee of a withdrawal), ignoring case.
+	DestinationName string `json:"destination_name"`
+	// DescriptionPattern is a regular expression matching the description.
+	DescriptionPattern string `json:"description_pattern"`
+	// MinAmount and MaxAmount are the inclusive bounds of the (positive)
+	// amount.
+	MinAmount decimal.NullDecimal `json:"min_amount"`
+	MaxAmount decimal.NullDecimal `json:"max_amount"`
+
+	CategoryID int `json:"category_id"`
+	// Description, if set, replaces the description of matching
+	// transactions.
+	Description string `json:"description"`
+}
+
+type Rules struct {
+	db *sql.DB
+	d  dialect.Dialect
+
+	// mu guards compiled, the valid rules in order with their description
+	// patterns, which is loaded when a transaction is first categorized and
+	// cleared when a rule is saved or deleted.
+	mu       sync.Mutex
+	compiled []compiledRule
+}
+
+type compiledRule struct {
+	Rule
+	re *regexp.Regexp
+}
+
+func New(db *sql.DB, d dialect.Dialect) *Rules {
+	return &Rules{db: db, d: d}
+}
+
+var hasID = regexp.MustCompile(`/[0-9]+$`)
+
+// validate checks the rule, returning its compiled description pattern.
+func (r Rule) validate() (*regexp.Regexp, error) {
+	if r.Name == "" {
+		return nil, fmt.Errorf("name must be provided")
+	}
+	if r.CategoryID <= 0 {
+		return nil, fmt.Errorf("category_id must be provided")
+	}
+	if r.DestinationName == "" && r.DescriptionPattern == "" && !r.MinAmount.Valid && !r.MaxAmount.Valid {
+		return nil, fmt.Errorf("at least one of destination_name, description_pattern, min_amount or max_amount must be provided")
+	}
+	if r.MinAmount.Valid && r.MaxAmount.Valid && r.MinAmount.Decimal.GreaterThan(r.MaxAmount.Decimal) {
+		return nil, fmt.Errorf("min_amount must not be greater than max_amount")
+	}
+	if r.DescriptionPattern == "" {
+		return nil, nil
+	}
+	re, err := regexp.Compile(r.DescriptionPattern)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse description_pattern: %s", err)
+	}
+	return re, nil
+}
+
+// matches returns true if t matches the conditions of the rule, whose
+// description pattern was compiled as re.
+func (r Rule) matches(t firefly.Transaction, re *regexp.Regexp) bool {
+	if r.DestinationName != "" && !strings.EqualFold(strings.TrimSpace(t.DestinationName), r.DestinationName) {
+		return false
+	}
+	if re != nil && !re.MatchString(t.Description) {
+		return false
+	}
+	if r.MinAmount.Valid && t.Amount.LessThan(r.MinAmount.Decimal) {
+		return false
+	}
+	if r.MaxAmount.Valid && t.Amount.GreaterThan(r.MaxAmount.Decimal) {
+		return false
+	}
+	return true
+}
+
+// Categorize applies the first rule (in order of ID) that matches t.
+func (rs *Rules) Categorize(ctx context.Context, t *firefly.Transaction) error {
+	rules, err := rs.compiledRules()
+	if err != nil {
+		return err
+	}
+	for _, r := range rules {
+		if !r.matches(*t, r.re) {
+			continue
+		}
+		t.CategoryID, t.CategoryName = strconv.Itoa(r.CategoryID), ""
+		if r.Description != "" {
+			t.Description = r.Description
+		}
+		return nil
+	}
+	return nil
+}
+
+// compiledRules returns the valid rules in order with their compiled
+// description patterns, loading them if they haven't been since a rule was
+// last changed.
+func (rs *Rules) compiledRules() ([]compiledRule, error) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if rs.compiled != nil {
+		return rs.compiled, nil
+	}
+
+	rules, err := rs.List()
+	if err != nil {
+		return nil, err
+	}
+	compiled := make([]compiledRule, 0, len(rules))
+	for _, r := range rules {
+		re, err := r.validate()
+		if err != nil {
+			log.Printf("Skipping invalid rule %d: %s", r.ID, err)
+			continue
+		}
+		compiled = append(compiled, compiledRule{Rule: r, re: re})
+	}
+	rs.compiled = compiled
+	return compiled, nil
+}
+
+// clearCompiled clears the compiled rules after a rule is changed, so that
+// they are loaded again.
+func (rs *Rules) clearCompiled() {
+	rs.mu.Lock()
+	rs.compiled = nil
+	rs.mu.Unlock()
+}
+
+func (rs *Rules) Handle(w http.ResponseWriter, req *http.Request) {
+	log.Printf("%s %s", req.Method, req.RequestURI)
+	switch req.Method {
+	case "GET":
+		if hasID.MatchString(req.URL.Path) {
+			rs.fetch(w, req)
+		} else {
+			rs.list(w, req)
+		}
+	case "POST":
+		rs.upsert(w, req)
+	case "DELETE":
+		rs.delete(w, req)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+		fmt.Fprintf(w, "Unsupported method %s", req.Method)
+	}
+}
+
+const columns = "id, name, destination_name, description_pattern, min_amount, max_amount, category_id, description"
+
+func (rs *Rules) fetch(w http.ResponseWriter, req *http.Request) {
+	id, _ := strconv.Atoi(req.URL.Path[strings.LastIndex(req.URL.Path, "/")+1:])
+	r, err := rs.Fetch(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		httperror.Send(w, req, http.StatusNotFound, fmt.Sprintf("No rule with ID %d", id))
+		return
+	}
+	if err != nil {
+		httperror.Send(w, req, http.StatusInternalServerError, fmt.Sprintf("Could not fetch rule: %s", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(r)
+}
+
+// Fetch fetches the rule with the provided ID. If there is no such rule,
+// sql.ErrNoRows is returned.
+func (rs *Rules) Fetch(id int) (Rule, error) {
+	const q = "SELECT " + columns + " FROM rules WHERE id = ?;"
+
+	var r Rule
+	err := rs.db.QueryRow(rs.d.Rebind(q), id).Scan(&r.ID, &r.Name, &r.DestinationName, &r.DescriptionPattern, &r.MinAmount, &r.MaxAmount, &r.CategoryID, &r.Description)
+	return r, err
+}
+
+func (rs *Rules) list(w http.ResponseWriter, req *http.Request) {
+	rules, err := rs.List()
+	if err != nil {
+		httperror.Send(w, req, http.StatusInternalServerError, fmt.Sprintf("Could not list rules: %s", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rules)
+}
+
+// List lists the rules in the order that they are applied.
+func (rs *Rules) List() ([]Rule, error) {
+	const q = "SELECT " + columns + " FROM rules ORDER BY id;"
+
+	rows, err := rs.db.Query(q)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rules := []Rule{}
+	for rows.Next() {
+		var r Rule
+		err := rows.Scan(&r.ID, &r.Name, &r.DestinationName, &r.DescriptionPattern, &r.MinAmount, &r.MaxAmount, &r.CategoryID, &r.Description)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+	return rules, rows.Err()
+}
+
+// upsert creates a rule from a JSON body, or replaces it if an ID is provided.
+func (rs *Rules) upsert(w http.ResponseWriter, req *http.Request) {
+	var r Rule
+	err := json.NewDecoder(req.Body).Decode(&r)
+	if err != nil {
+		httperror.Send(w, req, http.StatusBadRequest, fmt.Sprintf("Could not parse JSON body: %s", err))
+		return
+	}
+	if _, err := r.validate(); err != nil {
+		httperror.Send(w, req, http.StatusBadRequest, fmt.Sprintf("Invalid rule: %s", err))
+		return
+	}
+
+	r.ID, err = rs.Upsert(r)
+	if err != nil {
+		httperror.Send(w, req, http.StatusInternalServerError, fmt.Sprintf("Could not save rule: %s", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(r)
+}
+
+// Upsert creates or replaces the rule with the provided ID, returning its ID.
+// If the ID is 0, a new rule is created.
+func (rs *Rules) Upsert(r Rule) (int, error) {
+	const q_create = "INSERT INTO rules (name, destination_name, description_pattern, min_amount, max_amount, category_id, description) VALUES(?, ?, ?, ?, ?, ?, ?);"
+
+	defer rs.clearCompiled()
+	if r.ID == 0 {
+		return rs.d.InsertID(rs.db, q_create, r.Name, r.DestinationName, r.DescriptionPattern, r.MinAmount, r.MaxAmount, r.CategoryID, r.Description)
+	}
+	q := rs.d.Upsert("rules", strings.Split(columns, ", ")...)
+	_, err := rs.db.Exec(q, r.ID, r.Name, r.DestinationName, r.DescriptionPattern, r.MinAmount, r.MaxAmount, r.CategoryID, r.Description)
+	return r.ID, err
+}
+
+func (rs *Rules) delete(w http.ResponseWriter, req *http.Request) {
+	const q = "DELETE FROM rules WHERE id = ?;"
+
+	if !hasID.MatchString(req.URL.Path) {
+		httperror.Send(w, req, http.StatusBadRequest, "Must provide a rule ID to delete")
+		return
+	}
+	id, _ := strconv.Atoi(req.URL.Path[strings.LastIndex(req.URL.Path, "/")+1:])
+
+	_, err := rs.db.Exec(rs.d.Rebind(q), id)
+	rs.clearCompiled()
+	if err != nil {
+		httperror.Send(w, req, http.StatusInternalServerError, fmt.Sprintf("Could not delete rule: %s", err))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
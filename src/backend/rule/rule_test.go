@@ -0,0 +1,213 @@
+package rule_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/shopspring/decimal"
+
+	"github.com/davidschlachter/lychnos/src/backend/dialect"
+	"github.com/davidschlachter/lychnos/src/backend/firefly"
+	"github.com/davidschlachter/lychnos/src/backend/rule"
+)
+
+var ruleColumns = []string{"id", "name", "destination_name", "description_pattern", "min_amount", "max_amount", "category_id", "description"}
+
+func TestHandle(t *testing.T) {
+	for _, d := range dialect.All {
+		t.Run(d.String(), func(t *testing.T) { testHandle(t, d) })
+	}
+}
+
+func testHandle(t *testing.T, d dialect.Dialect) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Unexpected error opening mock database connection: %s\n", err)
+	}
+	defer db.Close()
+	rs := rule.New(db, d)
+
+	// Invalid rules are rejected
+	for _, body := range []string{
+		`{"name": "Everything", "category_id": 4}`,
+		`{"name": "Coffee", "description_pattern": "(", "category_id": 4}`,
+		`{"name": "Coffee", "destination_name": "Coffee Shop"}`,
+		`{"name": "Coffee", "min_amount": "10", "max_amount": "5", "category_id": 4}`,
+	} {
+		w := httptest.NewRecorder()
+		rs.Handle(w, httptest.NewRequest(http.MethodPost, "/api/rules/", strings.NewReader(body)))
+		if w.Result().StatusCode != http.StatusBadRequest {
+			t.Fatalf("Status code = %d for %s, want %d", w.Result().StatusCode, body, http.StatusBadRequest)
+		}
+	}
+
+	// Create
+	if d == dialect.Postgres {
+		mock.ExpectQuery(`INSERT INTO rules .* RETURNING id`).
+			WithArgs("Coffee", "Coffee Shop", "", nil, "20", 4, "Coffee").
+			WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	} else {
+		mock.ExpectExec(`INSERT INTO rules`).
+			WithArgs("Coffee", "Coffee Shop", "", nil, "20", 4, "Coffee").
+			WillReturnResult(sqlmock.NewResult(1, 1))
+	}
+	w := httptest.NewRecorder()
+	rs.Handle(w, httptest.NewRequest(http.MethodPost, "/api/rules/", strings.NewReader(`{"name": "Coffee", "destination_name": "Coffee Shop", "max_amount": "20", "category_id": 4, "description": "Coffee"}`)))
+	if w.Result().StatusCode != http.StatusCreated {
+		t.Fatalf("Status code = %d, want %d. Response body: %s", w.Result().StatusCode, http.StatusCreated, w.Body.String())
+	}
+	var created rule.Rule
+	json.NewDecoder(w.Body).Decode(&created)
+	if created.ID != 1 {
+		t.Fatalf("Got rule ID %d, wanted 1", created.ID)
+	}
+
+	// Fetch
+	mock.ExpectQuery(`SELECT id, name, destination_name, description_pattern, min_amount, max_amount, category_id, description FROM rules WHERE id = (\?|\$1);`).
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows(ruleColumns).AddRow(1, "Coffee", "Coffee Shop", "", nil, "20", 4, "Coffee"))
+	w = httptest.NewRecorder()
+	rs.Handle(w, httptest.NewRequest(http.MethodGet, "/api/rules/1", nil))
+	var fetched rule.Rule
+	json.NewDecoder(w.Body).Decode(&fetched)
+	if fetched.Name != "Coffee" || fetched.MinAmount.Valid || !fetched.MaxAmount.Decimal.Equal(decimal.NewFromInt(20)) {
+		t.Fatalf("Got rule %+v, wanted the Coffee rule with a maximum amount of 20", fetched)
+	}
+
+	// Delete
+	mock.ExpectExec(`DELETE FROM rules WHERE id = (\?|\$1);`).WithArgs(1).WillReturnResult(sqlmock.NewResult(0, 1))
+	w = httptest.NewRecorder()
+	rs.Handle(w, httptest.NewRequest(http.MethodDelete, "/api/rules/1", nil))
+	if w.Result().StatusCode != http.StatusNoContent {
+		t.Fatalf("Status code = %d, want %d", w.Result().StatusCode, http.StatusNoContent)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// expectRules expects the rules to be listed once.
+func expectRules(mock sqlmock.Sqlmock) {
+	mock.ExpectQuery(`SELECT id, name, destination_name, description_pattern, min_amount, max_amount, category_id, description FROM rules ORDER BY id;`).
+		WillReturnRows(sqlmock.NewRows(ruleColumns).
+			AddRow(1, "Coffee", "coffee shop", "", nil, "20", 4, "Coffee").
+			AddRow(2, "Groceries", "", "(?i)^(grocery|market)", "10", nil, 7, "").
+			AddRow(3, "Broken", "", "(", nil, nil, 9, ""))
+}
+
+func TestCategorize(t *testing.T) {
+	tests := []struct {
+		name string
+		txn  firefly.Transaction
+		want firefly.Transaction
+	}{
+		{
+			name: "destination name",
+			txn:  firefly.Transaction{Description: "STARBUCKS #123", DestinationName: "Coffee Shop", Amount: decimal.RequireFromString("4.50")},
+			want: firefly.Transaction{Description: "Coffee", DestinationName: "Coffee Shop", Amount: decimal.RequireFromString("4.50"), CategoryID: "4"},
+		},
+		{
+			name: "amount out of range",
+			txn:  firefly.Transaction{Description: "Catering", DestinationName: "Coffee Shop", Amount: decimal.RequireFromString("120")},
+			want: firefly.Transaction{Description: "Catering", DestinationName: "Coffee Shop", Amount: decimal.RequireFromString("120")},
+		},
+		{
+			name: "description pattern",
+			txn:  firefly.Transaction{Description: "Market on Main", DestinationName: "Market on Main", Amount: decimal.RequireFromString("45")},
+			want: firefly.Transaction{Description: "Market on Main", DestinationName: "Market on Main", Amount: decimal.RequireFromString("45"), CategoryID: "7"},
+		},
+		{
+			name: "no match",
+			txn:  firefly.Transaction{Description: "Hardware store", DestinationName: "Hardware store", Amount: decimal.RequireFromString("45")},
+			want: firefly.Transaction{Description: "Hardware store", DestinationName: "Hardware store", Amount: decimal.RequireFromString("45")},
+		},
+	}
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Unexpected error opening mock database connection: %s\n", err)
+	}
+	defer db.Close()
+	rs := rule.New(db, dialect.SQLite)
+
+	// The rules are only listed once
+	expectRules(mock)
+	for _, test := range tests {
+		got := test.txn
+		err := rs.Categorize(t.Context(), &got)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", test.name, err)
+		}
+		if got.CategoryID != test.want.CategoryID || got.Description != test.want.Description {
+			t.Errorf("%s: got category %q and description %q, wanted %q and %q", test.name, got.CategoryID, got.Description, test.want.CategoryID, test.want.Description)
+		}
+	}
+
+	// Saving a rule lists them again
+	mock.ExpectExec(`INSERT INTO rules`).WillReturnResult(sqlmock.NewResult(4, 1))
+	if _, err := rs.Upsert(rule.Rule{Name: "Hardware", DestinationName: "Hardware store", CategoryID: 8}); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	expectRules(mock)
+	got := firefly.Transaction{Description: "Catering", DestinationName: "Coffee Shop", Amount: decimal.RequireFromString("15")}
+	if err := rs.Categorize(t.Context(), &got); err != nil || got.CategoryID != "4" {
+		t.Errorf("Got category %q and error %v, wanted 4", got.CategoryID, err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Unexpected error opening mock database connection: %s\n", err)
+	}
+	defer db.Close()
+	rs := rule.New(db, dialect.SQLite)
+	expectRules(mock)
+
+	var gotStart time.Time
+	txns := func(ctx context.Context, start, end time.Time) ([]firefly.Transactions, error) {
+		gotStart = start
+		return []firefly.Transactions{
+			{ID: "1", Attributes: firefly.TransactionAttributes{Transactions: []firefly.Transaction{{Description: "Latte", DestinationName: "Coffee Shop", Amount: decimal.NewFromInt(5)}}}},
+			{ID: "2", Attributes: firefly.TransactionAttributes{Transactions: []firefly.Transaction{{Description: "Grocery store", DestinationName: "Grocery store", Amount: decimal.NewFromInt(60)}}}},
+			{ID: "3", Attributes: firefly.TransactionAttributes{Transactions: []firefly.Transaction{{Description: "Rent", DestinationName: "Landlord", Amount: decimal.NewFromInt(1500)}}}},
+		}, nil
+	}
+
+	w := httptest.NewRecorder()
+	rs.HandleDryRun(txns)(w, httptest.NewRequest(http.MethodGet, "/api/rules/dryrun?days=7", nil))
+	if w.Result().StatusCode != http.StatusOK {
+		t.Fatalf("Status code = %d, want %d. Response body: %s", w.Result().StatusCode, http.StatusOK, w.Body.String())
+	}
+	var got []rule.DryRun
+	json.NewDecoder(w.Body).Decode(&got)
+	if len(got) != 3 {
+		t.Fatalf("Got %d results, wanted 3", len(got))
+	}
+	for i, want := range []string{"1", "2"} {
+		if len(got[i].Matches) != 1 || got[i].Matches[0].ID != want {
+			t.Errorf("Got matches %+v for rule %s, wanted transaction %s", got[i].Matches, got[i].Rule.Name, want)
+		}
+	}
+	if got[2].Error == "" || len(got[2].Matches) != 0 {
+		t.Errorf("Got result %+v for an invalid rule, wanted an error", got[2])
+	}
+	if days := time.Since(gotStart).Hours() / 24; days < 6.9 || days > 7.1 {
+		t.Errorf("Got transactions from %.1f days ago, wanted 7", days)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
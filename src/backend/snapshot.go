@@ -0,0 +1,141 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/davidschlachter/lychnos/src/backend/dialect"
+	"github.com/davidschlachter/lychnos/src/backend/firefly"
+)
+
+// errNoSnapshot is returned by a snapshotStore if no snapshot has been saved.
+var errNoSnapshot = errors.New("no cache snapshot saved")
+
+// snapshotStore saves and loads snapshots of the Firefly-III cache, so that
+// the cache can be served immediately after a restart.
+type snapshotStore interface {
+	Load() ([]byte, error)
+	Save(data []byte) error
+}
+
+// newSnapshotStore returns a store for cache snapshots, based on the
+// CACHE_SNAPSHOT setting: "database" stores snapshots in the lychnos database,
+// and any other value is the path of a file. If the setting is empty, no
+// snapshots are stored and nil is returned.
+func newSnapshotStore(setting string, db *sql.DB, d dialect.Dialect) snapshotStore {
+	switch setting {
+	case "":
+		return nil
+	case "database":
+		return &dbSnapshotStore{db: db, d: d}
+	default:
+		return &fileSnapshotStore{path: setting}
+	}
+}
+
+type dbSnapshotStore struct {
+	db *sql.DB
+	d  dialect.Dialect
+}
+
+func (s *dbSnapshotStore) Load() ([]byte, error) {
+	const q = "SELECT data FROM cache_snapshots WHERE id = 1;"
+
+	var data string
+	err := s.db.QueryRow(q).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errNoSnapshot
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not load cache snapshot: %s", err)
+	}
+	return []byte(data), nil
+}
+
+func (s *dbSnapshotStore) Save(data []byte) error {
+	q := s.d.Upsert("cache_snapshots", "id", "saved_at", "data")
+	_, err := s.db.Exec(q, 1, time.Now().UTC().Format("2006-01-02 15:04:05"), string(data))
+	if err != nil {
+		return fmt.Errorf("could not save cache snapshot: %s", err)
+	}
+	return nil
+}
+
+type fileSnapshotStore struct {
+	path string
+}
+
+func (s *fileSnapshotStore) Load() ([]byte, error) {
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errNoSnapshot
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not load cache snapshot: %s", err)
+	}
+	return data, nil
+}
+
+// Save writes the snapshot to a temporary file first, so that a crash while
+// saving never leaves a partial snapshot behind.
+func (s *fileSnapshotStore) Save(data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return fmt.Errorf("could not save cache snapshot: %s", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err != nil {
+		return fmt.Errorf("could not save cache snapshot: %s", err)
+	}
+	err = os.Rename(tmp.Name(), s.path)
+	if err != nil {
+		return fmt.Errorf("could not save cache snapshot: %s", err)
+	}
+	return nil
+}
+
+// restoreSnapshot restores the cache from the latest saved snapshot, returning
+// true if successful.
+func restoreSnapshot(f *firefly.Firefly, s snapshotStore) bool {
+	if s == nil {
+		return false
+	}
+	data, err := s.Load()
+	if errors.Is(err, errNoSnapshot) {
+		return false
+	}
+	if err == nil {
+		err = f.Restore(data)
+	}
+	if err != nil {
+		log.Printf("Failed to restore cache snapshot: %s", err)
+		return false
+	}
+	return true
+}
+
+// saveSnapshot saves a snapshot of the cache, if a store is configured.
+func saveSnapshot(f *firefly.Firefly, s snapshotStore) {
+	if s == nil {
+		return
+	}
+	data, err := f.Snapshot()
+	if err == nil {
+		err = s.Save(data)
+	}
+	if err != nil {
+		log.Printf("Failed to save cache snapshot: %s", err)
+	}
+}
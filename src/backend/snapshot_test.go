@@ -0,0 +1,49 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/davidschlachter/lychnos/src/backend/dialect"
+)
+
+func TestSnapshotStores(t *testing.T) {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "lychnos.db"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer db.Close()
+	err = migrate(db, dialect.SQLite, false, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	stores := map[string]snapshotStore{
+		"database": newSnapshotStore("database", db, dialect.SQLite),
+		"file":     newSnapshotStore(filepath.Join(t.TempDir(), "snapshot.json"), db, dialect.SQLite),
+	}
+	for name, s := range stores {
+		_, err := s.Load()
+		if !errors.Is(err, errNoSnapshot) {
+			t.Errorf("%s: got error %v before saving, wanted errNoSnapshot", name, err)
+		}
+		for _, data := range []string{`{"version":1}`, `{"version":2}`} {
+			err = s.Save([]byte(data))
+			if err != nil {
+				t.Fatalf("%s: unexpected error: %s", name, err)
+			}
+			loaded, err := s.Load()
+			if err != nil {
+				t.Fatalf("%s: unexpected error: %s", name, err)
+			}
+			if string(loaded) != data {
+				t.Errorf("%s: loaded %s, wanted %s", name, loaded, data)
+			}
+		}
+	}
+	if newSnapshotStore("", db, dialect.SQLite) != nil {
+		t.Errorf("Expected no store without a setting")
+	}
+}
@@ -0,0 +1,83 @@
+package template
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/davidschlachter/lychnos/src/backend/firefly"
+	"github.com/davidschlachter/lychnos/src/backend/httperror"
+)
+
+// HandleApply handles POST /api/templates/{id}/apply, which creates a
+// transaction from a template. Only the amount and date (which default to the
+// template's amount and today) may be set, along with force to create a
+// transaction that looks like a duplicate.
+func (ts *Templates) HandleApply(w http.ResponseWriter, req *http.Request) {
+	const q = "UPDATE templates SET use_count = use_count + 1 WHERE id = ?;"
+
+	log.Printf("%s %s", req.Method, req.RequestURI)
+	id, err := strconv.Atoi(req.PathValue("id"))
+	if err != nil {
+		httperror.Send(w, req, http.StatusBadRequest, fmt.Sprintf("Could not parse template ID: %s", req.PathValue("id")))
+		return
+	}
+
+	err = req.ParseForm()
+	if err != nil {
+		httperror.Send(w, req, http.StatusInternalServerError, "Could not parse POST data")
+		return
+	}
+
+	t, err := ts.Fetch(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		httperror.Send(w, req, http.StatusNotFound, fmt.Sprintf("No template with ID %d", id))
+		return
+	}
+	if err != nil {
+		httperror.Send(w, req, http.StatusInternalServerError, fmt.Sprintf("Could not fetch template: %s", err))
+		return
+	}
+
+	date := strings.TrimSpace(req.Form.Get("date"))
+	if date == "" {
+		date = time.Now().Format(DateFormat)
+	}
+	// The amount is parsed along with the rest of the transaction
+	amount := strings.TrimSpace(req.Form.Get("amount"))
+	if amount == "" {
+		if !t.Amount.Valid {
+			httperror.Send(w, req, http.StatusBadRequest, "amount must be provided, since the template has no amount")
+			return
+		}
+		amount = t.Amount.Decimal.String()
+	}
+
+	form := t.form(date, amount)
+	form.Set("force", req.Form.Get("force"))
+	created, status, err := ts.f.CreateTransaction(req.Context(), form)
+	if firefly.SendDuplicate(w, err) {
+		return
+	}
+	if err != nil {
+		httperror.Send(w, req, status, err.Error())
+		return
+	}
+
+	// The transaction was created, so a failure to rank the template is
+	// only logged.
+	_, err = ts.db.Exec(ts.d.Rebind(q), id)
+	if err != nil {
+		log.Printf("Could not update use count of template %d: %s", id, err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(created)
+}
@@ -0,0 +1,243 @@
+// Package template saves frequently entered transactions, so that they can be
+// created again with a single request.
+package template
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/davidschlachter/lychnos/src/backend/dialect"
+	"github.com/davidschlachter/lychnos/src/backend/firefly"
+	"github.com/davidschlachter/lychnos/src/backend/httperror"
+	"github.com/shopspring/decimal"
+)
+
+// DateFormat is the format of the date of a transaction created from a
+// template.
+const DateFormat = "2006-01-02"
+
+// Template holds the fields of a transaction, except for its date. Templates
+// without an amount need one when they are applied, e.g. for groceries.
+type Template struct {
+	ID              int                 `json:"id"`
+	Name            string              `json:"name"`
+	Description     string              `json:"description"`
+	Amount          decimal.NullDecimal `json:"amount"`
+	SourceID        string              `json:"source_id"`
+	SourceName      string              `json:"source_name"`
+	DestinationID   string              `json:"destination_id"`
+	DestinationName string              `json:"destination_name"`
+	CategoryID      string              `json:"category_id"`
+	CategoryName    string              `json:"category_name"`
+	// UseCount is the number of transactions created from the template.
+	UseCount int `json:"use_count"`
+}
+
+type Templates struct {
+	db *sql.DB
+	d  dialect.Dialect
+	f  *firefly.Firefly
+}
+
+func New(db *sql.DB, d dialect.Dialect, f *firefly.Firefly) *Templates {
+	return &Templates{db: db, d: d, f: f}
+}
+
+var hasID = regexp.MustCompile(`/[0-9]+$`)
+
+// form returns the form values of a transaction created from the template, as
+// submitted to POST /api/transactions/.
+func (t Template) form(date, amount string) url.Values {
+	form := url.Values{}
+	form.Set("date", date)
+	form.Set("amount", amount)
+	form.Set("description", t.Description)
+	form.Set("source_id", t.SourceID)
+	form.Set("source_name", t.SourceName)
+	form.Set("destination_id", t.DestinationID)
+	form.Set("destination_name", t.DestinationName)
+	form.Set("category_id", t.CategoryID)
+	form.Set("category_name", t.CategoryName)
+	return form
+}
+
+func (ts *Templates) Handle(w http.ResponseWriter, req *http.Request) {
+	log.Printf("%s %s", req.Method, req.RequestURI)
+	switch req.Method {
+	case "GET":
+		if hasID.MatchString(req.URL.Path) {
+			ts.fetch(w, req)
+		} else {
+			ts.list(w, req)
+		}
+	case "POST":
+		ts.upsert(w, req)
+	case "DELETE":
+		ts.delete(w, req)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+		fmt.Fprintf(w, "Unsupported method %s", req.Method)
+	}
+}
+
+const columns = "id, name, description, amount, source_id, source_name, destination_id, destination_name, category_id, category_name, use_count"
+
+func (t *Template) scan(row interface{ Scan(...any) error }) error {
+	return row.Scan(&t.ID, &t.Name, &t.Description, &t.Amount, &t.SourceID, &t.SourceName, &t.DestinationID, &t.DestinationName, &t.CategoryID, &t.CategoryName, &t.UseCount)
+}
+
+func (ts *Templates) fetch(w http.ResponseWriter, req *http.Request) {
+	id, _ := strconv.Atoi(req.URL.Path[strings.LastIndex(req.URL.Path, "/")+1:])
+	t, err := ts.Fetch(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		httperror.Send(w, req, http.StatusNotFound, fmt.Sprintf("No template with ID %d", id))
+		return
+	}
+	if err != nil {
+		httperror.Send(w, req, http.StatusInternalServerError, fmt.Sprintf("Could not fetch template: %s", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(t)
+}
+
+// Fetch fetches the template with the provided ID. If there is no such
+// template, sql.ErrNoRows is returned.
+func (ts *Templates) Fetch(id int) (Template, error) {
+	const q = "SELECT " + columns + " FROM templates WHERE id = ?;"
+
+	var t Template
+	err := t.scan(ts.db.QueryRow(ts.d.Rebind(q), id))
+	return t, err
+}
+
+func (ts *Templates) list(w http.ResponseWriter, req *http.Request) {
+	templates, err := ts.List()
+	if err != nil {
+		httperror.Send(w, req, http.StatusInternalServerError, fmt.Sprintf("Could not list templates: %s", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(templates)
+}
+
+// List lists the templates, most used first.
+func (ts *Templates) List() ([]Template, error) {
+	const q = "SELECT " + columns + " FROM templates ORDER BY use_count DESC, name, id;"
+
+	rows, err := ts.db.Query(q)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	templates := []Template{}
+	for rows.Next() {
+		var t Template
+		if err := t.scan(rows); err != nil {
+			return nil, err
+		}
+		templates = append(templates, t)
+	}
+	return templates, rows.Err()
+}
+
+// upsert creates a template from a JSON body, or replaces it if an ID is
+// provided. Templates are validated like new transactions, so that applying
+// them only fails if the accounts or categories change.
+func (ts *Templates) upsert(w http.ResponseWriter, req *http.Request) {
+	var t Template
+	err := json.NewDecoder(req.Body).Decode(&t)
+	if err != nil {
+		httperror.Send(w, req, http.StatusBadRequest, fmt.Sprintf("Could not parse JSON body: %s", err))
+		return
+	}
+	if t.Name == "" {
+		httperror.Send(w, req, http.StatusBadRequest, "Invalid template: name must be provided")
+		return
+	}
+	if t.Description == "" {
+		t.Description = t.Name
+	}
+	if t.Amount.Valid && !t.Amount.Decimal.IsPositive() {
+		httperror.Send(w, req, http.StatusBadRequest, "Invalid template: amount must be greater than zero")
+		return
+	}
+	// A template without an amount is validated with a placeholder amount
+	amount := "1"
+	if t.Amount.Valid {
+		amount = t.Amount.Decimal.String()
+	}
+	status, err := ts.f.ValidateTransaction(req.Context(), t.form(time.Now().Format(DateFormat), amount))
+	if err != nil {
+		httperror.Send(w, req, status, fmt.Sprintf("Invalid template: %s", err))
+		return
+	}
+
+	// Replacing a template keeps its ranking
+	t.UseCount = 0
+	if t.ID != 0 {
+		existing, err := ts.Fetch(t.ID)
+		if errors.Is(err, sql.ErrNoRows) {
+			httperror.Send(w, req, http.StatusNotFound, fmt.Sprintf("No template with ID %d", t.ID))
+			return
+		}
+		if err != nil {
+			httperror.Send(w, req, http.StatusInternalServerError, fmt.Sprintf("Could not fetch template: %s", err))
+			return
+		}
+		t.UseCount = existing.UseCount
+	}
+
+	t.ID, err = ts.Upsert(t)
+	if err != nil {
+		httperror.Send(w, req, http.StatusInternalServerError, fmt.Sprintf("Could not save template: %s", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(t)
+}
+
+// Upsert creates or replaces the template with the provided ID, returning its
+// ID. If the ID is 0, a new template is created.
+func (ts *Templates) Upsert(t Template) (int, error) {
+	const q_create = "INSERT INTO templates (name, description, amount, source_id, source_name, destination_id, destination_name, category_id, category_name, use_count) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?);"
+
+	if t.ID == 0 {
+		return ts.d.InsertID(ts.db, q_create, t.Name, t.Description, t.Amount, t.SourceID, t.SourceName, t.DestinationID, t.DestinationName, t.CategoryID, t.CategoryName, t.UseCount)
+	}
+	q := ts.d.Upsert("templates", strings.Split(columns, ", ")...)
+	_, err := ts.db.Exec(q, t.ID, t.Name, t.Description, t.Amount, t.SourceID, t.SourceName, t.DestinationID, t.DestinationName, t.CategoryID, t.CategoryName, t.UseCount)
+	return t.ID, err
+}
+
+func (ts *Templates) delete(w http.ResponseWriter, req *http.Request) {
+	const q = "DELETE FROM templates WHERE id = ?;"
+
+	if !hasID.MatchString(req.URL.Path) {
+		httperror.Send(w, req, http.StatusBadRequest, "Must provide a template ID to delete")
+		return
+	}
+	id, _ := strconv.Atoi(req.URL.Path[strings.LastIndex(req.URL.Path, "/")+1:])
+
+	_, err := ts.db.Exec(ts.d.Rebind(q), id)
+	if err != nil {
+		httperror.Send(w, req, http.StatusInternalServerError, fmt.Sprintf("Could not delete template: %s", err))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
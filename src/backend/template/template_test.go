@@ -0,0 +1,134 @@
+package template_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+
+	"github.com/davidschlachter/lychnos/src/backend/dialect"
+	"github.com/davidschlachter/lychnos/src/backend/firefly"
+	"github.com/davidschlachter/lychnos/src/backend/firefly/fireflytest"
+	"github.com/davidschlachter/lychnos/src/backend/template"
+)
+
+var templateColumns = []string{"id", "name", "description", "amount", "source_id", "source_name", "destination_id", "destination_name", "category_id", "category_name", "use_count"}
+
+// newFirefly returns a client for a Firefly-III server with a single asset
+// account and category, and the server, which records the transactions
+// created.
+func newFirefly(t *testing.T) (*firefly.Firefly, *fireflytest.Server) {
+	server := fireflytest.NewServer(t, map[string]http.HandlerFunc{
+		"/api/v1/autocomplete/categories": func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`[{"id":"4","name":"Dining"}]`))
+		},
+	})
+	return server.Firefly(t, firefly.Config{}), server
+}
+
+func TestHandle(t *testing.T) {
+	f, _ := newFirefly(t)
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Unexpected error opening mock database connection: %s\n", err)
+	}
+	defer db.Close()
+	ts := template.New(db, dialect.SQLite, f)
+
+	// Templates are validated like new transactions
+	for _, body := range []string{
+		`{"description": "Coffee", "amount": "4.50", "source_id": "3", "destination_name": "Cafe X", "category_id": "4"}`,
+		`{"name": "Coffee", "amount": "-4.50", "source_id": "3", "destination_name": "Cafe X", "category_id": "4"}`,
+		`{"name": "Coffee", "amount": "4.50", "source_id": "3", "destination_name": "Cafe X", "category_id": "5"}`,
+		`{"name": "Coffee", "amount": "4.50", "source_id": "3", "category_id": "4"}`,
+	} {
+		w := httptest.NewRecorder()
+		ts.Handle(w, httptest.NewRequest(http.MethodPost, "/api/templates/", strings.NewReader(body)))
+		if w.Result().StatusCode != http.StatusBadRequest {
+			t.Fatalf("Status code = %d for %s, want %d. Response body: %s", w.Result().StatusCode, body, http.StatusBadRequest, w.Body.String())
+		}
+	}
+
+	// Create
+	mock.ExpectExec(`INSERT INTO templates`).
+		WithArgs("Coffee", "Coffee", "4.5", "3", "", "", "Cafe X", "4", "", 0).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	w := httptest.NewRecorder()
+	ts.Handle(w, httptest.NewRequest(http.MethodPost, "/api/templates/", strings.NewReader(`{"name": "Coffee", "amount": "4.50", "source_id": "3", "destination_name": "Cafe X", "category_id": "4"}`)))
+	if w.Result().StatusCode != http.StatusCreated {
+		t.Fatalf("Status code = %d, want %d. Response body: %s", w.Result().StatusCode, http.StatusCreated, w.Body.String())
+	}
+
+	// Replacing a template keeps its use count
+	mock.ExpectQuery(`SELECT .* FROM templates WHERE id = \?;`).WithArgs(1).
+		WillReturnRows(sqlmock.NewRows(templateColumns).AddRow(1, "Coffee", "Coffee", "4.5", "3", "", "", "Cafe X", "4", "", 7))
+	mock.ExpectExec(`REPLACE INTO templates`).
+		WithArgs(1, "Coffee", "Coffee", nil, "3", "", "", "Cafe X", "4", "", 7).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	w = httptest.NewRecorder()
+	ts.Handle(w, httptest.NewRequest(http.MethodPost, "/api/templates/", strings.NewReader(`{"id": 1, "name": "Coffee", "source_id": "3", "destination_name": "Cafe X", "category_id": "4"}`)))
+	if w.Result().StatusCode != http.StatusCreated {
+		t.Fatalf("Status code = %d, want %d. Response body: %s", w.Result().StatusCode, http.StatusCreated, w.Body.String())
+	}
+	var replaced template.Template
+	json.NewDecoder(w.Body).Decode(&replaced)
+	if replaced.UseCount != 7 || replaced.Amount.Valid {
+		t.Fatalf("Got template %+v, wanted a use count of 7 and no amount", replaced)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestHandleApply(t *testing.T) {
+	f, server := newFirefly(t)
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Unexpected error opening mock database connection: %s\n", err)
+	}
+	defer db.Close()
+	ts := template.New(db, dialect.SQLite, f)
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/templates/{id}/apply", ts.HandleApply)
+
+	// Without an amount, the client must provide one
+	mock.ExpectQuery(`SELECT .* FROM templates WHERE id = \?;`).WithArgs(2).
+		WillReturnRows(sqlmock.NewRows(templateColumns).AddRow(2, "Groceries", "Groceries", nil, "3", "", "", "Grocery store", "4", "", 0))
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/templates/2/apply", nil))
+	if w.Result().StatusCode != http.StatusBadRequest || len(server.Posted()) != 0 {
+		t.Fatalf("Status code = %d with %d transactions created, want %d and none", w.Result().StatusCode, len(server.Posted()), http.StatusBadRequest)
+	}
+
+	// Override the amount and date, and count the use
+	mock.ExpectQuery(`SELECT .* FROM templates WHERE id = \?;`).WithArgs(1).
+		WillReturnRows(sqlmock.NewRows(templateColumns).AddRow(1, "Coffee", "Coffee", "4.5", "3", "", "", "Cafe X", "4", "", 7))
+	mock.ExpectExec(`UPDATE templates SET use_count = use_count \+ 1 WHERE id = \?;`).WithArgs(1).WillReturnResult(sqlmock.NewResult(0, 1))
+	form := url.Values{"amount": {"5,25"}, "date": {"2025-03-01"}, "description": {"Ignored"}}
+	req := httptest.NewRequest(http.MethodPost, "/api/templates/1/apply", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	if w.Result().StatusCode != http.StatusCreated {
+		t.Fatalf("Status code = %d, want %d. Response body: %s", w.Result().StatusCode, http.StatusCreated, w.Body.String())
+	}
+	var created firefly.Transactions
+	json.NewDecoder(w.Body).Decode(&created)
+	if created.ID != "2774" || len(server.Posted()) != 1 {
+		t.Fatalf("Got transaction %+v with %d transactions created, wanted 2774", created, len(server.Posted()))
+	}
+	for _, want := range []string{`"amount":"5.25"`, `"date":"2025-03-01`, `"description":"Coffee"`, `"destination_name":"Cafe X"`, `"category_id":"4"`} {
+		if !strings.Contains(server.Posted()[0], want) {
+			t.Errorf("Created transaction %s, wanted it to contain %s", server.Posted()[0], want)
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
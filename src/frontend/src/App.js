@@ -2,6 +2,7 @@ import BigPicture from './BigPicture'
 import CategoryDetail from './CategoryDetail';
 import CategorySummaries from './CategorySummaries';
 import EditBudget from './EditBudget';
+import Login from './Login';
 import NavBar from './NavBar';
 import NewTxn from './NewTxn';
 import TransactionDetail from './TransactionDetail';
@@ -45,6 +46,7 @@ function App() {
           <Route path="/txn/:txnID" element={<TransactionDetail />} />
           <Route path="/budget/" element={<EditBudget />} />
           <Route path="/bigpicture/" element={<BigPicture />} />
+          <Route path="/login" element={<Login />} />
         </Routes>
         <NavBar />
       </Router>
@@ -28,6 +28,9 @@ class CategoryDetail extends React.Component {
     componentDidMount() {
         fetch("/api/reports/categorysummary/" + String(this.props.categoryId))
             .then(res => {
+                if (res.status === 401) {
+                    window.location.href = "/app/login";
+                }
                 if (!res.ok) {
                     return Promise.reject(res);
                 }
@@ -97,6 +100,7 @@ class CategoryDetail extends React.Component {
                 totalSpent += Math.round(parseFloat(item.earned) + parseFloat(item.spent))
             ));
             const actualLabel = totalSpent > 0 ? 'Earned so far' : 'Spent so far';
+            const carriedOver = Math.round(parseFloat(details[0].carried_over || 0))
             return (
                 <>
                     <Header back_visibility="visible" title="Category details"></Header>
@@ -106,6 +110,7 @@ class CategoryDetail extends React.Component {
                         </Typography>
                         <Typography variant="subtitle1" component="div" align="center" gutterBottom>
                             Budgeted: {details[0].amount}, {actualLabel}: {totalSpent}<br />
+                            {carriedOver !== 0 && <>Carried over from last budget: {carriedOver}<br /></>}
                             Left per month: <AmountLeft amount={details[0].amount} sum={totalSpent} timeSpent={timeSpent} />{"; Left today: "} <LeftToday actual={totalSpent} budgetted={details[0].amount} timeSpent={timeSpent} />
                         </Typography>
                         <div style={{ "width": "100%;" }}>
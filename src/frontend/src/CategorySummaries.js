@@ -27,6 +27,9 @@ class CategorySummaries extends React.Component {
     componentDidMount() {
         fetch("/api/reports/categorysummary/")
             .then(res => {
+                if (res.status === 401) {
+                    window.location.href = "/app/login";
+                }
                 if (!res.ok) {
                     return Promise.reject(res);
                 }
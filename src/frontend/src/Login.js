@@ -0,0 +1,45 @@
+import React from 'react';
+import Box from '@mui/material/Box';
+import LoadingButton from '@mui/lab/LoadingButton';
+import Stack from '@mui/material/Stack';
+import TextField from '@mui/material/TextField';
+import Typography from '@mui/material/Typography';
+
+export default function Login() {
+    const [username, setUsername] = React.useState("");
+    const [password, setPassword] = React.useState("");
+    const [error, setError] = React.useState(false);
+    const [submitted, setSubmitted] = React.useState(false);
+
+    function submitForm(event) {
+        event.preventDefault();
+        setSubmitted(true);
+        (async () => {
+            const rawResponse = await fetch('/api/auth/login', {
+                method: 'POST',
+                headers: {
+                    'Content-Type': 'application/x-www-form-urlencoded'
+                },
+                body: new URLSearchParams({ username: username, password: password })
+            });
+            if (rawResponse.status === 200) {
+                window.location.href = "/app/";
+            } else {
+                setError("Invalid username or password");
+                setSubmitted(false);
+            }
+        })();
+    }
+
+    return (
+        <Box component="form" onSubmit={submitForm} sx={{ p: 2, pb: 8 }}>
+            <Stack spacing={2}>
+                <Typography variant="h5" component="div">Log in</Typography>
+                {error && <Typography color="error">{error}</Typography>}
+                <TextField label="Username" autoComplete="username" value={username} onChange={(e) => setUsername(e.target.value)} />
+                <TextField label="Password" type="password" autoComplete="current-password" value={password} onChange={(e) => setPassword(e.target.value)} />
+                <LoadingButton type="submit" variant="contained" loading={submitted}>Log in</LoadingButton>
+            </Stack>
+        </Box>
+    );
+}
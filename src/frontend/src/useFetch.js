@@ -31,6 +31,10 @@ export default (url, options = { body: {}, query: {} }) => {
             body: options.method !== "GET" && JSON.stringify(options.body),
         })
             .then(res => {
+                if (res.status === 401) {
+                    // Authentication is enabled, and the session has expired
+                    window.location.href = "/app/login";
+                }
                 if (!res.ok) {
                     return Promise.reject(res);
                 }